@@ -0,0 +1,1330 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Document tree: parsing to nodes and rendering them
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"gob"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// node types
+const (
+	NODE_DOCUMENT = iota
+	NODE_BLOCKQUOTE
+	NODE_LIST
+	NODE_ITEM
+	NODE_PARAGRAPH
+	NODE_HEADER
+	NODE_HRULE
+	NODE_CODE_BLOCK
+	NODE_HTML_BLOCK
+	NODE_SHORTCODE_BLOCK
+	NODE_TABLE
+	NODE_TABLE_HEAD
+	NODE_TABLE_BODY
+	NODE_TABLE_ROW
+	NODE_TABLE_CELL
+	NODE_TABLE_CAPTION
+	NODE_LINE_BLOCK
+	NODE_DETAILS
+	NODE_SUMMARY
+	NODE_FOOTNOTES
+	NODE_FOOTNOTE
+	NODE_DIV
+	NODE_TEXT
+	NODE_ENTITY
+	NODE_EMPHASIS
+	NODE_DOUBLE_EMPHASIS
+	NODE_TRIPLE_EMPHASIS
+	NODE_STRIKETHROUGH
+	NODE_CODE
+	NODE_LINK
+	NODE_AUTOLINK
+	NODE_IMAGE
+	NODE_MEDIA_EMBED
+	NODE_LINEBREAK
+	NODE_HTML_SPAN
+	NODE_RUBY
+	NODE_RUBY_TEXT
+	NODE_KBD
+	NODE_SHORTCODE
+	NODE_FOOTNOTE_REF
+)
+
+// A Node is one element of a parsed document. Only the fields that
+// make sense for its type are filled in.
+type Node struct {
+	Type     int
+	Parent   *Node
+	Children []*Node
+
+	Literal []byte // text, code, raw HTML, entities, image alt text, and footnote names
+	Level   int    // header level
+	Flags   int    // list and item flags, cell alignment, autolink and media kinds, footnote flags
+	Start   int    // number of the first item of an ordered list, or of a footnote
+	Lang    string // code block language and the rest of its info string
+	Info    string
+	Fence   CodeFence // how a code block was written
+	Link    []byte    // link, autolink, and image destinations
+	Title   []byte
+	Attrs   *Attributes // of headers, code blocks, and divs
+
+	Pos Position // where a top-level block came from, zero for other nodes
+}
+
+// A Position is a range of the input, in lines and columns counting from 1.
+type Position struct {
+	Line, Col       int
+	EndLine, EndCol int
+}
+
+// A WalkStatus tells Walk where to go after a visit.
+type WalkStatus int
+
+// walk statuses
+const (
+	WALK_CONTINUE      WalkStatus = iota // go on to the next node
+	WALK_SKIP_CHILDREN                   // leave out the children of a node being entered
+	WALK_TERMINATE                       // stop walking
+)
+
+// A NodeVisitor is called by Walk on each node twice, once when entering
+// it (before its children) and once when leaving it (after them).
+type NodeVisitor func(n *Node, entering bool) WalkStatus
+
+// Walk a tree depth-first, calling the visitor on every node. The leaving
+// visit still happens when the children are skipped. Walk returns
+// WALK_TERMINATE if the visitor stopped the walk.
+func Walk(n *Node, visitor NodeVisitor) WalkStatus {
+	status := visitor(n, true)
+	if status == WALK_TERMINATE {
+		return status
+	}
+	if status != WALK_SKIP_CHILDREN {
+		for _, child := range n.Children {
+			if Walk(child, visitor) == WALK_TERMINATE {
+				return WALK_TERMINATE
+			}
+		}
+	}
+	if visitor(n, false) == WALK_TERMINATE {
+		return WALK_TERMINATE
+	}
+	return WALK_CONTINUE
+}
+
+//
+//
+// Parsing
+//
+//
+
+// the nodes made so far; their output is a placeholder naming the node
+type astBuilder struct {
+	nodes []*Node
+	attrs *Attributes // of the block whose callback comes next
+}
+
+const (
+	astMarkStart = '\x02'
+	astMarkEnd   = '\x03'
+)
+
+// Parse markdown-encoded text into a document tree, which can be
+// inspected and changed before it goes to Render.
+//
+// Renderer settings that steer the parser, such as the targets of
+// #hashtags and @mentions, variables, and extra block tags, are not
+// available here, so those constructs stay as text.
+func Parse(input []byte, extensions uint64) *Node {
+	return parse(input, extensions)
+}
+
+func parse(input []byte, extensions uint64, opts ...Option) *Node {
+	b := new(astBuilder)
+	doc := &Node{Type: NODE_DOCUMENT}
+	b.adopt(doc, MarkdownWith(astClean(input), append(opts, WithRenderer(astRenderer(b)), WithExtensions(extensions))...))
+	return doc
+}
+
+// the input with the markers, which are reserved for placeholders, blanked out
+func astClean(input []byte) []byte {
+	clean := make([]byte, len(input))
+	for i, c := range input {
+		if c == astMarkStart || c == astMarkEnd {
+			c = ' '
+		}
+		clean[i] = c
+	}
+	return clean
+}
+
+// Parse only the blocks of markdown-encoded text into a document tree;
+// the text in them stays as it is, in NODE_TEXT nodes.
+func ParseBlocks(input []byte, extensions uint64) *Node {
+	return parse(input, extensions, WithBlocksOnly())
+}
+
+// a renderer whose output is a tree instead of text
+func astRenderer(b *astBuilder) *Renderer {
+	r := new(Renderer)
+
+	r.blockcode = astBlockcode
+	r.blockquote = astBlockquote
+	r.blockhtml = astBlockHtml
+	r.header = astHeader
+	r.hrule = astHrule
+	r.list = astList
+	r.listitem = astListitem
+	r.paragraph = astParagraph
+	r.table = astTable
+	r.tableRow = astTableRow
+	r.tableCell = astTableCell
+	r.lineBlock = astLineBlock
+	r.details = astDetails
+	r.div = astDiv
+	r.attributes = astAttributes
+	r.blockShortcode = astBlockShortcode
+	r.footnotes = astFootnotes
+	r.footnoteItem = astFootnoteItem
+
+	r.autolink = astAutolink
+	r.codespan = astCodespan
+	r.doubleEmphasis = astDoubleEmphasis
+	r.emphasis = astEmphasis
+	r.image = astImage
+	r.mediaEmbed = astMediaEmbed
+	r.linebreak = astLinebreak
+	r.link = astLink
+	r.rawHtmlTag = astRawTag
+	r.tripleEmphasis = astTripleEmphasis
+	r.strikethrough = astStrikethrough
+	r.ruby = astRuby
+	r.kbd = astKbd
+	r.shortcode = astShortcode
+	r.footnoteRef = astFootnoteRef
+
+	r.entity = astEntity
+	r.normalText = astNormalText
+	r.sourcepos = astSourcepos
+
+	r.opaque = b
+	return r
+}
+
+// record a node, taking its children from the content, and leave a
+// placeholder for it in the output
+func (b *astBuilder) add(out *bytes.Buffer, n *Node, content []byte) {
+	if content != nil {
+		b.adopt(n, content)
+	}
+	out.WriteByte(astMarkStart)
+	out.WriteString(strconv.Itoa(len(b.nodes)))
+	out.WriteByte(astMarkEnd)
+	b.nodes = append(b.nodes, n)
+}
+
+// turn placeholders and the text between them into children of a node,
+// copying the text, as the parser reuses its buffers
+func (b *astBuilder) adopt(parent *Node, content []byte) {
+	mark := 0
+	for i := 0; i < len(content); i++ {
+		if content[i] != astMarkStart {
+			continue
+		}
+		end := i + 1
+		for end < len(content) && content[end] != astMarkEnd {
+			end++
+		}
+		id, err := strconv.Atoi(string(content[i+1 : end]))
+		if err != nil || id >= len(b.nodes) {
+			continue
+		}
+
+		if i > mark {
+			text := &Node{Type: NODE_TEXT, Literal: copyBytes(content[mark:i])}
+			text.Parent = parent
+			parent.Children = append(parent.Children, text)
+		}
+		child := b.nodes[id]
+		child.Parent = parent
+		parent.Children = append(parent.Children, child)
+
+		i = end
+		mark = end + 1
+	}
+	if mark < len(content) {
+		text := &Node{Type: NODE_TEXT, Literal: copyBytes(content[mark:])}
+		text.Parent = parent
+		parent.Children = append(parent.Children, text)
+	}
+}
+
+func astBlockcode(out *bytes.Buffer, text []byte, lang string, info string, fence CodeFence, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_CODE_BLOCK, Literal: copyBytes(text), Lang: lang, Info: info, Fence: fence}
+	n.Attrs, b.attrs = b.attrs, nil
+	b.add(out, n, nil)
+}
+
+func astBlockquote(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_BLOCKQUOTE}, text)
+}
+
+func astBlockHtml(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_HTML_BLOCK, Literal: copyBytes(text)}, nil)
+}
+
+func astHeader(out *bytes.Buffer, text []byte, level int, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_HEADER, Level: level}
+	n.Attrs, b.attrs = b.attrs, nil
+	b.add(out, n, text)
+}
+
+func astHrule(out *bytes.Buffer, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_HRULE}, nil)
+}
+
+func astList(out *bytes.Buffer, text []byte, flags int, start int, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_LIST, Flags: flags, Start: start}, text)
+}
+
+func astListitem(out *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_ITEM, Flags: flags}, text)
+}
+
+func astParagraph(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_PARAGRAPH}, text)
+}
+
+// the alignment of the columns is kept in the flags of the cells; a
+// caption is the first child, ahead of the head
+func astTable(out *bytes.Buffer, header []byte, body []byte, caption []byte, columns []int, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_TABLE}
+	if len(caption) > 0 {
+		c := &Node{Type: NODE_TABLE_CAPTION, Parent: n}
+		b.adopt(c, caption)
+		n.Children = append(n.Children, c)
+	}
+	head := &Node{Type: NODE_TABLE_HEAD, Parent: n}
+	b.adopt(head, header)
+	rows := &Node{Type: NODE_TABLE_BODY, Parent: n}
+	b.adopt(rows, body)
+	n.Children = append(n.Children, head, rows)
+	b.add(out, n, nil)
+}
+
+func astTableRow(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_TABLE_ROW}, text)
+}
+
+func astTableCell(out *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_TABLE_CELL, Flags: flags}, text)
+}
+
+func astLineBlock(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_LINE_BLOCK}, text)
+}
+
+// the summary is the first child, ahead of the blocks
+func astDetails(out *bytes.Buffer, summary []byte, text []byte, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_DETAILS}
+	s := &Node{Type: NODE_SUMMARY, Parent: n}
+	b.adopt(s, summary)
+	n.Children = []*Node{s}
+	b.add(out, n, text)
+}
+
+func astDiv(out *bytes.Buffer, text []byte, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_DIV}
+	n.Attrs, b.attrs = b.attrs, nil
+	b.add(out, n, text)
+}
+
+func astAttributes(attrs *Attributes, opaque interface{}) {
+	opaque.(*astBuilder).attrs = attrs
+}
+
+func astBlockShortcode(out *bytes.Buffer, text []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_SHORTCODE_BLOCK, Literal: copyBytes(text)}, nil)
+}
+
+func astFootnotes(out *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_FOOTNOTES, Flags: flags}, text)
+}
+
+func astFootnoteItem(out *bytes.Buffer, name []byte, text []byte, number int, flags int, opaque interface{}) {
+	n := &Node{Type: NODE_FOOTNOTE, Literal: copyBytes(name), Start: number, Flags: flags}
+	opaque.(*astBuilder).add(out, n, text)
+}
+
+func astAutolink(out *bytes.Buffer, link []byte, kind int, opaque interface{}) int {
+	if len(link) == 0 {
+		return 0
+	}
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_AUTOLINK, Link: copyBytes(link), Flags: kind}, nil)
+	return 1
+}
+
+func astCodespan(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_CODE, Literal: copyBytes(text)}, nil)
+	return 1
+}
+
+func astDoubleEmphasis(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	if len(text) == 0 {
+		return 0
+	}
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_DOUBLE_EMPHASIS}, text)
+	return 1
+}
+
+func astEmphasis(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	if len(text) == 0 {
+		return 0
+	}
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_EMPHASIS}, text)
+	return 1
+}
+
+func astImage(out *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) int {
+	if len(link) == 0 {
+		return 0
+	}
+	n := &Node{Type: NODE_IMAGE, Link: copyBytes(link), Title: copyBytes(title), Literal: copyBytes(alt)}
+	opaque.(*astBuilder).add(out, n, nil)
+	return 1
+}
+
+func astMediaEmbed(out *bytes.Buffer, link []byte, title []byte, alt []byte, kind int, opaque interface{}) int {
+	if len(link) == 0 {
+		return 0
+	}
+	n := &Node{Type: NODE_MEDIA_EMBED, Link: copyBytes(link), Title: copyBytes(title), Literal: copyBytes(alt), Flags: kind}
+	opaque.(*astBuilder).add(out, n, nil)
+	return 1
+}
+
+func astLinebreak(out *bytes.Buffer, opaque interface{}) int {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_LINEBREAK}, nil)
+	return 1
+}
+
+func astLink(out *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int {
+	n := &Node{Type: NODE_LINK, Link: copyBytes(link), Title: copyBytes(title)}
+	opaque.(*astBuilder).add(out, n, content)
+	return 1
+}
+
+func astRawTag(out *bytes.Buffer, tag []byte, opaque interface{}) int {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_HTML_SPAN, Literal: copyBytes(tag)}, nil)
+	return 1
+}
+
+func astTripleEmphasis(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	if len(text) == 0 {
+		return 0
+	}
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_TRIPLE_EMPHASIS}, text)
+	return 1
+}
+
+func astStrikethrough(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	if len(text) == 0 {
+		return 0
+	}
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_STRIKETHROUGH}, text)
+	return 1
+}
+
+// the base is the children, followed by the annotation
+func astRuby(out *bytes.Buffer, base []byte, text []byte, opaque interface{}) int {
+	if len(base) == 0 || len(text) == 0 {
+		return 0
+	}
+	b := opaque.(*astBuilder)
+	n := &Node{Type: NODE_RUBY}
+	b.adopt(n, base)
+	annotation := &Node{Type: NODE_RUBY_TEXT, Parent: n}
+	b.adopt(annotation, text)
+	n.Children = append(n.Children, annotation)
+	b.add(out, n, nil)
+	return 1
+}
+
+func astKbd(out *bytes.Buffer, key []byte, opaque interface{}) int {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_KBD, Literal: copyBytes(key)}, nil)
+	return 1
+}
+
+func astShortcode(out *bytes.Buffer, text []byte, opaque interface{}) int {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_SHORTCODE, Literal: copyBytes(text)}, nil)
+	return 1
+}
+
+// the locator of a citation becomes the children
+func astFootnoteRef(out *bytes.Buffer, name []byte, number int, locator []byte, flags int, opaque interface{}) int {
+	n := &Node{Type: NODE_FOOTNOTE_REF, Literal: copyBytes(name), Start: number, Flags: flags}
+	opaque.(*astBuilder).add(out, n, locator)
+	return 1
+}
+
+func astEntity(out *bytes.Buffer, entity []byte, opaque interface{}) {
+	opaque.(*astBuilder).add(out, &Node{Type: NODE_ENTITY, Literal: copyBytes(entity)}, nil)
+}
+
+// text stays in the output, so the parser can still look back at it
+func astNormalText(out *bytes.Buffer, text []byte, opaque interface{}) {
+	out.Write(text)
+}
+
+// every placeholder after the mark is a top-level block
+func astSourcepos(out *bytes.Buffer, mark int, line int, col int, endLine int, endCol int, opaque interface{}) {
+	b := opaque.(*astBuilder)
+	data := out.Bytes()[mark:]
+	for i := 0; i < len(data); i++ {
+		if data[i] != astMarkStart {
+			continue
+		}
+		end := i + 1
+		for end < len(data) && data[end] != astMarkEnd {
+			end++
+		}
+		if id, err := strconv.Atoi(string(data[i+1 : end])); err == nil && id < len(b.nodes) {
+			b.nodes[id].Pos = Position{line, col, endLine, endCol}
+		}
+		i = end
+	}
+}
+
+// the callbacks get slices of the input, which the tree must not share
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
+
+//
+//
+// Rendering
+//
+//
+
+// Render a document tree made by Parse. Elements the renderer has no
+// callback for are left out if they are blocks; spans it has no callback
+// for, or turns down, are reduced to their contents. The positions of
+// top-level blocks go to the renderer as they would from Markdown.
+func Render(doc *Node, renderer *Renderer) []byte {
+	output := bytes.NewBuffer(nil)
+	if renderer.documentHeader != nil {
+		renderer.documentHeader(output, renderer.opaque)
+	}
+	for _, n := range doc.Children {
+		mark := output.Len()
+		renderNode(output, n, renderer)
+		if renderer.sourcepos != nil && n.Pos.Line > 0 && output.Len() > mark {
+			p := n.Pos
+			renderer.sourcepos(output, mark, p.Line, p.Col, p.EndLine, p.EndCol, renderer.opaque)
+		}
+	}
+	if renderer.documentFooter != nil {
+		renderer.documentFooter(output, renderer.opaque)
+	}
+	return output.Bytes()
+}
+
+// render a list of nodes one after the other
+func renderChildren(out *bytes.Buffer, nodes []*Node, r *Renderer) {
+	for _, n := range nodes {
+		renderNode(out, n, r)
+	}
+}
+
+// render nodes into a buffer of their own, for the callback of their parent
+func renderContent(nodes []*Node, r *Renderer) []byte {
+	content := bytes.NewBuffer(nil)
+	renderChildren(content, nodes, r)
+	return content.Bytes()
+}
+
+func renderNode(out *bytes.Buffer, n *Node, r *Renderer) {
+	ret := 1
+	switch n.Type {
+	case NODE_DOCUMENT, NODE_TABLE_HEAD, NODE_TABLE_BODY, NODE_TABLE_CAPTION, NODE_SUMMARY, NODE_RUBY_TEXT:
+		renderChildren(out, n.Children, r)
+
+	case NODE_BLOCKQUOTE:
+		if r.blockquote != nil {
+			r.blockquote(out, renderContent(n.Children, r), r.opaque)
+		}
+	case NODE_LIST:
+		if r.list != nil {
+			r.list(out, renderContent(n.Children, r), n.Flags, n.Start, r.opaque)
+		}
+	case NODE_ITEM:
+		if r.listitem != nil {
+			r.listitem(out, renderContent(n.Children, r), n.Flags, r.opaque)
+		}
+	case NODE_PARAGRAPH:
+		if r.paragraph != nil {
+			r.paragraph(out, renderContent(n.Children, r), r.opaque)
+		}
+	case NODE_HEADER:
+		if r.header != nil {
+			renderAttributes(n, r)
+			r.header(out, renderContent(n.Children, r), n.Level, r.opaque)
+		}
+	case NODE_HRULE:
+		if r.hrule != nil {
+			r.hrule(out, r.opaque)
+		}
+	case NODE_CODE_BLOCK:
+		if r.blockcode != nil {
+			renderAttributes(n, r)
+			r.blockcode(out, n.Literal, n.Lang, n.Info, n.Fence, r.opaque)
+		}
+	case NODE_HTML_BLOCK:
+		if r.blockhtml != nil {
+			r.blockhtml(out, n.Literal, r.opaque)
+		}
+	case NODE_SHORTCODE_BLOCK:
+		if r.blockShortcode != nil {
+			r.blockShortcode(out, n.Literal, r.opaque)
+		}
+	case NODE_TABLE:
+		if r.table != nil {
+			var header, body, caption []byte
+			for _, part := range n.Children {
+				switch part.Type {
+				case NODE_TABLE_HEAD:
+					header = renderContent(part.Children, r)
+				case NODE_TABLE_CAPTION:
+					caption = renderContent(part.Children, r)
+				default:
+					body = append(body, renderContent([]*Node{part}, r)...)
+				}
+			}
+			r.table(out, header, body, caption, tableColumns(n), r.opaque)
+		}
+	case NODE_TABLE_ROW:
+		if r.tableRow != nil {
+			r.tableRow(out, renderContent(n.Children, r), r.opaque)
+		}
+	case NODE_TABLE_CELL:
+		if r.tableCell != nil {
+			r.tableCell(out, renderContent(n.Children, r), n.Flags, r.opaque)
+		}
+	case NODE_LINE_BLOCK:
+		if r.lineBlock != nil {
+			r.lineBlock(out, renderContent(n.Children, r), r.opaque)
+		}
+	case NODE_DETAILS:
+		if r.details != nil {
+			var summary []byte
+			blocks := n.Children
+			if len(blocks) > 0 && blocks[0].Type == NODE_SUMMARY {
+				summary = renderContent(blocks[0].Children, r)
+				blocks = blocks[1:]
+			}
+			r.details(out, summary, renderContent(blocks, r), r.opaque)
+		}
+	case NODE_DIV:
+		if r.div != nil {
+			// the divs inside take their own attributes first
+			text := renderContent(n.Children, r)
+			renderAttributes(n, r)
+			r.div(out, text, r.opaque)
+		} else {
+			renderChildren(out, n.Children, r)
+		}
+	case NODE_FOOTNOTES:
+		if r.footnotes != nil {
+			r.footnotes(out, renderContent(n.Children, r), n.Flags, r.opaque)
+		}
+	case NODE_FOOTNOTE:
+		if r.footnoteItem != nil {
+			r.footnoteItem(out, n.Literal, renderContent(n.Children, r), n.Start, n.Flags, r.opaque)
+		}
+
+	case NODE_TEXT:
+		if r.normalText != nil {
+			r.normalText(out, n.Literal, r.opaque)
+		} else {
+			out.Write(n.Literal)
+		}
+	case NODE_ENTITY:
+		if r.entity != nil {
+			r.entity(out, n.Literal, r.opaque)
+		} else {
+			out.Write(n.Literal)
+		}
+
+	case NODE_EMPHASIS:
+		ret = renderSpan(out, n, r, r.emphasis)
+	case NODE_DOUBLE_EMPHASIS:
+		ret = renderSpan(out, n, r, r.doubleEmphasis)
+	case NODE_TRIPLE_EMPHASIS:
+		ret = renderSpan(out, n, r, r.tripleEmphasis)
+	case NODE_STRIKETHROUGH:
+		ret = renderSpan(out, n, r, r.strikethrough)
+	case NODE_LINK:
+		ret = 0
+		if r.link != nil {
+			ret = r.link(out, n.Link, n.Title, renderContent(n.Children, r), r.opaque)
+		}
+		if ret == 0 {
+			renderChildren(out, n.Children, r)
+		}
+	case NODE_CODE:
+		ret = renderLiteral(out, n, r, r.codespan)
+	case NODE_HTML_SPAN:
+		ret = renderLiteral(out, n, r, r.rawHtmlTag)
+	case NODE_KBD:
+		ret = renderLiteral(out, n, r, r.kbd)
+	case NODE_SHORTCODE:
+		ret = renderLiteral(out, n, r, r.shortcode)
+	case NODE_AUTOLINK:
+		if r.autolink == nil || r.autolink(out, n.Link, n.Flags, r.opaque) == 0 {
+			renderLiteral(out, &Node{Literal: n.Link}, r, nil)
+		}
+	case NODE_IMAGE:
+		if r.image == nil || r.image(out, n.Link, n.Title, n.Literal, r.opaque) == 0 {
+			renderLiteral(out, n, r, nil)
+		}
+	case NODE_MEDIA_EMBED:
+		switch {
+		case r.mediaEmbed != nil && r.mediaEmbed(out, n.Link, n.Title, n.Literal, n.Flags, r.opaque) > 0:
+		case r.image != nil && r.image(out, n.Link, n.Title, n.Literal, r.opaque) > 0:
+		default:
+			renderLiteral(out, n, r, nil)
+		}
+	case NODE_LINEBREAK:
+		if r.linebreak == nil || r.linebreak(out, r.opaque) == 0 {
+			renderLiteral(out, &Node{Literal: []byte("\n")}, r, nil)
+		}
+	case NODE_RUBY:
+		var base, text []byte
+		for _, part := range n.Children {
+			if part.Type == NODE_RUBY_TEXT {
+				text = renderContent(part.Children, r)
+			} else {
+				base = append(base, renderContent([]*Node{part}, r)...)
+			}
+		}
+		if r.ruby == nil || r.ruby(out, base, text, r.opaque) == 0 {
+			out.Write(base)
+		}
+	case NODE_FOOTNOTE_REF:
+		locator := renderContent(n.Children, r)
+		if r.footnoteRef == nil || r.footnoteRef(out, n.Literal, n.Start, locator, n.Flags, r.opaque) == 0 {
+			// back to the reference as it was written
+			mark := "[^"
+			if n.Flags&FOOTNOTE_CITATION != 0 {
+				mark = "[#"
+			}
+			if len(n.Children) > 0 {
+				renderLiteral(out, &Node{Literal: []byte("[")}, r, nil)
+				out.Write(locator)
+				renderLiteral(out, &Node{Literal: []byte("]")}, r, nil)
+			}
+			renderLiteral(out, &Node{Literal: []byte(mark + string(n.Literal) + "]")}, r, nil)
+		}
+	}
+}
+
+// hand the attributes of a block to the renderer ahead of its callback
+func renderAttributes(n *Node, r *Renderer) {
+	if r.attributes != nil {
+		r.attributes(n.Attrs, r.opaque)
+	}
+}
+
+// render a span made of other nodes, falling back on its contents
+func renderSpan(out *bytes.Buffer, n *Node, r *Renderer, callback func(*bytes.Buffer, []byte, interface{}) int) int {
+	content := renderContent(n.Children, r)
+	if callback == nil || callback(out, content, r.opaque) == 0 {
+		out.Write(content)
+		return 0
+	}
+	return 1
+}
+
+// render a span made of literal text, falling back on the text itself
+func renderLiteral(out *bytes.Buffer, n *Node, r *Renderer, callback func(*bytes.Buffer, []byte, interface{}) int) int {
+	if callback != nil && callback(out, n.Literal, r.opaque) > 0 {
+		return 1
+	}
+	if r.normalText != nil {
+		r.normalText(out, n.Literal, r.opaque)
+	} else {
+		out.Write(n.Literal)
+	}
+	return 0
+}
+
+// the alignment of each column of a table, from the cells of its first
+// row; the body comes first, as the header of a grid table is aligned by
+// the line under it
+func tableColumns(table *Node) []int {
+	for i := len(table.Children) - 1; i >= 0; i-- {
+		part := table.Children[i]
+		if part.Type == NODE_TABLE_CAPTION || len(part.Children) == 0 {
+			continue
+		}
+		var columns []int
+		for _, cell := range part.Children[0].Children {
+			columns = append(columns, cell.Flags&TABLE_ALIGNMENT_CENTER)
+		}
+		return columns
+	}
+	return nil
+}
+
+//
+//
+// Transforming
+//
+//
+
+// A Transformer changes a document tree between parsing and rendering;
+// see WithTransformers.
+type Transformer func(doc *Node)
+
+// a parser that makes document trees with the same settings as options
+func newTreeParser(options *Options) *Parser {
+	tree := *options
+	tree.Renderer = astRenderer(new(astBuilder))
+	tree.Opaque = nil
+	tree.SourceMap = nil
+	tree.OutputFilters = nil
+	tree.Transformers = nil
+
+	// the settings that steer the parser carry over
+	r, from := tree.Renderer, options.Renderer
+	r.blockTags = from.blockTags
+	r.hashtagLink = from.hashtagLink
+	r.mentionLink = from.mentionLink
+	r.issueBase = from.issueBase
+	r.commitBase = from.commitBase
+	r.userBase = from.userBase
+	r.variable = from.variable
+	r.refResolver = from.refResolver
+	r.urlRewriter = from.urlRewriter
+	r.htmlHook = from.htmlHook
+
+	return NewParser(func(options *Options) { *options = tree })
+}
+
+// parse to a document tree, run the transformers on it, and render it
+func (p *Parser) transform(done <-chan bool, input []byte) ([]byte, bool) {
+	doc, finished := p.parseTree(done, input)
+	return p.renderTree(doc, p.options.Renderer, p.rndr.opaque), finished
+}
+
+// parse to a document tree and run the transformers on it
+func (p *Parser) parseTree(done <-chan bool, input []byte) (*Node, bool) {
+	if p.tree == nil {
+		p.tree = newTreeParser(&p.options)
+	}
+	b := p.tree.options.Renderer.opaque.(*astBuilder)
+	doc := &Node{Type: NODE_DOCUMENT}
+	content, finished := p.tree.MarkdownUntil(done, astClean(input))
+	p.rndr.inputErr = p.tree.rndr.inputErr
+	b.adopt(doc, content)
+	b.nodes = nil
+
+	for _, transformer := range p.options.Transformers {
+		transformer(doc)
+	}
+	return doc, finished
+}
+
+// render a document tree with the given user data and run the output filters
+func (p *Parser) renderTree(doc *Node, renderer *Renderer, opaque interface{}) []byte {
+	r := *renderer
+	r.opaque = opaque
+	output := Render(doc, &r)
+	for _, filter := range p.options.OutputFilters {
+		output = filter(output)
+	}
+	return output
+}
+
+//
+//
+// Querying
+//
+//
+
+// Find the nodes of the given type in a tree, in document order,
+// including the root.
+func FindAll(n *Node, nodeType int) []*Node {
+	var found []*Node
+	Walk(n, func(n *Node, entering bool) WalkStatus {
+		if entering && n.Type == nodeType {
+			found = append(found, n)
+		}
+		return WALK_CONTINUE
+	})
+	return found
+}
+
+// Find the first node of the given type in a tree, or nil if there is none.
+func FindFirst(n *Node, nodeType int) *Node {
+	var found *Node
+	Walk(n, func(n *Node, entering bool) WalkStatus {
+		if entering && n.Type == nodeType {
+			found = n
+			return WALK_TERMINATE
+		}
+		return WALK_CONTINUE
+	})
+	return found
+}
+
+// the names of the node types in selectors
+var nodeTypeNames = map[string]int{
+	"document":        NODE_DOCUMENT,
+	"blockquote":      NODE_BLOCKQUOTE,
+	"list":            NODE_LIST,
+	"item":            NODE_ITEM,
+	"paragraph":       NODE_PARAGRAPH,
+	"header":          NODE_HEADER,
+	"heading":         NODE_HEADER,
+	"hrule":           NODE_HRULE,
+	"code_block":      NODE_CODE_BLOCK,
+	"html_block":      NODE_HTML_BLOCK,
+	"shortcode_block": NODE_SHORTCODE_BLOCK,
+	"table":           NODE_TABLE,
+	"table_head":      NODE_TABLE_HEAD,
+	"table_body":      NODE_TABLE_BODY,
+	"table_row":       NODE_TABLE_ROW,
+	"table_cell":      NODE_TABLE_CELL,
+	"table_caption":   NODE_TABLE_CAPTION,
+	"line_block":      NODE_LINE_BLOCK,
+	"details":         NODE_DETAILS,
+	"summary":         NODE_SUMMARY,
+	"footnotes":       NODE_FOOTNOTES,
+	"footnote":        NODE_FOOTNOTE,
+	"div":             NODE_DIV,
+	"text":            NODE_TEXT,
+	"entity":          NODE_ENTITY,
+	"emphasis":        NODE_EMPHASIS,
+	"double_emphasis": NODE_DOUBLE_EMPHASIS,
+	"triple_emphasis": NODE_TRIPLE_EMPHASIS,
+	"strikethrough":   NODE_STRIKETHROUGH,
+	"code":            NODE_CODE,
+	"link":            NODE_LINK,
+	"autolink":        NODE_AUTOLINK,
+	"image":           NODE_IMAGE,
+	"media_embed":     NODE_MEDIA_EMBED,
+	"linebreak":       NODE_LINEBREAK,
+	"html_span":       NODE_HTML_SPAN,
+	"ruby":            NODE_RUBY,
+	"ruby_text":       NODE_RUBY_TEXT,
+	"kbd":             NODE_KBD,
+	"shortcode":       NODE_SHORTCODE,
+	"footnote_ref":    NODE_FOOTNOTE_REF,
+}
+
+// one step of a selector: a node type, or -1 for any, and the
+// attributes the node must have
+type selectorStep struct {
+	nodeType int
+	attrs    []selectorAttr
+}
+
+type selectorAttr struct {
+	name  string
+	value string
+	any   bool // only present, with any value
+}
+
+// Find the nodes of a tree that match a selector, in document order,
+// including the root. A selector is a node type, named as in the NODE_*
+// constants but in lower case, or * for any type, followed by any number
+// of attribute tests, such as header[level=2] or code_block[lang="go"],
+// or just [lang] for any value. The attributes are level, start, lang,
+// info, link, title, literal, and id. Steps separated by spaces select nodes
+// inside those matched by the step before, as in "blockquote link".
+func Select(n *Node, selector string) ([]*Node, os.Error) {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*Node
+	last := len(steps) - 1
+	Walk(n, func(m *Node, entering bool) WalkStatus {
+		if !entering || !steps[last].matches(m) {
+			return WALK_CONTINUE
+		}
+
+		// the earlier steps must match ancestors, nearest first
+		step := last - 1
+		for a := m.Parent; step >= 0 && a != nil && a != n.Parent; a = a.Parent {
+			if steps[step].matches(a) {
+				step--
+			}
+		}
+		if step < 0 {
+			found = append(found, m)
+		}
+		return WALK_CONTINUE
+	})
+	return found, nil
+}
+
+func parseSelector(selector string) ([]selectorStep, os.Error) {
+	var steps []selectorStep
+	i := 0
+	for {
+		for i < len(selector) && selector[i] == ' ' {
+			i++
+		}
+		if i >= len(selector) {
+			break
+		}
+
+		// the node type
+		beg := i
+		for i < len(selector) && selector[i] != ' ' && selector[i] != '[' {
+			i++
+		}
+		step := selectorStep{nodeType: -1}
+		if name := selector[beg:i]; name != "*" && name != "" {
+			nodeType, ok := nodeTypeNames[name]
+			if !ok {
+				return nil, os.NewError("blackfriday: unknown node type in selector: " + name)
+			}
+			step.nodeType = nodeType
+		}
+
+		// the attribute tests
+		for i < len(selector) && selector[i] == '[' {
+			end := i + 1
+			for end < len(selector) && selector[end] != ']' {
+				end++
+			}
+			if end >= len(selector) {
+				return nil, os.NewError("blackfriday: unclosed [ in selector")
+			}
+			attr := selectorAttr{name: selector[i+1 : end], any: true}
+			if eq := strings.Index(attr.name, "="); eq >= 0 {
+				attr.name, attr.value, attr.any = attr.name[:eq], attr.name[eq+1:], false
+				if len(attr.value) >= 2 && (attr.value[0] == '"' || attr.value[0] == '\'') && attr.value[len(attr.value)-1] == attr.value[0] {
+					attr.value = attr.value[1 : len(attr.value)-1]
+				}
+			}
+			if _, ok := nodeAttr(&Node{}, attr.name); !ok {
+				return nil, os.NewError("blackfriday: unknown attribute in selector: " + attr.name)
+			}
+			step.attrs = append(step.attrs, attr)
+			i = end + 1
+		}
+		if i < len(selector) && selector[i] != ' ' {
+			return nil, os.NewError("blackfriday: unexpected " + selector[i:i+1] + " in selector")
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, os.NewError("blackfriday: empty selector")
+	}
+	return steps, nil
+}
+
+func (s *selectorStep) matches(n *Node) bool {
+	if s.nodeType >= 0 && n.Type != s.nodeType {
+		return false
+	}
+	for _, attr := range s.attrs {
+		value, _ := nodeAttr(n, attr.name)
+		if (attr.any && value == "") || (!attr.any && value != attr.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// the value of a node's attribute as a string, empty if it is not set,
+// and whether there is such an attribute
+func nodeAttr(n *Node, name string) (string, bool) {
+	switch name {
+	case "level", "start":
+		number := n.Level
+		if name == "start" {
+			number = n.Start
+		}
+		if number == 0 {
+			return "", true
+		}
+		return strconv.Itoa(number), true
+	case "lang":
+		return n.Lang, true
+	case "info":
+		return n.Info, true
+	case "link":
+		return string(n.Link), true
+	case "title":
+		return string(n.Title), true
+	case "literal":
+		return string(n.Literal), true
+	case "id":
+		if n.Attrs == nil {
+			return "", true
+		}
+		return n.Attrs.Id, true
+	}
+	return "", false
+}
+
+//
+//
+// Incremental parsing
+//
+//
+
+// Apply an edit to the input of a document tree made by Parse, replacing
+// removed bytes at offset with inserted ones, and return the tree and the
+// input as they are after the edit. Only the top-level blocks around the
+// edit are parsed again, widening the range until the blocks on either
+// side of it come out as before; the rest of the tree is kept, and the
+// old tree should not be used afterwards. Edits touching reference
+// definitions, which apply to the whole document, parse it all again, as
+// does any edit to a document with raw HTML blocks, which can reach as far
+// as the next matching closing tag, and any edit under the extensions in
+// reparseWhole.
+func Reparse(doc *Node, input []byte, offset, removed int, inserted []byte, extensions uint64) (*Node, []byte) {
+	if offset < 0 || removed < 0 || offset+removed > len(input) {
+		return doc, input
+	}
+	edited := make([]byte, 0, len(input)-removed+len(inserted))
+	edited = append(edited, input[:offset]...)
+	edited = append(edited, inserted...)
+	edited = append(edited, input[offset+removed:]...)
+
+	// the lines the edit touches, before and after
+	beg, end := offset, offset+removed
+	for beg > 0 && input[beg-1] != '\n' && input[beg-1] != '\r' {
+		beg--
+	}
+	for end < len(input) && input[end] != '\n' && input[end] != '\r' {
+		end++
+	}
+	touched := append(append(append([]byte(nil), input[beg:offset]...), inserted...), input[offset+removed:end]...)
+	if bytes.Contains(input[beg:end], []byte("]:")) || bytes.Contains(touched, []byte("]:")) {
+		return Parse(edited, extensions), edited
+	}
+	if hasHtmlLine(input) || hasHtmlLine(edited) || extensions&reparseWhole != 0 {
+		return Parse(edited, extensions), edited
+	}
+
+	blocks := doc.Children
+	for _, block := range blocks {
+		if block.Pos.Line == 0 {
+			return Parse(edited, extensions), edited
+		}
+	}
+	lines := lineStarts(input)
+	blockStart := func(n *Node) int { return lines[n.Pos.Line-1] }
+	blockEnd := func(n *Node) int {
+		if n.Pos.EndLine < len(lines) {
+			return lines[n.Pos.EndLine]
+		}
+		return len(input)
+	}
+	shift := countLines(inserted) - countLines(input[offset:offset+removed])
+	refs := scanReferences(edited)
+
+	// the blocks the edit falls within
+	first, last := 0, len(blocks)-1
+	for first < len(blocks) && blockEnd(blocks[first]) < offset {
+		first++
+	}
+	for last >= 0 && blockStart(blocks[last]) > offset+removed {
+		last--
+	}
+
+	for widen := 1; ; widen *= 2 {
+		a, b := first-widen, last+widen
+
+		// blocks parsed in one step, such as a paragraph ending in a
+		// setext header, share a position and go together
+		for a > 0 && blocks[a-1].Pos == blocks[a].Pos {
+			a--
+		}
+		for b >= 0 && b+1 < len(blocks) && blocks[b+1].Pos == blocks[b].Pos {
+			b++
+		}
+
+		rs, re := 0, len(input)
+		if a >= 0 {
+			rs = blockStart(blocks[a])
+		}
+		if b+1 < len(blocks) {
+			re = blockStart(blocks[b+1]) // with what lies between
+		}
+		region := parse(edited[rs:re+len(inserted)-removed], extensions, WithReferences(refs))
+		before := countLines(input[:rs])
+		for _, n := range region.Children {
+			if n.Pos.Line > 0 {
+				n.Pos.Line += before
+				n.Pos.EndLine += before
+			}
+		}
+
+		// the blocks on either side must be as they were
+		fresh := region.Children
+		if a >= 0 && (len(fresh) == 0 || !sameBlock(fresh[0], blocks[a], 0)) {
+			continue
+		}
+		if b < len(blocks) && (len(fresh) == 0 || !sameBlock(fresh[len(fresh)-1], blocks[b], shift)) {
+			continue
+		}
+
+		// splice the new blocks in, moving the ones after down
+		var children []*Node
+		if a > 0 {
+			children = append(children, blocks[:a]...)
+		}
+		children = append(children, fresh...)
+		if b+1 < len(blocks) {
+			for _, n := range blocks[b+1:] {
+				n.Pos.Line += shift
+				n.Pos.EndLine += shift
+				children = append(children, n)
+			}
+		}
+		for _, n := range children {
+			n.Parent = doc
+		}
+		doc.Children = children
+		return doc, edited
+	}
+	panic("unreachable")
+}
+
+// The extensions that make Reparse parse the whole document again. They
+// number things, such as examples and footnotes, give headers ids that
+// depend on the headers before them, look for metadata at the start, or
+// make blocks, such as definition lists and table captions, that take in
+// lines of the block before.
+const reparseWhole = EXTENSION_IMPLICIT_HEADER_REFS | EXTENSION_EXAMPLE_LISTS | EXTENSION_FOOTNOTES |
+	EXTENSION_CITATIONS | EXTENSION_METADATA | EXTENSION_DEFINITION_LISTS | EXTENSION_TABLE_CAPTIONS
+
+// check for a line that may open a raw HTML block
+func hasHtmlLine(data []byte) bool {
+	return (len(data) > 0 && data[0] == '<') ||
+		bytes.Contains(data, []byte("\n<")) || bytes.Contains(data, []byte("\r<"))
+}
+
+// check that a block parsed again is the one that was there, of the same
+// type and attributes, with the same contents, on the same lines moved
+// down by shift
+func sameBlock(n, old *Node, shift int) bool {
+	return samePosition(n.Pos, old.Pos, shift) && nodeKey(n) == nodeKey(old)
+}
+
+// compare the lines of two positions, the first moved down by shift
+func samePosition(p, q Position, shift int) bool {
+	return p.Line == q.Line+shift && p.EndLine == q.EndLine+shift && p.Col == q.Col && p.EndCol == q.EndCol
+}
+
+// the offset of each line of the input, taking \r\n as one line break
+func lineStarts(input []byte) []int {
+	starts := []int{0}
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\r' && i+1 < len(input) && input[i+1] == '\n' {
+			i++
+		}
+		if input[i] == '\n' || input[i] == '\r' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+//
+//
+// Saving and loading
+//
+//
+
+// the layout of saved trees, to catch ones saved by another version
+const treeVersion = 5
+
+// a node without its parent, which would make a cycle
+type savedNode struct {
+	Type     int
+	Children []*savedNode
+	Literal  []byte
+	Level    int
+	Flags    int
+	Start    int
+	Lang     string
+	Info     string
+	Fence    CodeFence
+	Link     []byte
+	Title    []byte
+	Attrs    *Attributes
+	Pos      Position
+}
+
+type savedTree struct {
+	Version int
+	Root    *savedNode
+}
+
+// Save a document tree, e.g., to cache the parse of a large document
+// and render it later, in whatever format is wanted then.
+func EncodeTree(w io.Writer, doc *Node) os.Error {
+	return gob.NewEncoder(w).Encode(savedTree{treeVersion, saveNode(doc)})
+}
+
+// Load a document tree saved by EncodeTree.
+func DecodeTree(r io.Reader) (*Node, os.Error) {
+	var tree savedTree
+	if err := gob.NewDecoder(r).Decode(&tree); err != nil {
+		return nil, err
+	}
+	if tree.Version != treeVersion || tree.Root == nil {
+		return nil, os.NewError("blackfriday: saved tree has an unknown layout")
+	}
+	return loadNode(tree.Root, nil), nil
+}
+
+func saveNode(n *Node) *savedNode {
+	s := &savedNode{n.Type, nil, n.Literal, n.Level, n.Flags, n.Start, n.Lang, n.Info, n.Fence, n.Link, n.Title, n.Attrs, n.Pos}
+	for _, child := range n.Children {
+		s.Children = append(s.Children, saveNode(child))
+	}
+	return s
+}
+
+func loadNode(s *savedNode, parent *Node) *Node {
+	n := &Node{s.Type, parent, nil, s.Literal, s.Level, s.Flags, s.Start, s.Lang, s.Info, s.Fence, s.Link, s.Title, s.Attrs, s.Pos}
+	for _, child := range s.Children {
+		n.Children = append(n.Children, loadNode(child, n))
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checks of the syntax tree against rendering the document directly
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// the contents and position of every node of a tree
+func positionedKey(n *Node) string {
+	key := bytes.NewBufferString(fmt.Sprint(n.Pos))
+	key.WriteString(nodeKey(n))
+	for _, child := range n.Children {
+		if child.Parent != n {
+			key.WriteString("!parent")
+		}
+		key.WriteString(positionedKey(child))
+	}
+	return key.String()
+}
+
+func checkReparse(t *testing.T, extensions uint64, input string, offset, removed int, inserted string) {
+	doc := Parse([]byte(input), extensions)
+	doc, edited := Reparse(doc, []byte(input), offset, removed, []byte(inserted), extensions)
+	if got, want := positionedKey(doc), positionedKey(Parse(edited, extensions)); got != want {
+		t.Errorf("extensions %#x, %q with %d bytes at %d replaced by %q:\nReparse %s\nParse   %s",
+			extensions, input, removed, offset, inserted, got, want)
+	}
+}
+
+func TestReparseDocumentState(t *testing.T) {
+	// header ids and example numbers count from the start of the document
+	checkReparse(t, PANDOC_EXTENSIONS, "# Head\n\n# Head\n\npara\n", 18, 0, "x")
+	checkReparse(t, PANDOC_EXTENSIONS, "(@) one\n\npara\n\n(@) two\n", 21, 0, "x")
+
+	// a definition list takes in the lines before it
+	checkReparse(t, 0xd00d1f11, "![a](b \"title\")***x***Sub\n---\n#tag `code````\nTitle: x\n", 31, 19, "a. alpha\n")
+}
+
+func TestReparseEdits(t *testing.T) {
+	input := "# Title\n\nsome *para*\nmore text\n\n> quote\n> more\n\n* a\n* b\n\n  * c\n\n" +
+		"    code\n\nSetext\n------\n\n```go\nx\n\ny\n```\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\nlast para\n"
+	edits := []string{"", "\n", "\n\n", "x", "* ", "> ", "---\n", "```\n", "#", "    ", "=\n", "1. ", "| x |\n", ": def\n"}
+	for _, extensions := range []uint64{0, COMMON_EXTENSIONS, GFM_EXTENSIONS, PANDOC_EXTENSIONS} {
+		for offset := 0; offset <= len(input); offset++ {
+			for _, inserted := range edits {
+				checkReparse(t, extensions, input, offset, 0, inserted)
+			}
+			if offset+3 <= len(input) {
+				checkReparse(t, extensions, input, offset, 3, "")
+			}
+		}
+	}
+}
+
+// rendering a tree gives what rendering the input directly gives, also
+// where the renderer refuses a span and its markup stays as text
+func TestRenderTree(t *testing.T) {
+	for _, input := range []string{
+		"**\\*a*",
+		"*\\**",
+		"***\\****",
+		"~~\\~~~",
+		"a **b** *c* ***d*** ~~e~~",
+		"![](<>) ![x](y)",
+	} {
+		want := string(Markdown([]byte(input), HtmlRenderer(0), COMMON_EXTENSIONS))
+		got := string(Render(Parse([]byte(input), COMMON_EXTENSIONS), HtmlRenderer(0)))
+		if got != want {
+			t.Errorf("%q: tree gives %q, direct rendering %q", input, got, want)
+		}
+	}
+}
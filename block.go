@@ -12,6 +12,8 @@ package blackfriday
 
 import (
 	"bytes"
+	"strconv"
+	"utf8"
 )
 
 // parse block-level data
@@ -21,64 +23,263 @@ func parseBlock(out *bytes.Buffer, rndr *render, data []byte) {
 	}
 	rndr.nesting++
 
-	for len(data) > 0 {
-		if isPrefixHeader(rndr, data) {
-			data = data[blockPrefixHeader(out, rndr, data):]
-			continue
+	line := 0 // line of the text where data starts
+	track := rndr.nesting == 1 && (rndr.mk.sourcepos != nil || rndr.mapSource || rndr.diagnose)
+	for len(data) > 0 && !isCancelled(rndr) {
+		mark := out.Len()
+		if track && rndr.diagnose {
+			rndr.line = blockLine(rndr, data, line)
 		}
-		if data[0] == '<' && rndr.mk.blockhtml != nil {
-			if i := blockHtml(out, rndr, data, true); i > 0 {
-				data = data[i:]
-				continue
-			}
+		i := parseBlockNext(out, rndr, data)
+		if i > len(data) {
+			i = len(data) // a parser counted a newline that is not there
 		}
-		if i := isEmpty(data); i > 0 {
-			data = data[i:]
-			continue
+		if track {
+			line = blockSourcepos(out, rndr, mark, data[:i], line)
 		}
-		if isHrule(data) {
-			if rndr.mk.hrule != nil {
-				rndr.mk.hrule(out, rndr.mk.opaque)
-			}
-			var i int
-			for i = 0; i < len(data) && data[i] != '\n'; i++ {
+		if rndr.nesting == 1 {
+			limitOutput(out, rndr)
+			if rndr.writer != nil {
+				flushBlocks(out, rndr)
 			}
-			data = data[i:]
-			continue
 		}
-		if rndr.flags&EXTENSION_FENCED_CODE != 0 {
-			if i := blockFencedCode(out, rndr, data); i > 0 {
-				data = data[i:]
-				continue
-			}
+		data = data[i:]
+	}
+
+	rndr.nesting--
+}
+
+// stop parsing once the output has grown past its soft limit
+func limitOutput(out *bytes.Buffer, rndr *render) {
+	limit := rndr.limits.SoftOutput
+	if limit > 0 && !rndr.stopped && rndr.written+out.Len() > limit {
+		warn(rndr, DIAG_LIMIT, "output is longer than "+strconv.Itoa(limit)+" bytes; the rest is left out")
+		rndr.stopped = true
+	}
+}
+
+// how much finished output to hold on to before writing it when streaming
+const flushSize = 4 << 10
+
+// write out the top-level blocks done so far once there are enough of
+// them, keeping back the last byte, as callbacks look at whether anything
+// comes before them; a failed write stops the parsing
+func flushBlocks(out *bytes.Buffer, rndr *render) {
+	n := out.Len() - 1
+	if n < flushSize || rndr.writeErr != nil {
+		return
+	}
+	if _, err := rndr.writer.Write(out.Bytes()[:n]); err != nil {
+		rndr.writeErr = err
+		rndr.stopped = true
+		return
+	}
+	rndr.written += n
+	last := out.Bytes()[n]
+	out.Reset()
+	out.WriteByte(last)
+}
+
+// check whether the caller wants parsing to stop
+func isCancelled(rndr *render) bool {
+	if rndr.done != nil && !rndr.stopped {
+		select {
+		case <-rndr.done:
+			rndr.stopped = true
+		default:
 		}
-		if rndr.flags&EXTENSION_TABLES != 0 {
-			if i := blockTable(out, rndr, data); i > 0 {
-				data = data[i:]
-				continue
-			}
+	}
+	return rndr.stopped
+}
+
+// parse the block at the start of data and return its length
+func parseBlockNext(out *bytes.Buffer, rndr *render, data []byte) int {
+	if i := blockCustom(out, rndr, data, true); i > 0 {
+		return i
+	}
+	if isPrefixHeader(rndr, data) {
+		return blockPrefixHeader(out, rndr, data)
+	}
+	if rndr.commonMark && rndr.mk.blockhtml != nil {
+		if i := blockHtmlCommonMark(out, rndr, data); i > 0 {
+			return i
 		}
-		if blockQuotePrefix(data) > 0 {
-			data = data[blockQuote(out, rndr, data):]
-			continue
+	} else if data[0] == '<' && rndr.mk.blockhtml != nil {
+		if i := blockHtml(out, rndr, data, true); i > 0 {
+			return i
 		}
-		if blockCodePrefix(data) > 0 {
-			data = data[blockCode(out, rndr, data):]
-			continue
+	}
+	if data[0] == '<' && rndr.flags&EXTENSION_STRIP_COMMENTS != 0 {
+		if i := blockHtmlComment(data); i > 0 {
+			return i
 		}
-		if blockUliPrefix(data) > 0 {
-			data = data[blockList(out, rndr, data, 0):]
-			continue
+	}
+	if data[0] == '{' && rndr.flags&EXTENSION_SHORTCODES != 0 && rndr.mk.blockShortcode != nil {
+		if i := blockShortcode(out, rndr, data); i > 0 {
+			return i
 		}
-		if blockOliPrefix(data) > 0 {
-			data = data[blockList(out, rndr, data, LIST_TYPE_ORDERED):]
+	}
+	if i := isEmpty(data); i > 0 {
+		return i
+	}
+	if isHrule(data) {
+		if rndr.mk.hrule != nil {
+			rndr.mk.hrule(out, rndr.opaque)
+		}
+		return lineEnd(data, 0)
+	}
+	if rndr.flags&EXTENSION_FENCED_CODE != 0 {
+		if i := blockFencedCode(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_TABLES != 0 {
+		if i := blockTable(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_GRID_TABLES != 0 && data[0] == '+' {
+		if i := blockGridTable(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_DETAILS != 0 && data[0] == ':' {
+		if i := blockDetails(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_FENCED_DIVS != 0 && data[0] == ':' {
+		if i := blockFencedDiv(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_LINE_BLOCKS != 0 && blockLineBlockPrefix(data) > 0 {
+		return blockLineBlock(out, rndr, data)
+	}
+	if blockQuotePrefix(data) > 0 {
+		return blockQuote(out, rndr, data)
+	}
+	if blockCodePrefix(data) > 0 {
+		return blockCode(out, rndr, data)
+	}
+	if blockUliPrefix(data) > 0 {
+		return blockList(out, rndr, data, 0)
+	}
+	if i := blockOliPrefix(data); i > 0 && (!rndr.markdownPl || data[i-2] == '.') {
+		return blockList(out, rndr, data, LIST_TYPE_ORDERED)
+	}
+	if rndr.flags&EXTENSION_FANCY_LISTS != 0 {
+		if i, kind := blockFancyOliPrefix(data); i > 0 {
+			return blockList(out, rndr, data, LIST_TYPE_ORDERED|kind)
+		}
+	}
+	if rndr.flags&EXTENSION_EXAMPLE_LISTS != 0 {
+		if i, _ := blockExamplePrefix(data); i > 0 {
+			return blockList(out, rndr, data, LIST_TYPE_ORDERED|LIST_TYPE_EXAMPLE)
+		}
+	}
+	if rndr.flags&EXTENSION_DEFINITION_LISTS != 0 {
+		if i := blockDefinitionList(out, rndr, data); i > 0 {
+			return i
+		}
+	}
+	if i := blockCustom(out, rndr, data, false); i > 0 {
+		return i
+	}
+
+	return blockParagraph(out, rndr, data)
+}
+
+// try the caller's block parsers that go before or after the built-in ones
+func blockCustom(out *bytes.Buffer, rndr *render, data []byte, before bool) int {
+	for _, custom := range rndr.mk.blockParsers {
+		if (custom.priority > 0) != before {
 			continue
 		}
+		if i := custom.parser(out, data, rndr.opaque); i > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// the line of the input where the block at the start of data begins
+func blockLine(rndr *render, data []byte, line int) int {
+	for i := 0; i < len(data) && isspace(data[i]); i++ {
+		if data[i] == '\n' {
+			line++
+		}
+	}
+	if line < len(rndr.sourceLines) {
+		return rndr.sourceLines[line].number
+	}
+	return 0
+}
 
-		data = data[blockParagraph(out, rndr, data):]
+// report where a top-level block came from in the input,
+// returning the line of the text that follows it
+func blockSourcepos(out *bytes.Buffer, rndr *render, mark int, data []byte, line int) int {
+	beg, end := 0, len(data)
+	for beg < end && isspace(data[beg]) {
+		if data[beg] == '\n' {
+			line++
+		}
+		beg++
+	}
+	for end > beg && isspace(data[end-1]) {
+		end--
 	}
+	last := line + bytes.Count(data[beg:end], []byte("\n"))
 
-	rndr.nesting--
+	if beg < end && out.Len() > mark && last < len(rndr.sourceLines) {
+		src := rndr.source
+		first, final := rndr.sourceLines[line], rndr.sourceLines[last]
+
+		// columns are counted in the input, before tabs are expanded
+		i := first.offset
+		for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+			i++
+		}
+		col := i - first.offset + 1
+
+		i = final.offset
+		i = lineBreak(src, i)
+		for i > final.offset && isspace(src[i-1]) {
+			i--
+		}
+		if rndr.mk.sourcepos != nil {
+			rndr.mk.sourcepos(out, mark, first.number, col, final.number, i-final.offset, rndr.opaque)
+		}
+		if rndr.mapSource {
+			span := SourceSpan{rndr.written + mark, rndr.written + out.Len(), first.offset + col - 1, i}
+			rndr.sourceMap = append(rndr.sourceMap, span)
+		}
+	}
+
+	return line + bytes.Count(data[beg:], []byte("\n"))
+}
+
+// a shortcode, or a shortcode pair with everything between, alone on its line
+func blockShortcode(out *bytes.Buffer, rndr *render, data []byte) int {
+	end := shortcodeEnd(data)
+	if end == 0 {
+		return 0
+	}
+
+	// nothing else may follow it on the line
+	i := end
+	for i < len(data) && data[i] != '\n' {
+		if data[i] != ' ' && data[i] != '\t' {
+			return 0
+		}
+		i++
+	}
+	if i < len(data) {
+		i++
+	}
+
+	rndr.mk.blockShortcode(out, data[:end], rndr.opaque)
+	return i
 }
 
 func isPrefixHeader(rndr *render, data []byte) bool {
@@ -106,8 +307,7 @@ func blockPrefixHeader(out *bytes.Buffer, rndr *render, data []byte) int {
 	i, end := 0, 0
 	for i = level; i < len(data) && (data[i] == ' ' || data[i] == '\t'); i++ {
 	}
-	for end = i; end < len(data) && data[end] != '\n'; end++ {
-	}
+	end = lineEnd(data, i)
 	skip := end
 	for end > 0 && data[end-1] == '#' {
 		end--
@@ -115,12 +315,18 @@ func blockPrefixHeader(out *bytes.Buffer, rndr *render, data []byte) int {
 	for end > 0 && (data[end-1] == ' ' || data[end-1] == '\t') {
 		end--
 	}
-	if end > i {
-		work := bytes.NewBuffer(nil)
-		parseInline(work, rndr, data[i:end])
+	if end < i {
+		end = i // a header with no text, such as # alone
+	}
+	text, attrs := headerAttributes(rndr, data[i:end])
+	if len(text) > 0 {
+		work := newBuffer(rndr)
+		parseInline(work, rndr, text)
 		if rndr.mk.header != nil {
-			rndr.mk.header(out, work.Bytes(), level, rndr.mk.opaque)
+			blockAttributes(rndr, attrs)
+			rndr.mk.header(out, work.Bytes(), level, rndr.opaque)
 		}
+		freeBuffer(rndr, work)
 	}
 	return skip
 }
@@ -159,6 +365,38 @@ func isUnderlinedHeader(data []byte) int {
 	return 0
 }
 
+// pass raw HTML through the renderer's hook, if any, and render what is left
+func blockHtmlOutput(out *bytes.Buffer, rndr *render, data []byte) {
+	if rndr.mk.htmlHook != nil {
+		if data = rndr.mk.htmlHook(data, true); len(data) == 0 {
+			return
+		}
+	}
+	rndr.mk.blockhtml(out, data, rndr.opaque)
+}
+
+// an HTML comment followed by a blank line
+func blockHtmlComment(data []byte) int {
+	if len(data) <= 5 || data[0] != '<' || data[1] != '!' || data[2] != '-' || data[3] != '-' {
+		return 0
+	}
+
+	i := 5
+	for i < len(data) && !(data[i-2] == '-' && data[i-1] == '-' && data[i] == '>') {
+		i++
+	}
+	i++
+
+	j := 0
+	if i < len(data) {
+		j = isEmpty(data[i:])
+	}
+	if j == 0 {
+		return 0
+	}
+	return i + j
+}
+
 func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int {
 	var i, j int
 
@@ -166,31 +404,17 @@ func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int
 	if len(data) < 2 || data[0] != '<' {
 		return 0
 	}
-	curtag, tagfound := blockHtmlFindTag(data[1:])
+	curtag, tagfound := blockHtmlFindTag(rndr, data[1:])
 
 	// handle special cases
 	if !tagfound {
 
 		// HTML comment, laxist form
-		if len(data) > 5 && data[1] == '!' && data[2] == '-' && data[3] == '-' {
-			i = 5
-
-			for i < len(data) && !(data[i-2] == '-' && data[i-1] == '-' && data[i] == '>') {
-				i++
-			}
-			i++
-
-			if i < len(data) {
-				j = isEmpty(data[i:])
-			}
-
-			if j > 0 {
-				size := i + j
-				if do_render && rndr.mk.blockhtml != nil {
-					rndr.mk.blockhtml(out, data[:size], rndr.mk.opaque)
-				}
-				return size
+		if size := blockHtmlComment(data); size > 0 {
+			if do_render && rndr.mk.blockhtml != nil && rndr.flags&EXTENSION_STRIP_COMMENTS == 0 {
+				blockHtmlOutput(out, rndr, data[:size])
 			}
+			return size
 		}
 
 		// HR, which is the only self-closing block tag considered
@@ -206,7 +430,7 @@ func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int
 				if j > 0 {
 					size := i + j
 					if do_render && rndr.mk.blockhtml != nil {
-						rndr.mk.blockhtml(out, data[:size], rndr.mk.opaque)
+						blockHtmlOutput(out, rndr, data[:size])
 					}
 					return size
 				}
@@ -221,6 +445,7 @@ func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int
 	//      followed by a blank line
 	i = 1
 	found := false
+	closer := 0
 
 	// if not found, try a second pass looking for indented match
 	// but not if tag is "ins" or "del" (following original Markdown.pl)
@@ -239,6 +464,7 @@ func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int
 			j = blockHtmlFindEnd(curtag, rndr, data[i-1:])
 
 			if j > 0 {
+				closer = i - 1
 				i += j - 1
 				found = true
 				break
@@ -251,23 +477,129 @@ func blockHtml(out *bytes.Buffer, rndr *render, data []byte, do_render bool) int
 	}
 
 	// the end of the block has been found
+	if rndr.flags&EXTENSION_MARKDOWN_IN_HTML != 0 && blockHtmlMarkdown(out, rndr, data[:i], curtag, closer, do_render) {
+		return i
+	}
 	if do_render && rndr.mk.blockhtml != nil {
-		rndr.mk.blockhtml(out, data[:i], rndr.mk.opaque)
+		blockHtmlOutput(out, rndr, data[:i])
 	}
 
 	return i
 }
 
-func blockHtmlFindTag(data []byte) (string, bool) {
+// render the contents of an HTML block as markdown if the opening tag
+// asks for it with markdown="1" (or "block", or "span" for inline only)
+// closer is the offset of the closing tag
+func blockHtmlMarkdown(out *bytes.Buffer, rndr *render, data []byte, curtag string, closer int, do_render bool) bool {
+	// find the end of the opening tag
+	end := 1
+	for end < closer && data[end] != '>' {
+		if data[end] == '"' || data[end] == '\'' {
+			q := data[end]
+			end++
+			for end < closer && data[end] != q {
+				end++
+			}
+		}
+		end++
+	}
+	if end >= closer {
+		return false
+	}
+
+	mode, tag := htmlMarkdownAttr(data[:end+1])
+	if mode != "1" && mode != "block" && mode != "span" {
+		return false
+	}
+
+	// paragraphs and headers can only hold inline content
+	if mode == "1" && (curtag == "p" || (len(curtag) == 2 && curtag[0] == 'h' && curtag[1] >= '1' && curtag[1] <= '6')) {
+		mode = "span"
+	}
+	if !do_render || rndr.mk.blockhtml == nil {
+		return true
+	}
+
+	blockHtmlOutput(out, rndr, tag)
+	if mode == "span" {
+		parseInline(out, rndr, bytes.TrimSpace(data[end+1:closer]))
+	} else {
+		// block parsers expect their text to end in a newline
+		inner := data[end+1 : closer]
+		if len(inner) > 0 && inner[len(inner)-1] != '\n' {
+			work := newBuffer(rndr)
+			work.Write(inner)
+			work.WriteByte('\n')
+			parseBlock(out, rndr, work.Bytes())
+			freeBuffer(rndr, work)
+		} else {
+			parseBlock(out, rndr, inner)
+		}
+	}
+	blockHtmlOutput(out, rndr, data[closer:])
+
+	return true
+}
+
+// find the markdown attribute in an opening tag
+// returns its value and the tag with the attribute removed
+func htmlMarkdownAttr(tag []byte) (string, []byte) {
+	i := 0
+	for {
+		j := bytes.Index(tag[i:], []byte("markdown="))
+		if j < 0 {
+			return "", tag
+		}
+		i += j
+		if isspace(tag[i-1]) {
+			break
+		}
+		i++
+	}
+
+	// the value may be quoted or bare
+	beg := i + len("markdown=")
+	end := beg
+	if end < len(tag) && (tag[end] == '"' || tag[end] == '\'') {
+		q := tag[end]
+		end++
+		for end < len(tag) && tag[end] != q {
+			end++
+		}
+		if end >= len(tag) {
+			return "", tag
+		}
+		beg, end = beg+1, end+1
+	} else {
+		for end < len(tag) && !isspace(tag[end]) && tag[end] != '>' && tag[end] != '/' {
+			end++
+		}
+	}
+	value := tag[beg:end]
+	if len(value) > 0 && (value[len(value)-1] == '"' || value[len(value)-1] == '\'') {
+		value = value[:len(value)-1]
+	}
+
+	// drop the attribute along with the space before it
+	stripped := bytes.NewBuffer(nil)
+	stripped.Write(tag[:i-1])
+	stripped.Write(tag[end:])
+	return string(value), stripped.Bytes()
+}
+
+func blockHtmlFindTag(rndr *render, data []byte) (string, bool) {
 	i := 0
-	for i < len(data) && ((data[i] >= '0' && data[i] <= '9') || (data[i] >= 'A' && data[i] <= 'Z') || (data[i] >= 'a' && data[i] <= 'z')) {
+	for i < len(data) && (isalnum(data[i]) || (i > 0 && data[i] == '-')) {
 		i++
 	}
 	if i >= len(data) {
 		return "", false
 	}
 	key := string(data[:i])
-	if block_tags[key] {
+	if !rndr.markdownPl {
+		key = string(bytes.ToLower(data[:i]))
+	}
+	if rndr.blockTags[key] {
 		return key, true
 	}
 	return "", false
@@ -276,8 +608,15 @@ func blockHtmlFindTag(data []byte) (string, bool) {
 func blockHtmlFindEnd(tag string, rndr *render, data []byte) int {
 	// assume data[0] == '<' && data[1] == '/' already tested
 
-	// check if tag is a match
-	if len(tag)+3 >= len(data) || bytes.Compare(data[2:2+len(tag)], []byte(tag)) != 0 || data[len(tag)+2] != '>' {
+	// check if tag is a match, in any case but under Markdown.pl
+	if len(tag)+3 >= len(data) || data[len(tag)+2] != '>' {
+		return 0
+	}
+	if rndr.markdownPl {
+		if bytes.Compare(data[2:2+len(tag)], []byte(tag)) != 0 {
+			return 0
+		}
+	} else if hasPrefixFold(data[2:], tag) == 0 {
 		return 0
 	}
 
@@ -307,6 +646,20 @@ func blockHtmlFindEnd(tag string, rndr *render, data []byte) int {
 	return i + w
 }
 
+// whether a line holds nothing but spaces and tabs before its line
+// break; unlike isEmpty it looks from the end, where a line of text
+// shows itself at once however deeply it is indented
+func isBlankLine(line []byte) bool {
+	i := len(line)
+	if i > 0 && line[i-1] == '\n' {
+		i--
+	}
+	for i > 0 && (line[i-1] == ' ' || line[i-1] == '\t') {
+		i--
+	}
+	return i == 0
+}
+
 func isEmpty(data []byte) int {
 	var i int
 	for i = 0; i < len(data) && data[i] != '\n'; i++ {
@@ -354,7 +707,10 @@ func isHrule(data []byte) bool {
 	return n >= 3
 }
 
-func isFencedCode(data []byte, syntax **string) int {
+// returns the length of a code fence line, or 0 if there is none
+// when syntax is set, it receives the language and info gets the
+// complete info string following the fence, e.g., go linenos=table
+func isFencedCode(data []byte, syntax **string, info *string) int {
 	i, n := 0, 0
 
 	// skip initial spaces
@@ -388,6 +744,11 @@ func isFencedCode(data []byte, syntax **string) int {
 		return 0
 	}
 
+	// backticks after those of the fence make it a code span instead
+	if c == '`' && bytes.IndexByte(data[i:lineEnd(data, i)], '`') >= 0 {
+		return 0
+	}
+
 	if syntax != nil {
 		syn := 0
 
@@ -396,6 +757,7 @@ func isFencedCode(data []byte, syntax **string) int {
 		}
 
 		syntax_start := i
+		info_start := i
 
 		if i < len(data) && data[i] == '{' {
 			i++
@@ -427,10 +789,21 @@ func isFencedCode(data []byte, syntax **string) int {
 				syn++
 				i++
 			}
+
+			// anything else on the line is kept in the info string
+			i = lineEnd(data, i)
 		}
 
 		language := string(data[syntax_start : syntax_start+syn])
 		*syntax = &language
+
+		if info != nil {
+			info_end := i
+			for info_end > info_start && isspace(data[info_end-1]) {
+				info_end--
+			}
+			*info = string(data[info_start:info_end])
+		}
 	}
 
 	for i < len(data) && data[i] != '\n' {
@@ -443,29 +816,56 @@ func isFencedCode(data []byte, syntax **string) int {
 	return i + 1
 }
 
+// describe the opening fence of a code block
+// assumes it has been validated by isFencedCode
+func codeFence(data []byte) CodeFence {
+	var fence CodeFence
+	for data[fence.Indent] == ' ' {
+		fence.Indent++
+	}
+	fence.Char = data[fence.Indent]
+	for fence.Indent+fence.Length < len(data) && data[fence.Indent+fence.Length] == fence.Char {
+		fence.Length++
+	}
+	return fence
+}
+
 func blockFencedCode(out *bytes.Buffer, rndr *render, data []byte) int {
 	var lang *string
-	beg := isFencedCode(data, &lang)
+	var info string
+	beg := isFencedCode(data, &lang, &info)
 	if beg == 0 {
 		return 0
 	}
 
-	work := bytes.NewBuffer(nil)
+	// the code is passed on where it is, in data[code_b:code_e], unless a
+	// blank line holds white space to drop
+	work := newBuffer(rndr)
+	code_b, code_e, copied := beg, beg, false
 
+	closed := false
 	for beg < len(data) {
-		fence_end := isFencedCode(data[beg:], nil)
+		fence_end := isFencedCode(data[beg:], nil, nil)
 		if fence_end != 0 {
 			beg += fence_end
+			closed = true
 			break
 		}
 
 		var end int
-		for end = beg + 1; end < len(data) && data[end-1] != '\n'; end++ {
-		}
+		end = nextLine(data, beg)
 
 		if beg < end {
+			blank := isEmpty(data[beg:]) > 0
+			if !copied && blank && end-beg > 1 {
+				work.Write(data[code_b:code_e])
+				copied = true
+			}
+
 			// verbatim copy to the working buffer, escaping entities
-			if isEmpty(data[beg:]) > 0 {
+			if !copied {
+				code_e = end
+			} else if blank {
 				work.WriteByte('\n')
 			} else {
 				work.Write(data[beg:end])
@@ -474,8 +874,20 @@ func blockFencedCode(out *bytes.Buffer, rndr *render, data []byte) int {
 		beg = end
 	}
 
-	if work.Len() > 0 && work.Bytes()[work.Len()-1] != '\n' {
+	if !closed {
+		warn(rndr, DIAG_UNCLOSED_FENCE, "fenced code block is not closed")
+	}
+
+	code := data[code_b:code_e]
+	if copied {
+		code = work.Bytes()
+	}
+	if len(code) > 0 && code[len(code)-1] != '\n' {
+		if !copied {
+			work.Write(code)
+		}
 		work.WriteByte('\n')
+		code = work.Bytes()
 	}
 
 	if rndr.mk.blockcode != nil {
@@ -484,51 +896,95 @@ func blockFencedCode(out *bytes.Buffer, rndr *render, data []byte) int {
 			syntax = *lang
 		}
 
-		rndr.mk.blockcode(out, work.Bytes(), syntax, rndr.mk.opaque)
+		// under EXTENSION_ATTRIBUTES, {#id .lang key=value} gives the
+		// language by its classes and the rest as attributes
+		var attrs *Attributes
+		if rndr.flags&EXTENSION_ATTRIBUTES != 0 && len(info) > 0 && info[0] == '{' {
+			if attrs = parseAttributes([]byte(syntax)); attrs != nil {
+				syntax = ""
+				for i, class := range attrs.Classes {
+					if i > 0 {
+						syntax += " "
+					}
+					syntax += class
+				}
+				attrs.Classes = nil
+			}
+		}
+		blockAttributes(rndr, attrs)
+		rndr.mk.blockcode(out, code, syntax, info, codeFence(data), rndr.opaque)
 	}
+	freeBuffer(rndr, work)
 
 	return beg
 }
 
 func blockTable(out *bytes.Buffer, rndr *render, data []byte) int {
-	header_work := bytes.NewBuffer(nil)
-	i, columns, col_data := blockTableHeader(header_work, rndr, data)
+	// a caption may come on the line before the table, or the line after
+	var caption []byte
+	beg := 0
+	if rndr.flags&EXTENSION_TABLE_CAPTIONS != 0 {
+		caption, beg = tableCaption(data)
+	}
+
+	header_work := newBuffer(rndr)
+	i, columns, col_data := blockTableHeader(header_work, rndr, data[beg:])
 	if i > 0 {
-		body_work := bytes.NewBuffer(nil)
+		i += beg
+		body_work := newBuffer(rndr)
+		shown := tableColumnLimit(rndr, columns)
 
+		rows := 0
 		for i < len(data) {
-			pipes, row_start := 0, i
-			for ; i < len(data) && data[i] != '\n'; i++ {
-				if data[i] == '|' {
-					pipes++
-				}
-			}
+			row_start := i
+			i = lineEnd(data, i)
+			pipes := bytes.Count(data[row_start:i], []byte("|"))
 
 			if pipes == 0 || i == len(data) {
 				i = row_start
 				break
 			}
 
-			blockTableRow(body_work, rndr, data[row_start:i], columns, col_data)
+			if keepTableRow(rndr, rows) {
+				blockTableRow(body_work, rndr, data[row_start:i], columns, col_data, false)
+			}
+			rows++
 			i++
 		}
 
+		// an underline with neither a header nor rows is not a table
+		if rows == 0 && header_work.Len() == 0 {
+			freeBuffer(rndr, body_work)
+			freeBuffer(rndr, header_work)
+			return 0
+		}
+
+		warnTableLimits(rndr, columns, rows)
+		if caption == nil && rndr.flags&EXTENSION_TABLE_CAPTIONS != 0 {
+			var n int
+			if caption, n = tableCaption(data[i:]); n > 0 {
+				i += n
+			}
+		}
 		if rndr.mk.table != nil {
-			rndr.mk.table(out, header_work.Bytes(), body_work.Bytes(), rndr.mk.opaque)
+			caption_work := newBuffer(rndr)
+			if caption != nil {
+				parseInline(caption_work, rndr, caption)
+			}
+			rndr.mk.table(out, header_work.Bytes(), body_work.Bytes(), caption_work.Bytes(), col_data[:shown], rndr.opaque)
+			freeBuffer(rndr, caption_work)
 		}
+		freeBuffer(rndr, body_work)
 	}
+	freeBuffer(rndr, header_work)
 
 	return i
 }
 
 func blockTableHeader(out *bytes.Buffer, rndr *render, data []byte) (size int, columns int, column_data []int) {
-	i, pipes := 0, 0
 	column_data = []int{}
-	for i = 0; i < len(data) && data[i] != '\n'; i++ {
-		if data[i] == '|' {
-			pipes++
-		}
-	}
+	i := lineEnd(data, 0)
+	pipes := bytes.Count(data[:i], []byte("|"))
 
 	if i == len(data) || pipes == 0 {
 		return 0, 0, column_data
@@ -545,71 +1001,111 @@ func blockTableHeader(out *bytes.Buffer, rndr *render, data []byte) (size int, c
 	}
 
 	columns = pipes + 1
-	column_data = make([]int, columns)
+	column_data = rndr.arena.intSlice(columns)
+
+	// a table may start directly with the underline, in which case it has no header
+	if isTableUnderline(data[:header_end]) {
+		if tableUnderline(rndr, data[:header_end], columns, column_data) < columns {
+			return 0, 0, column_data
+		}
+		size = header_end + 1
+		return
+	}
 
 	// parse the header underline
 	i++
-	if i < len(data) && data[i] == '|' {
-		i++
+	under_end := i
+	under_end = lineEnd(data, under_end)
+
+	if tableUnderline(rndr, data[i:under_end], columns, column_data) < columns {
+		if isTableUnderline(data[i:under_end]) {
+			warn(rndr, DIAG_MALFORMED_TABLE, "table underline does not match the "+strconv.Itoa(columns)+" columns of the header")
+		}
+		return 0, 0, column_data
 	}
 
-	under_end := i
-	for under_end < len(data) && data[under_end] != '\n' {
-		under_end++
+	blockTableRow(out, rndr, data[:header_end], columns, column_data, true)
+	size = under_end + 1
+	return
+}
+
+// check if a line consists only of table underline characters
+func isTableUnderline(data []byte) bool {
+	dashes := 0
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '-':
+			dashes++
+		case '|', ':', ' ', '\t':
+		default:
+			return false
+		}
+	}
+	return dashes >= 3
+}
+
+// parse a table underline, filling in the alignment of each column
+// returns the number of columns found
+// each column needs three dashes and colons, or under CommonMark, as
+// in GitHub Flavored Markdown, one dash
+func tableUnderline(rndr *render, data []byte, columns int, column_data []int) int {
+	i := 0
+	if i < len(data) && data[i] == '|' {
+		i++
 	}
 
 	col := 0
-	for ; col < columns && i < under_end; col++ {
-		dashes := 0
+	for ; col < columns && i < len(data); col++ {
+		dashes, hyphens := 0, 0
 
-		for i < under_end && (data[i] == ' ' || data[i] == '\t') {
+		for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
 			i++
 		}
 
-		if data[i] == ':' {
+		if i < len(data) && data[i] == ':' {
 			i++
 			column_data[col] |= TABLE_ALIGNMENT_LEFT
 			dashes++
 		}
 
-		for i < under_end && data[i] == '-' {
+		for i < len(data) && data[i] == '-' {
 			i++
 			dashes++
+			hyphens++
 		}
 
-		if i < under_end && data[i] == ':' {
+		if i < len(data) && data[i] == ':' {
 			i++
 			column_data[col] |= TABLE_ALIGNMENT_RIGHT
 			dashes++
 		}
 
-		for i < under_end && (data[i] == ' ' || data[i] == '\t') {
+		for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
 			i++
 		}
 
-		if i < under_end && data[i] != '|' {
+		if i < len(data) && data[i] != '|' {
 			break
 		}
 
-		if dashes < 3 {
+		if dashes < 3 && !(rndr.commonMark && hyphens > 0) {
 			break
 		}
 
 		i++
 	}
 
-	if col < columns {
-		return 0, 0, column_data
-	}
-
-	blockTableRow(out, rndr, data[:header_end], columns, column_data)
-	size = under_end + 1
-	return
+	return col
 }
 
-func blockTableRow(out *bytes.Buffer, rndr *render, data []byte, columns int, col_data []int) {
+func blockTableRow(out *bytes.Buffer, rndr *render, data []byte, columns int, col_data []int, header bool) {
 	i, col := 0, 0
-	row_work := bytes.NewBuffer(nil)
+	row_work := newBuffer(rndr)
+	shown := tableColumnLimit(rndr, columns)
+	flags := 0
+	if header {
+		flags = TABLE_CELL_HEADER
+	}
 
 	if i < len(data) && data[i] == '|' {
 		i++
@@ -632,36 +1128,479 @@ func blockTableRow(out *bytes.Buffer, rndr *render, data []byte, columns int, co
 			cell_end--
 		}
 
-		cell_work := bytes.NewBuffer(nil)
-		parseInline(cell_work, rndr, data[cell_start:cell_end+1])
+		if col < shown {
+			cell_work := newBuffer(rndr)
+			parseInline(cell_work, rndr, data[cell_start:cell_end+1])
 
-		if rndr.mk.tableCell != nil {
-			cdata := 0
-			if col < len(col_data) {
-				cdata = col_data[col]
+			if rndr.mk.tableCell != nil {
+				cdata := 0
+				if col < len(col_data) {
+					cdata = col_data[col]
+				}
+				rndr.mk.tableCell(row_work, cell_work.Bytes(), cdata|flags, rndr.opaque)
 			}
-			rndr.mk.tableCell(row_work, cell_work.Bytes(), cdata, rndr.mk.opaque)
+			freeBuffer(rndr, cell_work)
 		}
 
 		i++
 	}
 
-	for ; col < columns; col++ {
+	if col < columns {
+		warn(rndr, DIAG_MALFORMED_TABLE, "table row has fewer cells than the header")
+	} else if i < len(data) && len(bytes.TrimSpace(data[i:])) > 0 {
+		warn(rndr, DIAG_MALFORMED_TABLE, "table row has more cells than the header")
+	}
+
+	for ; col < shown; col++ {
 		empty_cell := []byte{}
 		if rndr.mk.tableCell != nil {
 			cdata := 0
 			if col < len(col_data) {
 				cdata = col_data[col]
 			}
-			rndr.mk.tableCell(row_work, empty_cell, cdata, rndr.mk.opaque)
+			rndr.mk.tableCell(row_work, empty_cell, cdata|flags, rndr.opaque)
 		}
 	}
 
 	if rndr.mk.tableRow != nil {
-		rndr.mk.tableRow(out, row_work.Bytes(), rndr.mk.opaque)
+		rndr.mk.tableRow(out, row_work.Bytes(), rndr.opaque)
+	}
+	freeBuffer(rndr, row_work)
+}
+
+// grid tables draw every cell boundary, so cells can span several lines:
+//
+//	+-------+---------+
+//	| Name  | Notes   |
+//	+=======+=========+
+//	| one   | wrapped |
+//	|       | text    |
+//	+-------+---------+
+//
+// rows above a '=' separator form the header
+func blockGridTable(out *bytes.Buffer, rndr *render, data []byte) int {
+	// the first line is a separator that fixes the column boundaries
+	i := 0
+	i = lineEnd(data, i)
+	bounds, column_data := gridTableSeparator(data[:i], nil)
+	if len(bounds) < 2 {
+		return 0
+	}
+	columns := len(bounds) - 1
+	if i < len(data) {
+		i++
+	}
+
+	header_work := newBuffer(rndr)
+	body_work := newBuffer(rndr)
+	cells := make([]*bytes.Buffer, columns)
+	shown := tableColumnLimit(rndr, columns)
+	rows, body, pending := 0, 0, false
+
+	for i < len(data) {
+		line_start := i
+		i = lineEnd(data, i)
+		line := data[line_start:i]
+		if i < len(data) {
+			i++
+		}
+
+		// a separator line closes the current row
+		if len(line) > 0 && line[0] == '+' {
+			if !pending {
+				break
+			}
+			_, align := gridTableSeparator(line, bounds)
+			if align == nil {
+				break
+			}
+			if bytes.IndexByte(line, '=') >= 0 && header_work.Len() == 0 && body_work.Len() == 0 {
+				blockGridTableRow(header_work, rndr, cells[:shown], column_data, true)
+				for col := range column_data {
+					if align[col] != 0 {
+						column_data[col] = align[col]
+					}
+				}
+			} else {
+				if keepTableRow(rndr, body) {
+					blockGridTableRow(body_work, rndr, cells[:shown], column_data, false)
+				}
+				body++
+			}
+			cells = make([]*bytes.Buffer, columns)
+			rows++
+			pending = false
+			continue
+		}
+
+		// otherwise it must be a content line with a pipe on every boundary
+		if utf8.RuneCount(line) <= bounds[columns] || line[0] != '|' {
+			i = line_start
+			break
+		}
+		pipes := gridTablePipes(line, bounds)
+		if pipes == nil {
+			return 0
+		}
+		for col := 0; col < columns; col++ {
+			if cells[col] == nil {
+				cells[col] = bytes.NewBuffer(nil)
+			}
+			cells[col].Write(line[pipes[col]+1 : pipes[col+1]])
+			cells[col].WriteByte('\n')
+		}
+		pending = true
+	}
+
+	// the table must end on a separator
+	if pending || rows == 0 {
+		return 0
+	}
+
+	warnTableLimits(rndr, columns, body)
+	if rndr.mk.table != nil {
+		rndr.mk.table(out, header_work.Bytes(), body_work.Bytes(), nil, column_data[:shown], rndr.opaque)
+	}
+	freeBuffer(rndr, body_work)
+	freeBuffer(rndr, header_work)
+
+	return i
+}
+
+// the number of columns of a table that are rendered
+func tableColumnLimit(rndr *render, columns int) int {
+	if limit := rndr.limits.TableColumns; limit > 0 && columns > limit {
+		return limit
+	}
+	return columns
+}
+
+// whether a body row is rendered, given the number of rows before it
+func keepTableRow(rndr *render, rows int) bool {
+	limit := rndr.limits.TableRows
+	return limit <= 0 || rows < limit
+}
+
+// note the columns and rows of a table left out by the limits
+func warnTableLimits(rndr *render, columns, rows int) {
+	if limit := rndr.limits.TableColumns; limit > 0 && columns > limit {
+		warn(rndr, DIAG_LIMIT, "table has "+strconv.Itoa(columns)+" columns; only the first "+strconv.Itoa(limit)+" are kept")
+	}
+	if limit := rndr.limits.TableRows; limit > 0 && rows > limit {
+		warn(rndr, DIAG_LIMIT, "table has "+strconv.Itoa(rows)+" rows; only the first "+strconv.Itoa(limit)+" are kept")
 	}
 }
 
+// parse a grid table separator line such as +---+:--:+
+// bounds gives the expected '+' positions, or nil to find them
+// returns the '+' positions and the alignment of each column
+func gridTableSeparator(data []byte, bounds []int) ([]int, []int) {
+	end := len(data)
+	for end > 0 && (data[end-1] == ' ' || data[end-1] == '\t') {
+		end--
+	}
+	if end < 3 || data[0] != '+' || data[end-1] != '+' {
+		return nil, nil
+	}
+
+	found := []int{0}
+	align := []int{}
+	for i := 1; i < end; {
+		cell_start, fill := i, byte(0)
+		for i < end && data[i] != '+' {
+			if data[i] == '-' || data[i] == '=' {
+				if fill != 0 && fill != data[i] {
+					return nil, nil
+				}
+				fill = data[i]
+			} else if data[i] != ':' {
+				return nil, nil
+			}
+			i++
+		}
+		if fill == 0 {
+			return nil, nil
+		}
+
+		cdata := 0
+		if data[cell_start] == ':' {
+			cdata |= TABLE_ALIGNMENT_LEFT
+		}
+		if data[i-1] == ':' {
+			cdata |= TABLE_ALIGNMENT_RIGHT
+		}
+		align = append(align, cdata)
+		found = append(found, i)
+		i++
+	}
+
+	if bounds != nil {
+		if len(found) != len(bounds) {
+			return nil, nil
+		}
+		for i := range found {
+			if found[i] != bounds[i] {
+				return nil, nil
+			}
+		}
+	}
+	return found, align
+}
+
+// find the pipes of a grid table content line at the boundaries of its
+// separator, which are counted in characters rather than bytes so that
+// cells with multibyte text line up with the ASCII separator
+// returns the byte offset of each pipe, or nil if one is missing
+func gridTablePipes(line []byte, bounds []int) []int {
+	pipes := make([]int, 0, len(bounds))
+	column := 0
+	for i := 0; i < len(line) && len(pipes) < len(bounds); column++ {
+		if column == bounds[len(pipes)] {
+			if line[i] != '|' {
+				return nil
+			}
+			pipes = append(pipes, i)
+		}
+		_, size := utf8.DecodeRune(line[i:])
+		i += size
+	}
+	if len(pipes) < len(bounds) {
+		return nil
+	}
+	return pipes
+}
+
+// render one row of grid table cells
+func blockGridTableRow(out *bytes.Buffer, rndr *render, cells []*bytes.Buffer, col_data []int, header bool) {
+	row_work := newBuffer(rndr)
+	flags := 0
+	if header {
+		flags = TABLE_CELL_HEADER
+	}
+
+	for col, cell := range cells {
+		cell_work := newBuffer(rndr)
+		if cell != nil {
+			text := gridTableCellText(cell.Bytes())
+			if gridTableCellIsBlock(text) {
+				parseBlock(cell_work, rndr, text)
+			} else {
+				parseInline(cell_work, rndr, bytes.TrimRight(text, "\n"))
+			}
+		}
+
+		if rndr.mk.tableCell != nil {
+			rndr.mk.tableCell(row_work, cell_work.Bytes(), col_data[col]|flags, rndr.opaque)
+		}
+		freeBuffer(rndr, cell_work)
+	}
+
+	if rndr.mk.tableRow != nil {
+		rndr.mk.tableRow(out, row_work.Bytes(), rndr.opaque)
+	}
+	freeBuffer(rndr, row_work)
+}
+
+// strip the indentation shared by every line of a cell,
+// along with trailing whitespace and surrounding blank lines
+func gridTableCellText(data []byte) []byte {
+	indent := -1
+	for beg := 0; beg < len(data); {
+		end := beg
+		end = lineEnd(data, end)
+		if isEmpty(data[beg:]) == 0 {
+			n := 0
+			for beg+n < end && data[beg+n] == ' ' {
+				n++
+			}
+			if indent < 0 || n < indent {
+				indent = n
+			}
+		}
+		beg = end + 1
+	}
+
+	work := bytes.NewBuffer(nil)
+	for beg := 0; beg < len(data); {
+		end := beg
+		end = lineEnd(data, end)
+		line := data[beg:end]
+		if isEmpty(line) > 0 {
+			if work.Len() > 0 {
+				work.WriteByte('\n')
+			}
+		} else {
+			work.Write(bytes.TrimRight(line[indent:], " \t"))
+			work.WriteByte('\n')
+		}
+		beg = end + 1
+	}
+
+	text := work.Bytes()
+	for len(text) > 1 && text[len(text)-1] == '\n' && text[len(text)-2] == '\n' {
+		text = text[:len(text)-1]
+	}
+	return text
+}
+
+// decide whether a cell holds block content or a run of inline text
+func gridTableCellIsBlock(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	if bytes.Index(data, []byte("\n\n")) >= 0 {
+		return true
+	}
+	return data[0] == '#' || blockQuotePrefix(data) > 0 || blockCodePrefix(data) > 0 ||
+		blockUliPrefix(data) > 0 || blockOliPrefix(data) > 0 || isFencedCode(data, nil, nil) > 0
+}
+
+// returns line block prefix length
+func blockLineBlockPrefix(data []byte) int {
+	if len(data) > 1 && data[0] == '|' {
+		if data[1] == ' ' {
+			return 2
+		}
+		if data[1] == '\n' {
+			return 1
+		}
+	}
+	return 0
+}
+
+// parse a line block, where every line starting with '|' is kept
+// as a separate line along with its leading spaces:
+//
+//	| The Right Honourable
+//	|     Member for Finchley
+//
+// a line starting with a space continues the previous one
+func blockLineBlock(out *bytes.Buffer, rndr *render, data []byte) int {
+	work := bytes.NewBuffer(nil)
+	line := bytes.NewBuffer(nil)
+
+	beg := 0
+	for beg < len(data) {
+		pre := blockLineBlockPrefix(data[beg:])
+		if pre == 0 {
+			break
+		}
+
+		end := beg + pre
+		end = lineEnd(data, end)
+		line.Reset()
+		line.Write(data[beg+pre : end])
+		beg = end + 1
+
+		// join continuation lines
+		for beg < len(data) && data[beg] == ' ' && isEmpty(data[beg:]) == 0 {
+			end = lineEnd(data, beg)
+			line.WriteByte(' ')
+			line.Write(bytes.TrimLeft(data[beg:end], " "))
+			beg = end + 1
+		}
+
+		parseInline(work, rndr, line.Bytes())
+		work.WriteByte('\n')
+	}
+	if beg > len(data) {
+		beg = len(data)
+	}
+
+	if rndr.mk.lineBlock != nil {
+		rndr.mk.lineBlock(out, work.Bytes(), rndr.opaque)
+	}
+	return beg
+}
+
+// returns the length of the colons opening or closing a container, e.g., :::
+func blockContainerFence(data []byte) int {
+	i := 0
+	for i < len(data) && data[i] == ':' {
+		i++
+	}
+	if i < 3 {
+		return 0
+	}
+	return i
+}
+
+// the start of the line that closes the container whose blocks start at
+// data[beg:], skipping those of the containers nested in it, or the end
+// of data if there is none
+func blockContainerEnd(data []byte, beg int) int {
+	i, depth := beg, 1
+	for i < len(data) {
+		end := lineEnd(data, i)
+		if n := blockContainerFence(data[i:end]); n > 0 {
+			if isEmpty(data[i+n:]) > 0 {
+				depth--
+			} else {
+				depth++
+			}
+		}
+		if depth == 0 {
+			break
+		}
+		i = end + 1
+	}
+	return i
+}
+
+// parse a collapsible section, which is shown by its summary until opened:
+//
+//	:::details Spoiler for episode 3
+//	It was the butler.
+//	:::
+//
+// containers may be nested
+func blockDetails(out *bytes.Buffer, rndr *render, data []byte) int {
+	i := blockContainerFence(data)
+	if i == 0 {
+		return 0
+	}
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if !bytes.HasPrefix(data[i:], []byte("details")) {
+		return 0
+	}
+	i += len("details")
+
+	// the rest of the line is the summary
+	summary_start := i
+	i = lineEnd(data, i)
+	summary := bytes.TrimSpace(data[summary_start:i])
+	if summary_start < i && data[summary_start] != ' ' {
+		return 0
+	}
+	i++
+
+	beg := i
+	i = blockContainerEnd(data, beg)
+	if i >= len(data) {
+		return 0
+	}
+
+	work := newBuffer(rndr)
+	parseBlock(work, rndr, data[beg:i])
+	summary_work := newBuffer(rndr)
+	parseInline(summary_work, rndr, summary)
+
+	if rndr.mk.details != nil {
+		rndr.mk.details(out, summary_work.Bytes(), work.Bytes(), rndr.opaque)
+	}
+	freeBuffer(rndr, summary_work)
+	freeBuffer(rndr, work)
+
+	// skip the closing line
+	i = lineEnd(data, i)
+	if i < len(data) {
+		i++
+	}
+	return i
+}
+
 // returns blockquote prefix length
 func blockQuotePrefix(data []byte) int {
 	i := 0
@@ -679,35 +1618,95 @@ func blockQuotePrefix(data []byte) int {
 
 // parse a blockquote fragment
 func blockQuote(out *bytes.Buffer, rndr *render, data []byte) int {
-	block := bytes.NewBuffer(nil)
-	work := bytes.NewBuffer(nil)
+	block := newBuffer(rndr)
+	work := blockText{data: data}
 	beg, end := 0, 0
 	for beg < len(data) {
-		for end = beg + 1; end < len(data) && data[end-1] != '\n'; end++ {
-		}
+		end = nextLine(data, beg)
 
 		if pre := blockQuotePrefix(data[beg:]); pre > 0 {
 			beg += pre // skip prefix
 		} else {
 			// empty line followed by non-quote line
-			if isEmpty(data[beg:]) > 0 && (end >= len(data) || (blockQuotePrefix(data[end:]) == 0 && isEmpty(data[end:]) == 0)) {
+			if isBlankLine(data[beg:end]) && (end >= len(data) || (blockQuotePrefix(data[end:]) == 0 && isEmpty(data[end:]) == 0)) {
 				break
 			}
 		}
 
-		if beg < end { // copy into the in-place working buffer
-			work.Write(data[beg:end])
-		}
+		work.add(rndr, beg, end)
 		beg = end
 	}
 
-	parseBlock(block, rndr, work.Bytes())
+	parseBlock(block, rndr, work.bytes())
 	if rndr.mk.blockquote != nil {
-		rndr.mk.blockquote(out, block.Bytes(), rndr.mk.opaque)
+		rndr.mk.blockquote(out, block.Bytes(), rndr.opaque)
 	}
+	work.free(rndr)
+	freeBuffer(rndr, block)
 	return end
 }
 
+// The text of a quote or list item, with the prefixes of its lines taken
+// off, is a slice of the data for as long as it runs on unbroken there,
+// as it does for lines without a prefix, and is only copied into a
+// buffer from the first line that breaks it. Nested containers would
+// otherwise copy the same lines once for every level.
+type blockText struct {
+	data     []byte
+	from, to int           // the slice, until copied
+	work     *bytes.Buffer // the copy, once made
+}
+
+// add data[beg:end] to the text
+func (t *blockText) add(rndr *render, beg, end int) {
+	switch {
+	case beg >= end:
+	case t.work != nil:
+		t.work.Write(t.data[beg:end])
+	case t.from == t.to:
+		t.from, t.to = beg, end
+	case beg == t.to:
+		t.to = end
+	default:
+		t.copy(rndr)
+		t.work.Write(t.data[beg:end])
+	}
+}
+
+// add a line break that is not in the data
+func (t *blockText) addNewline(rndr *render) {
+	t.copy(rndr)
+	t.work.WriteByte('\n')
+}
+
+// switch from the slice to a copy
+func (t *blockText) copy(rndr *render) {
+	if t.work == nil {
+		t.work = newBuffer(rndr)
+		t.work.Write(t.data[t.from:t.to])
+	}
+}
+
+func (t *blockText) bytes() []byte {
+	if t.work != nil {
+		return t.work.Bytes()
+	}
+	return t.data[t.from:t.to]
+}
+
+func (t *blockText) len() int {
+	if t.work != nil {
+		return t.work.Len()
+	}
+	return t.to - t.from
+}
+
+func (t *blockText) free(rndr *render) {
+	if t.work != nil {
+		freeBuffer(rndr, t.work)
+	}
+}
+
 // returns prefix length for block code
 func blockCodePrefix(data []byte) int {
 	if len(data) > 0 && data[0] == '\t' {
@@ -720,12 +1719,11 @@ func blockCodePrefix(data []byte) int {
 }
 
 func blockCode(out *bytes.Buffer, rndr *render, data []byte) int {
-	work := bytes.NewBuffer(nil)
+	work := newBuffer(rndr)
 
 	beg, end := 0, 0
 	for beg < len(data) {
-		for end = beg + 1; end < len(data) && data[end-1] != '\n'; end++ {
-		}
+		end = nextLine(data, beg)
 
 		if pre := blockCodePrefix(data[beg:end]); pre > 0 {
 			beg += pre
@@ -753,15 +1751,13 @@ func blockCode(out *bytes.Buffer, rndr *render, data []byte) int {
 	for len(workbytes) > n && workbytes[len(workbytes)-n-1] == '\n' {
 		n++
 	}
-	if n > 0 {
-		work = bytes.NewBuffer(workbytes[:len(workbytes)-n])
-	}
-
+	work.Truncate(len(workbytes) - n)
 	work.WriteByte('\n')
 
 	if rndr.mk.blockcode != nil {
-		rndr.mk.blockcode(out, work.Bytes(), "", rndr.mk.opaque)
+		rndr.mk.blockcode(out, work.Bytes(), "", "", CodeFence{}, rndr.opaque)
 	}
+	freeBuffer(rndr, work)
 
 	return beg
 }
@@ -787,83 +1783,496 @@ func blockOliPrefix(data []byte) int {
 	if i >= len(data) || data[i] < '0' || data[i] > '9' {
 		return 0
 	}
+	org := i
 	for i < len(data) && data[i] >= '0' && data[i] <= '9' {
 		i++
 	}
-	if i+1 >= len(data) || data[i] != '.' || (data[i+1] != ' ' && data[i+1] != '\t') {
+
+	// as in CommonMark, a number of more than nine digits is no list
+	// item, which also keeps the start number from overflowing
+	if i-org > 9 {
+		return 0
+	}
+	if i+1 >= len(data) || (data[i] != '.' && data[i] != ')') || (data[i+1] != ' ' && data[i+1] != '\t') {
 		return 0
 	}
 	return i + 2
 }
 
+// returns the prefix of an ordered list item numbered with a letter
+// or a roman numeral, e.g., "b." or "iv)", along with the list type
+func blockFancyOliPrefix(data []byte) (int, int) {
+	i := 0
+	for i < len(data) && i < 3 && data[i] == ' ' {
+		i++
+	}
+	org := i
+	for i < len(data) && i-org < 8 && ((data[i] >= 'a' && data[i] <= 'z') || (data[i] >= 'A' && data[i] <= 'Z')) {
+		i++
+	}
+	if i == org || i+1 >= len(data) || (data[i] != '.' && data[i] != ')') || (data[i+1] != ' ' && data[i+1] != '\t') {
+		return 0, 0
+	}
+
+	// a single capital followed by a period looks like an initial,
+	// so it needs two spaces after it to be a list item
+	marker := data[org:i]
+	if data[i] == '.' && len(marker) == 1 && marker[0] >= 'A' && marker[0] <= 'Z' {
+		if i+2 >= len(data) || data[i+2] != ' ' {
+			return 0, 0
+		}
+	}
+
+	kind := 0
+	switch {
+	case romanValue(marker) > 0 && (len(marker) > 1 || tolower(marker[0]) == 'i'):
+		if marker[0] >= 'a' {
+			kind = LIST_TYPE_LOWER_ROMAN
+		} else {
+			kind = LIST_TYPE_UPPER_ROMAN
+		}
+	case len(marker) == 1 && marker[0] >= 'a':
+		kind = LIST_TYPE_LOWER_ALPHA
+	case len(marker) == 1:
+		kind = LIST_TYPE_UPPER_ALPHA
+	default:
+		return 0, 0
+	}
+	return i + 2, kind
+}
+
+// returns ordered list item prefix in any of the styles enabled for this document
+func blockAnyOliPrefix(rndr *render, data []byte) int {
+	if i := blockOliPrefix(data); i > 0 {
+		// Markdown.pl only knows 1. and not 1)
+		if rndr.markdownPl && data[i-2] == ')' {
+			return 0
+		}
+		return i
+	}
+	if rndr.flags&EXTENSION_FANCY_LISTS != 0 {
+		if i, _ := blockFancyOliPrefix(data); i > 0 {
+			return i
+		}
+	}
+	if rndr.flags&EXTENSION_EXAMPLE_LISTS != 0 {
+		i, _ := blockExamplePrefix(data)
+		return i
+	}
+	return 0
+}
+
+// whether a list item may interrupt a paragraph: as in CommonMark, the
+// item must not be empty and an ordered list must start at 1, so that
+// a line such as "1984. was a good year" stays in the paragraph
+func listInterrupts(rndr *render, data []byte) bool {
+	i := blockUliPrefix(data)
+	if i == 0 {
+		if i = blockAnyOliPrefix(rndr, data); i == 0 {
+			return false
+		}
+		if blockOliPrefix(data) > 0 {
+			if blockOliNumber(data, 0) != 1 {
+				return false
+			}
+		} else if _, kind := blockFancyOliPrefix(data); kind != 0 && blockOliNumber(data, kind) != 1 {
+			return false
+		}
+	}
+	return isEmpty(data[i:]) == 0
+}
+
+// returns the prefix of a Pandoc example list item, "(@)" or "(@label)",
+// along with the label
+func blockExamplePrefix(data []byte) (int, []byte) {
+	i := 0
+	for i < len(data) && i < 3 && data[i] == ' ' {
+		i++
+	}
+	if i+2 >= len(data) || data[i] != '(' || data[i+1] != '@' {
+		return 0, nil
+	}
+	i += 2
+	org := i
+	for i < len(data) && (isalnum(data[i]) || data[i] == '_' || data[i] == '-') {
+		i++
+	}
+	if i+1 >= len(data) || data[i] != ')' || (data[i+1] != ' ' && data[i+1] != '\t') {
+		return 0, nil
+	}
+	return i + 2, data[org:i]
+}
+
+// number the labelled example list items ahead of time,
+// so they can be referred to from anywhere in the document
+func findExampleLabels(data []byte) map[string]int {
+	labels := make(map[string]int)
+	n := 0
+	for beg := 0; beg < len(data); {
+		if i, label := blockExamplePrefix(data[beg:]); i > 0 {
+			n++
+			if _, ok := labels[string(label)]; len(label) > 0 && !ok {
+				labels[string(label)] = n
+			}
+		}
+		beg = lineEnd(data, beg)
+		beg++
+	}
+	return labels
+}
+
+// the numerals of the digits of a number up to 3999, by place
+var romanDigits = [4][10]string{
+	{"", "i", "ii", "iii", "iv", "v", "vi", "vii", "viii", "ix"},
+	{"", "x", "xx", "xxx", "xl", "l", "lx", "lxx", "lxxx", "xc"},
+	{"", "c", "cc", "ccc", "cd", "d", "dc", "dcc", "dccc", "cm"},
+	{"", "m", "mm", "mmm"},
+}
+
+// returns the value of a roman numeral, or 0 if it is not one
+// all of the letters must be in the same case, and the numeral must be
+// written the usual way, so that words such as "mix" or "did" are not
+func romanValue(data []byte) int {
+	n, prev := 0, 0
+	for i := len(data) - 1; i >= 0; i-- {
+		c := data[i]
+		if (c >= 'a') != (data[0] >= 'a') {
+			return 0
+		}
+
+		v := 0
+		switch tolower(c) {
+		case 'i':
+			v = 1
+		case 'v':
+			v = 5
+		case 'x':
+			v = 10
+		case 'l':
+			v = 50
+		case 'c':
+			v = 100
+		case 'd':
+			v = 500
+		case 'm':
+			v = 1000
+		default:
+			return 0
+		}
+
+		if v < prev {
+			n -= v
+		} else {
+			n += v
+			prev = v
+		}
+	}
+	if n <= 0 || n >= 4000 {
+		return 0
+	}
+
+	// only the one way of writing n is a numeral
+	i := len(data)
+	for place, rest := 0, n; rest > 0; place, rest = place+1, rest/10 {
+		digit := romanDigits[place][rest%10]
+		if i < len(digit) {
+			return 0
+		}
+		for j := 0; j < len(digit); j++ {
+			if tolower(data[i-len(digit)+j]) != digit[j] {
+				return 0
+			}
+		}
+		i -= len(digit)
+	}
+	if i != 0 {
+		return 0
+	}
+	return n
+}
+
 // parse ordered or unordered list block
 func blockList(out *bytes.Buffer, rndr *render, data []byte, flags int) int {
-	work := bytes.NewBuffer(nil)
+	work := newBuffer(rndr)
 
+	// ordered lists keep the number of the first item,
+	// while example lists carry on from the last example
+	start := 0
+	if flags&LIST_TYPE_EXAMPLE != 0 {
+		start = rndr.examples + 1
+	} else if flags&LIST_TYPE_ORDERED != 0 {
+		start = blockOliNumber(data, flags)
+		if rndr.markdownPl {
+			start = 1
+		}
+	}
+
+	// under CommonMark, one blank line makes every item hold paragraphs,
+	// so it is looked for before any item is rendered
+	marker := listMarker(data)
 	i, j := 0, 0
+	loose := rndr.commonMark && listIsLoose(rndr, data, flags)
+	if loose {
+		flags |= LIST_ITEM_CONTAINS_BLOCK
+	}
 	for i < len(data) {
+		// Markdown.pl puts an item in paragraphs for the blank lines
+		// around it alone, not for those of the items before it
+		if rndr.markdownPl {
+			flags &^= LIST_ITEM_CONTAINS_BLOCK
+			if i > 0 && blankLineBefore(data, i) {
+				flags |= LIST_ITEM_CONTAINS_BLOCK
+			}
+		}
 		j = blockListItem(work, rndr, data[i:], &flags)
 		i += j
+		loose = loose || flags&LIST_ITEM_CONTAINS_BLOCK != 0
 
 		if j == 0 || flags&LIST_ITEM_END_OF_LIST != 0 {
 			break
 		}
 	}
 
+	// once an item holds blocks, so do all of the items after it
+	if loose {
+		flags |= LIST_LOOSE
+	}
+	flags = flags&^listMarkerFlags | marker
+
 	if rndr.mk.list != nil {
-		rndr.mk.list(out, work.Bytes(), flags, rndr.mk.opaque)
+		rndr.mk.list(out, work.Bytes(), flags, start, rndr.opaque)
 	}
+	freeBuffer(rndr, work)
 	return i
 }
 
+// whether blank lines set apart the items of a list, or the blocks of
+// one of its items
+func listIsLoose(rndr *render, data []byte, flags int) bool {
+	flags &^= LIST_ITEM_CONTAINS_BLOCK | LIST_ITEM_END_OF_LIST
+	for i := 0; i < len(data); {
+		beg := listItemPrefix(rndr, data[i:], flags)
+		if beg == 0 {
+			break
+		}
+		item := data[i:]
+		orgpre := 0
+		for orgpre < 3 && orgpre < len(item) && item[orgpre] == ' ' {
+			orgpre++
+		}
+		work, first := blockText{data: item}, nextLine(item, beg-1)
+		work.add(rndr, beg, first)
+		end, _ := listItemLines(rndr, item, first, orgpre, listItemIndent(rndr, item, beg), &work, &flags)
+		work.free(rndr)
+		if flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+			return true
+		}
+		if end == 0 || flags&LIST_ITEM_END_OF_LIST != 0 {
+			break
+		}
+		i += end
+	}
+	return false
+}
+
+// whether the line before data[i:] is blank
+func blankLineBefore(data []byte, i int) bool {
+	if i < 2 || data[i-1] != '\n' {
+		return false
+	}
+	beg := i - 1
+	for beg > 0 && data[beg-1] != '\n' {
+		beg--
+	}
+	return isBlankLine(data[beg:i])
+}
+
+// returns the marker flags of a list item
+// assumes the prefix has been validated
+func listMarker(data []byte) int {
+	i := 0
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i < len(data) {
+		switch data[i] {
+		case '+':
+			return LIST_BULLET_PLUS
+		case '-':
+			return LIST_BULLET_DASH
+		case '*', '(':
+			return 0
+		}
+	}
+	for i < len(data) && isalnum(data[i]) {
+		i++
+	}
+	if i < len(data) && data[i] == ')' {
+		return LIST_DELIM_PAREN
+	}
+	return 0
+}
+
+// returns the number of an ordered list item
+// assumes the prefix has been validated by blockOliPrefix or blockFancyOliPrefix
+func blockOliNumber(data []byte, flags int) int {
+	i := 0
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// letters count from a, numerals have their roman value
+	if flags&(LIST_TYPE_LOWER_ROMAN|LIST_TYPE_UPPER_ROMAN) != 0 {
+		end := i
+		for end < len(data) && data[end] != '.' && data[end] != ')' {
+			end++
+		}
+		return romanValue(data[i:end])
+	}
+	if flags&(LIST_TYPE_LOWER_ALPHA|LIST_TYPE_UPPER_ALPHA) != 0 {
+		return int(tolower(data[i])-'a') + 1
+	}
+
+	// blockOliPrefix allows no more than nine digits
+	n := 0
+	for ; i < len(data) && isdigit(data[i]); i++ {
+		n = n*10 + int(data[i]-'0')
+	}
+	return n
+}
+
 // parse a single list item
 // assumes initial prefix is already removed
 func blockListItem(out *bytes.Buffer, rndr *render, data []byte, flags *int) int {
 	// keep track of the first indentation prefix
-	beg, end, pre, sublist, orgpre, i := 0, 0, 0, 0, 0, 0
+	beg, end, sublist, orgpre := 0, 0, 0, 0
 
 	for orgpre < 3 && orgpre < len(data) && data[orgpre] == ' ' {
 		orgpre++
 	}
 
-	beg = blockUliPrefix(data)
-	if beg == 0 {
-		beg = blockOliPrefix(data)
-	}
+	beg = listItemPrefix(rndr, data, *flags)
 	if beg == 0 {
 		return 0
 	}
+	if *flags&LIST_TYPE_EXAMPLE != 0 {
+		rndr.examples++
+	}
+	*flags = *flags&^listMarkerFlags | listMarker(data)
+	indent := listItemIndent(rndr, data, beg)
 
 	// skip leading whitespace on first line
 	for beg < len(data) && data[beg] == ' ' {
 		beg++
 	}
 
+	// a task box at the start goes to the renderer as flags
+	*flags &^= LIST_ITEM_TASK | LIST_ITEM_CHECKED
+	if rndr.flags&EXTENSION_TASK_LISTS != 0 {
+		if box := taskBox(data[beg:]); box > 0 {
+			*flags |= box
+			beg += 3
+			for beg < len(data) && (data[beg] == ' ' || data[beg] == '\t') {
+				beg++
+			}
+		}
+	}
+
 	// skip to the beginning of the following line
 	end = beg
-	for end < len(data) && data[end-1] != '\n' {
-		end++
+	if end < len(data) && data[end-1] != '\n' {
+		end = nextLine(data, end)
 	}
 
 	// get working buffers
-	work := bytes.NewBuffer(nil)
-	inter := bytes.NewBuffer(nil)
+	work := blockText{data: data}
+	inter := newBuffer(rndr)
 
 	// put the first line into the working buffer
-	work.Write(data[beg:end])
-	beg = end
+	work.add(rndr, beg, end)
+	beg, sublist = listItemLines(rndr, data, end, orgpre, indent, &work, flags)
 
-	// process the following lines
-	in_empty, has_inside_empty := false, false
-	for beg < len(data) {
-		end++
+	workbytes := work.bytes()
+	if *flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		// intermediate render of block li
+		if sublist > 0 && sublist < len(workbytes) {
+			parseBlock(inter, rndr, workbytes[:sublist])
+			parseBlock(inter, rndr, workbytes[sublist:])
+		} else {
+			parseBlock(inter, rndr, workbytes)
+		}
+	} else {
+		// intermediate render of inline li
+		if sublist > 0 && sublist < len(workbytes) {
+			parseInline(inter, rndr, workbytes[:sublist])
+			parseBlock(inter, rndr, workbytes[sublist:])
+		} else {
+			parseInline(inter, rndr, workbytes)
+		}
+	}
 
-		for end < len(data) && data[end-1] != '\n' {
-			end++
+	// render li itself
+	if rndr.mk.listitem != nil {
+		rndr.mk.listitem(out, inter.Bytes(), *flags, rndr.opaque)
+	}
+	freeBuffer(rndr, inter)
+	work.free(rndr)
+
+	return beg
+}
+
+// the start of the text of the list item at the start of data, or 0 if
+// there is none that belongs in a list with these flags
+func listItemPrefix(rndr *render, data []byte, flags int) int {
+	beg := blockUliPrefix(data)
+	if beg == 0 {
+		beg = blockAnyOliPrefix(rndr, data)
+	}
+	if beg == 0 {
+		return 0
+	}
+
+	// example items and other items do not share a list
+	if rndr.flags&EXTENSION_EXAMPLE_LISTS != 0 {
+		i, _ := blockExamplePrefix(data)
+		if (i > 0) != (flags&LIST_TYPE_EXAMPLE != 0) {
+			return 0
 		}
+	}
+	return beg
+}
+
+// the indentation the lines of a list item need after a blank line, where
+// beg follows its marker: four spaces, or under CommonMark that of the
+// text after the marker, or of one space after it when the text has five
+// or more before it or there is none
+func listItemIndent(rndr *render, data []byte, beg int) int {
+	if !rndr.commonMark {
+		return 4
+	}
+	end := beg
+	for end < len(data) && data[end] == ' ' {
+		end++
+	}
+	if end-beg >= 4 || end == len(data) || data[end] == '\n' {
+		return beg
+	}
+	return end
+}
+
+// add the lines of a list item after its first, from beg on, to work
+// without their indentation, flagging blank lines inside the item and
+// the end of the list; it returns the end of the item and where in work
+// a sublist starts, or 0. After a blank line, a line needs an indentation
+// of indent to stay in the item.
+func listItemLines(rndr *render, data []byte, beg, orgpre, indent int, work *blockText, flags *int) (int, int) {
+	end, pre, sublist, i := beg, 0, 0, 0
+	in_empty, has_inside_empty := false, false
+	for beg < len(data) {
+		end = nextLine(data, end)
 
 		// process an empty line
-		if isEmpty(data[beg:end]) > 0 {
+		if isBlankLine(data[beg:end]) {
 			in_empty = true
 			beg = end
 			continue
@@ -871,7 +2280,7 @@ func blockListItem(out *bytes.Buffer, rndr *render, data []byte, flags *int) int
 
 		// calculate the indentation
 		i = 0
-		for i < 4 && beg+i < end && data[beg+i] == ' ' {
+		for i < indent && beg+i < end && data[beg+i] == ' ' {
 			i++
 		}
 
@@ -883,27 +2292,32 @@ func blockListItem(out *bytes.Buffer, rndr *render, data []byte, flags *int) int
 
 		// check for a new item
 		chunk := data[beg+i : end]
-		if (blockUliPrefix(chunk) > 0 && !isHrule(chunk)) || blockOliPrefix(chunk) > 0 {
-			if in_empty {
+		if (blockUliPrefix(chunk) > 0 && !isHrule(chunk)) || blockAnyOliPrefix(rndr, chunk) > 0 {
+			// under CommonMark, a blank line inside a sublist leaves
+			// this item tight, and any item less indented than its
+			// text follows it
+			if in_empty && !(rndr.commonMark && sublist > 0 && pre >= indent) {
 				has_inside_empty = true
 			}
 
-			if pre == orgpre { // the following item must have the same indentation
+			if pre == orgpre || (rndr.commonMark && pre < indent) { // the following item must have the same indentation
 				break
 			}
 
 			if sublist == 0 {
-				sublist = work.Len()
+				sublist = work.len()
 			}
 		} else {
 			// only join indented stuff after empty lines
-			if in_empty && i < 4 && data[beg] != '\t' {
+			if in_empty && i < indent && data[beg] != '\t' {
 				*flags |= LIST_ITEM_END_OF_LIST
 				break
 			} else {
 				if in_empty {
-					work.WriteByte('\n')
-					has_inside_empty = true
+					work.addNewline(rndr)
+					if !(rndr.commonMark && sublist > 0 && data[beg+i] == ' ') {
+						has_inside_empty = true
+					}
 				}
 			}
 		}
@@ -911,68 +2325,87 @@ func blockListItem(out *bytes.Buffer, rndr *render, data []byte, flags *int) int
 		in_empty = false
 
 		// add the line into the working buffer without prefix
-		work.Write(data[beg+i : end])
+		work.add(rndr, beg+i, end)
 		beg = end
 	}
 
-	// render li contents
 	if has_inside_empty {
 		*flags |= LIST_ITEM_CONTAINS_BLOCK
 	}
+	return beg, sublist
+}
 
-	workbytes := work.Bytes()
-	if *flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
-		// intermediate render of block li
-		if sublist > 0 && sublist < len(workbytes) {
-			parseBlock(inter, rndr, workbytes[:sublist])
-			parseBlock(inter, rndr, workbytes[sublist:])
-		} else {
-			parseBlock(inter, rndr, workbytes)
-		}
-	} else {
-		// intermediate render of inline li
-		if sublist > 0 && sublist < len(workbytes) {
-			parseInline(inter, rndr, workbytes[:sublist])
-			parseBlock(inter, rndr, workbytes[sublist:])
-		} else {
-			parseInline(inter, rndr, workbytes)
-		}
+// the flags for a task box, "[ ]", "[x]" or "[X]" followed by a space,
+// at the start of an item's text, or 0 if there is none
+func taskBox(data []byte) int {
+	if len(data) < 4 || data[0] != '[' || data[2] != ']' || (data[3] != ' ' && data[3] != '\t') {
+		return 0
 	}
-
-	// render li itself
-	if rndr.mk.listitem != nil {
-		rndr.mk.listitem(out, inter.Bytes(), *flags, rndr.mk.opaque)
+	switch data[1] {
+	case ' ':
+		return LIST_ITEM_TASK
+	case 'x', 'X':
+		return LIST_ITEM_TASK | LIST_ITEM_CHECKED
 	}
-
-	return beg
+	return 0
 }
 
 func blockParagraph(out *bytes.Buffer, rndr *render, data []byte) int {
 	i, end, level := 0, 0, 0
 
 	for i < len(data) {
-		for end = i + 1; end < len(data) && data[end-1] != '\n'; end++ {
-		}
+		end = nextLine(data, i)
 
 		if isEmpty(data[i:]) > 0 {
 			break
 		}
-		if level = isUnderlinedHeader(data[i:]); level > 0 {
-			break
+		if rndr.flags&EXTENSION_NO_SETEXT_HEADERS == 0 {
+			if level = isUnderlinedHeader(data[i:]); level > 0 {
+				break
+			}
 		}
 
-		if rndr.flags&EXTENSION_LAX_HTML_BLOCKS != 0 {
+		if rndr.flags&EXTENSION_LAX_HTML_BLOCKS != 0 && !rndr.commonMark {
 			if data[i] == '<' && rndr.mk.blockhtml != nil && blockHtml(out, rndr, data[i:], false) > 0 {
 				end = i
 				break
 			}
 		}
 
+		// under CommonMark, HTML blocks but the seventh kind interrupt it
+		if i > 0 && rndr.commonMark && rndr.mk.blockhtml != nil {
+			if kind := htmlBlockKind(data[i:]); kind > 0 && kind < 7 {
+				end = i
+				break
+			}
+		}
+
 		if isPrefixHeader(rndr, data[i:]) || isHrule(data[i:]) {
 			end = i
 			break
 		}
 
+		// Markdown.pl finds quotes before paragraphs, so one may interrupt it
+		if i > 0 && rndr.markdownPl && blockQuotePrefix(data[i:]) > 0 {
+			end = i
+			break
+		}
+
+		// lists, quotes and fenced code may interrupt a paragraph
+		if i > 0 && rndr.flags&EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK != 0 {
+			if listInterrupts(rndr, data[i:]) || blockQuotePrefix(data[i:]) > 0 {
+				end = i
+				break
+			}
+			if rndr.flags&EXTENSION_FENCED_CODE != 0 {
+				var lang *string
+				if isFencedCode(data[i:], &lang, nil) > 0 {
+					end = i
+					break
+				}
+			}
+		}
+
 		i = end
 	}
 
@@ -983,11 +2416,12 @@ func blockParagraph(out *bytes.Buffer, rndr *render, data []byte) int {
 	}
 
 	if level == 0 {
-		tmp := bytes.NewBuffer(nil)
+		tmp := newBuffer(rndr)
 		parseInline(tmp, rndr, work[:size])
 		if rndr.mk.paragraph != nil {
-			rndr.mk.paragraph(out, tmp.Bytes(), rndr.mk.opaque)
+			rndr.mk.paragraph(out, tmp.Bytes(), rndr.opaque)
 		}
+		freeBuffer(rndr, tmp)
 	} else {
 		if size > 0 {
 			beg := 0
@@ -1004,11 +2438,12 @@ func blockParagraph(out *bytes.Buffer, rndr *render, data []byte) int {
 			}
 
 			if size > 0 {
-				tmp := bytes.NewBuffer(nil)
+				tmp := newBuffer(rndr)
 				parseInline(tmp, rndr, work[:size])
 				if rndr.mk.paragraph != nil {
-					rndr.mk.paragraph(out, tmp.Bytes(), rndr.mk.opaque)
+					rndr.mk.paragraph(out, tmp.Bytes(), rndr.opaque)
 				}
+				freeBuffer(rndr, tmp)
 
 				work = work[beg:]
 				size = i - beg
@@ -1017,12 +2452,15 @@ func blockParagraph(out *bytes.Buffer, rndr *render, data []byte) int {
 			}
 		}
 
-		header_work := bytes.NewBuffer(nil)
-		parseInline(header_work, rndr, work[:size])
+		text, attrs := headerAttributes(rndr, work[:size])
+		header_work := newBuffer(rndr)
+		parseInline(header_work, rndr, text)
 
 		if rndr.mk.header != nil {
-			rndr.mk.header(out, header_work.Bytes(), level, rndr.mk.opaque)
+			blockAttributes(rndr, attrs)
+			rndr.mk.header(out, header_work.Bytes(), level, rndr.opaque)
 		}
+		freeBuffer(rndr, header_work)
 	}
 
 	return end
@@ -0,0 +1,171 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checks of block parsing, and benchmarks of it on deeply nested input
+//
+//
+
+package blackfriday
+
+import (
+	"strings"
+	"testing"
+)
+
+// lines of text in quotes nested depth deep, each line with all of its
+// prefixes or, when lazy, only the first
+func nestedQuotes(depth, lines int, lazy bool) []byte {
+	prefix := strings.Repeat("> ", depth)
+	doc := prefix + "a quote\n"
+	for i := 1; i < lines; i++ {
+		if lazy {
+			doc += "a lazy line of text\n"
+		} else {
+			doc += prefix + "a line of text\n"
+		}
+	}
+	return []byte(doc)
+}
+
+// lines of text in the last item of lists nested depth deep
+func nestedLists(depth, lines int) []byte {
+	doc := ""
+	for level := 0; level < depth; level++ {
+		doc += strings.Repeat("  ", level) + "- item\n"
+	}
+	indent := strings.Repeat("  ", depth)
+	for i := 0; i < lines; i++ {
+		doc += indent + "a line of text\n"
+	}
+	return []byte(doc)
+}
+
+func benchmarkNested(b *testing.B, input []byte, depth int) {
+	b.StopTimer()
+	p := NewParser(WithMaxNesting(2*depth + 2))
+	b.SetBytes(int64(len(input)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		p.Markdown(input)
+	}
+}
+
+// each level does a fixed amount of work per line, so with a prefix on
+// every line the cost per byte stays about the same at any depth
+func BenchmarkNestedQuotes4(b *testing.B) {
+	benchmarkNested(b, nestedQuotes(4, 200, false), 4)
+}
+
+func BenchmarkNestedQuotes64(b *testing.B) {
+	benchmarkNested(b, nestedQuotes(64, 200, false), 64)
+}
+
+// lazy lines have no prefixes, yet every level sees them, so their cost
+// grows linearly with the depth
+func BenchmarkNestedLazyQuotes4(b *testing.B) {
+	benchmarkNested(b, nestedQuotes(4, 200, true), 4)
+}
+
+func BenchmarkNestedLazyQuotes64(b *testing.B) {
+	benchmarkNested(b, nestedQuotes(64, 200, true), 64)
+}
+
+func BenchmarkNestedLists4(b *testing.B) {
+	benchmarkNested(b, nestedLists(4, 200), 4)
+}
+
+func BenchmarkNestedLists64(b *testing.B) {
+	benchmarkNested(b, nestedLists(64, 200), 64)
+}
+
+// the text inside a markdown="1" block need not end in a newline, and
+// the block parsers must not run past its end
+func TestHtmlMarkdownWithoutNewline(t *testing.T) {
+	var extensions uint64 = EXTENSION_MARKDOWN_IN_HTML | EXTENSION_FENCED_CODE
+	for _, input := range []string{
+		"<div markdown=\"1\">\n~~~---foo@bar.com</div>",
+		"<div markdown=\"1\">\n```\ncode</div>",
+		"<div markdown=\"1\">\n# title</div>",
+	} {
+		output := string(Markdown([]byte(input), HtmlRenderer(0), extensions))
+		if !strings.HasSuffix(output, "</div>\n") {
+			t.Errorf("%q: got %q", input, output)
+		}
+	}
+}
+
+// grid table boundaries are counted in characters, so cells with
+// multibyte text line up with the separators
+func TestGridTableMultibyteCells(t *testing.T) {
+	input := "+------+-------+\n" +
+		"| Name | Place |\n" +
+		"+======+=======+\n" +
+		"| café | Zürich|\n" +
+		"+------+-------+\n" +
+		"| naïve| Köln  |\n" +
+		"+------+-------+\n"
+	output := string(Markdown([]byte(input), HtmlRenderer(0), EXTENSION_GRID_TABLES))
+	for _, cell := range []string{"<td>café</td>", "<td>Zürich</td>", "<td>naïve</td>", "<td>Köln</td>"} {
+		if !strings.Contains(output, cell) {
+			t.Errorf("missing %q in %q", cell, output)
+		}
+	}
+}
+
+// only a list starting at 1, and with something in its first item, may
+// interrupt a paragraph
+func TestListInterruptsParagraph(t *testing.T) {
+	var extensions uint64 = EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK | EXTENSION_FANCY_LISTS
+	for _, c := range []struct{ input, want string }{
+		{"The year\n1984. was good\n", "<p>The year\n1984. was good</p>\n"},
+		{"Text\n2. two\n", "<p>Text\n2. two</p>\n"},
+		{"Text\nb. bee\n", "<p>Text\nb. bee</p>\n"},
+		{"Text\n+ \nmore\n", "<p>Text\n+ \nmore</p>\n"},
+		{"Text\n1. \nmore\n", "<p>Text\n1. \nmore</p>\n"},
+		{"Text\n1. one\n", "<p>Text</p>\n\n<ol>\n<li>one</li>\n</ol>\n"},
+		{"Text\ni. one\n", "<p>Text</p>\n\n<ol type=\"i\">\n<li>one</li>\n</ol>\n"},
+		{"Text\n- item\n", "<p>Text</p>\n\n<ul>\n<li>item</li>\n</ul>\n"},
+	} {
+		if output := string(Markdown([]byte(c.input), HtmlRenderer(0), extensions)); output != c.want {
+			t.Errorf("%q: got %q, want %q", c.input, output, c.want)
+		}
+	}
+}
+
+func TestRomanValue(t *testing.T) {
+	for numeral, want := range map[string]int{
+		"i": 1, "iv": 4, "ix": 9, "xiv": 14, "xl": 40, "xcix": 99,
+		"cdxliv": 444, "mcmxc": 1990, "MMXXIV": 2024, "mmmcmxcix": 3999,
+		"mix": 1009, "did": 0, "mid": 0, "vim": 0, "civic": 0, "dim": 0,
+		"iiii": 0, "vv": 0, "ic": 0, "il": 0, "xm": 0, "iix": 0, "mmmm": 0, "Xi": 0,
+	} {
+		if n := romanValue([]byte(numeral)); n != want {
+			t.Errorf("%q: got %d, want %d", numeral, n, want)
+		}
+	}
+
+	// a word that is no numeral does not start a list
+	input := "vim. is an editor\n\ndid. it\n"
+	want := "<p>vim. is an editor</p>\n\n<p>did. it</p>\n"
+	if output := string(Markdown([]byte(input), HtmlRenderer(0), EXTENSION_FANCY_LISTS)); output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// as in CommonMark, a number of more than nine digits starts no list
+func TestLongListNumbers(t *testing.T) {
+	for _, c := range []struct{ input, want string }{
+		{"123456789. item\n", "<ol start=\"123456789\">\n<li>item</li>\n</ol>\n"},
+		{"1234567890. item\n", "<p>1234567890. item</p>\n"},
+		{"99999999999) item\n", "<p>99999999999) item</p>\n"},
+	} {
+		if output := string(Markdown([]byte(c.input), HtmlRenderer(0), 0)); output != c.want {
+			t.Errorf("%q: got %q, want %q", c.input, output, c.want)
+		}
+	}
+}
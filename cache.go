@@ -0,0 +1,118 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Caching rendered documents
+//
+//
+
+package blackfriday
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// A CacheStore holds rendered documents for a Cache, e.g., in memory or
+// in a service shared by several servers. Its methods may be called at
+// the same time, and it may forget documents whenever it likes.
+type CacheStore interface {
+	Get(key string) (output []byte, ok bool)
+	Set(key string, output []byte)
+}
+
+// A Cache renders markdown through a Processor, keeping the output in a
+// store so that input seen before is not parsed again. The key of each
+// document is made from a hash of the input, the parser settings, and
+// the name of the renderer's configuration.
+type Cache struct {
+	processor *Processor
+	store     CacheStore
+	prefix    string // the part of each key that comes from the settings
+}
+
+// Create a cache that renders with the given options, as for
+// MarkdownWith. The settings of a renderer, such as its flags and
+// callbacks, cannot be read back, so config names them; it must change
+// whenever they, or the filters, transformers, and block tags, do, and
+// must differ between caches that share a store and render differently.
+// Options that fill in results, such as WithSourceMap, only do so when
+// the document is not in the store.
+func NewCache(store CacheStore, config string, opts ...Option) *Cache {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	prefix := fmt.Sprintf("%q %x %d %t %t %d %t %t %v %t %t %d ", config, options.Extensions, options.TabSize,
+		options.PreserveTabs, options.WideColumns, options.MaxNesting, options.BlocksOnly, options.Strict, options.Limits,
+		options.CommonMark, options.MarkdownPl, options.Normalize)
+	return &Cache{
+		processor: NewProcessor(opts...),
+		store:     store,
+		prefix:    prefix,
+	}
+}
+
+// Render a block of markdown-encoded text, or find it in the store. The
+// output may be shared with other calls and must not be changed.
+func (c *Cache) Render(input []byte) []byte {
+	hash := sha1.New()
+	hash.Write(input)
+	key := c.prefix + hex.EncodeToString(hash.Sum())
+	if output, ok := c.store.Get(key); ok {
+		return output
+	}
+	output := c.processor.Render(input)
+	c.store.Set(key, output)
+	return output
+}
+
+// Create a store that keeps documents in memory, between size and twice
+// size of them. When it fills up, the documents not used since the last
+// time it did are forgotten.
+func NewMemoryStore(size int) CacheStore {
+	return &memoryStore{
+		size:   size,
+		recent: make(map[string][]byte),
+	}
+}
+
+type memoryStore struct {
+	size   int
+	lock   sync.Mutex
+	recent map[string][]byte // documents used since the store last filled up
+	old    map[string][]byte // documents used before that
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if output, ok := s.recent[key]; ok {
+		return output, true
+	}
+	output, ok := s.old[key]
+	if ok {
+		s.add(key, output)
+	}
+	return output, ok
+}
+
+func (s *memoryStore) Set(key string, output []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.add(key, output)
+}
+
+// add a document to the recent ones, starting afresh when they fill up
+func (s *memoryStore) add(key string, output []byte) {
+	if len(s.recent) >= s.size {
+		s.old, s.recent = s.recent, make(map[string][]byte)
+	}
+	s.recent[key] = output
+}
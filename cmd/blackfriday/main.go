@@ -0,0 +1,241 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Command-line converter for shell pipelines
+//
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/russross/blackfriday"
+	"io/ioutil"
+	"os"
+)
+
+// every extension, on by default if it is one of COMMON_EXTENSIONS
+var extensions = []struct {
+	name string
+	flag uint64
+}{
+	{"no-intra-emphasis", blackfriday.EXTENSION_NO_INTRA_EMPHASIS},
+	{"tables", blackfriday.EXTENSION_TABLES},
+	{"fenced-code", blackfriday.EXTENSION_FENCED_CODE},
+	{"autolink", blackfriday.EXTENSION_AUTOLINK},
+	{"strikethrough", blackfriday.EXTENSION_STRIKETHROUGH},
+	{"lax-html-blocks", blackfriday.EXTENSION_LAX_HTML_BLOCKS},
+	{"space-headers", blackfriday.EXTENSION_SPACE_HEADERS},
+	{"grid-tables", blackfriday.EXTENSION_GRID_TABLES},
+	{"line-blocks", blackfriday.EXTENSION_LINE_BLOCKS},
+	{"no-setext-headers", blackfriday.EXTENSION_NO_SETEXT_HEADERS},
+	{"no-empty-line-before-block", blackfriday.EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK},
+	{"hashtags", blackfriday.EXTENSION_HASHTAGS},
+	{"mentions", blackfriday.EXTENSION_MENTIONS},
+	{"ruby", blackfriday.EXTENSION_RUBY},
+	{"fancy-lists", blackfriday.EXTENSION_FANCY_LISTS},
+	{"details", blackfriday.EXTENSION_DETAILS},
+	{"kbd", blackfriday.EXTENSION_KBD},
+	{"media-embed", blackfriday.EXTENSION_MEDIA_EMBED},
+	{"github-refs", blackfriday.EXTENSION_GITHUB_REFS},
+	{"shortcodes", blackfriday.EXTENSION_SHORTCODES},
+	{"strip-comments", blackfriday.EXTENSION_STRIP_COMMENTS},
+	{"markdown-in-html", blackfriday.EXTENSION_MARKDOWN_IN_HTML},
+	{"join-cjk-lines", blackfriday.EXTENSION_JOIN_CJK_LINES},
+	{"example-lists", blackfriday.EXTENSION_EXAMPLE_LISTS},
+	{"task-lists", blackfriday.EXTENSION_TASK_LISTS},
+	{"metadata", blackfriday.EXTENSION_METADATA},
+	{"footnotes", blackfriday.EXTENSION_FOOTNOTES},
+	{"citations", blackfriday.EXTENSION_CITATIONS},
+	{"table-captions", blackfriday.EXTENSION_TABLE_CAPTIONS},
+	{"definition-lists", blackfriday.EXTENSION_DEFINITION_LISTS},
+	{"fenced-divs", blackfriday.EXTENSION_FENCED_DIVS},
+	{"attributes", blackfriday.EXTENSION_ATTRIBUTES},
+	{"implicit-header-refs", blackfriday.EXTENSION_IMPLICIT_HEADER_REFS},
+}
+
+// the flags for the extensions, in the same order
+var enabled = make([]*bool, len(extensions))
+
+func main() {
+	renderer := flag.String("renderer", "html", "output format: html, comment (safe for untrusted input), gfm (as GitHub renders it), markdownpl (as Markdown.pl renders it), or text")
+	page := flag.Bool("page", false, "write a complete HTML page instead of a fragment")
+	title := flag.String("title", "", "the title of the page under -page, the metadata title or the first header by default")
+	css := flag.String("css", "", "link a style sheet from the page under -page")
+	toc := flag.Bool("toc", false, "write only the table of contents")
+	xhtml := flag.Bool("xhtml", true, "write XHTML-style singleton tags")
+	smartypants := flag.Bool("smartypants", false, "use typographic quotes, dashes, and fractions")
+	output := flag.String("o", "", "write to this file instead of standard output")
+	lint := flag.Bool("lint", false, "check each input against the style rules instead of converting it")
+	normalize := flag.String("normalize", "", "clean up line breaks and a byte order mark first, and replace invalid UTF-8 (replace) or refuse it (error)")
+	lineLength := flag.Int("line-length", blackfriday.LINT_LINE_LENGTH, "the longest line allowed under -lint, 0 for any")
+	for i, ext := range extensions {
+		enabled[i] = flag.Bool(ext.name, ext.flag&blackfriday.COMMON_EXTENSIONS != 0, "the "+ext.name+" extension")
+	}
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "[options] [inputfile ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *lint {
+		lintFiles(*lineLength)
+		return
+	}
+
+	// read the input, from standard input if no files are named
+	var input []byte
+	var err os.Error
+	if flag.NArg() == 0 {
+		if input, err = ioutil.ReadAll(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading from Stdin:", err)
+			os.Exit(-1)
+		}
+	}
+	for _, name := range flag.Args() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading from", name, ":", err)
+			os.Exit(-1)
+		}
+		// keep each file's last line apart from the next file
+		if len(input) > 0 && input[len(input)-1] != '\n' {
+			input = append(input, '\n')
+		}
+		input = append(input, data...)
+	}
+	switch *normalize {
+	case "":
+	case "replace", "error":
+		invalid := blackfriday.NORMALIZE_REPLACE
+		if *normalize == "error" {
+			invalid = blackfriday.NORMALIZE_ERROR
+		}
+		if input, err = blackfriday.Normalize(input, invalid); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown normalization:", *normalize)
+		os.Exit(-1)
+	}
+
+	// set up options
+	exts := enabledExtensions()
+
+	var html_flags uint64
+	if *xhtml {
+		html_flags |= blackfriday.HTML_USE_XHTML
+	}
+	if *smartypants {
+		html_flags |= blackfriday.HTML_USE_SMARTYPANTS
+		html_flags |= blackfriday.HTML_SMARTYPANTS_FRACTIONS
+		html_flags |= blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+	}
+	if *page {
+		html_flags |= blackfriday.HTML_COMPLETE_PAGE
+	}
+
+	// render the data
+	var result []byte
+	switch {
+	case *toc:
+		result = blackfriday.Markdown(input, blackfriday.HtmlTocRenderer(html_flags), exts)
+	case *renderer == "html":
+		r := blackfriday.HtmlRenderer(html_flags)
+		if *page {
+			if *title == "" && exts&blackfriday.EXTENSION_METADATA != 0 {
+				*title = blackfriday.Metadata(input)["title"]
+			}
+			if *title == "" {
+				if headings := blackfriday.Extract(input, exts).Headings; len(headings) > 0 {
+					*title = headings[0].Text
+				}
+			}
+			r.SetPageTitle(*title)
+			if *css != "" {
+				r.AddPageCSS(*css)
+			}
+		}
+		result = blackfriday.Markdown(input, r, exts)
+	case *renderer == "comment":
+		result = blackfriday.Markdown(input, blackfriday.CommentRenderer(), exts&blackfriday.COMMENT_EXTENSIONS)
+	case *renderer == "gfm":
+		result = blackfriday.MarkdownGFM(input)
+	case *renderer == "markdownpl":
+		result = blackfriday.MarkdownPl(input)
+	case *renderer == "text":
+		result = blackfriday.ExtractText(input, exts)
+		if len(result) > 0 {
+			result = append(result, '\n')
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown renderer:", *renderer)
+		os.Exit(-1)
+	}
+
+	// output the result
+	if *output != "" {
+		if err = ioutil.WriteFile(*output, result, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing to", *output, ":", err)
+			os.Exit(-1)
+		}
+	} else {
+		if _, err = os.Stdout.Write(result); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing to Stdout:", err)
+			os.Exit(-1)
+		}
+	}
+}
+
+// the extensions picked by the flags
+func enabledExtensions() uint64 {
+	var exts uint64
+	for i, ext := range extensions {
+		if *enabled[i] {
+			exts |= ext.flag
+		}
+	}
+	return exts
+}
+
+// check each input file, or standard input, against the style rules,
+// printing the warnings and exiting with status 1 if there were any
+func lintFiles(lineLength int) {
+	rules := blackfriday.LintRules{Rules: blackfriday.LINT_ALL, LineLength: lineLength}
+	if lineLength <= 0 {
+		rules.Rules &^= blackfriday.LINT_LONG_LINE
+	}
+
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	failed := false
+	for _, name := range names {
+		var input []byte
+		var err os.Error
+		if name == "-" {
+			input, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			input, err = ioutil.ReadFile(name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading from", name, ":", err)
+			os.Exit(-1)
+		}
+		for _, w := range blackfriday.Lint(input, enabledExtensions(), rules) {
+			fmt.Printf("%s:%d:%d: %s\n", name, w.Pos.Line, w.Pos.Col, w.Message)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,163 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Runs the examples of the CommonMark spec under WithCommonMark
+//
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/russross/blackfriday"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// the fence around each example in spec.txt
+const fence = "```````````````````````````````` example"
+
+type example struct {
+	number   int
+	section  string
+	markdown string
+	html     string
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "print each example that fails")
+	section := flag.String("section", "", "run only the examples of this section")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "[options] spec.txt")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	spec, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading from", flag.Arg(0), ":", err)
+		os.Exit(-1)
+	}
+	examples := parseSpec(string(spec))
+	if len(examples) == 0 {
+		fmt.Fprintln(os.Stderr, "No examples found in", flag.Arg(0))
+		os.Exit(-1)
+	}
+
+	// the counts for each section, in the order they come
+	var sections []string
+	passed, total := make(map[string]int), make(map[string]int)
+	for _, ex := range examples {
+		if *section != "" && ex.section != *section {
+			continue
+		}
+		if total[ex.section] == 0 {
+			sections = append(sections, ex.section)
+		}
+		total[ex.section]++
+
+		got := string(blackfriday.MarkdownWith([]byte(ex.markdown), blackfriday.WithCommonMark()))
+		if normalize(got) == normalize(ex.html) {
+			passed[ex.section]++
+		} else if *verbose {
+			fmt.Printf("Example %d (%s)\n--- markdown\n%s--- expected\n%s--- got\n%s\n",
+				ex.number, ex.section, ex.markdown, ex.html, got)
+		}
+	}
+
+	allPassed, allTotal := 0, 0
+	for _, name := range sections {
+		fmt.Printf("%4d/%4d %5.1f%%  %s\n", passed[name], total[name], percent(passed[name], total[name]), name)
+		allPassed += passed[name]
+		allTotal += total[name]
+	}
+	fmt.Printf("%4d/%4d %5.1f%%  all\n", allPassed, allTotal, percent(allPassed, allTotal))
+	if allPassed < allTotal {
+		os.Exit(1)
+	}
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// the examples of the spec, each with the header it comes under; in them
+// → stands for a tab, and a line holding only . parts the markdown from
+// the HTML
+func parseSpec(spec string) []example {
+	var examples []example
+	var cur *example
+	section, inHtml := "", false
+	for len(spec) > 0 {
+		line := spec
+		if i := strings.Index(spec, "\n"); i >= 0 {
+			line, spec = spec[:i+1], spec[i+1:]
+		} else {
+			spec = ""
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+
+		switch {
+		case cur == nil && trimmed == fence:
+			examples = append(examples, example{number: len(examples) + 1, section: section})
+			cur, inHtml = &examples[len(examples)-1], false
+		case cur == nil && strings.HasPrefix(line, "#"):
+			section = strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+		case cur == nil:
+		case strings.HasPrefix(trimmed, fence[:32]) && strings.TrimLeft(trimmed, "`") == "":
+			cur = nil
+		case trimmed == "." && !inHtml:
+			inHtml = true
+		default:
+			line = strings.Replace(line, "→", "\t", -1)
+			if inHtml {
+				cur.html += line
+			} else {
+				cur.markdown += line
+			}
+		}
+	}
+	return examples
+}
+
+// make two renderings that differ only in ways that do not matter to a
+// browser compare equal: whitespace next to tags is dropped, and
+// singleton tags lose their slash
+func normalize(html string) string {
+	html = strings.Replace(html, " />", ">", -1)
+	html = strings.Replace(html, "/>", ">", -1)
+
+	out := make([]byte, 0, len(html))
+	for i := 0; i < len(html); i++ {
+		if isSpace(html[i]) {
+			j := i
+			for j < len(html) && isSpace(html[j]) {
+				j++
+			}
+			if (len(out) == 0 || out[len(out)-1] == '>') || j == len(html) || html[j] == '<' {
+				i = j - 1
+				continue
+			}
+		}
+		out = append(out, html[i])
+	}
+	return string(out)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
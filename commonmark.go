@@ -0,0 +1,577 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// CommonMark compliance mode
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+)
+
+// Follow CommonMark (https://spec.commonmark.org) where it differs from
+// the rules used otherwise. Emphasis with * and _ is worked out by the
+// delimiter algorithm of the spec, so runs of them match the way every
+// CommonMark renderer matches them, and code spans, links, autolinks and
+// raw HTML bind more tightly than emphasis. HTML blocks are the seven
+// kinds of the spec, each with its own way of starting and ending, rather
+// than known tags followed by a blank line. A backslash at the end of a
+// line is a hard line break, and a header needs a space after its #s, as
+// with EXTENSION_SPACE_HEADERS. Fenced code blocks are part of the spec,
+// so EXTENSION_FENCED_CODE is turned on. After a blank line, a line stays
+// in a list item if it is indented as far as the text of the item, and a
+// list is loose, with every item in paragraphs, when a blank line sets
+// apart any two of its items or two blocks of one item.
+//
+// Other constructs follow the usual rules, and extensions still work.
+// cmd/spectest runs the examples of the spec to show how close this is.
+func WithCommonMark() Option {
+	return func(options *Options) {
+		options.CommonMark = true
+		options.Extensions |= EXTENSION_SPACE_HEADERS | EXTENSION_FENCED_CODE
+	}
+}
+
+// Follow GitHub Flavored Markdown (https://github.github.com/gfm), which
+// is CommonMark with tables, strikethrough, autolinks, task lists and the
+// filtering of some raw HTML tags, rendered with GFMRenderer. Hard line
+// breaks are those of CommonMark, two spaces or a backslash at the end of
+// a line, and each cell of the line under a table header needs only one
+// dash, as tables under CommonMark do. The renderer is replaced, so any WithRenderer goes after this,
+// e.g., with one made with HTML_HARD_WRAP to break at every newline, as
+// GitHub does in comments.
+func WithGFM() Option {
+	return func(options *Options) {
+		WithCommonMark()(options)
+		options.Extensions |= GFM_EXTENSIONS
+		options.Renderer = GFMRenderer()
+	}
+}
+
+// the tags that start an HTML block of the sixth kind
+var commonMarkBlockTags = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"base":       true,
+	"basefont":   true,
+	"blockquote": true,
+	"body":       true,
+	"caption":    true,
+	"center":     true,
+	"col":        true,
+	"colgroup":   true,
+	"dd":         true,
+	"details":    true,
+	"dialog":     true,
+	"dir":        true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"frame":      true,
+	"frameset":   true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"head":       true,
+	"header":     true,
+	"hr":         true,
+	"html":       true,
+	"iframe":     true,
+	"legend":     true,
+	"li":         true,
+	"link":       true,
+	"main":       true,
+	"menu":       true,
+	"menuitem":   true,
+	"nav":        true,
+	"noframes":   true,
+	"ol":         true,
+	"optgroup":   true,
+	"option":     true,
+	"p":          true,
+	"param":      true,
+	"search":     true,
+	"section":    true,
+	"summary":    true,
+	"table":      true,
+	"tbody":      true,
+	"td":         true,
+	"tfoot":      true,
+	"th":         true,
+	"thead":      true,
+	"title":      true,
+	"tr":         true,
+	"track":      true,
+	"ul":         true,
+}
+
+// the tags whose contents, blank lines and all, make an HTML block of
+// the first kind
+var commonMarkRawTags = []string{"pre", "script", "style", "textarea"}
+
+// the kind of HTML block, 1 to 7, that starts the first line of data
+// after up to three spaces, or 0 if there is none
+func htmlBlockKind(data []byte) int {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	line := data[i:lineEnd(data, i)]
+	if len(line) < 2 || line[0] != '<' {
+		return 0
+	}
+
+	for _, tag := range commonMarkRawTags {
+		if n := hasPrefixFold(line[1:], tag); n > 0 {
+			if 1+n == len(line) || line[1+n] == ' ' || line[1+n] == '\t' || line[1+n] == '>' {
+				return 1
+			}
+		}
+	}
+	switch {
+	case bytes.HasPrefix(line, []byte("<!--")):
+		return 2
+	case line[1] == '?':
+		return 3
+	case bytes.HasPrefix(line, []byte("<![CDATA[")):
+		return 5
+	case line[1] == '!' && len(line) > 2 && isletter(line[2]):
+		return 4
+	}
+
+	// a block-level tag, opening or closing
+	beg := 1
+	if line[1] == '/' {
+		beg = 2
+	}
+	end := beg
+	for end < len(line) && isalnum(line[end]) {
+		end++
+	}
+	if end > beg && commonMarkBlockTags[string(bytes.ToLower(line[beg:end]))] {
+		if end == len(line) || line[end] == ' ' || line[end] == '\t' || line[end] == '>' ||
+			(line[end] == '/' && end+1 < len(line) && line[end+1] == '>') {
+			return 6
+		}
+	}
+
+	// any other whole tag alone on its line
+	if n := htmlTagEnd(line); n > 0 && isEmpty(line[n:]) > 0 {
+		return 7
+	}
+	return 0
+}
+
+// an HTML block as CommonMark has it, kept as it is
+func blockHtmlCommonMark(out *bytes.Buffer, rndr *render, data []byte) int {
+	kind := htmlBlockKind(data)
+	if kind == 0 {
+		return 0
+	}
+
+	// the end is on the line that holds the closing string, or just
+	// before the first blank line
+	end := len(data)
+	switch kind {
+	case 1:
+		for beg := 0; beg < len(data); beg = nextLine(data, beg) {
+			if line := data[beg:lineEnd(data, beg)]; hasRawTagEnd(line) {
+				end = nextLine(data, beg)
+				break
+			}
+		}
+	case 2, 3, 4, 5:
+		closer := "-->"
+		switch kind {
+		case 3:
+			closer = "?>"
+		case 4:
+			closer = ">"
+		case 5:
+			closer = "]]>"
+		}
+		if i := bytes.Index(data, []byte(closer)); i >= 0 {
+			end = nextLine(data, i)
+		}
+	default:
+		for beg := nextLine(data, 0); beg < len(data); beg = nextLine(data, beg) {
+			if isBlankLine(data[beg:lineEnd(data, beg)]) {
+				end = beg
+				break
+			}
+		}
+	}
+
+	blockHtmlOutput(out, rndr, data[:end])
+	return end
+}
+
+// whether a line holds a closing tag that ends an HTML block of the
+// first kind
+func hasRawTagEnd(line []byte) bool {
+	for i := bytes.Index(line, []byte("</")); i >= 0; {
+		for _, tag := range commonMarkRawTags {
+			if n := hasPrefixFold(line[i+2:], tag); n > 0 && i+2+n < len(line) && line[i+2+n] == '>' {
+				return true
+			}
+		}
+		j := bytes.Index(line[i+2:], []byte("</"))
+		if j < 0 {
+			break
+		}
+		i += 2 + j
+	}
+	return false
+}
+
+// the length of prefix at the start of data, ignoring ASCII case, or 0
+// if it is not there
+func hasPrefixFold(data []byte, prefix string) int {
+	if len(data) < len(prefix) {
+		return 0
+	}
+	for i := 0; i < len(prefix); i++ {
+		c := data[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != prefix[i] {
+			return 0
+		}
+	}
+	return len(prefix)
+}
+
+// the length of the whole opening or closing tag at the start of data,
+// as CommonMark defines them, or 0 if there is none
+func htmlTagEnd(data []byte) int {
+	if len(data) < 3 || data[0] != '<' {
+		return 0
+	}
+	i := 1
+	closing := data[1] == '/'
+	if closing {
+		i++
+	}
+
+	// the tag name
+	if i >= len(data) || !isletter(data[i]) {
+		return 0
+	}
+	for i < len(data) && (isalnum(data[i]) || data[i] == '-') {
+		i++
+	}
+
+	if !closing {
+		// attributes, each after whitespace, with optional values
+		for {
+			j := skipTagSpace(data, i)
+			if j == i || j >= len(data) || !(isletter(data[j]) || data[j] == '_' || data[j] == ':') {
+				i = j
+				break
+			}
+			i = j
+			for i < len(data) && (isalnum(data[i]) || data[i] == '_' || data[i] == '.' || data[i] == ':' || data[i] == '-') {
+				i++
+			}
+
+			j = skipTagSpace(data, i)
+			if j >= len(data) || data[j] != '=' {
+				continue
+			}
+			j = skipTagSpace(data, j+1)
+			if j >= len(data) {
+				return 0
+			}
+			switch data[j] {
+			case '"', '\'':
+				k := bytes.IndexByte(data[j+1:], data[j])
+				if k < 0 {
+					return 0
+				}
+				i = j + 1 + k + 1
+			default:
+				k := j
+				for k < len(data) && !isspace(data[k]) && bytes.IndexByte([]byte("\"'=<>`"), data[k]) < 0 {
+					k++
+				}
+				if k == j {
+					return 0
+				}
+				i = k
+			}
+		}
+		if i < len(data) && data[i] == '/' {
+			i++
+		}
+	} else {
+		i = skipTagSpace(data, i)
+	}
+
+	if i < len(data) && data[i] == '>' {
+		return i + 1
+	}
+	return 0
+}
+
+// skip whitespace in a tag, which may include one line break
+func skipTagSpace(data []byte, i int) int {
+	for i < len(data) && isspace(data[i]) {
+		i++
+	}
+	return i
+}
+
+func isletter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// A delimiter is a run of * or _ in text being parsed for spans. Its
+// characters are written out as they are when it is found, and once the
+// whole text is parsed, runs that match become emphasis.
+type delimiter struct {
+	c           byte
+	n, length   int  // the characters not yet matched, and all of them
+	open, close bool // whether it can open or close emphasis
+	beg, end    int  // where its characters are in the output
+
+	// the delimiters before and after it that are still to be matched
+	prev, next int
+
+	// the first of the emphasis it closes, in the order they were
+	// matched, with the last for adding more, and the last it opens
+	closes, lastClose, opens int
+}
+
+// emphasis found between two delimiters, by index
+type emphMatch struct {
+	opener, closer, n   int
+	nextClose, nextOpen int // the one before it with the same closer, or opener
+}
+
+// '*' and '_' under CommonMark: note a run of them, whose part in
+// emphasis is worked out when the whole text has been parsed
+func inlineDelimiter(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	c := data[offset]
+	end := offset
+	for end < len(data) && data[end] == c {
+		end++
+	}
+
+	// whether the run is left-flanking and right-flanking
+	spaceBefore, punctBefore, _ := runeClass(data[:offset], true)
+	spaceAfter, punctAfter, _ := runeClass(data[end:], false)
+	left := !spaceAfter && (!punctAfter || spaceBefore || punctBefore)
+	right := !spaceBefore && (!punctBefore || spaceAfter || punctAfter)
+
+	d := delimiter{c: c, n: end - offset, length: end - offset, closes: -1, lastClose: -1, opens: -1}
+	d.open, d.close = left, right
+	if c == '_' {
+		d.open = left && (!right || punctBefore)
+		d.close = right && (!left || punctAfter)
+	}
+
+	d.beg = out.Len()
+	if rndr.mk.normalText != nil {
+		rndr.mk.normalText(out, data[offset:end], rndr.opaque)
+	} else {
+		out.Write(data[offset:end])
+	}
+	d.end = out.Len()
+	rndr.delims = append(rndr.delims, d)
+	return end - offset
+}
+
+// drop the delimiters of the text being parsed that are in the output
+// from length on, after a span parser has taken that output back
+func forgetDelimiters(rndr *render, length int) {
+	n := len(rndr.delims)
+	for n > rndr.delimBase && rndr.delims[n-1].end > length {
+		n--
+	}
+	rndr.delims = rndr.delims[:n]
+}
+
+// match the delimiters of the text being parsed, by the procedure for
+// processing emphasis of the spec, and rewrite the output from the
+// first of them with the emphasis they make
+func inlineEmphasisCommonMark(out *bytes.Buffer, rndr *render) {
+	ds := rndr.delims[rndr.delimBase:]
+	if len(ds) == 0 {
+		return
+	}
+	base := len(rndr.emphMatches)
+	for i := range ds {
+		ds[i].prev, ds[i].next = i-1, i+1
+	}
+	ds[len(ds)-1].next = -1
+
+	// where the search for an opener stops, by character, by the length
+	// of the closing run modulo 3, and by whether it can open
+	var bottom [12]int
+	for k := range bottom {
+		bottom[k] = -1
+	}
+
+	unlink := func(i int) {
+		if ds[i].prev >= 0 {
+			ds[ds[i].prev].next = ds[i].next
+		}
+		if ds[i].next >= 0 {
+			ds[ds[i].next].prev = ds[i].prev
+		}
+	}
+
+	for cur := 0; cur >= 0; {
+		closer := &ds[cur]
+		if !closer.close {
+			cur = closer.next
+			continue
+		}
+		key := closer.length % 3 * 2
+		if closer.c == '_' {
+			key += 6
+		}
+		if closer.open {
+			key++
+		}
+
+		found := -1
+		for o := closer.prev; o > bottom[key]; o = ds[o].prev {
+			opener := &ds[o]
+			if !opener.open || opener.c != closer.c {
+				continue
+			}
+			// the rule of three, for runs that can both open and close
+			if (opener.close || closer.open) && (opener.length+closer.length)%3 == 0 &&
+				!(opener.length%3 == 0 && closer.length%3 == 0) {
+				continue
+			}
+			found = o
+			break
+		}
+		if found < 0 {
+			bottom[key] = closer.prev
+			next := closer.next
+			if !closer.open {
+				unlink(cur)
+			}
+			cur = next
+			continue
+		}
+
+		opener := &ds[found]
+		n := 1
+		if opener.n >= 2 && closer.n >= 2 {
+			n = 2
+		}
+		opener.n -= n
+		closer.n -= n
+
+		m := len(rndr.emphMatches) - base
+		rndr.emphMatches = append(rndr.emphMatches, emphMatch{found, cur, n, -1, opener.opens})
+		opener.opens = m
+		if closer.closes < 0 {
+			closer.closes = m
+		} else {
+			rndr.emphMatches[base+closer.lastClose].nextClose = m
+		}
+		closer.lastClose = m
+
+		// the delimiters in between can no longer match
+		opener.next, closer.prev = cur, found
+		if opener.n == 0 {
+			unlink(found)
+		}
+		if closer.n == 0 {
+			next := closer.next
+			unlink(cur)
+			cur = next
+		}
+	}
+
+	if len(rndr.emphMatches) > base {
+		renderEmphasisCommonMark(out, rndr, ds, rndr.emphMatches[base:])
+	}
+	rndr.emphMatches = rndr.emphMatches[:base]
+}
+
+// rewrite the output from the first delimiter on, putting the text
+// between matched delimiters through the emphasis callbacks
+func renderEmphasisCommonMark(out *bytes.Buffer, rndr *render, ds []delimiter, matches []emphMatch) {
+	start := ds[0].beg
+	src := newBuffer(rndr)
+	src.Write(out.Bytes()[start:])
+	out.Truncate(start)
+	text := src.Bytes()
+
+	// the text of each emphasis still open, innermost last
+	stack := []*bytes.Buffer{out}
+	pos := start
+	for i := range ds {
+		d := &ds[i]
+		top := stack[len(stack)-1]
+		top.Write(text[pos-start : d.beg-start])
+
+		for m := d.closes; m >= 0; m = matches[m].nextClose {
+			content := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			top = stack[len(stack)-1]
+			emphasisCommonMark(top, rndr, content.Bytes(), d.c, matches[m].n)
+			freeBuffer(rndr, content)
+		}
+
+		if d.n == d.length {
+			top.Write(text[d.beg-start : d.end-start])
+		} else if d.n > 0 {
+			writeDelimiters(top, rndr, d.c, d.n)
+		}
+
+		for m := d.opens; m >= 0; m = matches[m].nextOpen {
+			stack = append(stack, newBuffer(rndr))
+		}
+		pos = d.end
+	}
+	stack[len(stack)-1].Write(text[pos-start:])
+	freeBuffer(rndr, src)
+}
+
+// render emphasis of n characters c, or put the characters back around
+// the text if there is no callback for it or it turns it down
+func emphasisCommonMark(out *bytes.Buffer, rndr *render, text []byte, c byte, n int) {
+	callback := rndr.mk.emphasis
+	if n == 2 {
+		callback = rndr.mk.doubleEmphasis
+	}
+	if callback != nil && callback(out, text, rndr.opaque) > 0 {
+		return
+	}
+	writeDelimiters(out, rndr, c, n)
+	out.Write(text)
+	writeDelimiters(out, rndr, c, n)
+}
+
+func writeDelimiters(out *bytes.Buffer, rndr *render, c byte, n int) {
+	chars := bytes.Repeat([]byte{c}, n)
+	if rndr.mk.normalText != nil {
+		rndr.mk.normalText(out, chars, rndr.opaque)
+	} else {
+		out.Write(chars)
+	}
+}
@@ -0,0 +1,227 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Structural differences between two versions of a document
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// These are the kinds of change found by Diff.
+const (
+	CHANGE_ADDED = iota
+	CHANGE_REMOVED
+	CHANGE_MODIFIED
+)
+
+// A Change is a node that differs between two versions of a document.
+type Change struct {
+	Kind int   // one of the CHANGE_* kinds
+	Old  *Node // the node in the old version, nil if it was added
+	New  *Node // the node in the new version, nil if it was removed
+
+	// the text of the header a top-level block comes under, in the new
+	// version unless it was removed; empty before the first header
+	Section string
+
+	// for a modified node, the changes to its children
+	Changes []Change
+}
+
+// Parse two versions of a document and find the blocks that were added,
+// removed, or modified, in the order of the new version, for reviewing
+// changes to a document. Blocks that are the same, apart from where they
+// are, are left out. A modified block holds the changes to its children,
+// down to the spans; a text span that changed at all is modified as a
+// whole.
+func Diff(old, new []byte, extensions uint64) []Change {
+	before, after := Parse(old, extensions), Parse(new, extensions)
+	changes := diffNodes(before.Children, after.Children)
+
+	// note the section of each top-level change
+	oldSections, newSections := sectionNames(before), sectionNames(after)
+	for i := range changes {
+		if c := &changes[i]; c.New != nil {
+			c.Section = newSections[c.New]
+		} else {
+			c.Section = oldSections[c.Old]
+		}
+	}
+	return changes
+}
+
+// the changes between two lists of sibling nodes
+func diffNodes(old, new []*Node) []Change {
+	oldKeys, newKeys := make([]string, len(old)), make([]string, len(new))
+	for i, n := range old {
+		oldKeys[i] = nodeKey(n)
+	}
+	for j, n := range new {
+		newKeys[j] = nodeKey(n)
+	}
+
+	// longest common subsequence: common[i][j] is the length of the
+	// longest one between old[i:] and new[j:]
+	common := make([][]int, len(old)+1)
+	for i := range common {
+		common[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if oldKeys[i] == newKeys[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	// the nodes between two that are the same were removed or added
+	var changes []Change
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		oi, nj := i, j
+		for i < len(old) && j < len(new) && oldKeys[i] != newKeys[j] {
+			if common[i+1][j] >= common[i][j+1] {
+				i++
+			} else {
+				j++
+			}
+		}
+		if i == len(old) || j == len(new) {
+			i, j = len(old), len(new)
+		}
+		changes = diffRun(changes, old[oi:i], new[nj:j])
+		if i < len(old) && j < len(new) {
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+// the changes between nodes that were removed and added in the same
+// place, pairing nodes of the same type as modified; blocks must also
+// have much of their text in common
+func diffRun(changes []Change, removed, added []*Node) []Change {
+	paired := make([]int, len(added)) // index in removed plus one, or 0
+	used := make([]bool, len(removed))
+	for j, n := range added {
+		for i, m := range removed {
+			if !used[i] && m.Type == n.Type && (n.Type >= NODE_TEXT || similarText(m, n)) {
+				paired[j], used[i] = i+1, true
+				break
+			}
+		}
+	}
+
+	// removed nodes go before the added or modified node that follows them
+	next := 0
+	for j, n := range added {
+		if paired[j] == 0 {
+			changes = append(changes, Change{Kind: CHANGE_ADDED, New: n})
+			continue
+		}
+		i := paired[j] - 1
+		for ; next < i; next++ {
+			if !used[next] {
+				changes = append(changes, Change{Kind: CHANGE_REMOVED, Old: removed[next]})
+			}
+		}
+		if next == i {
+			next++
+		}
+		m := removed[i]
+		changes = append(changes, Change{Kind: CHANGE_MODIFIED, Old: m, New: n, Changes: diffNodes(m.Children, n.Children)})
+	}
+	for ; next < len(removed); next++ {
+		if !used[next] {
+			changes = append(changes, Change{Kind: CHANGE_REMOVED, Old: removed[next]})
+		}
+	}
+	return changes
+}
+
+// check whether at least half the words of the longer of two nodes'
+// texts are in the other
+func similarText(a, b *Node) bool {
+	aWords, bWords := bytes.Fields(nodeText(a)), bytes.Fields(nodeText(b))
+	count := make(map[string]int)
+	for _, word := range aWords {
+		count[string(word)]++
+	}
+	shared := 0
+	for _, word := range bWords {
+		if count[string(word)] > 0 {
+			count[string(word)]--
+			shared++
+		}
+	}
+	longer := len(aWords)
+	if len(bWords) > longer {
+		longer = len(bWords)
+	}
+	return 2*shared >= longer
+}
+
+// a string that is the same for nodes that are the same apart from
+// where they are
+func nodeKey(n *Node) string {
+	key := bytes.NewBuffer(nil)
+	writeNodeKey(key, n)
+	return key.String()
+}
+
+func writeNodeKey(out *bytes.Buffer, n *Node) {
+	out.WriteString(strconv.Itoa(n.Type))
+	for _, number := range []int{n.Level, n.Flags, n.Start} {
+		out.WriteByte(' ')
+		out.WriteString(strconv.Itoa(number))
+	}
+	for _, text := range [][]byte{[]byte(n.Lang), []byte(n.Info), n.Link, n.Title, n.Literal} {
+		out.WriteByte(' ')
+		out.WriteString(strconv.Itoa(len(text)))
+		out.WriteByte(':')
+		out.Write(text)
+	}
+	if a := n.Attrs; a != nil {
+		out.WriteString(" {" + strconv.Quote(a.Id))
+		for _, class := range a.Classes {
+			out.WriteString(" ." + strconv.Quote(class))
+		}
+		for _, pair := range a.Pairs {
+			out.WriteString(" " + strconv.Quote(pair[0]) + "=" + strconv.Quote(pair[1]))
+		}
+		out.WriteByte('}')
+	}
+	out.WriteByte('(')
+	for _, child := range n.Children {
+		writeNodeKey(out, child)
+	}
+	out.WriteByte(')')
+}
+
+// the text of the header each top-level block of a document comes under
+func sectionNames(doc *Node) map[*Node]string {
+	names := make(map[*Node]string)
+	section := ""
+	for _, n := range doc.Children {
+		if n.Type == NODE_HEADER {
+			section = string(nodeText(n))
+		}
+		names[n] = section
+	}
+	return names
+}
@@ -40,15 +40,9 @@ func main() {
 	}
 
 	// set up options
-	var extensions uint32
-	extensions |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
-	extensions |= blackfriday.EXTENSION_TABLES
-	extensions |= blackfriday.EXTENSION_FENCED_CODE
-	extensions |= blackfriday.EXTENSION_AUTOLINK
-	extensions |= blackfriday.EXTENSION_STRIKETHROUGH
-	extensions |= blackfriday.EXTENSION_SPACE_HEADERS
+	var extensions uint64 = blackfriday.COMMON_EXTENSIONS
 
-	html_flags := 0
+	var html_flags uint64
 	html_flags |= blackfriday.HTML_USE_XHTML
 	// note: uncomment the following line to enable smartypants
 	// it is commented out by default so that markdown
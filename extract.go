@@ -0,0 +1,381 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Information gathered from a document without rendering it
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"strconv"
+	"unicode"
+	"utf8"
+)
+
+// The structure and references of a document, as found by Extract.
+type DocumentInfo struct {
+	Headings       []*Heading // the outline, with subheadings nested
+	FirstParagraph []byte     // plain text of the first top-level paragraph
+	Links          []LinkInfo // links and autolinks, in order
+	Images         []LinkInfo // images and media embeds, in order
+	CodeLanguages  []string   // languages of code blocks, each listed once
+}
+
+// A Heading is one entry in the outline of a document.
+type Heading struct {
+	Text     string // plain text
+	Level    int
+	Id       string // the id HtmlRenderer gives it under HTML_TOC
+	Children []*Heading
+}
+
+// A LinkInfo describes a link or an image.
+type LinkInfo struct {
+	Dest    []byte
+	Title   []byte
+	Text    []byte   // plain text of a link, alt text of an image
+	Image   bool     // an image or media embed rather than a link
+	Context []byte   // plain text of the block it is in
+	Pos     Position // of the top-level block it is in
+}
+
+// Parse a document and gather its outline, first paragraph, links, images,
+// and code languages, for site generators and other tools that need the
+// structure rather than the output.
+func Extract(input []byte, extensions uint64) DocumentInfo {
+	var info DocumentInfo
+	doc := Parse(input, extensions)
+
+	var open []*Heading // the last heading at each level above the current one
+	count := 0
+	languages := make(map[string]bool)
+	Walk(doc, func(n *Node, entering bool) WalkStatus {
+		if !entering {
+			return WALK_CONTINUE
+		}
+		switch n.Type {
+		case NODE_HEADER:
+			h := &Heading{Text: string(nodeText(n)), Level: n.Level}
+			h.Id = "toc_" + strconv.Itoa(count)
+			count++
+			for len(open) > 0 && open[len(open)-1].Level >= n.Level {
+				open = open[:len(open)-1]
+			}
+			if len(open) == 0 {
+				info.Headings = append(info.Headings, h)
+			} else {
+				parent := open[len(open)-1]
+				parent.Children = append(parent.Children, h)
+			}
+			open = append(open, h)
+
+		case NODE_PARAGRAPH:
+			if info.FirstParagraph == nil && n.Parent == doc {
+				info.FirstParagraph = nodeText(n)
+			}
+
+		case NODE_LINK, NODE_AUTOLINK:
+			info.Links = append(info.Links, linkInfo(n))
+		case NODE_IMAGE, NODE_MEDIA_EMBED:
+			info.Images = append(info.Images, linkInfo(n))
+
+		case NODE_CODE_BLOCK:
+			if n.Lang != "" && !languages[n.Lang] {
+				languages[n.Lang] = true
+				info.CodeLanguages = append(info.CodeLanguages, n.Lang)
+			}
+		}
+		return WALK_CONTINUE
+	})
+
+	return info
+}
+
+// Parse a document and return its links, autolinks, images, and media
+// embeds, in order, e.g., to check the links or gather the assets.
+func Links(input []byte, extensions uint64) []LinkInfo {
+	var links []LinkInfo
+	Walk(Parse(input, extensions), func(n *Node, entering bool) WalkStatus {
+		switch n.Type {
+		case NODE_LINK, NODE_AUTOLINK, NODE_IMAGE, NODE_MEDIA_EMBED:
+			if entering {
+				links = append(links, linkInfo(n))
+			}
+		}
+		return WALK_CONTINUE
+	})
+	return links
+}
+
+// describe a link or an image and where it is
+func linkInfo(n *Node) LinkInfo {
+	info := LinkInfo{Dest: n.Link, Title: n.Title}
+	switch n.Type {
+	case NODE_LINK:
+		info.Text = nodeText(n)
+	case NODE_AUTOLINK:
+		info.Text = n.Link
+	default:
+		info.Text, info.Image = n.Literal, true
+	}
+
+	for p := n.Parent; p != nil; p = p.Parent {
+		if info.Context == nil && p.Type < NODE_TEXT {
+			info.Context = collapseSpace(nodeText(p))
+		}
+		if p.Pos.Line > 0 {
+			info.Pos = p.Pos
+			break
+		}
+	}
+	return info
+}
+
+// A CodeBlock is a block of code in a document, as found by CodeBlocks.
+type CodeBlock struct {
+	Lang string // the language, empty if none was given
+	Info string // the whole info string of a fenced block
+	Code []byte
+
+	// where the block came from, or the top-level block it is inside,
+	// such as a list
+	Pos Position
+}
+
+// Parse a document and return its code blocks, fenced and indented, in
+// order, e.g., to compile and run the examples in it.
+func CodeBlocks(input []byte, extensions uint64) []CodeBlock {
+	var blocks []CodeBlock
+	for _, n := range FindAll(Parse(input, extensions), NODE_CODE_BLOCK) {
+		block := CodeBlock{Lang: n.Lang, Info: n.Info, Code: n.Literal}
+		for p := n; p != nil; p = p.Parent {
+			if p.Pos.Line > 0 {
+				block.Pos = p.Pos
+				break
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// A Section is a part of a document that starts with a header, as found
+// by Split.
+type Section struct {
+	Title  string // plain text of the header, empty before the first one
+	Level  int    // of the header, 0 before the first one
+	Id     string // the id HtmlRenderer gives the header under HTML_TOC
+	Source []byte // the input from the header up to the next section
+	Body   *Node  // a document holding the blocks after the header
+}
+
+// Parse a document and split it into sections at each top-level header
+// of the given level or a higher one, e.g., to paginate a manual. What
+// comes before the first of those headers makes a section with no title,
+// unless it is blank. Links in a Body use references from anywhere in
+// the document, but the Source of a section has only its own.
+func Split(input []byte, level int, extensions uint64) []Section {
+	doc := Parse(input, extensions)
+	lines := lineStarts(input)
+
+	// the ids count every header, as the table of contents does
+	ids := make(map[*Node]string)
+	for i, n := range FindAll(doc, NODE_HEADER) {
+		ids[n] = "toc_" + strconv.Itoa(i)
+	}
+
+	sections := []Section{{Body: &Node{Type: NODE_DOCUMENT}}}
+	start := 0 // where the source of the last section begins
+	for i, n := range doc.Children {
+		if n.Type == NODE_HEADER && n.Level <= level && n.Pos.Line > 0 {
+			// a setext header is parsed with the paragraph before it
+			line := n.Pos.Line
+			if i > 0 && doc.Children[i-1].Pos == n.Pos {
+				line = n.Pos.EndLine - 1
+			}
+			sections[len(sections)-1].Source = input[start:lines[line-1]]
+			start = lines[line-1]
+			sections = append(sections, Section{
+				Title: string(nodeText(n)),
+				Level: n.Level,
+				Id:    ids[n],
+				Body:  &Node{Type: NODE_DOCUMENT},
+			})
+			continue
+		}
+		body := sections[len(sections)-1].Body
+		n.Parent = body
+		body.Children = append(body.Children, n)
+	}
+	sections[len(sections)-1].Source = input[start:]
+
+	if len(bytes.TrimSpace(sections[0].Source)) == 0 {
+		sections = sections[1:]
+	}
+	return sections
+}
+
+// The reading speed assumed by Stats, in words per minute.
+const WORDS_PER_MINUTE = 200
+
+// Counts for the readable text of a document, as found by Stats.
+type TextStats struct {
+	Words       int
+	Characters  int // characters other than white space
+	ReadingTime int // in minutes, rounded up
+}
+
+// Parse a document and count the words and characters of its text,
+// leaving out code blocks, raw HTML, images, and URLs, and estimate how
+// long it takes to read at WORDS_PER_MINUTE.
+func Stats(input []byte, extensions uint64) TextStats {
+	text := bytes.NewBuffer(nil)
+	Walk(Parse(input, extensions), func(n *Node, entering bool) WalkStatus {
+		if !entering {
+			if n.Type < NODE_TEXT {
+				text.WriteByte('\n') // blocks do not run together
+			}
+			return WALK_CONTINUE
+		}
+		switch n.Type {
+		case NODE_CODE_BLOCK, NODE_HTML_BLOCK, NODE_SHORTCODE_BLOCK, NODE_AUTOLINK,
+			NODE_IMAGE, NODE_MEDIA_EMBED, NODE_HTML_SPAN, NODE_SHORTCODE, NODE_RUBY_TEXT:
+			return WALK_SKIP_CHILDREN
+		case NODE_TEXT, NODE_ENTITY, NODE_CODE, NODE_KBD, NODE_LINEBREAK:
+			writeNodeText(text, n)
+		}
+		return WALK_CONTINUE
+	})
+
+	var stats TextStats
+	for _, word := range bytes.Fields(text.Bytes()) {
+		if isUrlWord(word) {
+			continue
+		}
+		stats.Characters += utf8.RuneCount(word)
+		for _, c := range string(word) {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) {
+				stats.Words++
+				break
+			}
+		}
+	}
+	stats.ReadingTime = (stats.Words + WORDS_PER_MINUTE - 1) / WORDS_PER_MINUTE
+	return stats
+}
+
+// a bare URL in the text, which is not read as words
+func isUrlWord(word []byte) bool {
+	lower := bytes.ToLower(word)
+	return bytes.HasPrefix(lower, []byte("http://")) || bytes.HasPrefix(lower, []byte("https://")) ||
+		bytes.HasPrefix(lower, []byte("ftp://")) || bytes.HasPrefix(lower, []byte("www."))
+}
+
+// Parse a document and return its text without any markup, e.g., for a
+// search index or a meta description. Each paragraph, header, list item,
+// table row, or code block goes on a line of its own, with white space
+// inside it collapsed, and top-level blocks are set apart by blank lines.
+// Raw HTML is left out, and images give their alt text.
+func ExtractText(input []byte, extensions uint64) []byte {
+	out := bytes.NewBuffer(nil)
+	for _, block := range Parse(input, extensions).Children {
+		mark := out.Len()
+		if mark > 0 {
+			out.WriteByte('\n')
+		}
+		if !writeBlockText(out, block) {
+			out.Truncate(mark)
+		}
+	}
+	return out.Bytes()
+}
+
+// write the text of a block a line at a time, returning false if it had none
+func writeBlockText(out *bytes.Buffer, n *Node) bool {
+	switch n.Type {
+	case NODE_HTML_BLOCK, NODE_SHORTCODE_BLOCK, NODE_HRULE:
+		return false
+	case NODE_CODE_BLOCK:
+		return writeTextLine(out, bytes.TrimSpace(n.Literal))
+	case NODE_TABLE_ROW:
+		row := bytes.NewBuffer(nil)
+		for _, cell := range n.Children {
+			row.WriteByte(' ') // cells would run together otherwise
+			writeNodeText(row, cell)
+		}
+		return writeTextLine(out, collapseSpace(row.Bytes()))
+	}
+
+	// runs of spans make a line, between the blocks
+	written := false
+	line := bytes.NewBuffer(nil)
+	for _, child := range n.Children {
+		if child.Type >= NODE_TEXT {
+			writeNodeText(line, child)
+			continue
+		}
+		if writeTextLine(out, collapseSpace(line.Bytes())) {
+			written = true
+		}
+		line.Reset()
+		if writeBlockText(out, child) {
+			written = true
+		}
+	}
+	if writeTextLine(out, collapseSpace(line.Bytes())) {
+		written = true
+	}
+	return written
+}
+
+// write a line of text, if there is any
+func writeTextLine(out *bytes.Buffer, text []byte) bool {
+	if len(text) == 0 {
+		return false
+	}
+	out.Write(text)
+	out.WriteByte('\n')
+	return true
+}
+
+// join the words of a text with single spaces
+func collapseSpace(text []byte) []byte {
+	return bytes.Join(bytes.Fields(text), []byte(" "))
+}
+
+// the text of a node without any markup, with entities decoded
+func nodeText(n *Node) []byte {
+	text := bytes.NewBuffer(nil)
+	writeNodeText(text, n)
+	return text.Bytes()
+}
+
+func writeNodeText(out *bytes.Buffer, n *Node) {
+	switch n.Type {
+	case NODE_TEXT, NODE_CODE, NODE_KBD, NODE_IMAGE, NODE_MEDIA_EMBED:
+		out.Write(n.Literal)
+	case NODE_ENTITY:
+		if text := decodeEntity(n.Literal); text != nil {
+			out.Write(text)
+		} else {
+			out.Write(n.Literal)
+		}
+	case NODE_AUTOLINK:
+		out.Write(n.Link)
+	case NODE_LINEBREAK:
+		out.WriteByte('\n')
+	case NODE_HTML_SPAN, NODE_SHORTCODE, NODE_RUBY_TEXT:
+		// markup only
+	default:
+		for _, child := range n.Children {
+			writeNodeText(out, child)
+		}
+	}
+}
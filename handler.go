@@ -0,0 +1,126 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Serving markdown files over HTTP
+//
+//
+
+package blackfriday
+
+import (
+	"fmt"
+	"hash/crc32"
+	"http"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Handler serves a directory of markdown files as HTML pages, e.g.,
+// for a documentation site. A request for /guide renders guide.md, and
+// one for a directory renders its index file; other files, such as
+// images, are served as they are. It is safe for concurrent use, as a
+// Processor is.
+type Handler struct {
+	root       string
+	processor  *Processor
+	extensions uint64
+	index      string
+	maxAge     int
+	page       func(w io.Writer, title string, body []byte)
+}
+
+// Create a handler for the markdown files under a directory, rendered
+// with the given options, as for MarkdownWith.
+func NewHandler(root string, opts ...Option) *Handler {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return &Handler{
+		root:       root,
+		processor:  NewProcessor(opts...),
+		extensions: options.Extensions,
+		index:      "index.md",
+	}
+}
+
+// Set the file rendered for a directory, "index.md" by default.
+func (h *Handler) SetIndex(name string) {
+	h.index = name
+}
+
+// Let clients and proxies cache pages for the given number of seconds.
+// Either way, a client can check whether its copy is current.
+func (h *Handler) SetMaxAge(seconds int) {
+	h.maxAge = seconds
+}
+
+// Set the function that writes the page around each rendered document,
+// e.g., with a site's header and navigation. It gets the text of the
+// first header as the title. Without one, the document is sent alone.
+func (h *Handler) SetPage(page func(w io.Writer, title string, body []byte)) {
+	h.page = page
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	dir := ""
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/"):
+		name = path.Join(name, h.index)
+	case path.Ext(name) == "":
+		dir = name
+		name += ".md"
+	case path.Ext(name) != ".md":
+		http.ServeFile(w, r, h.file(name))
+		return
+	}
+
+	input, err := ioutil.ReadFile(h.file(name))
+	if err != nil {
+		// a directory named without the slash
+		if _, err := ioutil.ReadFile(h.file(path.Join(dir, h.index))); dir != "" && err == nil {
+			http.Redirect(w, r, dir+"/", http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	// the page changes only with the file
+	etag := fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE(input))
+	w.Header().Set("ETag", etag)
+	if h.maxAge > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(h.maxAge))
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if h.page == nil {
+		h.processor.RenderTo(w, input)
+		return
+	}
+	body := h.processor.Render(input)
+	title := ""
+	if headings := Extract(input, h.extensions).Headings; len(headings) > 0 {
+		title = headings[0].Text
+	}
+	h.page(w, title, body)
+}
+
+// the path of a file under the root, from a cleaned URL path
+func (h *Handler) file(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
@@ -16,6 +16,8 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
+	"utf8"
 )
 
 const (
@@ -32,22 +34,119 @@ const (
 	HTML_USE_SMARTYPANTS
 	HTML_SMARTYPANTS_FRACTIONS
 	HTML_SMARTYPANTS_LATEX_DASHES
+	HTML_SYMBOL_REPLACEMENTS
+	HTML_ESCAPE_HTML
+	HTML_NOFOLLOW_LINKS
+	HTML_HREF_TARGET_BLANK
+	HTML_HEADER_ANCHORS
+	HTML_LINE_NUMBERS
+	HTML_LINE_NUMBERS_TABLE
+	HTML_FIGURES
+	HTML_SOURCEPOS
+	HTML_SMARTYPANTS_ANGLED_QUOTES
+	HTML_SMARTYPANTS_GERMAN_QUOTES
+	HTML_SMARTYPANTS_QUOTES_ONLY
+	HTML_COMPLETE_PAGE
+	HTML_TABLE_WRAPPER
+	HTML_DECODE_ENTITIES
+	HTML_STRIKETHROUGH_S
+	HTML_PRETTY_PRINT
+	HTML_MINIFY
+	HTML_OBFUSCATE_EMAILS
+	HTML_DETECT_DIRECTION
+	HTML_NUMBER_SECTIONS
+	HTML_EMAIL
+	HTML_TAGFILTER
+	HTML_NO_FOOTNOTE_RETURNS
 )
 
+// A CodeHighlighter renders a code block in place of the HTML renderer.
+// It gets the raw code and the first word of the language from the fence,
+// and returns false to leave the block to the default escaped <pre><code>.
+type CodeHighlighter func(out *bytes.Buffer, code []byte, lang string) bool
+
+// An ImageAttributes hook gives extra attributes for an image, such as
+// srcset, sizes, or loading="lazy", as name and value pairs in order.
+type ImageAttributes func(link []byte) [][2]string
+
+// An AttributeHook sees the name and attributes of every start tag in the
+// output, with the values unescaped, and returns the attributes to write,
+// e.g., adding class="prose-table" to tables or referrerpolicy to images.
+type AttributeHook func(tag string, attrs [][2]string) [][2]string
+
+// A Slugger turns the plain text of a header into its id, e.g.,
+// "Getting Started" into "getting-started".
+type Slugger func(text []byte) string
+
+// A LinkPolicy decides the rel and target attributes of each link,
+// e.g., by its host, in place of HTML_NOFOLLOW_LINKS and
+// HTML_HREF_TARGET_BLANK. Empty values are left out, and returning
+// false leaves the link as plain text.
+type LinkPolicy func(url []byte) (rel string, target string, ok bool)
+
 type htmlOptions struct {
-	flags     int
+	flags     uint64
 	close_tag string // how to end singleton tags: usually " />\n", possibly ">\n"
 	toc_data  struct {
 		header_count  int
 		current_level int
+		slugs         map[string]int // times each slug has been used
+		sections      [6]int         // section numbers under HTML_NUMBER_SECTIONS
 	}
 	smartypants *SmartypantsRenderer
+	policy      *HtmlPolicy
+	schemes     map[string]bool // allowed link schemes, nil for any
+	siteHost    string          // links to other hosts are external
+	nofollowRel string          // rel value for external links under HTML_NOFOLLOW_LINKS
+	anchor      string          // permalink markup under HTML_HEADER_ANCHORS
+	highlighter CodeHighlighter
+	classPrefix string
+	idPrefix    string // wrapped around generated header ids
+	idSuffix    string
+	slugger     Slugger
+	numberFrom  int    // the first header level numbered under HTML_NUMBER_SECTIONS
+	numberSep   string // goes after each part of a section number
+	emailStyles map[string]string
+	emailWidth  int // width of images under HTML_EMAIL, 0 to leave it out
+	imageAttrs  ImageAttributes
+	absPrefix   string // base URL for relative links and images
+	linkPolicy  LinkPolicy
+	attrHook    AttributeHook
+	tableClass  string // class of the <div> around tables under HTML_TABLE_WRAPPER
+	langPrefix  string // goes before the language class of code blocks
+	emTag       string // elements for *emphasis* and **strong emphasis**
+	strongTag   string
+	attrs       *Attributes // of the block whose callback comes next
+
+	// the markup of footnotes: the id prefixes of notes and references,
+	// the classes of references and of the links back to them, and the
+	// contents and title of those links
+	footnote struct {
+		noteId, refId       string
+		refClass, backClass string
+		back, backTitle     string
+	}
+
+	// the <head> of the page under HTML_COMPLETE_PAGE
+	page struct {
+		title   string
+		lang    string
+		dir     string
+		charset string
+		css     []string
+		meta    [][2]string
+	}
 }
 
 var xhtml_close = " />\n"
 var html_close = ">\n"
 
-func HtmlRenderer(flags int) *Renderer {
+func HtmlRenderer(flags uint64) *Renderer {
+	// email clients want neither wrappers nor layout tables
+	if flags&HTML_EMAIL != 0 {
+		flags &^= HTML_TABLE_WRAPPER | HTML_LINE_NUMBERS_TABLE
+	}
+
 	// configure the rendering engine
 	r := new(Renderer)
 	if flags&HTML_GITHUB_BLOCKCODE == 0 {
@@ -56,7 +155,7 @@ func HtmlRenderer(flags int) *Renderer {
 		r.blockcode = htmlBlockcodeGithub
 	}
 	r.blockquote = htmlBlockquote
-	if flags&HTML_SKIP_HTML == 0 {
+	if flags&(HTML_SKIP_HTML|HTML_ESCAPE_HTML) == 0 {
 		r.blockhtml = htmlRawBlock
 	}
 	r.header = htmlHeader
@@ -67,6 +166,21 @@ func HtmlRenderer(flags int) *Renderer {
 	r.table = htmlTable
 	r.tableRow = htmlTablerow
 	r.tableCell = htmlTablecell
+	r.lineBlock = htmlLineBlock
+	r.details = htmlDetails
+	r.div = htmlDiv
+	r.attributes = htmlAttributes
+	r.blockShortcode = htmlBlockShortcode
+	r.footnotes = htmlFootnotes
+	r.footnoteItem = htmlFootnoteItem
+	if flags&HTML_COMPLETE_PAGE != 0 {
+		r.documentHeader = htmlDocumentHeader
+	}
+	r.documentFooter = htmlDocumentFooter
+	r.wholeOutput = htmlWholeOutput
+	if flags&HTML_SOURCEPOS != 0 {
+		r.sourcepos = htmlSourcepos
+	}
 
 	r.autolink = htmlAutolink
 	r.codespan = htmlCodespan
@@ -74,14 +188,27 @@ func HtmlRenderer(flags int) *Renderer {
 	r.emphasis = htmlEmphasis
 	if flags&HTML_SKIP_IMAGES == 0 {
 		r.image = htmlImage
+		r.mediaEmbed = htmlMediaEmbed
+	} else {
+		r.image = htmlImageAlt
 	}
 	r.linebreak = htmlLinebreak
 	if flags&HTML_SKIP_LINKS == 0 {
 		r.link = htmlLink
+	} else {
+		r.link = htmlLinkText
 	}
 	r.rawHtmlTag = htmlRawTag
 	r.tripleEmphasis = htmlTripleEmphasis
 	r.strikethrough = htmlStrikethrough
+	r.ruby = htmlRuby
+	r.kbd = htmlKbd
+	r.shortcode = htmlShortcode
+	r.footnoteRef = htmlFootnoteRef
+
+	if flags&HTML_DECODE_ENTITIES != 0 {
+		r.entity = htmlEntity
+	}
 
 	var cb *SmartypantsRenderer
 	if flags&HTML_USE_SMARTYPANTS == 0 {
@@ -95,14 +222,525 @@ func HtmlRenderer(flags int) *Renderer {
 	if flags&HTML_USE_XHTML != 0 {
 		close_tag = xhtml_close
 	}
-	r.opaque = &htmlOptions{flags: flags, close_tag: close_tag, smartypants: cb}
+	options := &htmlOptions{flags: flags, close_tag: close_tag, smartypants: cb, nofollowRel: "nofollow", anchor: "&para;", tableClass: "table-wrapper", emTag: "em", strongTag: "strong", numberFrom: 1, numberSep: "."}
+	options.page.charset = "utf-8"
+	options.footnote.noteId, options.footnote.refId = "fn:", "fnref:"
+	options.footnote.refClass, options.footnote.backClass = "footnote", "reversefootnote"
+	options.footnote.back, options.footnote.backTitle = "&#8617;", "return to body"
+	r.opaque = options
+	return r
+}
+
+// Create a renderer for untrusted short-form input such as comments:
+// emphasis, code, quotes, and links marked nofollow, but no images,
+// headers, or raw HTML. Images show their alt text, headers are plain
+// paragraphs, and raw HTML is escaped. Links may be relative or use http,
+// https, ftp or mailto; others are plain text. Use it with
+// COMMENT_EXTENSIONS, which leaves out tables, or call MarkdownComment.
+func CommentRenderer() *Renderer {
+	r := HtmlRenderer(HTML_ESCAPE_HTML | HTML_SKIP_IMAGES | HTML_NOFOLLOW_LINKS)
+	r.header = htmlHeaderText
+	r.SetLinkSchemes("http", "https", "ftp", "mailto")
 	return r
 }
 
-func HtmlTocRenderer(flags int) *Renderer {
+// the renderer flags of GitHub Flavored Markdown, as used by GFMRenderer
+const GFM_HTML_FLAGS = HTML_USE_XHTML | HTML_TAGFILTER
+
+// Create a renderer that writes what GitHub Flavored Markdown does:
+// XHTML-style singleton tags, "language-" on the class of fenced code,
+// and raw HTML that may not open the tags GitHub filters. Use it with
+// GFM_EXTENSIONS under CommonMark, as WithGFM and MarkdownGFM do.
+func GFMRenderer() *Renderer {
+	r := HtmlRenderer(GFM_HTML_FLAGS)
+	r.SetLanguageClassPrefix("language-")
+	return r
+}
+
+// Create a renderer that writes what Markdown.pl does: XHTML-style
+// singleton tags, a space before each <br />, and the blocks in a quote
+// indented by two spaces, but for code. Use it under WithMarkdownPl, as
+// MarkdownPl does.
+func MarkdownPlRenderer() *Renderer {
+	r := HtmlRenderer(HTML_USE_XHTML)
+	r.blockquote = htmlBlockquoteMarkdownPl
+	r.linebreak = htmlLinebreakMarkdownPl
+	return r
+}
+
+// Set the host of the site being rendered for, e.g., "example.com".
+// Under HTML_NOFOLLOW_LINKS, absolute links to any other host get
+// rel="nofollow", or rel set to the given value if it is not empty,
+// e.g., "nofollow ugc" for user-generated content. Under
+// HTML_HREF_TARGET_BLANK, links to this host stay in the same tab.
+func (r *Renderer) SetNofollow(siteHost string, rel string) {
+	options, ok := r.opaque.(*htmlOptions)
+	if !ok {
+		return
+	}
+	options.siteHost = string(bytes.ToLower([]byte(siteHost)))
+	if rel != "" {
+		options.nofollowRel = rel
+	}
+}
+
+// Let a hook change the attributes of every element the renderer writes.
+func (r *Renderer) SetAttributeHook(hook AttributeHook) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.attrHook = hook
+	}
+}
+
+// Use a callback to set rel and target, or block links, one link at a time.
+func (r *Renderer) SetLinkPolicy(policy LinkPolicy) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.linkPolicy = policy
+	}
+}
+
+// Set the <title> of the page written under HTML_COMPLETE_PAGE.
+func (r *Renderer) SetPageTitle(title string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.page.title = title
+	}
+}
+
+// Set the language and direction of the page, e.g., "ar" and "rtl",
+// on its <html> element. Empty values are left out.
+func (r *Renderer) SetPageLanguage(lang string, dir string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.page.lang = lang
+		options.page.dir = dir
+	}
+}
+
+// Set the character set declared by the page, "utf-8" by default.
+func (r *Renderer) SetPageCharset(charset string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.page.charset = charset
+	}
+}
+
+// Link style sheets from the page, in order.
+func (r *Renderer) AddPageCSS(urls ...string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.page.css = append(options.page.css, urls...)
+	}
+}
+
+// Add a <meta name="..." content="..."> tag to the page, e.g.,
+// for a description or author.
+func (r *Renderer) AddPageMeta(name string, content string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.page.meta = append(options.page.meta, [2]string{name, content})
+	}
+}
+
+// Restrict the destinations of links and images from a renderer created
+// by HtmlRenderer to the given URL schemes, e.g., "http", "https", and
+// "mailto". Relative links are always allowed, but for those with an &
+// before the first :, /, ? or #. Links with any other scheme, such as
+// javascript: or data:, are left as plain text.
+func (r *Renderer) SetLinkSchemes(schemes ...string) {
+	options, ok := r.opaque.(*htmlOptions)
+	if !ok {
+		return
+	}
+	options.schemes = make(map[string]bool)
+	for _, scheme := range schemes {
+		options.schemes[string(bytes.ToLower([]byte(scheme)))] = true
+	}
+}
+
+// Test if a link uses one of the allowed schemes.
+func (options *htmlOptions) allowLink(link []byte) bool {
+	if options.schemes == nil {
+		return true
+	}
+	scheme := linkScheme(link)
+	return scheme == "" || options.schemes[scheme]
+}
+
+// Find the scheme of a link, lowercase and without the whitespace
+// and control characters that browsers ignore. Relative links have none.
+// A character reference before the scheme could end, as in
+// javascript&#58;, hides a scheme from this test but not from the
+// browser, so such a link gets "&", which no list of schemes holds.
+func linkScheme(link []byte) string {
+	scheme := bytes.NewBuffer(nil)
+	for _, c := range link {
+		switch {
+		case c == ':':
+			return scheme.String()
+		case c == '&':
+			return "&"
+		case c == '/' || c == '?' || c == '#':
+			return ""
+		case c > ' ':
+			scheme.WriteByte(tolower(c))
+		}
+	}
+	return ""
+}
+
+// Put a prefix on every class the renderer generates, including code
+// language classes, to keep them apart from the host page's stylesheets.
+func (r *Renderer) SetClassPrefix(prefix string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.classPrefix = prefix
+	}
+}
+
+// Put a prefix such as "language-" or "lang-" on the class naming the
+// language of a fenced code block, to suit the client-side highlighter.
+// Any classes after the language are left alone.
+func (r *Renderer) SetLanguageClassPrefix(prefix string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.langPrefix = prefix
+	}
+}
+
+// Choose the elements for emphasis and strong emphasis, e.g., "i" and "b"
+// for targets that expect them, in place of "em" and "strong".
+func (r *Renderer) SetEmphasisTags(em string, strong string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.emTag = em
+		options.strongTag = strong
+	}
+}
+
+// Set the class of the <div> put around each table under
+// HTML_TABLE_WRAPPER, "table-wrapper" by default, so wide tables
+// can be given a horizontal scroll bar.
+func (r *Renderer) SetTableWrapper(class string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.tableClass = class
+	}
+}
+
+// Wrap the generated header ids, e.g., with the prefix "post-42-",
+// so several documents rendered onto one page do not share anchors.
+// Use the same values for HtmlTocRenderer so its links still match.
+func (r *Renderer) SetHeaderIdAffixes(prefix, suffix string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.idPrefix = prefix
+		options.idSuffix = suffix
+	}
+}
+
+// Set the first header level numbered under HTML_NUMBER_SECTIONS, e.g.,
+// 2 to leave a single <h1> title alone, and what goes after each part
+// of a number, "." by default for 1., 1.1., 1.1.1.
+func (r *Renderer) SetSectionNumbering(level int, separator string) {
+	if level < 1 {
+		level = 1
+	}
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.numberFrom = level
+		options.numberSep = separator
+	}
+}
+
+// Set the markup of the link at the end of each footnote back to where it
+// is referenced, "&#8617;" by default, and its title, "return to body",
+// e.g., to give screen readers words in place of the arrow. An empty
+// title is left out. HTML_NO_FOOTNOTE_RETURNS leaves out the link.
+func (r *Renderer) SetFootnoteReturn(markup string, title string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.footnote.back = markup
+		options.footnote.backTitle = title
+	}
+}
+
+// Set what goes before the number in the ids of footnotes and of the
+// references to them, "fn:" and "fnref:" by default, e.g., "fn-" and
+// "fnref-" for ids that need no escaping in CSS selectors, and the
+// classes of the references and of the links back to them, "footnote"
+// and "reversefootnote". The header id affixes and class prefix still
+// apply.
+func (r *Renderer) SetFootnoteFormat(noteId, refId, refClass, backClass string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.footnote.noteId = noteId
+		options.footnote.refId = refId
+		options.footnote.refClass = refClass
+		options.footnote.backClass = backClass
+	}
+}
+
+// count the next header at a level and write its section number
+func htmlSectionNumber(ob *bytes.Buffer, level int, options *htmlOptions) {
+	if options.flags&HTML_NUMBER_SECTIONS == 0 || level < options.numberFrom || level > 6 {
+		return
+	}
+	sections := &options.toc_data.sections
+	sections[level-1]++
+	for i := level; i < len(sections); i++ {
+		sections[i] = 0
+	}
+
+	ob.WriteString("<span class=\"" + options.class("section-number") + "\">")
+	for i := options.numberFrom - 1; i < level; i++ {
+		ob.WriteString(strconv.Itoa(sections[i]))
+		attrEscape(ob, []byte(options.numberSep))
+	}
+	ob.WriteString("</span> ")
+}
+
+// Make header ids from the header text with a callback, in place of
+// numbering them, to match an existing site's anchors. Repeated slugs
+// get -1, -2, and so on. Use the same callback for HtmlTocRenderer.
+func (r *Renderer) SetSlugger(slugger Slugger) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.slugger = slugger
+	}
+}
+
+// the id of the next header, numbered or made from its text
+func (options *htmlOptions) nextHeaderId(text []byte) string {
+	id := "toc_" + strconv.Itoa(options.toc_data.header_count)
+	options.toc_data.header_count++
+
+	if options.slugger != nil {
+		if slug := options.slugger(htmlPlainText(text)); slug != "" {
+			if options.toc_data.slugs == nil {
+				options.toc_data.slugs = make(map[string]int)
+			}
+			id = slug
+			if n := options.toc_data.slugs[slug]; n > 0 {
+				id += "-" + strconv.Itoa(n)
+			}
+			options.toc_data.slugs[slug]++
+		}
+	}
+	return options.idPrefix + id + options.idSuffix
+}
+
+// Render a document and check that each link to a #fragment of the same
+// page goes to an id or named anchor in the output, e.g., to a header
+// under HTML_TOC, for checking documentation in a build. Each link that
+// does not gets a DIAG_BROKEN_ANCHOR diagnostic on the first line of the
+// top-level block it is in. The renderer's own user data is left alone.
+func CheckAnchors(input []byte, renderer *Renderer, extensions uint64) []Diagnostic {
+	output := MarkdownWith(input, WithRenderer(renderer), WithExtensions(extensions), WithOpaque(renderer.CallOpaque()))
+	anchors := htmlAnchors(output)
+
+	var diags []Diagnostic
+	for _, link := range Links(input, extensions) {
+		if link.Image || len(link.Dest) < 2 || link.Dest[0] != '#' {
+			continue
+		}
+		if fragment := string(link.Dest[1:]); !anchors[fragment] {
+			diags = append(diags, Diagnostic{link.Pos.Line, DIAG_BROKEN_ANCHOR, "no anchor for link to #" + fragment})
+		}
+	}
+	return diags
+}
+
+// the ids and anchor names in rendered HTML
+func htmlAnchors(data []byte) map[string]bool {
+	anchors := make(map[string]bool)
+	for i := 0; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		end, name, closing := htmlTagInfo(data[i:])
+		if end == 0 || closing || name[0] == '!' {
+			continue
+		}
+		for _, attr := range htmlTagAttrs(data[i:i+end], name) {
+			if attr[0] == "id" || (attr[0] == "name" && name == "a") {
+				anchors[string(htmlUnescape([]byte(attr[1])))] = true
+			}
+		}
+		i += end - 1
+	}
+	return anchors
+}
+
+// the text of rendered HTML, without its tags or entities
+func htmlPlainText(data []byte) []byte {
+	text := bytes.NewBuffer(nil)
+	mark := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		if end, _, _ := htmlTagInfo(data[i:]); end > 0 {
+			text.Write(data[mark:i])
+			i += end - 1
+			mark = i + 1
+		}
+	}
+	text.Write(data[mark:])
+	return htmlUnescape(text.Bytes())
+}
+
+// add the class prefix to each of a space-separated list of classes
+func (options *htmlOptions) class(names string) string {
+	if options.classPrefix == "" {
+		return names
+	}
+	return options.classPrefix + strings.Replace(names, " ", " "+options.classPrefix, -1)
+}
+
+// Add the attributes given by a hook to every image.
+func (r *Renderer) SetImageAttributes(f ImageAttributes) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.imageAttrs = f
+	}
+}
+
+// write the extra attributes for an image from the hook, if there is one
+func htmlImageAttrs(ob *bytes.Buffer, link []byte, options *htmlOptions) {
+	if options.imageAttrs == nil {
+		return
+	}
+	for _, attr := range options.imageAttrs(link) {
+		ob.WriteString(" " + attr[0] + "=\"")
+		attrEscape(ob, []byte(attr[1]))
+		ob.WriteByte('"')
+	}
+}
+
+// Hand code blocks to a highlighter before rendering them as usual.
+func (r *Renderer) SetCodeHighlighter(h CodeHighlighter) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.highlighter = h
+	}
+}
+
+// give a code block to the highlighter, if there is one
+func htmlHighlight(ob *bytes.Buffer, text []byte, lang string, options *htmlOptions) bool {
+	if options.highlighter == nil {
+		return false
+	}
+
+	// just the first class, without a leading dot
+	i := 0
+	for i < len(lang) && !isspace(lang[i]) {
+		i++
+	}
+	lang = lang[:i]
+	if len(lang) > 0 && lang[0] == '.' {
+		lang = lang[1:]
+	}
+
+	return options.highlighter(ob, text, lang)
+}
+
+// Set the markup of the permalink added to each header under
+// HTML_HEADER_ANCHORS. It is written as raw HTML; the default is a pilcrow.
+func (r *Renderer) SetHeaderAnchor(markup string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.anchor = markup
+	}
+}
+
+// Put a base URL, e.g., "http://example.com/blog/", in front of relative
+// link and image destinations, for output read away from the site
+// such as feeds and emails. Links to a fragment of the page are kept.
+func (r *Renderer) SetAbsolutePrefix(prefix string) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.absPrefix = prefix
+	}
+}
+
+// resolve a relative link against the absolute prefix
+func (options *htmlOptions) absoluteLink(link []byte) []byte {
+	if options.absPrefix == "" || len(link) == 0 || link[0] == '#' || linkScheme(link) != "" || bytes.HasPrefix(link, []byte("//")) {
+		return link
+	}
+	prefix := options.absPrefix
+	if prefix[len(prefix)-1] == '/' && link[0] == '/' {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return append([]byte(prefix), link...)
+}
+
+// Find the host of an absolute link, lowercase and without any user
+// or port. Relative links have none.
+func linkHost(link []byte) string {
+	// the // must come first or right after the scheme
+	i := bytes.Index(link, []byte("//"))
+	if i < 0 {
+		return ""
+	}
+	if i > 0 {
+		if link[i-1] != ':' {
+			return ""
+		}
+		for _, c := range link[:i-1] {
+			if !isalnum(c) && c != '+' && c != '-' && c != '.' {
+				return ""
+			}
+		}
+	}
+	host := link[i+2:]
+	for j, c := range host {
+		if c == '/' || c == '?' || c == '#' {
+			host = host[:j]
+			break
+		}
+	}
+	if at := bytes.LastIndex(host, []byte("@")); at >= 0 {
+		host = host[at+1:]
+	}
+	if colon := bytes.LastIndex(host, []byte(":")); colon >= 0 && bytes.IndexByte(host[colon:], ']') < 0 {
+		host = host[:colon]
+	}
+	return string(bytes.ToLower(host))
+}
+
+// find the rel and target for a link, and whether to keep it
+func (options *htmlOptions) linkAttrs(link []byte) (rel string, target string, ok bool) {
+	if options.linkPolicy != nil {
+		return options.linkPolicy(link)
+	}
+	if options.flags&(HTML_NOFOLLOW_LINKS|HTML_HREF_TARGET_BLANK) == 0 {
+		return "", "", true
+	}
+	host := linkHost(link)
+	if host == "" || host == options.siteHost {
+		return "", "", true
+	}
+
+	if options.flags&HTML_NOFOLLOW_LINKS != 0 {
+		rel = options.nofollowRel
+	}
+	if options.flags&HTML_HREF_TARGET_BLANK != 0 {
+		// keep the new page from reaching back through window.opener
+		if rel != "" {
+			rel += " "
+		}
+		rel += "noopener noreferrer"
+		target = "_blank"
+	}
+	return rel, target, true
+}
+
+// write the extra attributes for a link
+func htmlLinkAttrs(ob *bytes.Buffer, rel string, target string) {
+	if target != "" {
+		ob.WriteString(" target=\"")
+		attrEscape(ob, []byte(target))
+		ob.WriteByte('"')
+	}
+	if rel != "" {
+		ob.WriteString(" rel=\"")
+		attrEscape(ob, []byte(rel))
+		ob.WriteByte('"')
+	}
+}
+
+// Create a renderer that outputs only the table of contents of a
+// document, as nested lists linking to the headers. The links match the
+// header ids written by HtmlRenderer with HTML_TOC, so the same input
+// can be rendered once with each to put the contents in a sidebar.
+func HtmlTocRenderer(flags uint64) *Renderer {
 	// configure the rendering engine
 	r := new(Renderer)
 	r.header = htmlTocHeader
+	r.attributes = htmlAttributes
 
 	r.codespan = htmlCodespan
 	r.doubleEmphasis = htmlDoubleEmphasis
@@ -110,16 +748,34 @@ func HtmlTocRenderer(flags int) *Renderer {
 	r.tripleEmphasis = htmlTripleEmphasis
 	r.strikethrough = htmlStrikethrough
 
+	// entries are already links, so links in headers keep only their text
+	r.link = htmlTocLink
+	r.rawHtmlTag = htmlRawTag
+	r.normalText = htmlNormalText
+
 	r.documentFooter = htmlTocFinalize
 
 	close_tag := ">\n"
 	if flags&HTML_USE_XHTML != 0 {
 		close_tag = " />\n"
 	}
-	r.opaque = &htmlOptions{flags: flags | HTML_TOC, close_tag: close_tag}
+	r.opaque = &htmlOptions{flags: flags | HTML_TOC | HTML_SKIP_HTML, close_tag: close_tag, emTag: "em", strongTag: "strong", numberFrom: 1, numberSep: "."}
 	return r
 }
 
+// Make user data for one call with WithOpaque. It has the settings of
+// this renderer but its own record of the headers seen so far, so calls
+// made at the same time can share an HTML renderer.
+func (r *Renderer) CallOpaque() interface{} {
+	options, ok := r.opaque.(*htmlOptions)
+	if !ok {
+		return r.opaque
+	}
+	call := *options
+	call.toc_data = new(htmlOptions).toc_data
+	return &call
+}
+
 func attrEscape(ob *bytes.Buffer, src []byte) {
 	for i := 0; i < len(src); i++ {
 		// directly copy normal characters
@@ -155,18 +811,39 @@ func htmlHeader(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
 		ob.WriteByte('\n')
 	}
 
-	if options.flags&HTML_TOC != 0 {
-		ob.WriteString(fmt.Sprintf("<h%d id=\"toc_%d\">", level, options.toc_data.header_count))
-		options.toc_data.header_count++
-	} else {
-		ob.WriteString(fmt.Sprintf("<h%d>", level))
+	// permalinks need an id to point at, so they number headers like the
+	// toc; one the document gives is used as it is
+	attrs := options.takeAttributes()
+	id := ""
+	if options.flags&(HTML_TOC|HTML_HEADER_ANCHORS) != 0 {
+		id = options.nextHeaderId(text)
 	}
+	if attrs != nil && attrs.Id != "" {
+		id = attrs.Id
+	}
+	ob.WriteString(fmt.Sprintf("<h%d", level))
+	htmlAttrs(ob, id, attrs, options)
+	htmlDir(ob, text, options)
+	ob.WriteByte('>')
 
+	htmlSectionNumber(ob, level, options)
 	ob.Write(text)
+	if options.flags&HTML_HEADER_ANCHORS != 0 {
+		ob.WriteString(" <a class=\"" + options.class("anchor") + "\" href=\"#")
+		attrEscape(ob, []byte(id))
+		ob.WriteString("\">")
+		ob.WriteString(options.anchor)
+		ob.WriteString("</a>")
+	}
 	ob.WriteString(fmt.Sprintf("</h%d>\n", level))
 }
 
+func htmlHeaderText(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
+	htmlParagraph(ob, text, opaque)
+}
+
 func htmlRawBlock(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	options := opaque.(*htmlOptions)
 	sz := len(text)
 	for sz > 0 && text[sz-1] == '\n' {
 		sz--
@@ -178,13 +855,52 @@ func htmlRawBlock(ob *bytes.Buffer, text []byte, opaque interface{}) {
 	if org >= sz {
 		return
 	}
+	if options.flags&HTML_SKIP_STYLE != 0 && isHtmlTag(text[org:sz], "style") {
+		return
+	}
 	if ob.Len() > 0 {
 		ob.WriteByte('\n')
 	}
-	ob.Write(text[org:sz])
+	if options.policy != nil {
+		options.policy.sanitize(ob, text[org:sz])
+	} else if options.flags&HTML_TAGFILTER != 0 {
+		htmlTagFilter(ob, text[org:sz])
+	} else {
+		ob.Write(text[org:sz])
+	}
+	ob.WriteByte('\n')
+}
+
+func htmlBlockShortcode(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.Write(text)
 	ob.WriteByte('\n')
 }
 
+// mark the first tag of a top-level block with the lines and columns
+// it came from, e.g., data-sourcepos="12:1-15:8", for editor scroll sync
+func htmlSourcepos(ob *bytes.Buffer, mark int, line int, col int, endLine int, endCol int, opaque interface{}) {
+	out := ob.Bytes()
+	i := mark
+	for i < len(out) && isspace(out[i]) {
+		i++
+	}
+	if i+1 >= len(out) || out[i] != '<' || !isalnum(out[i+1]) {
+		return
+	}
+	i++
+	for i < len(out) && isalnum(out[i]) {
+		i++
+	}
+
+	rest := append([]byte(nil), out[i:]...)
+	ob.Truncate(i)
+	ob.WriteString(fmt.Sprintf(" data-sourcepos=\"%d:%d-%d:%d\"", line, col, endLine, endCol))
+	ob.Write(rest)
+}
+
 func htmlHrule(ob *bytes.Buffer, opaque interface{}) {
 	options := opaque.(*htmlOptions)
 
@@ -195,13 +911,23 @@ func htmlHrule(ob *bytes.Buffer, opaque interface{}) {
 	ob.WriteString(options.close_tag)
 }
 
-func htmlBlockcode(ob *bytes.Buffer, text []byte, lang string, opaque interface{}) {
+func htmlBlockcode(ob *bytes.Buffer, text []byte, lang string, info string, fence CodeFence, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	attrs := options.takeAttributes()
 	if ob.Len() > 0 {
 		ob.WriteByte('\n')
 	}
+	if htmlHighlight(ob, text, lang, options) {
+		return
+	}
+	if options.flags&HTML_LINE_NUMBERS_TABLE != 0 {
+		htmlLineNumberTable(ob, text, options)
+	}
 
+	ob.WriteString("<pre")
+	htmlAttrs(ob, "", attrs, options)
 	if lang != "" {
-		ob.WriteString("<pre><code class=\"")
+		ob.WriteString("><code class=\"")
 
 		for i, cls := 0, 0; i < len(lang); i, cls = i+1, cls+1 {
 			for i < len(lang) && isspace(lang[i]) {
@@ -220,21 +946,24 @@ func htmlBlockcode(ob *bytes.Buffer, text []byte, lang string, opaque interface{
 
 				if cls > 0 {
 					ob.WriteByte(' ')
+					attrEscape(ob, []byte(options.classPrefix+lang[org:i]))
+				} else {
+					attrEscape(ob, []byte(options.classPrefix+options.langPrefix+lang[org:i]))
 				}
-				attrEscape(ob, []byte(lang[org:]))
 			}
 		}
 
 		ob.WriteString("\">")
 	} else {
-		ob.WriteString("<pre><code>")
+		ob.WriteString("><code>")
 	}
 
-	if len(text) > 0 {
-		attrEscape(ob, text)
-	}
+	htmlCodeBody(ob, text, info, options)
 
 	ob.WriteString("</code></pre>\n")
+	if options.flags&HTML_LINE_NUMBERS_TABLE != 0 {
+		ob.WriteString("</td></tr></table>\n")
+	}
 }
 
 /*
@@ -255,13 +984,23 @@ func htmlBlockcode(ob *bytes.Buffer, text []byte, lang string, opaque interface{
  * E.g.
  *              ~~~~ {.python .numbered}        =>      <pre lang="python"><code>
  */
-func htmlBlockcodeGithub(ob *bytes.Buffer, text []byte, lang string, opaque interface{}) {
+func htmlBlockcodeGithub(ob *bytes.Buffer, text []byte, lang string, info string, fence CodeFence, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	attrs := options.takeAttributes()
 	if ob.Len() > 0 {
 		ob.WriteByte('\n')
 	}
+	if htmlHighlight(ob, text, lang, options) {
+		return
+	}
+	if options.flags&HTML_LINE_NUMBERS_TABLE != 0 {
+		htmlLineNumberTable(ob, text, options)
+	}
 
+	ob.WriteString("<pre")
+	htmlAttrs(ob, "", attrs, options)
 	if len(lang) > 0 {
-		ob.WriteString("<pre lang=\"")
+		ob.WriteString(" lang=\"")
 
 		i := 0
 		for i < len(lang) && !isspace(lang[i]) {
@@ -276,68 +1015,318 @@ func htmlBlockcodeGithub(ob *bytes.Buffer, text []byte, lang string, opaque inte
 
 		ob.WriteString("\"><code>")
 	} else {
-		ob.WriteString("<pre><code>")
+		ob.WriteString("><code>")
 	}
 
-	if len(text) > 0 {
-		attrEscape(ob, text)
-	}
+	htmlCodeBody(ob, text, info, options)
 
 	ob.WriteString("</code></pre>\n")
+	if options.flags&HTML_LINE_NUMBERS_TABLE != 0 {
+		ob.WriteString("</td></tr></table>\n")
+	}
 }
 
+// write the contents of a code block, split into numbered or
+// highlighted lines if asked for
+func htmlCodeBody(ob *bytes.Buffer, text []byte, info string, options *htmlOptions) {
+	hl := codeHighlightLines(info)
+	if options.flags&(HTML_LINE_NUMBERS|HTML_LINE_NUMBERS_TABLE) == 0 || (options.flags&HTML_LINE_NUMBERS == 0 && len(hl) == 0) {
+		if len(text) > 0 {
+			attrEscape(ob, text)
+		}
+		return
+	}
 
-func htmlBlockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
-	ob.WriteString("<blockquote>\n")
-	ob.Write(text)
-	ob.WriteString("</blockquote>")
-}
+	// the table layout has its numbers in a separate column
+	numbered := options.flags&HTML_LINE_NUMBERS_TABLE == 0
+	for n, beg := 1, 0; beg < len(text); n++ {
+		end := beg
+		for end < len(text) && text[end] != '\n' {
+			end++
+		}
+		if end < len(text) {
+			end++
+		}
 
-func htmlTable(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
+		if hl[n] {
+			ob.WriteString("<span class=\"" + options.class("line hl") + "\">")
+		} else {
+			ob.WriteString("<span class=\"" + options.class("line") + "\">")
+		}
+		if numbered {
+			ob.WriteString("<span class=\"" + options.class("ln") + "\">")
+			ob.WriteString(strconv.Itoa(n))
+			ob.WriteString("</span>")
+		}
+		attrEscape(ob, text[beg:end])
+		ob.WriteString("</span>")
+		beg = end
 	}
-	ob.WriteString("<table><thead>\n")
-	ob.Write(header)
-	ob.WriteString("\n</thead><tbody>\n")
-	ob.Write(body)
-	ob.WriteString("\n</tbody></table>")
 }
 
-func htmlTablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
+// start the table holding a code block with the line numbers beside it
+func htmlLineNumberTable(ob *bytes.Buffer, text []byte, options *htmlOptions) {
+	ob.WriteString("<table class=\"" + options.class("lntable") + "\"><tr><td class=\"" + options.class("lntd") + "\"><pre><code>")
+	lines := bytes.Count(text, []byte("\n"))
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		lines++
 	}
-	ob.WriteString("<tr>\n")
-	ob.Write(text)
-	ob.WriteString("\n</tr>")
+	for n := 1; n <= lines; n++ {
+		ob.WriteString("<span class=\"" + options.class("ln") + "\">")
+		ob.WriteString(strconv.Itoa(n))
+		ob.WriteString("</span>\n")
+	}
+	ob.WriteString("</code></pre></td>\n<td class=\"" + options.class("lntd") + "\">")
 }
 
-func htmlTablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
+// find the lines to highlight from hl_lines in a fence's info string,
+// e.g., hl_lines="1 3-5" or hl_lines=[2,4]
+func codeHighlightLines(info string) map[int]bool {
+	i := strings.Index(info, "hl_lines=")
+	if i < 0 {
+		return nil
+	}
+	value := info[i+len("hl_lines="):]
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'' || value[0] == '[') {
+		close := byte(']')
+		if value[0] != '[' {
+			close = value[0]
+		}
+		if end := strings.IndexAny(value[1:], string([]byte{close})); end >= 0 {
+			value = value[1 : end+1]
+		} else {
+			value = value[1:]
+		}
+	} else if end := strings.IndexAny(value, " \t"); end >= 0 {
+		value = value[:end]
 	}
-	switch align {
+
+	lines := make(map[int]bool)
+	for _, part := range strings.Split(strings.Replace(value, ",", " ", -1), " ") {
+		part = strings.Trim(part, "\"'")
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if dash := strings.Index(part, "-"); dash >= 0 {
+			from, to = part[:dash], part[dash+1:]
+		}
+		a, err1 := strconv.Atoi(from)
+		b, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || b-a > 10000 {
+			continue
+		}
+		for n := a; n <= b; n++ {
+			lines[n] = true
+		}
+	}
+	return lines
+}
+
+func htmlBlockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	ob.WriteString("<blockquote>\n")
+	ob.Write(text)
+	ob.WriteString("</blockquote>")
+}
+
+// Markdown.pl indents every line of a quote, blank ones too, and then
+// takes the indent back off each <pre> and the blank lines before it
+func htmlBlockquoteMarkdownPl(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	text = bytes.TrimRight(text, "\n")
+	quote := bytes.NewBuffer(nil)
+	quote.WriteString("  ")
+	for i := 0; i < len(text); i++ {
+		quote.WriteByte(text[i])
+		if text[i] == '\n' {
+			quote.WriteString("  ")
+		}
+	}
+	text = quote.Bytes()
+
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<blockquote>\n")
+	for len(text) > 0 {
+		pre := bytes.Index(text, []byte("<pre>"))
+		if pre < 0 {
+			ob.Write(text)
+			break
+		}
+		end := bytes.Index(text[pre:], []byte("</pre>"))
+		if end < 0 {
+			ob.Write(text)
+			break
+		}
+		end += pre + len("</pre>")
+		for pre > 0 && isspace(text[pre-1]) {
+			pre--
+		}
+		code := bytes.Replace(text[pre:end], []byte("\n  "), []byte("\n"), -1)
+		if pre == 0 && bytes.HasPrefix(code, []byte("  ")) {
+			code = code[2:]
+		}
+		ob.Write(text[:pre])
+		ob.Write(code)
+		text = text[end:]
+	}
+	ob.WriteString("\n</blockquote>\n")
+}
+
+func htmlDetails(ob *bytes.Buffer, summary []byte, text []byte, opaque interface{}) {
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<details>")
+	if len(summary) > 0 {
+		ob.WriteString("<summary>")
+		ob.Write(summary)
+		ob.WriteString("</summary>")
+	}
+	ob.WriteByte('\n')
+	ob.Write(text)
+	ob.WriteString("</details>\n")
+}
+
+func htmlDiv(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	attrs := options.takeAttributes()
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<div")
+	htmlAttrs(ob, "", attrs, options)
+	ob.WriteString(">\n")
+	ob.Write(text)
+	ob.WriteString("</div>\n")
+}
+
+func htmlTable(ob *bytes.Buffer, header []byte, body []byte, caption []byte, columns []int, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	wrap := options.flags&HTML_TABLE_WRAPPER != 0
+
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	if wrap {
+		ob.WriteString("<div class=\"")
+		attrEscape(ob, []byte(options.class(options.tableClass)))
+		ob.WriteString("\">\n")
+	}
+	ob.WriteString("<table>")
+	if len(caption) > 0 {
+		ob.WriteString("<caption>")
+		ob.Write(caption)
+		ob.WriteString("</caption>\n")
+	}
+	if len(header) > 0 {
+		ob.WriteString("<thead>\n")
+		ob.Write(header)
+		ob.WriteString("\n</thead>")
+	}
+	ob.WriteString("<tbody>\n")
+	ob.Write(body)
+	ob.WriteString("\n</tbody></table>")
+	if wrap {
+		ob.WriteString("\n</div>")
+	}
+}
+
+func htmlTablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<tr>\n")
+	ob.Write(text)
+	ob.WriteString("\n</tr>")
+}
+
+func htmlTablecell(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	tag := "td"
+	if flags&TABLE_CELL_HEADER != 0 {
+		tag = "th"
+	}
+	ob.WriteString("<" + tag)
+	switch flags & TABLE_ALIGNMENT_CENTER {
 	case TABLE_ALIGNMENT_LEFT:
-		ob.WriteString("<td align=\"left\">")
+		ob.WriteString(" align=\"left\"")
 	case TABLE_ALIGNMENT_RIGHT:
-		ob.WriteString("<td align=\"right\">")
+		ob.WriteString(" align=\"right\"")
 	case TABLE_ALIGNMENT_CENTER:
-		ob.WriteString("<td align=\"center\">")
-	default:
-		ob.WriteString("<td>")
+		ob.WriteString(" align=\"center\"")
 	}
+	htmlDir(ob, text, options)
+	ob.WriteByte('>')
 
 	ob.Write(text)
-	ob.WriteString("</td>")
+	ob.WriteString("</" + tag + ">")
+}
+
+func htmlLineBlock(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<div class=\"" + options.class("line-block") + "\">")
+	for i, first := 0, true; i < len(text); i, first = i+1, false {
+		if !first {
+			ob.WriteString("<br")
+			ob.WriteString(options.close_tag)
+		}
+
+		// keep the leading spaces
+		for i < len(text) && text[i] == ' ' {
+			ob.WriteString("&nbsp;")
+			i++
+		}
+
+		org := i
+		for i < len(text) && text[i] != '\n' {
+			i++
+		}
+		ob.Write(text[org:i])
+	}
+	ob.WriteString("</div>\n")
 }
 
-func htmlList(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+func htmlList(ob *bytes.Buffer, text []byte, flags int, start int, opaque interface{}) {
+	options := opaque.(*htmlOptions)
 	if ob.Len() > 0 {
 		ob.WriteByte('\n')
 	}
+	if flags&LIST_TYPE_DEFINITION != 0 {
+		ob.WriteString("<dl>\n")
+		ob.Write(text)
+		ob.WriteString("</dl>\n")
+		return
+	}
 	if flags&LIST_TYPE_ORDERED != 0 {
-		ob.WriteString("<ol>\n")
+		ob.WriteString("<ol")
+		if flags&LIST_TYPE_EXAMPLE != 0 {
+			ob.WriteString(" class=\"" + options.class("example") + "\"")
+		}
+		switch {
+		case flags&LIST_TYPE_LOWER_ALPHA != 0:
+			ob.WriteString(" type=\"a\"")
+		case flags&LIST_TYPE_UPPER_ALPHA != 0:
+			ob.WriteString(" type=\"A\"")
+		case flags&LIST_TYPE_LOWER_ROMAN != 0:
+			ob.WriteString(" type=\"i\"")
+		case flags&LIST_TYPE_UPPER_ROMAN != 0:
+			ob.WriteString(" type=\"I\"")
+		}
+		if start != 1 {
+			ob.WriteString(" start=\"")
+			ob.WriteString(strconv.Itoa(start))
+			ob.WriteString("\"")
+		}
+		ob.WriteString(">\n")
 	} else {
 		ob.WriteString("<ul>\n")
 	}
@@ -350,13 +1339,151 @@ func htmlList(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
 }
 
 func htmlListitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
-	ob.WriteString("<li>")
+	options := opaque.(*htmlOptions)
+
+	// the terms and definitions of a definition list have their own tags
+	tag := "li"
+	if flags&LIST_TYPE_TERM != 0 {
+		tag = "dt"
+	} else if flags&LIST_TYPE_DEFINITION != 0 {
+		tag = "dd"
+	}
+
+	ob.WriteString("<" + tag)
+	htmlDir(ob, text, options)
+	ob.WriteByte('>')
 	size := len(text)
 	for size > 0 && text[size-1] == '\n' {
 		size--
 	}
+	if flags&LIST_ITEM_TASK != 0 {
+		// the box goes inside the first paragraph of a loose item
+		if bytes.HasPrefix(text, []byte("<p>")) {
+			ob.WriteString("<p>")
+			text, size = text[3:], size-3
+		}
+		htmlTaskBox(ob, flags, options)
+	}
 	ob.Write(text[:size])
-	ob.WriteString("</li>\n")
+	ob.WriteString("</" + tag + ">\n")
+}
+
+// the disabled checkbox of a task list item, followed by a space
+func htmlTaskBox(ob *bytes.Buffer, flags int, options *htmlOptions) {
+	ob.WriteString("<input ")
+	if flags&LIST_ITEM_CHECKED != 0 {
+		ob.WriteString("checked=\"\" ")
+	}
+	ob.WriteString("disabled=\"\" type=\"checkbox\"")
+	if options.flags&HTML_USE_XHTML != 0 {
+		ob.WriteString(" /")
+	}
+	ob.WriteString("> ")
+}
+
+// keep the attributes of the next header, code block, or div until its
+// callback takes them
+func htmlAttributes(attrs *Attributes, opaque interface{}) {
+	opaque.(*htmlOptions).attrs = attrs
+}
+
+func (options *htmlOptions) takeAttributes() *Attributes {
+	attrs := options.attrs
+	options.attrs = nil
+	return attrs
+}
+
+// write the id of a block and the classes and other attributes the
+// document gave it; the others are left out under HTML_SKIP_HTML or with
+// a policy, as they could carry scripts
+func htmlAttrs(ob *bytes.Buffer, id string, attrs *Attributes, options *htmlOptions) {
+	if id == "" && attrs != nil {
+		id = attrs.Id
+	}
+	if id != "" {
+		ob.WriteString(" id=\"")
+		attrEscape(ob, []byte(id))
+		ob.WriteByte('"')
+	}
+	if attrs == nil {
+		return
+	}
+	if len(attrs.Classes) > 0 {
+		ob.WriteString(" class=\"")
+		for i, class := range attrs.Classes {
+			if i > 0 {
+				ob.WriteByte(' ')
+			}
+			attrEscape(ob, []byte(class))
+		}
+		ob.WriteByte('"')
+	}
+	if options.flags&HTML_SKIP_HTML != 0 || options.policy != nil {
+		return
+	}
+	for _, pair := range attrs.Pairs {
+		ob.WriteByte(' ')
+		attrEscape(ob, []byte(pair[0]))
+		ob.WriteString("=\"")
+		attrEscape(ob, []byte(pair[1]))
+		ob.WriteByte('"')
+	}
+}
+
+// Under HTML_DETECT_DIRECTION, mark a block whose text starts out in a
+// right-to-left script such as Arabic or Hebrew with dir="rtl".
+func htmlDir(ob *bytes.Buffer, text []byte, options *htmlOptions) {
+	if options.flags&HTML_DETECT_DIRECTION != 0 && isRtlText(text) {
+		ob.WriteString(" dir=\"rtl\"")
+	}
+}
+
+// Test if the first letter of rendered HTML, outside its tags and
+// entities, is in a right-to-left script.
+func isRtlText(text []byte) bool {
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == '<':
+			if end, _, _ := htmlTagInfo(text[i:]); end > 0 {
+				i += end
+				continue
+			}
+		case c == '&':
+			end := i + 1
+			for end < len(text) && (isalnum(text[end]) || text[end] == '#') {
+				end++
+			}
+			if end < len(text) && text[end] == ';' {
+				i = end + 1
+				continue
+			}
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			return false
+		case c >= 0x80:
+			r, size := utf8.DecodeRune(text[i:])
+			if isRtl(int(r)) {
+				return true
+			}
+
+			// other letters are left-to-right, but not punctuation and symbols
+			if r >= 0xC0 && !(r >= 0x2000 && r <= 0x2BFF) {
+				return false
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return false
+}
+
+// test if a code point is in a right-to-left script
+func isRtl(c int) bool {
+	return (c >= 0x0590 && c <= 0x08FF) || // Hebrew, Arabic, Syriac, Thaana, N'Ko...
+		(c >= 0xFB1D && c <= 0xFDFF) || // Hebrew and Arabic presentation forms
+		(c >= 0xFE70 && c <= 0xFEFF) ||
+		(c >= 0x10800 && c <= 0x10FFF) ||
+		(c >= 0x1E800 && c <= 0x1EFFF)
 }
 
 func htmlParagraph(ob *bytes.Buffer, text []byte, opaque interface{}) {
@@ -379,7 +1506,22 @@ func htmlParagraph(ob *bytes.Buffer, text []byte, opaque interface{}) {
 		return
 	}
 
-	ob.WriteString("<p>")
+	// a figure on its own is a block already
+	if options.flags&HTML_FIGURES != 0 && bytes.HasPrefix(text[i:], []byte("<figure>")) {
+		end := len(text)
+		for end > i && isspace(text[end-1]) {
+			end--
+		}
+		if bytes.HasSuffix(text[i:end], []byte("</figure>")) && bytes.Count(text[i:end], []byte("<figure>")) == 1 {
+			ob.Write(text[i:end])
+			ob.WriteByte('\n')
+			return
+		}
+	}
+
+	ob.WriteString("<p")
+	htmlDir(ob, text[i:], options)
+	ob.WriteByte('>')
 	if options.flags&HTML_HARD_WRAP != 0 {
 		for i < len(text) {
 			org := i
@@ -414,13 +1556,43 @@ func htmlAutolink(ob *bytes.Buffer, link []byte, kind int, opaque interface{}) i
 	if options.flags&HTML_SAFELINK != 0 && !isSafeLink(link) && kind != LINK_TYPE_EMAIL {
 		return 0
 	}
+	if kind == LINK_TYPE_EMAIL && options.schemes != nil && !options.schemes["mailto"] {
+		return 0
+	}
+	if kind != LINK_TYPE_EMAIL && !options.allowLink(link) {
+		return 0
+	}
+	email := kind == LINK_TYPE_EMAIL || bytes.HasPrefix(link, []byte("mailto:"))
+	write := attrEscape
+	if email && options.flags&HTML_OBFUSCATE_EMAILS != 0 {
+		write = obfuscateEscape
+	}
+	if options.flags&HTML_SKIP_LINKS != 0 {
+		write(ob, link)
+		return 1
+	}
 
-	ob.WriteString("<a href=\"")
+	href := link
 	if kind == LINK_TYPE_EMAIL {
-		ob.WriteString("mailto:")
+		href = append([]byte("mailto:"), link...)
 	}
-	ob.Write(link)
-	ob.WriteString("\">")
+	rel, target := "", ""
+	if kind != LINK_TYPE_EMAIL || options.linkPolicy != nil {
+		var ok bool
+		if rel, target, ok = options.linkAttrs(href); !ok {
+			return 0
+		}
+	}
+
+	ob.WriteString("<a href=\"")
+	if email && options.flags&HTML_OBFUSCATE_EMAILS != 0 {
+		obfuscateEscape(ob, href)
+	} else {
+		ob.Write(href)
+	}
+	ob.WriteByte('"')
+	htmlLinkAttrs(ob, rel, target)
+	ob.WriteByte('>')
 
 	/*
 	 * Pretty print: if we get an email address as
@@ -428,9 +1600,9 @@ func htmlAutolink(ob *bytes.Buffer, link []byte, kind int, opaque interface{}) i
 	 * want to print the `mailto:` prefix
 	 */
 	if bytes.HasPrefix(link, []byte("mailto:")) {
-		attrEscape(ob, link[7:])
+		write(ob, link[7:])
 	} else {
-		attrEscape(ob, link)
+		write(ob, link)
 	}
 
 	ob.WriteString("</a>")
@@ -438,6 +1610,21 @@ func htmlAutolink(ob *bytes.Buffer, link []byte, kind int, opaque interface{}) i
 	return 1
 }
 
+// Write text as character references, alternating decimal and hex, so
+// addresses in the page are harder for simple scrapers to pick out.
+func obfuscateEscape(ob *bytes.Buffer, src []byte) {
+	for i, c := range src {
+		switch {
+		case c >= 0x80:
+			ob.WriteByte(c)
+		case i%2 == 0:
+			ob.WriteString(fmt.Sprintf("&#%d;", c))
+		default:
+			ob.WriteString(fmt.Sprintf("&#x%x;", c))
+		}
+	}
+}
+
 func htmlCodespan(ob *bytes.Buffer, text []byte, opaque interface{}) int {
 	ob.WriteString("<code>")
 	attrEscape(ob, text)
@@ -446,30 +1633,51 @@ func htmlCodespan(ob *bytes.Buffer, text []byte, opaque interface{}) int {
 }
 
 func htmlDoubleEmphasis(ob *bytes.Buffer, text []byte, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+
 	if len(text) == 0 {
 		return 0
 	}
-	ob.WriteString("<strong>")
+	ob.WriteString("<" + options.strongTag + ">")
 	ob.Write(text)
-	ob.WriteString("</strong>")
+	ob.WriteString("</" + options.strongTag + ">")
 	return 1
 }
 
 func htmlEmphasis(ob *bytes.Buffer, text []byte, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+
 	if len(text) == 0 {
 		return 0
 	}
-	ob.WriteString("<em>")
+	ob.WriteString("<" + options.emTag + ">")
 	ob.Write(text)
-	ob.WriteString("</em>")
+	ob.WriteString("</" + options.emTag + ">")
 	return 1
 }
 
 func htmlImage(ob *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) int {
 	options := opaque.(*htmlOptions)
-	if len(link) == 0 {
+	if len(link) == 0 || !options.allowLink(link) {
 		return 0
 	}
+	link = options.absoluteLink(link)
+
+	// a title becomes the caption of a figure
+	if options.flags&HTML_FIGURES != 0 && len(title) > 0 {
+		ob.WriteString("<figure><img src=\"")
+		attrEscape(ob, link)
+		ob.WriteString("\" alt=\"")
+		attrEscape(ob, alt)
+		ob.WriteByte('"')
+		htmlImageAttrs(ob, link, options)
+		ob.WriteString(strings.TrimRight(options.close_tag, "\n"))
+		ob.WriteString("<figcaption>")
+		attrEscape(ob, title)
+		ob.WriteString("</figcaption></figure>")
+		return 1
+	}
+
 	ob.WriteString("<img src=\"")
 	attrEscape(ob, link)
 	ob.WriteString("\" alt=\"")
@@ -482,10 +1690,70 @@ func htmlImage(ob *bytes.Buffer, link []byte, title []byte, alt []byte, opaque i
 	}
 
 	ob.WriteByte('"')
+	htmlImageAttrs(ob, link, options)
 	ob.WriteString(options.close_tag)
 	return 1
 }
 
+func htmlMediaEmbed(ob *bytes.Buffer, link []byte, title []byte, alt []byte, kind int, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+	if len(link) == 0 || !options.allowLink(link) {
+		return 0
+	}
+	link = options.absoluteLink(link)
+
+	// boolean attributes need a value in xhtml
+	controls, fullscreen := " controls", " allowfullscreen"
+	if options.flags&HTML_USE_XHTML != 0 {
+		controls, fullscreen = " controls=\"controls\"", " allowfullscreen=\"allowfullscreen\""
+	}
+
+	tag := "video"
+	switch kind {
+	case MEDIA_TYPE_YOUTUBE, MEDIA_TYPE_VIMEO:
+		_, id := mediaType(link)
+		if kind == MEDIA_TYPE_YOUTUBE {
+			ob.WriteString("<iframe src=\"https://www.youtube.com/embed/")
+		} else {
+			ob.WriteString("<iframe src=\"https://player.vimeo.com/video/")
+		}
+		attrEscape(ob, id)
+		if len(title) == 0 {
+			title = alt
+		}
+		if len(title) > 0 {
+			ob.WriteString("\" title=\"")
+			attrEscape(ob, title)
+		}
+		ob.WriteString("\" frameborder=\"0\"")
+		ob.WriteString(fullscreen)
+		ob.WriteString("></iframe>")
+		return 1
+	case MEDIA_TYPE_AUDIO:
+		tag = "audio"
+	}
+
+	ob.WriteString("<" + tag + " src=\"")
+	attrEscape(ob, link)
+	if len(title) > 0 {
+		ob.WriteString("\" title=\"")
+		attrEscape(ob, title)
+	}
+	ob.WriteByte('"')
+	ob.WriteString(controls)
+	ob.WriteByte('>')
+	if len(alt) > 0 {
+		attrEscape(ob, alt)
+	}
+	ob.WriteString("</" + tag + ">")
+	return 1
+}
+
+func htmlImageAlt(ob *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) int {
+	attrEscape(ob, alt)
+	return 1
+}
+
 func htmlLinebreak(ob *bytes.Buffer, opaque interface{}) int {
 	options := opaque.(*htmlOptions)
 	ob.WriteString("<br")
@@ -493,12 +1761,25 @@ func htmlLinebreak(ob *bytes.Buffer, opaque interface{}) int {
 	return 1
 }
 
+func htmlLinebreakMarkdownPl(ob *bytes.Buffer, opaque interface{}) int {
+	ob.WriteByte(' ')
+	return htmlLinebreak(ob, opaque)
+}
+
 func htmlLink(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int {
 	options := opaque.(*htmlOptions)
 
 	if options.flags&HTML_SAFELINK != 0 && !isSafeLink(link) {
 		return 0
 	}
+	if !options.allowLink(link) {
+		return 0
+	}
+	link = options.absoluteLink(link)
+	rel, target, ok := options.linkAttrs(link)
+	if !ok {
+		return 0
+	}
 
 	ob.WriteString("<a href=\"")
 	if len(link) > 0 {
@@ -508,7 +1789,9 @@ func htmlLink(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaqu
 		ob.WriteString("\" title=\"")
 		attrEscape(ob, title)
 	}
-	ob.WriteString("\">")
+	ob.WriteByte('"')
+	htmlLinkAttrs(ob, rel, target)
+	ob.WriteByte('>')
 	if len(content) > 0 {
 		ob.Write(content)
 	}
@@ -516,6 +1799,11 @@ func htmlLink(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaqu
 	return 1
 }
 
+func htmlLinkText(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int {
+	ob.Write(content)
+	return 1
+}
+
 func htmlRawTag(ob *bytes.Buffer, text []byte, opaque interface{}) int {
 	options := opaque.(*htmlOptions)
 	if options.flags&HTML_SKIP_HTML != 0 {
@@ -530,34 +1818,602 @@ func htmlRawTag(ob *bytes.Buffer, text []byte, opaque interface{}) int {
 	if options.flags&HTML_SKIP_IMAGES != 0 && isHtmlTag(text, "img") {
 		return 1
 	}
+	if options.flags&HTML_ESCAPE_HTML != 0 {
+		attrEscape(ob, text)
+		return 1
+	}
+	if options.policy != nil {
+		options.policy.sanitize(ob, text)
+		return 1
+	}
+	if options.flags&HTML_TAGFILTER != 0 {
+		htmlTagFilter(ob, text)
+		return 1
+	}
+	ob.Write(text)
+	return 1
+}
+
+// the tags that GitHub Flavored Markdown will not pass on as raw HTML
+var filteredTags = []string{"title", "textarea", "style", "xmp", "iframe", "noembed", "noframes", "script", "plaintext"}
+
+// Under HTML_TAGFILTER, write raw HTML with the < of each opening or
+// closing filtered tag escaped, so the tag shows as text, as GitHub does.
+func htmlTagFilter(ob *bytes.Buffer, text []byte) {
+	for {
+		i := bytes.IndexByte(text, '<')
+		if i < 0 {
+			ob.Write(text)
+			return
+		}
+		ob.Write(text[:i])
+		text = text[i:]
+
+		name := 1
+		if name < len(text) && text[name] == '/' {
+			name++
+		}
+		filtered := false
+		for _, tag := range filteredTags {
+			if n := hasPrefixFold(text[name:], tag); n > 0 {
+				end := name + n
+				if end == len(text) || isspace(text[end]) || text[end] == '>' || text[end] == '/' {
+					filtered = true
+					break
+				}
+			}
+		}
+		if filtered {
+			ob.WriteString("&lt;")
+		} else {
+			ob.WriteByte('<')
+		}
+		text = text[1:]
+	}
+}
+
+func htmlShortcode(ob *bytes.Buffer, text []byte, opaque interface{}) int {
 	ob.Write(text)
 	return 1
 }
 
+// the id of a footnote, "fn:1", or of a citation, "cn:1", with the header
+// id affixes so several documents can share a page
+func htmlNoteId(number int, flags int, options *htmlOptions) string {
+	kind := options.footnote.noteId
+	if flags&FOOTNOTE_CITATION != 0 {
+		kind = "cn:"
+	}
+	return options.idPrefix + kind + strconv.Itoa(number) + options.idSuffix
+}
+
+// a footnote reference as a superscript number, or a citation as its
+// number in brackets after the locator, if any
+func htmlFootnoteRef(ob *bytes.Buffer, name []byte, number int, locator []byte, flags int, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+	id := htmlNoteId(number, flags, options)
+	if flags&FOOTNOTE_CITATION != 0 {
+		ob.WriteString("<a href=\"#" + id + "\" title=\"see citation\" class=\"" + options.class("citation") + "\">[")
+		if len(locator) > 0 {
+			ob.Write(locator)
+			ob.WriteString(", ")
+		}
+		ob.WriteString(strconv.Itoa(number) + "]</a>")
+		return 1
+	}
+	ob.WriteString("<a href=\"#" + id + "\" id=\"" + options.idPrefix + options.footnote.refId + strconv.Itoa(number) + options.idSuffix)
+	ob.WriteString("\" title=\"see footnote\" class=\"" + options.class(options.footnote.refClass) + "\"><sup>" + strconv.Itoa(number) + "</sup></a>")
+	return 1
+}
+
+// the notes after a rule, in a numbered list
+func htmlFootnotes(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	class := "footnotes"
+	if flags&FOOTNOTE_CITATION != 0 {
+		class = "citations"
+	}
+	if ob.Len() > 0 {
+		ob.WriteByte('\n')
+	}
+	ob.WriteString("<div class=\"" + options.class(class) + "\">\n<hr" + options.close_tag + "<ol>\n")
+	ob.Write(text)
+	ob.WriteString("</ol>\n</div>\n")
+}
+
+// a note, with a link back to the first reference to a footnote at the
+// end of its last paragraph, unless HTML_NO_FOOTNOTE_RETURNS is set
+func htmlFootnoteItem(ob *bytes.Buffer, name []byte, text []byte, number int, flags int, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	ob.WriteString("<li id=\"" + htmlNoteId(number, flags, options) + "\">\n")
+	for len(text) > 0 && text[len(text)-1] == '\n' {
+		text = text[:len(text)-1]
+	}
+	closing := ""
+	if bytes.HasSuffix(text, []byte("</p>")) {
+		text, closing = text[:len(text)-4], "</p>"
+	}
+	ob.Write(text)
+	if flags&FOOTNOTE_CITATION == 0 && options.flags&HTML_NO_FOOTNOTE_RETURNS == 0 {
+		ob.WriteString(" <a href=\"#" + options.idPrefix + options.footnote.refId + strconv.Itoa(number) + options.idSuffix)
+		if options.footnote.backTitle != "" {
+			ob.WriteString("\" title=\"")
+			attrEscape(ob, []byte(options.footnote.backTitle))
+		}
+		ob.WriteString("\" class=\"" + options.class(options.footnote.backClass) + "\">" + options.footnote.back + "</a>")
+	}
+	ob.WriteString(closing + "\n</li>\n")
+}
+
 func htmlTripleEmphasis(ob *bytes.Buffer, text []byte, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+
 	if len(text) == 0 {
 		return 0
 	}
-	ob.WriteString("<strong><em>")
+	ob.WriteString("<" + options.strongTag + "><" + options.emTag + ">")
 	ob.Write(text)
-	ob.WriteString("</em></strong>")
+	ob.WriteString("</" + options.emTag + "></" + options.strongTag + ">")
 	return 1
 }
 
 func htmlStrikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) int {
+	options := opaque.(*htmlOptions)
+
 	if len(text) == 0 {
 		return 0
 	}
-	ob.WriteString("<del>")
+
+	// <del> marks removed text, <s> text that is no longer accurate
+	tag := "del"
+	if options.flags&HTML_STRIKETHROUGH_S != 0 {
+		tag = "s"
+	}
+	ob.WriteString("<" + tag + ">")
+	ob.Write(text)
+	ob.WriteString("</" + tag + ">")
+	return 1
+}
+
+func htmlKbd(ob *bytes.Buffer, key []byte, opaque interface{}) int {
+	ob.WriteString("<kbd>")
+	attrEscape(ob, key)
+	ob.WriteString("</kbd>")
+	return 1
+}
+
+func htmlRuby(ob *bytes.Buffer, base []byte, text []byte, opaque interface{}) int {
+	if len(base) == 0 || len(text) == 0 {
+		return 0
+	}
+	ob.WriteString("<ruby>")
+	ob.Write(base)
+	ob.WriteString("<rp>(</rp><rt>")
 	ob.Write(text)
-	ob.WriteString("</del>")
+	ob.WriteString("</rt><rp>)</rp></ruby>")
 	return 1
 }
 
+// write an entity as the character it stands for, escaped where needed
+func htmlEntity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	if text := decodeEntity(entity); text != nil {
+		attrEscape(ob, text)
+	} else {
+		ob.Write(entity)
+	}
+}
+
 func htmlNormalText(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	if options.flags&HTML_SYMBOL_REPLACEMENTS != 0 {
+		escaped := bytes.NewBuffer(nil)
+		attrEscape(escaped, text)
+		symbolReplacements(ob, escaped.Bytes())
+		return
+	}
 	attrEscape(ob, text)
 }
 
+// start a complete page, up to the <body>
+func htmlDocumentHeader(ob *bytes.Buffer, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+	xhtml := options.flags&HTML_USE_XHTML != 0
+
+	if xhtml {
+		ob.WriteString("<!DOCTYPE html PUBLIC \"-//W3C//DTD XHTML 1.0 Transitional//EN\" ")
+		ob.WriteString("\"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd\">\n")
+		ob.WriteString("<html xmlns=\"http://www.w3.org/1999/xhtml\"")
+	} else {
+		ob.WriteString("<!DOCTYPE html>\n<html")
+	}
+	if options.page.lang != "" {
+		ob.WriteString(" lang=\"")
+		attrEscape(ob, []byte(options.page.lang))
+		ob.WriteByte('"')
+	}
+	if options.page.dir != "" {
+		ob.WriteString(" dir=\"")
+		attrEscape(ob, []byte(options.page.dir))
+		ob.WriteByte('"')
+	}
+	ob.WriteString(">\n")
+	ob.WriteString("<head>\n")
+
+	ob.WriteString("  <title>")
+	attrEscape(ob, []byte(options.page.title))
+	ob.WriteString("</title>\n")
+
+	if options.page.charset != "" {
+		if xhtml {
+			ob.WriteString("  <meta http-equiv=\"Content-Type\" content=\"text/html; charset=")
+		} else {
+			ob.WriteString("  <meta charset=\"")
+		}
+		attrEscape(ob, []byte(options.page.charset))
+		ob.WriteByte('"')
+		ob.WriteString(options.close_tag)
+	}
+	for _, meta := range options.page.meta {
+		ob.WriteString("  <meta name=\"")
+		attrEscape(ob, []byte(meta[0]))
+		ob.WriteString("\" content=\"")
+		attrEscape(ob, []byte(meta[1]))
+		ob.WriteByte('"')
+		ob.WriteString(options.close_tag)
+	}
+	for _, css := range options.page.css {
+		ob.WriteString("  <link rel=\"stylesheet\" type=\"text/css\" href=\"")
+		attrEscape(ob, []byte(css))
+		ob.WriteByte('"')
+		ob.WriteString(options.close_tag)
+	}
+
+	ob.WriteString("</head>\n<body>\n")
+}
+
+// finish a complete page, and lay out the whole document for reading
+// or squeeze it down for sending
+func htmlDocumentFooter(ob *bytes.Buffer, opaque interface{}) {
+	options := opaque.(*htmlOptions)
+
+	if options.flags&HTML_COMPLETE_PAGE != 0 {
+		ob.WriteString("\n</body>\n</html>\n")
+	}
+	if options.flags&HTML_EMAIL != 0 {
+		styled := htmlApplyAttributeHook(ob.Bytes(), options.emailAttrs)
+		ob.Reset()
+		ob.Write(styled)
+	}
+	if options.attrHook != nil {
+		hooked := htmlApplyAttributeHook(ob.Bytes(), options.attrHook)
+		ob.Reset()
+		ob.Write(hooked)
+	}
+
+	var layout []byte
+	switch {
+	case options.flags&HTML_PRETTY_PRINT != 0:
+		layout = htmlPrettyPrint(ob.Bytes())
+	case options.flags&HTML_MINIFY != 0:
+		layout = htmlMinify(ob.Bytes())
+	default:
+		return
+	}
+	ob.Reset()
+	ob.Write(layout)
+}
+
+// whether the footer rewrites the whole page, which then cannot be
+// written out a block at a time
+func htmlWholeOutput(opaque interface{}) bool {
+	options := opaque.(*htmlOptions)
+	return options.flags&(HTML_EMAIL|HTML_PRETTY_PRINT|HTML_MINIFY) != 0 || options.attrHook != nil
+}
+
+// rewrite every start tag with the attributes given by the hook
+func htmlApplyAttributeHook(data []byte, hook AttributeHook) []byte {
+	out := bytes.NewBuffer(nil)
+	mark := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		end, name, closing := htmlTagInfo(data[i:])
+		if end == 0 || closing || name[0] == '!' {
+			continue
+		}
+		tag := data[i : i+end]
+		out.Write(data[mark:i])
+
+		attrs := htmlTagAttrs(tag, name)
+		for j := range attrs {
+			attrs[j][1] = string(htmlUnescape([]byte(attrs[j][1])))
+		}
+		out.WriteString("<" + name)
+		for _, attr := range hook(name, attrs) {
+			out.WriteString(" " + attr[0] + "=\"")
+			attrEscape(out, []byte(attr[1]))
+			out.WriteByte('"')
+		}
+		if len(tag) > 1 && tag[len(tag)-2] == '/' {
+			out.WriteString(" /")
+		}
+		out.WriteByte('>')
+
+		i += end - 1
+		mark = i + 1
+
+		// script and style contents are not markup
+		if name == "script" || name == "style" {
+			for i+1 < len(data) {
+				if n, endName, endClosing := htmlTagInfo(data[i+1:]); n > 0 && endClosing && endName == name {
+					break
+				}
+				i++
+			}
+		}
+	}
+	out.Write(data[mark:])
+	return out.Bytes()
+}
+
+// the inline styles of each element under HTML_EMAIL
+var emailStyles = map[string]string{
+	"a":          "color:#0366d6;text-decoration:underline",
+	"blockquote": "margin:0 0 16px;padding:0 16px;border-left:4px solid #dddddd;color:#555555",
+	"code":       "font-family:Menlo,Consolas,monospace;font-size:90%",
+	"h1":         "margin:24px 0 16px;font-size:28px;line-height:1.25",
+	"h2":         "margin:24px 0 16px;font-size:24px;line-height:1.25",
+	"h3":         "margin:24px 0 16px;font-size:20px;line-height:1.25",
+	"h4":         "margin:24px 0 16px;font-size:16px;line-height:1.25",
+	"h5":         "margin:24px 0 16px;font-size:14px;line-height:1.25",
+	"h6":         "margin:24px 0 16px;font-size:13px;line-height:1.25",
+	"hr":         "border:0;border-top:1px solid #dddddd;margin:24px 0",
+	"img":        "border:0;max-width:100%;height:auto",
+	"li":         "margin:0 0 4px",
+	"ol":         "margin:0 0 16px;padding-left:32px",
+	"p":          "margin:0 0 16px;line-height:1.5",
+	"pre":        "margin:0 0 16px;padding:12px;background:#f6f8fa;white-space:pre-wrap",
+	"table":      "border-collapse:collapse;margin:0 0 16px",
+	"td":         "border:1px solid #dddddd;padding:6px 12px",
+	"th":         "border:1px solid #dddddd;padding:6px 12px",
+	"ul":         "margin:0 0 16px;padding-left:32px",
+}
+
+// Set the inline style written on an element under HTML_EMAIL, in place
+// of the default; an empty style leaves the element unstyled.
+func (r *Renderer) SetEmailStyle(tag string, style string) {
+	options, ok := r.opaque.(*htmlOptions)
+	if !ok {
+		return
+	}
+	if options.emailStyles == nil {
+		options.emailStyles = make(map[string]string)
+		for t, s := range emailStyles {
+			options.emailStyles[t] = s
+		}
+	}
+	options.emailStyles[tag] = style
+}
+
+// Give images a width attribute under HTML_EMAIL, for the clients
+// that ignore max-width in styles.
+func (r *Renderer) SetEmailImageWidth(width int) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.emailWidth = width
+	}
+}
+
+// swap the classes of an element for inline styles, as email clients
+// drop the style sheets the classes would need
+func (options *htmlOptions) emailAttrs(tag string, attrs [][2]string) [][2]string {
+	styles := options.emailStyles
+	if styles == nil {
+		styles = emailStyles
+	}
+
+	style := styles[tag]
+	hasWidth := false
+	kept := attrs[:0]
+	for _, attr := range attrs {
+		switch attr[0] {
+		case "class":
+			continue
+		case "style":
+			// styles already on the element win
+			if style != "" {
+				style += ";"
+			}
+			style += attr[1]
+			continue
+		case "width":
+			hasWidth = true
+		}
+		kept = append(kept, attr)
+	}
+
+	if tag == "img" && !hasWidth && options.emailWidth > 0 {
+		kept = append(kept, [2]string{"width", strconv.Itoa(options.emailWidth)})
+	}
+	if style != "" {
+		kept = append(kept, [2]string{"style", style})
+	}
+	return kept
+}
+
+// block-level elements, which go on lines of their own
+var prettyBlockTags = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"blockquote": true,
+	"body":       true,
+	"caption":    true,
+	"dd":         true,
+	"details":    true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"head":       true,
+	"header":     true,
+	"html":       true,
+	"li":         true,
+	"nav":        true,
+	"ol":         true,
+	"p":          true,
+	"section":    true,
+	"summary":    true,
+	"table":      true,
+	"tbody":      true,
+	"td":         true,
+	"tfoot":      true,
+	"th":         true,
+	"thead":      true,
+	"title":      true,
+	"tr":         true,
+	"ul":         true,
+}
+
+// block-level elements without a closing tag
+var prettyVoidTags = map[string]bool{
+	"!doctype": true,
+	"hr":       true,
+	"link":     true,
+	"meta":     true,
+}
+
+// elements whose contents are copied exactly, whitespace and all
+var prettyVerbatimTags = map[string]bool{
+	"pre":    true,
+	"script": true,
+	"style":  true,
+}
+
+// test if a tag name is laid out as a block
+func isPrettyBlockTag(name string) bool {
+	return prettyBlockTags[name] || prettyVoidTags[name] || prettyVerbatimTags[name]
+}
+
+// Put each block-level element of generated HTML on its own line,
+// indented by its nesting, leaving text and inline elements alone.
+func htmlPrettyPrint(data []byte) []byte {
+	out := bytes.NewBuffer(nil)
+	depth := 0
+	lineOpen := false  // the current line has something on it
+	afterBlock := true // the last thing written was a block tag
+	afterClose := true // the last thing written ended a block
+
+	indent := func() {
+		if lineOpen {
+			out.WriteByte('\n')
+		}
+		out.WriteString(strings.Repeat("  ", depth))
+		lineOpen = true
+	}
+
+	i := 0
+	for i < len(data) {
+		// text and inline elements up to the next block tag
+		end, name, closing := htmlTagInfo(data[i:])
+		if end == 0 || !isPrettyBlockTag(name) {
+			j := i
+			if end > 0 {
+				j += end
+			}
+			for j < len(data) {
+				if data[j] == '<' {
+					if n, tag, _ := htmlTagInfo(data[j:]); n > 0 {
+						if isPrettyBlockTag(tag) {
+							break
+						}
+						j += n
+						continue
+					}
+				}
+				j++
+			}
+
+			// whitespace between blocks is replaced by the layout
+			text := data[i:j]
+			if afterBlock {
+				text = bytes.TrimLeft(text, " \t\n")
+			}
+			if j < len(data) {
+				text = bytes.TrimRight(text, " \t\n")
+			}
+			if len(text) > 0 {
+				if !lineOpen {
+					indent()
+				}
+				out.Write(text)
+				afterBlock, afterClose = false, false
+			}
+			i = j
+			continue
+		}
+
+		tag := data[i : i+end]
+		switch {
+		case prettyVerbatimTags[name] && !closing:
+			// copy everything up to the matching end tag
+			j := i + end
+			for j < len(data) {
+				if n, endName, endClosing := htmlTagInfo(data[j:]); n > 0 && endClosing && endName == name {
+					j += n
+					break
+				}
+				j++
+			}
+			indent()
+			out.Write(data[i:j])
+			end = j - i
+			afterClose = true
+
+		case prettyVoidTags[name] || prettyVerbatimTags[name]:
+			indent()
+			out.Write(tag)
+			afterClose = true
+
+		case closing:
+			if depth > 0 {
+				depth--
+			}
+			if afterClose || !lineOpen {
+				indent()
+			}
+			out.Write(tag)
+			afterClose = true
+
+		default:
+			indent()
+			out.Write(tag)
+			depth++
+			afterClose = false
+		}
+		if afterClose {
+			out.WriteByte('\n')
+			lineOpen = false
+		}
+		afterBlock = true
+		i += end
+	}
+
+	if lineOpen {
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
 func htmlTocHeader(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
 	options := opaque.(*htmlOptions)
 	for level > options.toc_data.current_level {
@@ -576,10 +2432,14 @@ func htmlTocHeader(ob *bytes.Buffer, text []byte, level int, opaque interface{})
 		options.toc_data.current_level--
 	}
 
-	ob.WriteString("<li><a href=\"#toc_")
-	ob.WriteString(strconv.Itoa(options.toc_data.header_count))
+	id := options.nextHeaderId(text)
+	if attrs := options.takeAttributes(); attrs != nil && attrs.Id != "" {
+		id = attrs.Id
+	}
+	ob.WriteString("<li><a href=\"#")
+	attrEscape(ob, []byte(id))
 	ob.WriteString("\">")
-	options.toc_data.header_count++
+	htmlSectionNumber(ob, level, options)
 
 	if len(text) > 0 {
 		ob.Write(text)
@@ -587,6 +2447,11 @@ func htmlTocHeader(ob *bytes.Buffer, text []byte, level int, opaque interface{})
 	ob.WriteString("</a></li>\n")
 }
 
+func htmlTocLink(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int {
+	ob.Write(content)
+	return 1
+}
+
 func htmlTocFinalize(ob *bytes.Buffer, opaque interface{}) {
 	options := opaque.(*htmlOptions)
 	for options.toc_data.current_level > 1 {
@@ -617,7 +2482,7 @@ func isHtmlTag(tag []byte, tagname string) bool {
 		i++
 	}
 
-	tag_i := i
+	tag_i := 0
 	for ; i < len(tag); i, tag_i = i+1, tag_i+1 {
 		if tag_i >= len(tagname) {
 			break
@@ -634,3 +2499,127 @@ func isHtmlTag(tag []byte, tagname string) bool {
 
 	return isspace(tag[i]) || tag[i] == '>'
 }
+
+// start tags that end an open paragraph
+var minifyParagraphEnds = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"details": true, "div": true, "dl": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "ul": true,
+}
+
+// elements that a paragraph can end with, leaving out its </p>
+var minifyParagraphParents = map[string]bool{
+	"article": true, "aside": true, "blockquote": true, "body": true,
+	"dd": true, "details": true, "div": true, "figure": true, "footer": true,
+	"header": true, "li": true, "section": true, "td": true, "th": true,
+}
+
+// Test if the HTML spec lets an end tag be left out when the tag
+// that follows it has the given name.
+func minifyOptionalEnd(name string, next string, nextClosing bool) bool {
+	switch name {
+	case "p":
+		if nextClosing {
+			return minifyParagraphParents[next]
+		}
+		return minifyParagraphEnds[next]
+	case "li":
+		return next == "li" && !nextClosing || nextClosing && (next == "ul" || next == "ol")
+	case "dt":
+		return !nextClosing && (next == "dt" || next == "dd")
+	case "dd":
+		return !nextClosing && (next == "dt" || next == "dd") || nextClosing && next == "dl"
+	case "td", "th":
+		return !nextClosing && (next == "td" || next == "th") || nextClosing && next == "tr"
+	case "tr":
+		return !nextClosing && next == "tr" || nextClosing && (next == "thead" || next == "tbody" || next == "tfoot" || next == "table")
+	case "thead":
+		return !nextClosing && next == "tbody"
+	case "tbody":
+		return nextClosing && next == "table"
+	}
+	return false
+}
+
+// Shrink generated HTML: drop the whitespace around block-level
+// elements, collapse other runs of whitespace, and leave out end tags
+// the browser can infer. Preformatted text and the contents of a
+// <textarea> are copied exactly.
+func htmlMinify(data []byte) []byte {
+	out := bytes.NewBuffer(nil)
+	afterBlock := true // the last thing written was a block tag
+
+	i := 0
+	for i < len(data) {
+		end, name, closing := htmlTagInfo(data[i:])
+
+		// text, with its whitespace collapsed
+		if end == 0 {
+			j := i + 1
+			for j < len(data) && data[j] != '<' {
+				j++
+			}
+			text := data[i:j]
+			if afterBlock {
+				text = bytes.TrimLeft(text, " \t\n")
+			}
+			if _, next, _ := htmlTagInfo(data[j:]); j >= len(data) || isPrettyBlockTag(next) {
+				text = bytes.TrimRight(text, " \t\n")
+			}
+			for k := 0; k < len(text); k++ {
+				if !isspace(text[k]) {
+					out.WriteByte(text[k])
+					continue
+				}
+				for k+1 < len(text) && isspace(text[k+1]) {
+					k++
+				}
+				out.WriteByte(' ')
+			}
+			if len(text) > 0 {
+				afterBlock = false
+			}
+			i = j
+			continue
+		}
+
+		// copy preformatted elements up to the matching end tag, and
+		// textareas, which keep their whitespace but are not blocks
+		if (prettyVerbatimTags[name] || name == "textarea") && !closing {
+			j := i + end
+			for j < len(data) {
+				if n, endName, endClosing := htmlTagInfo(data[j:]); n > 0 && endClosing && endName == name {
+					j += n
+					break
+				}
+				j++
+			}
+			out.Write(data[i:j])
+			afterBlock = prettyVerbatimTags[name]
+			i = j
+			continue
+		}
+
+		// leave out end tags that the next tag implies
+		if closing {
+			j := i + end
+			for j < len(data) && isspace(data[j]) {
+				j++
+			}
+			if n, next, nextClosing := htmlTagInfo(data[j:]); n > 0 && minifyOptionalEnd(name, next, nextClosing) {
+				afterBlock = true
+				i = j
+				continue
+			}
+		}
+
+		out.Write(data[i : i+end])
+		afterBlock = isPrettyBlockTag(name)
+		i += end
+	}
+
+	return out.Bytes()
+}
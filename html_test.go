@@ -0,0 +1,62 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checks of the HTML renderer
+//
+//
+
+package blackfriday
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinkSchemesCharacterReferences(t *testing.T) {
+	r := HtmlRenderer(0)
+	r.SetLinkSchemes("http", "https")
+	for _, input := range []string{
+		"[x](javascript&#58;alert(1))",
+		"[x](javascript&colon;alert(1))",
+		"[x](&#106;avascript:alert(1))",
+		"[x](&#106avascript:alert(1))",
+		"[x](&#x6A;avascript:alert(1))",
+		"![x](javascript&#58;alert(1))",
+		"[x]\n\n[x]: javascript&#58;alert(1)\n",
+	} {
+		if output := string(Markdown([]byte(input), r, COMMON_EXTENSIONS)); strings.Contains(output, "href=") || strings.Contains(output, "src=") {
+			t.Errorf("%q: a link got through: %q", input, output)
+		}
+	}
+
+	// references after the scheme, or in a relative path, are fine
+	for _, input := range []string{"[x](http://example.com/?a=1&amp;b=2)", "[x](/a/b&amp;c)", "[x](?a&b)"} {
+		if output := string(Markdown([]byte(input), r, COMMON_EXTENSIONS)); !strings.Contains(output, "href=") {
+			t.Errorf("%q: the link was refused: %q", input, output)
+		}
+	}
+}
+
+func TestCommentRendererLinks(t *testing.T) {
+	for _, input := range []string{
+		"[x](javascript:alert(1))",
+		"[x](javascript&#58;alert(1))",
+		"[x](&#106;avascript:alert(1))",
+		"[x](data:text/html,x)",
+		"<javascript:alert(1)>",
+	} {
+		if output := string(MarkdownComment([]byte(input))); strings.Contains(output, "href=") {
+			t.Errorf("%q: a link got through: %q", input, output)
+		}
+	}
+
+	want := `<p><a href="mailto:a@b.c">x</a> <a href="https://example.com" rel="nofollow">y</a> <a href="/z">z</a></p>` + "\n"
+	if output := string(MarkdownComment([]byte("[x](mailto:a@b.c) [y](https://example.com) [z](/z)"))); output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
@@ -12,6 +12,8 @@ package blackfriday
 
 import (
 	"bytes"
+	"strconv"
+	"utf8"
 )
 
 // Functions to parse text within a block
@@ -20,20 +22,28 @@ import (
 // offset is the number of valid chars before the current cursor
 
 func parseInline(out *bytes.Buffer, rndr *render, data []byte) {
+	if rndr.blocksOnly {
+		out.Write(data)
+		return
+	}
 	if rndr.nesting >= rndr.maxNesting {
 		return
 	}
 	rndr.nesting++
+	emph := rndr.emph
+	rndr.emph = nil
+	delimBase := rndr.delimBase
+	rndr.delimBase = len(rndr.delims)
 
 	i, end := 0, 0
 	for i < len(data) {
 		// copy inactive chars into the output
-		for end < len(data) && rndr.inline[data[end]] == nil {
+		for end < len(data) && (rndr.inline[data[end]] == nil || rndr.commitRefs && !commitRefTrigger(rndr, data, end)) {
 			end++
 		}
 
 		if rndr.mk.normalText != nil {
-			rndr.mk.normalText(out, data[i:end], rndr.mk.opaque)
+			rndr.mk.normalText(out, data[i:end], rndr.opaque)
 		} else {
 			out.Write(data[i:end])
 		}
@@ -55,19 +65,45 @@ func parseInline(out *bytes.Buffer, rndr *render, data []byte) {
 		}
 	}
 
+	if len(rndr.delims) > rndr.delimBase {
+		inlineEmphasisCommonMark(out, rndr)
+		rndr.delims = rndr.delims[:rndr.delimBase]
+	}
+	rndr.delimBase = delimBase
+	rndr.emph = emph
 	rndr.nesting--
 }
 
 // single and double emphasis parsing
 func inlineEmphasis(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
-	data = data[offset:]
+	if rndr.emph == nil {
+		rndr.emph = newEmphIndex(rndr, data)
+	}
+	ret := inlineEmphasisSpan(out, rndr, data[offset:])
+
+	// an opening at the start of a word that is never closed
+	c := data[offset]
+	if ret == 0 && rndr.strict && (offset == 0 || !isalnumBefore(data, offset) && data[offset-1] != c) {
+		n := offset
+		for n < len(data) && data[n] == c {
+			n++
+		}
+		if n-offset <= 3 && n < len(data) && !isspaceAt(data, n) && (c != '~' || n-offset == 2) {
+			warn(rndr, DIAG_UNCLOSED_EMPHASIS, "emphasis opened with "+string(data[offset:n])+" is not closed")
+		}
+	}
+	return ret
+}
+
+// the emphasis, double emphasis, or strikethrough at the start of data
+func inlineEmphasisSpan(out *bytes.Buffer, rndr *render, data []byte) int {
 	c := data[0]
 	ret := 0
 
 	if len(data) > 2 && data[1] != c {
 		// whitespace cannot follow an opening emphasis;
 		// strikethrough only takes two characters '~~'
-		if c == '~' || isspace(data[1]) {
+		if c == '~' || isspaceAt(data, 1) {
 			return 0
 		}
 		if ret = inlineHelperEmph1(out, rndr, data[1:], c); ret == 0 {
@@ -78,7 +114,7 @@ func inlineEmphasis(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 	}
 
 	if len(data) > 3 && data[1] == c && data[2] != c {
-		if isspace(data[2]) {
+		if isspaceAt(data, 2) {
 			return 0
 		}
 		if ret = inlineHelperEmph2(out, rndr, data[2:], c); ret == 0 {
@@ -89,7 +125,7 @@ func inlineEmphasis(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 	}
 
 	if len(data) > 4 && data[1] == c && data[2] == c && data[3] != c {
-		if c == '~' || isspace(data[3]) {
+		if c == '~' || isspaceAt(data, 3) {
 			return 0
 		}
 		if ret = inlineHelperEmph3(out, rndr, data, 3, c); ret == 0 {
@@ -142,11 +178,11 @@ func inlineCodespan(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 		return 0
 	}
 	if f_begin < f_end {
-		if rndr.mk.codespan(out, data[f_begin:f_end], rndr.mk.opaque) == 0 {
+		if rndr.mk.codespan(out, data[f_begin:f_end], rndr.opaque) == 0 {
 			end = 0
 		}
 	} else {
-		if rndr.mk.codespan(out, nil, rndr.mk.opaque) == 0 {
+		if rndr.mk.codespan(out, nil, rndr.opaque) == 0 {
 			end = 0
 		}
 	}
@@ -158,6 +194,9 @@ func inlineCodespan(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 // '\n' preceded by two spaces
 func inlineLinebreak(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	if offset < 2 || data[offset-1] != ' ' || data[offset-2] != ' ' {
+		if rndr.flags&EXTENSION_JOIN_CJK_LINES != 0 {
+			return inlineJoinCJK(data, offset)
+		}
 		return 0
 	}
 
@@ -172,7 +211,7 @@ func inlineLinebreak(out *bytes.Buffer, rndr *render, data []byte, offset int) i
 	if rndr.mk.linebreak == nil {
 		return 0
 	}
-	if rndr.mk.linebreak(out, rndr.mk.opaque) > 0 {
+	if rndr.mk.linebreak(out, rndr.opaque) > 0 {
 		return 1
 	} else {
 		return 0
@@ -181,12 +220,65 @@ func inlineLinebreak(out *bytes.Buffer, rndr *render, data []byte, offset int) i
 	return 0
 }
 
+// drop a newline (and the next line's indentation) between two CJK
+// characters, since browsers would otherwise render it as a space
+func inlineJoinCJK(data []byte, offset int) int {
+	end := offset + 1
+	for end < len(data) && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+
+	before, _ := utf8.DecodeLastRune(data[:offset])
+	after, _ := utf8.DecodeRune(data[end:])
+	if !isCJK(int(before)) || !isCJK(int(after)) {
+		return 0
+	}
+	return end - offset
+}
+
+// Test if a character is Chinese or Japanese, which are written without
+// spaces between words. Korean uses spaces, so Hangul is left out.
+func isCJK(c int) bool {
+	return (c >= 0x3000 && c <= 0x30ff) || // punctuation, hiragana, katakana
+		(c >= 0x3400 && c <= 0x4dbf) || // ideographs extension A
+		(c >= 0x4e00 && c <= 0x9fff) || // unified ideographs
+		(c >= 0xf900 && c <= 0xfaff) || // compatibility ideographs
+		(c >= 0xff00 && c <= 0xffef) || // fullwidth forms
+		(c >= 0x20000 && c <= 0x2ffff) // supplementary ideographs
+}
+
+// craft a reference id from the link text in data[1:txt_e],
+// folding each line break into a single space
+func linkTextId(data []byte, txt_e int, text_has_nl bool) []byte {
+	if !text_has_nl {
+		return data[1:txt_e]
+	}
+
+	b := bytes.NewBuffer(nil)
+	for j := 1; j < txt_e; j++ {
+		switch {
+		case data[j] != '\n':
+			b.WriteByte(data[j])
+		case data[j-1] != ' ':
+			b.WriteByte(' ')
+		}
+	}
+	return b.Bytes()
+}
+
 // '[': parse a link or an image
 func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	isImg := offset > 0 && data[offset-1] == '!'
 
 	data = data[offset:]
 
+	// references to footnotes and citations look like links
+	if !isImg && rndr.notes != nil {
+		if ret := inlineFootnote(out, rndr, data); ret > 0 {
+			return ret
+		}
+	}
+
 	i := 1
 	var title, link []byte
 	text_has_nl := false
@@ -217,6 +309,9 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	}
 
 	if i >= len(data) {
+		if rndr.strict {
+			warn(rndr, DIAG_BROKEN_LINK, "link text opened with [ is not closed")
+		}
 		return 0
 	}
 
@@ -254,6 +349,7 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 		}
 
 		if i >= len(data) {
+			brokenLink(rndr, data, txt_e)
 			return 0
 		}
 		link_e := i
@@ -276,6 +372,7 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 			}
 
 			if i >= len(data) {
+				brokenLink(rndr, data, txt_e)
 				return 0
 			}
 
@@ -333,63 +430,47 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 
 		// find the reference
 		if link_b == link_e {
-			if text_has_nl {
-				b := bytes.NewBuffer(nil)
-
-				for j := 1; j < txt_e; j++ {
-					switch {
-					case data[j] != '\n':
-						b.WriteByte(data[j])
-					case data[j-1] != ' ':
-						b.WriteByte(' ')
-					}
-				}
-
-				id = b.Bytes()
-			} else {
-				id = data[1:txt_e]
-			}
+			id = linkTextId(data, txt_e, text_has_nl)
 		} else {
 			id = data[link_b:link_e]
 		}
 
 		// find the reference with matching id (ids are case-insensitive)
-		key := string(bytes.ToLower(id))
-		lr, ok := rndr.refs[key]
+		lr, ok := findReference(rndr, id, false)
+
+		// brackets set apart by whitespace may just be the next bit of text,
+		// so fall back to a shortcut reference; what the document defines
+		// comes before what the resolver gives
+		spaced := link_b-1 > txt_e+1
+		for _, resolve := range []bool{false, true} {
+			if !ok && resolve {
+				lr, ok = findReference(rndr, id, true)
+			}
+			if !ok && spaced {
+				if lr, ok = findReference(rndr, linkTextId(data, txt_e, text_has_nl), resolve); ok {
+					i = txt_e
+				}
+			}
+		}
 		if !ok {
+			if link_b-1 == txt_e+1 {
+				warn(rndr, DIAG_UNRESOLVED_REFERENCE, "no reference defined for ["+string(id)+"]")
+			}
 			return 0
 		}
 
 		// keep link and title from reference
 		link = lr.link
 		title = lr.title
+		lr.used = true
 		i++
 
 	// shortcut reference style link
 	default:
-		var id []byte
-
-		// craft the id
-		if text_has_nl {
-			b := bytes.NewBuffer(nil)
-
-			for j := 1; j < txt_e; j++ {
-				switch {
-				case data[j] != '\n':
-					b.WriteByte(data[j])
-				case data[j-1] != ' ':
-					b.WriteByte(' ')
-				}
-			}
-
-			id = b.Bytes()
-		} else {
-			id = data[1:txt_e]
-		}
+		id := linkTextId(data, txt_e, text_has_nl)
 
 		// find the reference with matching id
-		key := string(bytes.ToLower(id))
-		lr, ok := rndr.refs[key]
+		lr, ok := findReference(rndr, id, true)
 		if !ok {
 			return 0
 		}
@@ -397,26 +478,28 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 		// keep link and title from reference
 		link = lr.link
 		title = lr.title
+		lr.used = true
 
 		// rewind the whitespace
 		i = txt_e + 1
 	}
 
 	// build content: img alt is escaped, link content is parsed
-	content := bytes.NewBuffer(nil)
+	var content []byte
+	var work *bytes.Buffer
 	if txt_e > 1 {
 		if isImg {
-			content.Write(data[1:txt_e])
+			content = data[1:txt_e]
 		} else {
-			parseInline(content, rndr, data[1:txt_e])
+			work = newBuffer(rndr)
+			parseInline(work, rndr, data[1:txt_e])
+			content = work.Bytes()
 		}
 	}
 
 	var u_link []byte
 	if len(link) > 0 {
-		u_link_buf := bytes.NewBuffer(nil)
-		unescapeText(u_link_buf, link)
-		u_link = u_link_buf.Bytes()
+		u_link = unescapeLink(link)
 	}
 
 	// call the relevant rendering function
@@ -424,13 +507,32 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	if isImg {
 		outSize := out.Len()
 		outBytes := out.Bytes()
-		if outSize > 0 && outBytes[outSize-1] == '!' {
+		bang := outSize > 0 && outBytes[outSize-1] == '!'
+		if bang {
 			out.Truncate(outSize - 1)
 		}
 
-		ret = rndr.mk.image(out, u_link, title, content.Bytes(), rndr.mk.opaque)
+		// images pointing at audio or video can be embedded instead
+		kind := MEDIA_TYPE_NONE
+		if rndr.flags&EXTENSION_MEDIA_EMBED != 0 && rndr.mk.mediaEmbed != nil {
+			kind, _ = mediaType(u_link)
+		}
+		u_link = rewriteUrl(rndr, u_link, URL_IMAGE)
+		if kind != MEDIA_TYPE_NONE {
+			ret = rndr.mk.mediaEmbed(out, u_link, title, content, kind, rndr.opaque)
+		} else {
+			ret = rndr.mk.image(out, u_link, title, content, rndr.opaque)
+		}
+
+		// put the '!' back if the image was turned down
+		if ret == 0 && bang {
+			out.WriteByte('!')
+		}
 	} else {
-		ret = rndr.mk.link(out, u_link, title, content.Bytes(), rndr.mk.opaque)
+		ret = rndr.mk.link(out, rewriteUrl(rndr, u_link, URL_LINK), title, content, rndr.opaque)
+	}
+	if work != nil {
+		freeBuffer(rndr, work)
 	}
 
 	if ret > 0 {
@@ -439,9 +541,24 @@ func inlineLink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	return 0
 }
 
+// in strict mode, note a link whose destination is not closed, unless
+// the parenthesis is set apart from the text and may just be more text
+func brokenLink(rndr *render, data []byte, txt_e int) {
+	if rndr.strict && txt_e+1 < len(data) && data[txt_e+1] == '(' {
+		warn(rndr, DIAG_BROKEN_LINK, "link destination opened with ( is not closed")
+	}
+}
+
 // '<' when tags or autolinks are allowed
 func inlineLangle(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	data = data[offset:]
+
+	// drop comments entirely when stripping them
+	if rndr.flags&EXTENSION_STRIP_COMMENTS != 0 && bytes.HasPrefix(data, []byte("<!--")) {
+		if end := bytes.Index(data[4:], []byte("-->")); end >= 0 {
+			return end + 7
+		}
+	}
 	altype := LINK_TYPE_NOT_AUTOLINK
 	end := tagLength(data, &altype)
 	ret := 0
@@ -449,11 +566,21 @@ func inlineLangle(out *bytes.Buffer, rndr *render, data []byte, offset int) int
 	if end > 2 {
 		switch {
 		case rndr.mk.autolink != nil && altype != LINK_TYPE_NOT_AUTOLINK:
-			u_link := bytes.NewBuffer(nil)
-			unescapeText(u_link, data[1:end+1-2])
-			ret = rndr.mk.autolink(out, u_link.Bytes(), altype, rndr.mk.opaque)
+			kind := URL_AUTOLINK
+			if altype == LINK_TYPE_EMAIL {
+				kind = URL_EMAIL
+			}
+			ret = rndr.mk.autolink(out, rewriteUrl(rndr, unescapeLink(data[1:end+1-2]), kind), altype, rndr.opaque)
 		case rndr.mk.rawHtmlTag != nil:
-			ret = rndr.mk.rawHtmlTag(out, data[:end], rndr.mk.opaque)
+			tag := data[:end]
+			if rndr.mk.htmlHook != nil {
+				tag = rndr.mk.htmlHook(tag, false)
+			}
+			if len(tag) == 0 {
+				ret = 1 // dropped by the hook
+			} else {
+				ret = rndr.mk.rawHtmlTag(out, tag, rndr.opaque)
+			}
 		}
 	}
 
@@ -466,16 +593,29 @@ func inlineLangle(out *bytes.Buffer, rndr *render, data []byte, offset int) int
 // '\\' backslash escape
 var escapeChars = []byte("\\`*_{}[]()#+-.!:|&<>")
 
+// the characters Markdown.pl lets a backslash escape
+var markdownPlEscapeChars = []byte("\\`*_{}[]()>#+-.!")
+
 func inlineEscape(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	data = data[offset:]
 
 	if len(data) > 1 {
-		if bytes.IndexByte(escapeChars, data[1]) < 0 {
+		if data[1] == '\n' && rndr.commonMark && rndr.mk.linebreak != nil {
+			if rndr.mk.linebreak(out, rndr.opaque) == 0 {
+				return 0
+			}
+			return 2
+		}
+		chars := escapeChars
+		if rndr.markdownPl {
+			chars = markdownPlEscapeChars
+		}
+		if bytes.IndexByte(chars, data[1]) < 0 {
 			return 0
 		}
 
 		if rndr.mk.normalText != nil {
-			rndr.mk.normalText(out, data[1:2], rndr.mk.opaque)
+			rndr.mk.normalText(out, data[1:2], rndr.opaque)
 		} else {
 			out.WriteByte(data[1])
 		}
@@ -484,6 +624,16 @@ func inlineEscape(out *bytes.Buffer, rndr *render, data []byte, offset int) int
 	return 2
 }
 
+// remove the backslash escapes from a link, copying it only if it has any
+func unescapeLink(src []byte) []byte {
+	if bytes.IndexByte(src, '\\') < 0 {
+		return src
+	}
+	ob := bytes.NewBuffer(nil)
+	unescapeText(ob, src)
+	return ob.Bytes()
+}
+
 func unescapeText(ob *bytes.Buffer, src []byte) {
 	i := 0
 	for i < len(src) {
@@ -527,7 +677,7 @@ func inlineEntity(out *bytes.Buffer, rndr *render, data []byte, offset int) int
 	}
 
 	if rndr.mk.entity != nil {
-		rndr.mk.entity(out, data[:end], rndr.mk.opaque)
+		rndr.mk.entity(out, data[:end], rndr.opaque)
 	} else {
 		out.Write(data[:end])
 	}
@@ -540,7 +690,7 @@ func inlineAutolink(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 	data = data[offset:]
 
 	if offset > 0 {
-		if !isspace(orig_data[offset-1]) && !ispunct(orig_data[offset-1]) {
+		if !wordStart(orig_data, offset) {
 			return 0
 		}
 	}
@@ -549,8 +699,546 @@ func inlineAutolink(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 		return 0
 	}
 
+	link_end := autolinkEnd(orig_data, offset)
+
+	if rndr.mk.autolink != nil {
+		// a link turned down by the renderer stays as text
+		if rndr.mk.autolink(out, rewriteUrl(rndr, unescapeLink(data[:link_end]), URL_AUTOLINK), LINK_TYPE_NORMAL, rndr.opaque) == 0 {
+			return 0
+		}
+	}
+
+	return link_end
+}
+
+// 'w': a bare www. address, rendered as a regular http:// link
+func inlineWwwAutolink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	orig_data := data
+	data = data[offset:]
+
+	if offset > 0 {
+		if !wordStart(orig_data, offset) {
+			return 0
+		}
+	}
+
+	if rndr.mk.link == nil || len(data) < 5 || tolower(data[0]) != 'w' || tolower(data[1]) != 'w' || tolower(data[2]) != 'w' || data[3] != '.' || !isalnum(data[4]) {
+		return 0
+	}
+
+	link_end := autolinkEnd(orig_data, offset)
+
+	u_link := bytes.NewBufferString("http://")
+	unescapeText(u_link, data[:link_end])
+
+	content := bytes.NewBuffer(nil)
+	if rndr.mk.normalText != nil {
+		rndr.mk.normalText(content, data[:link_end], rndr.opaque)
+	} else {
+		content.Write(data[:link_end])
+	}
+
+	if rndr.mk.link(out, rewriteUrl(rndr, u_link.Bytes(), URL_AUTOLINK), nil, content.Bytes(), rndr.opaque) == 0 {
+		return 0
+	}
+	return link_end
+}
+
+// '@': a bare email address
+// the local part has already been copied to the output, so it gets rewound
+func inlineEmailAutolink(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	if rndr.mk.autolink == nil {
+		return 0
+	}
+
+	// rewind over the local part
+	rewind := 0
+	for rewind < offset && isEmailChar(data[offset-rewind-1]) {
+		rewind++
+	}
+	if rewind == 0 || !bytes.HasSuffix(out.Bytes(), data[offset-rewind:offset]) {
+		return 0
+	}
+
+	// the domain needs at least one dot and must end on a letter or digit
+	end, dots := offset+1, 0
+	for end < len(data) && (isalnum(data[end]) || data[end] == '-' || data[end] == '.') {
+		if data[end] == '.' {
+			dots++
+		}
+		end++
+	}
+	for end > offset+1 && !isalnum(data[end-1]) {
+		if data[end-1] == '.' {
+			dots--
+		}
+		end--
+	}
+	if end == offset+1 || dots == 0 {
+		return 0
+	}
+
+	out.Truncate(out.Len() - rewind)
+	forgetDelimiters(rndr, out.Len())
+	if rndr.mk.autolink(out, rewriteUrl(rndr, data[offset-rewind:end], URL_EMAIL), LINK_TYPE_EMAIL, rndr.opaque) == 0 {
+		out.Write(data[offset-rewind : offset])
+		return 0
+	}
+
+	return end - offset
+}
+
+// '[': a keyboard key, [[Ctrl]], falling back to a link or an image
+func inlineKbd(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	key := data[offset:]
+
+	if len(key) > 4 && key[1] == '[' {
+		end := 2
+		for end < len(key) && key[end] != ']' && key[end] != '[' && key[end] != '\n' {
+			end++
+		}
+		if end > 2 && end+1 < len(key) && key[end] == ']' && key[end+1] == ']' {
+			if rndr.mk.kbd(out, key[2:end], rndr.opaque) > 0 {
+				return end + 2
+			}
+		}
+	}
+
+	return inlineLink(out, rndr, data, offset)
+}
+
+// '{': a Hugo-style shortcode, {{< name args >}} or {{% name args %}},
+// passed through untouched, falling back to ruby annotation
+func inlineShortcode(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	if end := shortcodeEnd(data[offset:]); end > 0 {
+		if rndr.mk.shortcode(out, data[offset:offset+end], rndr.opaque) > 0 {
+			return end
+		}
+	}
+
+	if rndr.flags&EXTENSION_RUBY != 0 && rndr.mk.ruby != nil {
+		return inlineRuby(out, rndr, data, offset)
+	}
+	return 0
+}
+
+// '{': a {{name}} variable, falling back to a shortcode or ruby annotation
+func inlineVariable(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	if end, name := variableName(data[offset:]); end > 0 {
+		if value := rndr.mk.variable(name); value != nil {
+			if rndr.mk.normalText != nil {
+				rndr.mk.normalText(out, value, rndr.opaque)
+			} else {
+				out.Write(value)
+			}
+			return end
+		}
+	}
+
+	switch {
+	case rndr.flags&EXTENSION_SHORTCODES != 0 && rndr.mk.shortcode != nil:
+		return inlineShortcode(out, rndr, data, offset)
+	case rndr.flags&EXTENSION_RUBY != 0 && rndr.mk.ruby != nil:
+		return inlineRuby(out, rndr, data, offset)
+	}
+	return 0
+}
+
+// parse a {{name}} variable at the start of data, allowing spaces inside the braces
+// returns its length and the name
+func variableName(data []byte) (int, []byte) {
+	if len(data) < 5 || data[0] != '{' || data[1] != '{' {
+		return 0, nil
+	}
+	i := 2
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	beg := i
+	for i < len(data) && (isalnum(data[i]) || data[i] == '_' || data[i] == '-' || data[i] == '.') {
+		i++
+	}
+	end := i
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if end == beg || i+1 >= len(data) || data[i] != '}' || data[i+1] != '}' {
+		return 0, nil
+	}
+	return i + 2, data[beg:end]
+}
+
+// find the end of the shortcode at the start of data, including
+// everything up to its closing {{< /name >}} if it has one
+func shortcodeEnd(data []byte) int {
+	end, name, closing, selfClosing := shortcodeTag(data)
+	if end == 0 || closing {
+		return 0
+	}
+	if selfClosing {
+		return end
+	}
+
+	// look for the matching close, skipping nested pairs of the same name
+	depth := 1
+	for i := end; i < len(data); i++ {
+		if data[i] != '{' {
+			continue
+		}
+		j, other, c, sc := shortcodeTag(data[i:])
+		if j == 0 {
+			continue
+		}
+		if bytes.Equal(other, name) {
+			if c {
+				depth--
+				if depth == 0 {
+					return i + j
+				}
+			} else if !sc {
+				depth++
+			}
+		}
+		i += j - 1
+	}
+
+	// no close, so it stands alone
+	return end
+}
+
+// parse a single {{< ... >}} or {{% ... %}} tag at the start of data
+// returns its length, its name, and whether it closes or is self-closing
+func shortcodeTag(data []byte) (end int, name []byte, closing, selfClosing bool) {
+	if len(data) < 7 || data[0] != '{' || data[1] != '{' || (data[2] != '<' && data[2] != '%') {
+		return
+	}
+	delim := data[2]
+	if delim == '<' {
+		delim = '>'
+	}
+
+	// find the closing delimiter, skipping over quoted arguments
+	i := 3
+	for i+2 < len(data) && !(data[i] == delim && data[i+1] == '}' && data[i+2] == '}') {
+		if data[i] == '"' || data[i] == '`' {
+			q := data[i]
+			i++
+			for i < len(data) && data[i] != q {
+				if q == '"' && data[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		}
+		i++
+	}
+	if i+2 >= len(data) {
+		return
+	}
+	inner := bytes.TrimSpace(data[3:i])
+
+	switch {
+	case bytes.HasPrefix(inner, []byte("/*")):
+		// a commented-out shortcode
+		name, selfClosing = []byte("/*"), true
+	case len(inner) > 0 && inner[0] == '/':
+		closing = true
+		inner = bytes.TrimSpace(inner[1:])
+	case len(inner) > 0 && inner[len(inner)-1] == '/':
+		selfClosing = true
+	}
+	if name == nil {
+		n := 0
+		for n < len(inner) && !isspace(inner[n]) && inner[n] != '/' {
+			n++
+		}
+		if n == 0 {
+			return
+		}
+		name = inner[:n]
+	}
+
+	end = i + 3
+	return
+}
+
+// '(': a reference to a labelled example list item, (@label)
+func inlineExampleRef(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	data = data[offset:]
+	if len(data) < 4 || data[1] != '@' {
+		return 0
+	}
+
+	end := 2
+	for end < len(data) && (isalnum(data[end]) || data[end] == '_' || data[end] == '-') {
+		end++
+	}
+	if end == 2 || end >= len(data) || data[end] != ')' {
+		return 0
+	}
+	n, ok := rndr.exampleLabels[string(data[2:end])]
+	if !ok {
+		return 0
+	}
+
+	num := []byte("(" + strconv.Itoa(n) + ")")
+	if rndr.mk.normalText != nil {
+		rndr.mk.normalText(out, num, rndr.opaque)
+	} else {
+		out.Write(num)
+	}
+	return end + 1
+}
+
+// '{': ruby annotation, {base|annotation}
+func inlineRuby(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	data = data[offset:]
+
+	// look for the separator and the closing brace on the same line
+	sep, end := 0, 1
+	for end < len(data) && data[end] != '}' && data[end] != '\n' && data[end] != '{' {
+		if data[end] == '|' && sep == 0 {
+			sep = end
+		}
+		end++
+	}
+	if end >= len(data) || data[end] != '}' || sep <= 1 || sep+1 >= end {
+		return 0
+	}
+
+	base := bytes.NewBuffer(nil)
+	parseInline(base, rndr, data[1:sep])
+	text := bytes.NewBuffer(nil)
+	parseInline(text, rndr, data[sep+1:end])
+
+	if rndr.mk.ruby(out, base.Bytes(), text.Bytes(), rndr.opaque) == 0 {
+		return 0
+	}
+	return end + 1
+}
+
+// '#': a hashtag such as #golang
+func inlineHashtag(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	end := inlineHelperTag(data, offset)
+	if end == 0 {
+		return 0
+	}
+
+	// all digits is an issue number, not a tag
+	letters := false
+	for _, c := range data[offset+1 : offset+end] {
+		if !isdigit(c) {
+			letters = true
+		}
+	}
+	if !letters {
+		return 0
+	}
+
+	return inlineHelperTagLink(out, rndr, data[offset:offset+end], rndr.mk.hashtagLink(data[offset+1:offset+end]))
+}
+
+// '@': a mention such as @russross, or a bare email address
+func inlineMention(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	if offset > 0 && isEmailChar(data[offset-1]) {
+		if rndr.flags&EXTENSION_AUTOLINK != 0 {
+			return inlineEmailAutolink(out, rndr, data, offset)
+		}
+		return 0
+	}
+
+	end := inlineHelperTag(data, offset)
+	if end == 0 {
+		return 0
+	}
+
+	name := data[offset+1 : offset+end]
+	var link []byte
+	if rndr.flags&EXTENSION_MENTIONS != 0 && rndr.mk.mentionLink != nil {
+		link = rndr.mk.mentionLink(name)
+	} else {
+		link = refLink(rndr.mk.userBase, name)
+	}
+
+	return inlineHelperTagLink(out, rndr, data[offset:offset+end], link)
+}
+
+// '#' or 'G': an issue reference such as #123 or GH-123
+func inlineIssueRef(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	start := 1
+	if data[offset] == 'G' {
+		start = 3
+		if !bytes.HasPrefix(data[offset:], []byte("GH-")) {
+			return 0
+		}
+	}
+
+	end := start
+	for offset+end < len(data) && isdigit(data[offset+end]) {
+		end++
+	}
+	if end > start && refBoundary(data, offset, offset+end) {
+		text := data[offset : offset+end]
+		return inlineHelperTagLink(out, rndr, text, refLink(rndr.mk.issueBase, text[start:]))
+	}
+
+	// not an issue, but it might still be a hashtag
+	if data[offset] == '#' && rndr.flags&EXTENSION_HASHTAGS != 0 && rndr.mk.hashtagLink != nil {
+		return inlineHashtag(out, rndr, data, offset)
+	}
+	return 0
+}
+
+// '0'-'9', 'a'-'f': a bare commit SHA of 7 to 40 hex digits
+func inlineCommitRef(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	if end := commitRefLength(data, offset); end > 0 {
+		text := data[offset : offset+end]
+		return inlineHelperTagLink(out, rndr, text, refLink(rndr.mk.commitBase, text))
+	}
+
+	// 'f' might be the start of an ftp link
+	if data[offset] == 'f' && rndr.flags&EXTENSION_AUTOLINK != 0 {
+		return inlineAutolink(out, rndr, data, offset)
+	}
+	return 0
+}
+
+// the length of the commit SHA starting at data[offset], or 0 if none does
+func commitRefLength(data []byte, offset int) int {
+	end, letters, digits := 0, false, false
+	for offset+end < len(data) && end <= 40 {
+		c := data[offset+end]
+		if isdigit(c) {
+			digits = true
+		} else if c >= 'a' && c <= 'f' {
+			letters = true
+		} else {
+			break
+		}
+		end++
+	}
+
+	// a SHA mixes letters and digits, which keeps words and plain numbers out
+	if end >= 7 && end <= 40 && letters && digits && refBoundary(data, offset, offset+end) {
+		return end
+	}
+	return 0
+}
+
+// whether the trigger at data[offset] is worth calling once hex digits
+// are commit ref triggers: a digit or letter that cannot start a SHA
+// stays in the text around it, so a failed match does not cut a run
+// such as "1/2" in two before smartypants sees it
+func commitRefTrigger(rndr *render, data []byte, offset int) bool {
+	c := data[offset]
+	if !isdigit(c) && (c < 'a' || c > 'f') {
+		return true
+	}
+	if c == 'f' && rndr.flags&EXTENSION_AUTOLINK != 0 {
+		return true
+	}
+	return wordStart(data, offset) && commitRefLength(data, offset) > 0
+}
+
+// Test if data[beg:end] stands apart from the words around it.
+func refBoundary(data []byte, beg, end int) bool {
+	if !wordStart(data, beg) {
+		return false
+	}
+	return end >= len(data) || (!isalnumAt(data, end) && data[end] != '_')
+}
+
+// Build the link for a GitHub-style reference, or nil if there is no base URL.
+func refLink(base string, id []byte) []byte {
+	if base == "" {
+		return nil
+	}
+	link := bytes.NewBufferString(base)
+	link.Write(id)
+	return link.Bytes()
+}
+
+// find the end of a #tag or @name starting at data[offset]
+// it must follow a word boundary and is made of letters, digits, '_' and '-'
+func inlineHelperTag(data []byte, offset int) int {
+	if !wordStart(data, offset) {
+		return 0
+	}
+
+	end := 1
+	for offset+end < len(data) {
+		c := data[offset+end]
+		if c >= utf8.RuneSelf {
+			if !isalnumAt(data, offset+end) {
+				break
+			}
+			_, size := utf8.DecodeRune(data[offset+end:])
+			end += size
+			continue
+		}
+		if !isalnum(c) && c != '_' && c != '-' {
+			break
+		}
+		end++
+	}
+	for end > 1 && data[offset+end-1] == '-' {
+		end--
+	}
+	if end == 1 {
+		return 0
+	}
+	return end
+}
+
+// render a #tag, @name, or other reference as a link to the given target
+func inlineHelperTagLink(out *bytes.Buffer, rndr *render, text []byte, link []byte) int {
+	if rndr.mk.link == nil || len(link) == 0 {
+		return 0
+	}
+
+	content := bytes.NewBuffer(nil)
+	if rndr.mk.normalText != nil {
+		rndr.mk.normalText(content, text, rndr.opaque)
+	} else {
+		content.Write(text)
+	}
+
+	if rndr.mk.link(out, rewriteUrl(rndr, link, URL_LINK), nil, content.Bytes(), rndr.opaque) == 0 {
+		return 0
+	}
+	return len(text)
+}
+
+// pass a destination through the renderer's URL rewriter, if any
+func rewriteUrl(rndr *render, link []byte, kind int) []byte {
+	if rndr.mk.urlRewriter == nil {
+		return link
+	}
+	return rndr.mk.urlRewriter(link, kind)
+}
+
+// Test if a character can appear in the local part of an email address.
+func isEmailChar(c byte) bool {
+	return isalnum(c) || c == '.' || c == '+' || c == '-' || c == '_'
+}
+
+// find the end of an autolink starting at data[offset:],
+// leaving out trailing punctuation that is not part of the url
+func autolinkEnd(orig_data []byte, offset int) int {
+	data := orig_data[offset:]
+
+	// the link runs to whitespace, or to punctuation beyond ASCII such
+	// as the closing bracket of （http://example.com/）
 	link_end := 0
 	for link_end < len(data) && !isspace(data[link_end]) {
+		if data[link_end] >= utf8.RuneSelf {
+			if space, punct, _ := runeClass(data[link_end:], false); space || punct {
+				break
+			}
+			_, size := utf8.DecodeRune(data[link_end:])
+			link_end += size
+			continue
+		}
 		link_end++
 	}
 
@@ -618,14 +1306,85 @@ func inlineAutolink(out *bytes.Buffer, rndr *render, data []byte, offset int) in
 		}
 	}
 
-	if rndr.mk.autolink != nil {
-		u_link := bytes.NewBuffer(nil)
-		unescapeText(u_link, data[:link_end])
+	return link_end
+}
 
-		rndr.mk.autolink(out, u_link.Bytes(), LINK_TYPE_NORMAL, rndr.mk.opaque)
+var videoExtensions = []string{".mp4", ".m4v", ".webm", ".ogv", ".mov"}
+var audioExtensions = []string{".mp3", ".m4a", ".ogg", ".oga", ".wav", ".flac"}
+
+// Identify links to embeddable media.
+// Returns the media type, along with the video id for hosted videos.
+func mediaType(link []byte) (int, []byte) {
+	// hosted videos are recognized by their address
+	rest := link
+	for _, prefix := range []string{"https://", "http://", "//"} {
+		if len(rest) >= len(prefix) && bytes.Equal(bytes.ToLower(rest[:len(prefix)]), []byte(prefix)) {
+			rest = rest[len(prefix):]
+			break
+		}
+	}
+	for _, prefix := range []string{"www.", "m."} {
+		if bytes.HasPrefix(rest, []byte(prefix)) {
+			rest = rest[len(prefix):]
+			break
+		}
+	}
+	switch {
+	case bytes.HasPrefix(rest, []byte("youtube.com/watch?")):
+		query := rest[len("youtube.com/watch?"):]
+		for len(query) > 0 {
+			param := query
+			if amp := bytes.IndexByte(query, '&'); amp >= 0 {
+				param, query = query[:amp], query[amp+1:]
+			} else {
+				query = nil
+			}
+			if bytes.HasPrefix(param, []byte("v=")) {
+				return mediaVideoId(MEDIA_TYPE_YOUTUBE, param[2:])
+			}
+		}
+		return MEDIA_TYPE_NONE, nil
+	case bytes.HasPrefix(rest, []byte("youtube.com/embed/")):
+		return mediaVideoId(MEDIA_TYPE_YOUTUBE, rest[len("youtube.com/embed/"):])
+	case bytes.HasPrefix(rest, []byte("youtu.be/")):
+		return mediaVideoId(MEDIA_TYPE_YOUTUBE, rest[len("youtu.be/"):])
+	case bytes.HasPrefix(rest, []byte("vimeo.com/")):
+		return mediaVideoId(MEDIA_TYPE_VIMEO, rest[len("vimeo.com/"):])
 	}
 
-	return link_end
+	// files are recognized by their extension, ignoring any query or fragment
+	path := link
+	if end := bytes.IndexAny(path, "?#"); end >= 0 {
+		path = path[:end]
+	}
+	path = bytes.ToLower(path)
+	for _, ext := range videoExtensions {
+		if bytes.HasSuffix(path, []byte(ext)) {
+			return MEDIA_TYPE_VIDEO, nil
+		}
+	}
+	for _, ext := range audioExtensions {
+		if bytes.HasSuffix(path, []byte(ext)) {
+			return MEDIA_TYPE_AUDIO, nil
+		}
+	}
+	return MEDIA_TYPE_NONE, nil
+}
+
+// take the video id from the start of data
+// ids are made of letters, digits, '-' and '_', and vimeo's are all digits
+func mediaVideoId(kind int, data []byte) (int, []byte) {
+	end := 0
+	for end < len(data) && (isalnum(data[end]) || data[end] == '-' || data[end] == '_') {
+		if kind == MEDIA_TYPE_VIMEO && !isdigit(data[end]) {
+			return MEDIA_TYPE_NONE, nil
+		}
+		end++
+	}
+	if end == 0 || (end < len(data) && data[end] != '?' && data[end] != '&' && data[end] != '#') {
+		return MEDIA_TYPE_NONE, nil
+	}
+	return kind, data[:end]
 }
 
 var validUris = [][]byte{[]byte("http://"), []byte("https://"), []byte("ftp://"), []byte("mailto://")}
@@ -642,6 +1401,27 @@ func isSafeLink(link []byte) bool {
 	return false
 }
 
+// the reference for a link id, defined in the document or else, when
+// resolve is set, given by the reference resolver, whose answer is kept
+// for the next use
+func findReference(rndr *render, id []byte, resolve bool) (*reference, bool) {
+	key := refKey(rndr, id)
+	if lr, ok := rndr.refs[string(key)]; ok {
+		return lr, true
+	}
+	if !resolve || rndr.mk.refResolver == nil || len(id) == 0 {
+		return nil, false
+	}
+	ref, ok := rndr.mk.refResolver(id)
+	if !ok || ref == nil {
+		return nil, false
+	}
+	lr := rndr.arena.reference()
+	lr.link, lr.title, lr.external = ref.Link, ref.Title, true
+	rndr.refs[string(key)] = lr
+	return lr, true
+}
+
 // return the length of the given tag, or 0 is it's not valid
 func tagLength(data []byte, autolink *int) int {
 	var i, j int
@@ -758,84 +1538,233 @@ func isMailtoAutolink(data []byte) int {
 	return 0
 }
 
-// look for the next emph char, skipping other constructs
-func inlineHelperFindEmphChar(data []byte, c byte) int {
-	i := 1
+// The search for the delimiters closing an emphasis starts afresh from
+// every opening one, so on hostile input, such as "*a *a *a ..." or
+// "*[a *[a ...", a long text is searched over and over. An emphasis
+// index makes each step of a search take constant time and remembers
+// what searches have found: a search that comes to a position another
+// one went through goes the same way from there. This keeps the work
+// close to linear in the length of the text. A short text is searched
+// as it is, without the index.
+type emphIndex struct {
+	data  []byte
+	long  bool
+	arena *arena         // where the tables come from
+	next  map[byte][]int // where each character is next found
+	found map[byte][]int // the result of the search for each character plus one, by position
+	dead  map[int][]bool // where searches for each character and kind of emphasis failed
+	path  []int          // where the current searches went
+}
+
+// the shortest text worth indexing
+const emphIndexMin = 256
+
+// start the index of a text being parsed for spans; each level of
+// nesting has one of its own, used over and over
+func newEmphIndex(rndr *render, data []byte) *emphIndex {
+	if rndr.emphs == nil {
+		rndr.emphs = make([]emphIndex, rndr.maxNesting+1)
+	}
+	ix := &rndr.emphs[rndr.nesting]
+	*ix = emphIndex{data: data, long: len(data) >= emphIndexMin, arena: &rndr.arena, path: ix.path[:0]}
+	if ix.long {
+		ix.next = make(map[byte][]int)
+		ix.found = make(map[byte][]int)
+		ix.dead = make(map[int][]bool)
+	}
+	return ix
+}
 
+// the position of the next x from i on, or the length of the text
+func (ix *emphIndex) find(x byte, i int) int {
+	data := ix.data
+	if i >= len(data) {
+		return len(data)
+	}
+	if !ix.long {
+		if j := bytes.IndexByte(data[i:], x); j >= 0 {
+			return i + j
+		}
+		return len(data)
+	}
+
+	next := ix.next[x]
+	if next == nil {
+		next = ix.arena.intSlice(len(data) + 1)
+		next[len(data)] = len(data)
+		for j := len(data) - 1; j >= 0; j-- {
+			if data[j] == x {
+				next[j] = j
+			} else {
+				next[j] = next[j+1]
+			}
+		}
+		ix.next[x] = next
+	}
+	return next[i]
+}
+
+// the first c between beg and end, or 0 if there is none
+func (ix *emphIndex) findBefore(c byte, beg, end int) int {
+	if i := ix.find(c, beg); i < end {
+		return i
+	}
+	return 0
+}
+
+// look for the next emph char after data[at], skipping other constructs;
+// returns its position in the text, or 0 if there is none
+func (ix *emphIndex) findEmphChar(at int, c byte) int {
+	data := ix.data
+	found := ix.found[c]
+	if ix.long && found == nil {
+		found = ix.arena.intSlice(len(data))
+		ix.found[c] = found
+	}
+
+	// each time around the loop, the rest of the search depends only
+	// on i, so every i passed on the way gets the same result
+	path := len(ix.path)
+	result := 0
+	i := at + 1
 	for i < len(data) {
-		for i < len(data) && data[i] != c && data[i] != '`' && data[i] != '[' {
-			i++
+		if found != nil {
+			if found[i] > 0 {
+				result = found[i] - 1
+				break
+			}
+			ix.path = append(ix.path, i)
+		}
+
+		end := ix.find(c, i)
+		if j := ix.find('`', i); j < end {
+			end = j
 		}
+		if j := ix.find('[', i); j < end {
+			end = j
+		}
+		i = end
 		if i >= len(data) {
-			return 0
+			break
 		}
 		if data[i] == c {
-			return i
+			result = i
+			break
 		}
 
 		// do not count escaped chars
-		if i != 0 && data[i-1] == '\\' {
+		if data[i-1] == '\\' {
 			i++
 			continue
 		}
 
 		if data[i] == '`' {
 			// skip a code span
-			tmp_i := 0
 			i++
-			for i < len(data) && data[i] != '`' {
-				if tmp_i == 0 && data[i] == c {
-					tmp_i = i
-				}
-				i++
-			}
+			end = ix.find('`', i)
+			tmp_i := ix.findBefore(c, i, end)
+			i = end
 			if i >= len(data) {
-				return tmp_i
+				result = tmp_i
+				break
 			}
 			i++
 		} else {
-			if data[i] == '[' {
-				// skip a link
-				tmp_i := 0
-				i++
-				for i < len(data) && data[i] != ']' {
-					if tmp_i == 0 && data[i] == c {
-						tmp_i = i
-					}
-					i++
-				}
-				i++
-				for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n') {
-					i++
-				}
-				if i >= len(data) {
-					return tmp_i
-				}
-				if data[i] != '[' && data[i] != '(' { // not a link
-					if tmp_i > 0 {
-						return tmp_i
-					} else {
-						continue
-					}
-				}
-				cc := data[i]
+			// skip a link
+			i++
+			end = ix.find(']', i)
+			tmp_i := ix.findBefore(c, i, end)
+			i = end + 1
+			for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n') {
 				i++
-				for i < len(data) && data[i] != cc {
-					if tmp_i == 0 && data[i] == c {
-						tmp_i = i
-					}
-					i++
-				}
-				if i >= len(data) {
-					return tmp_i
+			}
+			if i >= len(data) {
+				result = tmp_i
+				break
+			}
+			if data[i] != '[' && data[i] != '(' { // not a link
+				if tmp_i > 0 {
+					result = tmp_i
+					break
+				} else {
+					continue
 				}
-				i++
 			}
+			cc := data[i]
+			i++
+			end = ix.find(cc, i)
+			if tmp_i == 0 {
+				tmp_i = ix.findBefore(c, i, end)
+			}
+			i = end
+			if i >= len(data) {
+				result = tmp_i
+				break
+			}
+			i++
+		}
+	}
+
+	for _, j := range ix.path[path:] {
+		found[j] = result + 1
+	}
+	ix.path = ix.path[:path]
+	return result
+}
+
+// A search for the delimiters that close one kind of emphasis, in data,
+// the rest of the indexed text. Each position where it looks for the next
+// delimiter is kept, so that if the search fails, later searches that
+// come to one of them can give up at once.
+type emphScan struct {
+	ix   *emphIndex
+	base int // where data starts in the text
+	c    byte
+	dead []bool
+	path int // where this search starts in ix.path
+}
+
+func newEmphScan(rndr *render, data []byte, c byte, kind int) emphScan {
+	ix := rndr.emph
+	s := emphScan{ix: ix, base: len(ix.data) - len(data), c: c, path: len(ix.path)}
+	if ix.long {
+		key := int(c)<<2 | kind
+		s.dead = ix.dead[key]
+		if s.dead == nil {
+			s.dead = ix.arena.boolSlice(len(ix.data))
+			ix.dead[key] = s.dead
+		}
+	}
+	return s
+}
+
+// the offset from data[i] of the next emph char after it, or 0 if there
+// is none or a search has been this way before without finding a close
+func (s *emphScan) next(i int) int {
+	at := s.base + i
+	if s.dead != nil {
+		if s.dead[at] {
+			return 0
 		}
+		s.ix.path = append(s.ix.path, at)
+	}
+	if j := s.ix.findEmphChar(at, s.c); j > 0 {
+		return j - at
 	}
 	return 0
 }
 
+// the search found no close, so neither will any that comes its way;
+// a search that finds one just drops what it kept
+func (s *emphScan) end(failed bool) {
+	if failed && s.dead != nil {
+		for _, at := range s.ix.path[s.path:] {
+			s.dead[at] = true
+		}
+	}
+	s.ix.path = s.ix.path[:s.path]
+}
+
 func inlineHelperEmph1(out *bytes.Buffer, rndr *render, data []byte, c byte) int {
 	i := 0
 
@@ -848,14 +1777,15 @@ func inlineHelperEmph1(out *bytes.Buffer, rndr *render, data []byte, c byte) int
 		i = 1
 	}
 
+	scan := newEmphScan(rndr, data, c, 1)
 	for i < len(data) {
-		length := inlineHelperFindEmphChar(data[i:], c)
+		length := scan.next(i)
 		if length == 0 {
-			return 0
+			break
 		}
 		i += length
 		if i >= len(data) {
-			return 0
+			break
 		}
 
 		if i+1 < len(data) && data[i+1] == c {
@@ -863,17 +1793,19 @@ func inlineHelperEmph1(out *bytes.Buffer, rndr *render, data []byte, c byte) int
 			continue
 		}
 
-		if data[i] == c && !isspace(data[i-1]) {
+		if data[i] == c && !isspaceBefore(data, i) {
 
 			if rndr.flags&EXTENSION_NO_INTRA_EMPHASIS != 0 {
-				if !(i+1 == len(data) || isspace(data[i+1]) || ispunct(data[i+1])) {
+				if !wordEnd(data, i+1) {
 					continue
 				}
 			}
+			scan.end(false)
 
-			work := bytes.NewBuffer(nil)
+			work := newBuffer(rndr)
 			parseInline(work, rndr, data[:i])
-			r := rndr.mk.emphasis(out, work.Bytes(), rndr.mk.opaque)
+			r := rndr.mk.emphasis(out, work.Bytes(), rndr.opaque)
+			freeBuffer(rndr, work)
 			if r > 0 {
 				return i + 1
 			} else {
@@ -882,6 +1814,7 @@ func inlineHelperEmph1(out *bytes.Buffer, rndr *render, data []byte, c byte) int
 		}
 	}
 
+	scan.end(true)
 	return 0
 }
 
@@ -897,17 +1830,20 @@ func inlineHelperEmph2(out *bytes.Buffer, rndr *render, data []byte, c byte) int
 
 	i := 0
 
+	scan := newEmphScan(rndr, data, c, 2)
 	for i < len(data) {
-		length := inlineHelperFindEmphChar(data[i:], c)
+		length := scan.next(i)
 		if length == 0 {
-			return 0
+			break
 		}
 		i += length
 
-		if i+1 < len(data) && data[i] == c && data[i+1] == c && i > 0 && !isspace(data[i-1]) {
-			work := bytes.NewBuffer(nil)
+		if i+1 < len(data) && data[i] == c && data[i+1] == c && i > 0 && !isspaceBefore(data, i) {
+			scan.end(false)
+			work := newBuffer(rndr)
 			parseInline(work, rndr, data[:i])
-			r := render_method(out, work.Bytes(), rndr.mk.opaque)
+			r := render_method(out, work.Bytes(), rndr.opaque)
+			freeBuffer(rndr, work)
 			if r > 0 {
 				return i + 2
 			} else {
@@ -916,6 +1852,7 @@ func inlineHelperEmph2(out *bytes.Buffer, rndr *render, data []byte, c byte) int
 		}
 		i++
 	}
+	scan.end(true)
 	return 0
 }
 
@@ -924,25 +1861,28 @@ func inlineHelperEmph3(out *bytes.Buffer, rndr *render, data []byte, offset int,
 	orig_data := data
 	data = data[offset:]
 
+	scan := newEmphScan(rndr, data, c, 3)
 	for i < len(data) {
-		length := inlineHelperFindEmphChar(data[i:], c)
+		length := scan.next(i)
 		if length == 0 {
-			return 0
+			break
 		}
 		i += length
 
 		// skip whitespace preceded symbols
-		if data[i] != c || isspace(data[i-1]) {
+		if data[i] != c || isspaceBefore(data, i) {
 			continue
 		}
+		scan.end(false)
 
 		switch {
 		case (i+2 < len(data) && data[i+1] == c && data[i+2] == c && rndr.mk.tripleEmphasis != nil):
 			// triple symbol found
-			work := bytes.NewBuffer(nil)
+			work := newBuffer(rndr)
 
 			parseInline(work, rndr, data[:i])
-			r := rndr.mk.tripleEmphasis(out, work.Bytes(), rndr.mk.opaque)
+			r := rndr.mk.tripleEmphasis(out, work.Bytes(), rndr.opaque)
+			freeBuffer(rndr, work)
 			if r > 0 {
 				return i + 3
 			} else {
@@ -966,5 +1906,20 @@ func inlineHelperEmph3(out *bytes.Buffer, rndr *render, data []byte, offset int,
 			}
 		}
 	}
+	scan.end(true)
 	return 0
 }
+
+// wrap a caller's span parser, trying the built-in one for its
+// character when it takes nothing
+func customInline(parser InlineParser, builtin inlineParser) inlineParser {
+	return func(out *bytes.Buffer, rndr *render, data []byte, offset int) int {
+		if n := parser(out, data, offset, rndr.opaque); n > 0 {
+			return n
+		}
+		if builtin != nil {
+			return builtin(out, rndr, data, offset)
+		}
+		return 0
+	}
+}
@@ -0,0 +1,39 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checks of inline parsing
+//
+//
+
+package blackfriday
+
+import (
+	"strings"
+	"testing"
+)
+
+// digits and letters that start no commit SHA stay in the text around
+// them, so smartypants sees fractions and quotes whole
+func TestCommitRefsWithSmartypants(t *testing.T) {
+	r := HtmlRenderer(HTML_USE_SMARTYPANTS)
+	r.SetGithubRefLinks("", "https://example.com/commit/", "")
+	for _, c := range []struct{ input, want string }{
+		{"1/2 cup", "&frac12; cup"},
+		{"add 3/4 of it", "add &frac34; of it"},
+		{"x1/2", "x1/2"},
+		{`"a b" and 'deed'`, "&ldquo;a b&rdquo; and &lsquo;deed&rsquo;"},
+		{"fixed in 1a2b3c4d, see 1/4",
+			`fixed in <a href="https://example.com/commit/1a2b3c4d">1a2b3c4d</a>, see &frac14;`},
+		{"no x1a2b3c4d", "no x1a2b3c4d"},
+	} {
+		output := string(Markdown([]byte(c.input), r, EXTENSION_GITHUB_REFS))
+		if !strings.Contains(output, c.want) {
+			t.Errorf("%q: want %q in %q", c.input, c.want, output)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checking documents against style rules
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"utf8"
+)
+
+// These are the style rules checked by Lint.
+const (
+	LINT_HEADER_SKIP = 1 << iota // a header more than one level below the one before it
+	LINT_HARD_BREAK              // a line break made by trailing spaces, which are easy to miss
+	LINT_BARE_URL                // a URL in the text that is not written as <url> or a link
+	LINT_LIST_MARKER             // a list item marker other than the first one used
+	LINT_LONG_LINE               // a line longer than the limit, outside code
+)
+
+// All of the style rules.
+const LINT_ALL = LINT_HEADER_SKIP | LINT_HARD_BREAK | LINT_BARE_URL | LINT_LIST_MARKER | LINT_LONG_LINE
+
+// The longest line allowed by LINT_LONG_LINE, unless set otherwise.
+const LINT_LINE_LENGTH = 80
+
+// LintRules picks the style rules checked by Lint.
+type LintRules struct {
+	Rules      int // the LINT_* rules to check
+	LineLength int // the longest line allowed, LINT_LINE_LENGTH if 0
+}
+
+// A LintWarning is a place where a document breaks a style rule.
+type LintWarning struct {
+	Pos     Position // where the problem starts
+	Rule    int      // the LINT_* rule broken
+	Message string
+}
+
+// Parse a document and check it against the given style rules, returning
+// the warnings in the order of the input. Blocks nested in lists and
+// quotes are found at the line of the top-level block they are in.
+// LINT_BARE_URL finds URLs that were linked by EXTENSION_AUTOLINK, and
+// those that were left as text without it. LINT_LONG_LINE leaves out
+// lines with no space past the limit, which wrapping would not shorten,
+// such as one ending in a long URL.
+func Lint(input []byte, extensions uint64, rules LintRules) []LintWarning {
+	doc := Parse(input, extensions)
+	l := &linter{input: input, starts: lineStarts(input), rules: rules, found: make(map[int]bool)}
+	l.code = l.codeLines(doc)
+
+	level := 0 // of the last header
+	for _, block := range doc.Children {
+		Walk(block, func(n *Node, entering bool) WalkStatus {
+			if !entering {
+				return WALK_CONTINUE
+			}
+			switch n.Type {
+			case NODE_HEADER:
+				if level > 0 && n.Level > level+1 {
+					l.warn(block.Pos.Line, block.Pos.Col, LINT_HEADER_SKIP,
+						"level "+strconv.Itoa(n.Level)+" header after a level "+strconv.Itoa(level)+" one")
+				}
+				level = n.Level
+			case NODE_TEXT:
+				if extensions&EXTENSION_AUTOLINK == 0 {
+					l.bareURLs(block, n.Literal)
+				}
+			case NODE_AUTOLINK:
+				if n.Flags == LINK_TYPE_NORMAL {
+					l.bareURLs(block, n.Link)
+				}
+			case NODE_LINK, NODE_IMAGE:
+				return WALK_SKIP_CHILDREN
+			}
+			return WALK_CONTINUE
+		})
+		if block.Type == NODE_LIST || block.Type == NODE_BLOCKQUOTE {
+			l.listMarkers(block)
+		}
+	}
+	l.lines()
+
+	sort.Sort(lintOrder(l.warnings))
+	return l.warnings
+}
+
+type linter struct {
+	input    []byte
+	starts   []int  // the offset of each line
+	code     []bool // whether each line is code, from 0
+	rules    LintRules
+	marker   byte         // the first list item marker
+	found    map[int]bool // the offsets of bare URLs already warned about
+	warnings []LintWarning
+}
+
+// add a warning, if its rule is checked
+func (l *linter) warn(line, col int, rule int, msg string) {
+	if l.rules.Rules&rule != 0 {
+		l.warnings = append(l.warnings, LintWarning{Pos: Position{Line: line, Col: col}, Rule: rule, Message: msg})
+	}
+}
+
+// a line of the input, without its end
+func (l *linter) line(i int) []byte {
+	end := len(l.input)
+	if i+1 < len(l.starts) {
+		end = l.starts[i+1]
+	}
+	return bytes.TrimRight(l.input[l.starts[i]:end], "\r\n")
+}
+
+// note which lines are in code blocks: all of a top-level one, and the
+// fenced ones inside lists and quotes
+func (l *linter) codeLines(doc *Node) []bool {
+	code := make([]bool, len(l.starts))
+	for _, block := range doc.Children {
+		switch block.Type {
+		case NODE_CODE_BLOCK:
+			for i := block.Pos.Line; i <= block.Pos.EndLine && i > 0; i++ {
+				code[i-1] = true
+			}
+		case NODE_LIST, NODE_BLOCKQUOTE:
+			fence := []byte(nil)
+			for i := block.Pos.Line; i <= block.Pos.EndLine && i > 0; i++ {
+				text := bytes.TrimLeft(l.line(i-1), " \t>")
+				if fence != nil {
+					code[i-1] = true
+					if bytes.HasPrefix(text, fence) {
+						fence = nil
+					}
+				} else if bytes.HasPrefix(text, []byte("```")) || bytes.HasPrefix(text, []byte("~~~")) {
+					code[i-1] = true
+					fence = text[:3]
+				}
+			}
+		}
+	}
+	return code
+}
+
+// warn about each URL that is not in angle brackets in the text of a
+// top-level block
+func (l *linter) bareURLs(block *Node, text []byte) {
+	if block.Pos.Line < 1 {
+		return
+	}
+	start, end := l.starts[block.Pos.Line-1], len(l.input)
+	if block.Pos.EndLine < len(l.starts) {
+		end = l.starts[block.Pos.EndLine]
+	}
+	for _, prefix := range []string{"http://", "https://", "ftp://"} {
+		for i := 0; i < len(text); {
+			j := bytes.Index(text[i:], []byte(prefix))
+			if j < 0 {
+				break
+			}
+			url := text[i+j:]
+			if k := bytes.IndexAny(url, " \t\n"); k >= 0 {
+				url = url[:k]
+			}
+			i += j + len(url)
+
+			// find the first place in the source it was written bare
+			for at := start; at < end; {
+				k := bytes.Index(l.input[at:end], url)
+				if k < 0 {
+					break
+				}
+				at += k
+				if !l.found[at] && (at == 0 || bytes.IndexByte([]byte("<([\"'"), l.input[at-1]) < 0) {
+					l.found[at] = true
+					line := block.Pos.Line
+					for line < len(l.starts) && l.starts[line] <= at {
+						line++
+					}
+					col := utf8.RuneCount(l.input[l.starts[line-1]:at]) + 1
+					l.warn(line, col, LINT_BARE_URL, "bare URL "+string(url)+"; write it as <"+string(url)+">")
+					break
+				}
+				at += len(url)
+			}
+		}
+	}
+}
+
+// warn about list item markers that are not the first one used in the
+// document, in the lines of a top-level list or quote
+func (l *linter) listMarkers(block *Node) {
+	for i := block.Pos.Line; i <= block.Pos.EndLine && i > 0; i++ {
+		if l.code[i-1] {
+			continue
+		}
+		src := l.line(i - 1)
+		text := bytes.TrimLeft(src, " \t>")
+		if len(text) < 2 || (text[0] != '-' && text[0] != '*' && text[0] != '+') || (text[1] != ' ' && text[1] != '\t') {
+			continue
+		}
+		if isHrule(text) {
+			continue
+		}
+		if l.marker == 0 {
+			l.marker = text[0]
+		} else if text[0] != l.marker {
+			l.warn(i, len(src)-len(text)+1, LINT_LIST_MARKER,
+				"list item marked with "+string(text[0])+" instead of "+string(l.marker))
+		}
+	}
+}
+
+// check the rules that go line by line
+func (l *linter) lines() {
+	limit := l.rules.LineLength
+	if limit <= 0 {
+		limit = LINT_LINE_LENGTH
+	}
+	for i := range l.starts {
+		if l.code[i] {
+			continue
+		}
+		src := l.line(i)
+
+		// trailing spaces before a line of the same paragraph
+		if end := len(bytes.TrimRight(src, " ")); len(src)-end >= 2 && end > 0 &&
+			i+1 < len(l.starts) && !l.code[i+1] && len(bytes.TrimSpace(l.line(i+1))) > 0 {
+			l.warn(i+1, utf8.RuneCount(src[:end])+1, LINT_HARD_BREAK, "hard line break made by trailing spaces")
+		}
+
+		// a long line with a space past the limit could be wrapped there
+		text := bytes.TrimRight(src, " \t")
+		if n := utf8.RuneCount(text); n > limit {
+			rest := text
+			for k := 0; k < limit; k++ {
+				_, size := utf8.DecodeRune(rest)
+				rest = rest[size:]
+			}
+			if bytes.IndexAny(rest, " \t") >= 0 {
+				l.warn(i+1, limit+1, LINT_LONG_LINE, "line is "+strconv.Itoa(n)+" characters long, over "+strconv.Itoa(limit))
+			}
+		}
+	}
+}
+
+// sorting warnings by position
+type lintOrder []LintWarning
+
+func (w lintOrder) Len() int      { return len(w) }
+func (w lintOrder) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w lintOrder) Less(i, j int) bool {
+	if w[i].Pos.Line != w[j].Pos.Line {
+		return w[i].Pos.Line < w[j].Pos.Line
+	}
+	return w[i].Pos.Col < w[j].Pos.Col
+}
@@ -14,11 +14,18 @@ package blackfriday
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
 	"unicode"
+	"utf8"
 )
 
 // These are the supported markdown parsing extensions.
-// OR these values together to select multiple extensions.
+// OR these values together to select multiple extensions. Sets of them
+// are uint64 values, which leaves room for more.
 const (
 	EXTENSION_NO_INTRA_EMPHASIS = 1 << iota
 	EXTENSION_TABLES
@@ -27,8 +34,52 @@ const (
 	EXTENSION_STRIKETHROUGH
 	EXTENSION_LAX_HTML_BLOCKS
 	EXTENSION_SPACE_HEADERS
+	EXTENSION_GRID_TABLES
+	EXTENSION_LINE_BLOCKS
+	EXTENSION_NO_SETEXT_HEADERS
+	EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK
+	EXTENSION_HASHTAGS
+	EXTENSION_MENTIONS
+	EXTENSION_RUBY
+	EXTENSION_FANCY_LISTS
+	EXTENSION_DETAILS
+	EXTENSION_KBD
+	EXTENSION_MEDIA_EMBED
+	EXTENSION_GITHUB_REFS
+	EXTENSION_SHORTCODES
+	EXTENSION_STRIP_COMMENTS
+	EXTENSION_MARKDOWN_IN_HTML
+	EXTENSION_JOIN_CJK_LINES
+	EXTENSION_EXAMPLE_LISTS
+	EXTENSION_VARIABLES
+	EXTENSION_VARIABLES_AS_MARKDOWN
+	EXTENSION_TASK_LISTS
+	EXTENSION_METADATA
+	EXTENSION_FOOTNOTES
+	EXTENSION_CITATIONS
+	EXTENSION_TABLE_CAPTIONS
+	EXTENSION_DEFINITION_LISTS
+	EXTENSION_FENCED_DIVS
+	EXTENSION_ATTRIBUTES
+	EXTENSION_IMPLICIT_HEADER_REFS
 )
 
+// the extensions most documents are written for, as used by the example
+// program and cmd/blackfriday
+const COMMON_EXTENSIONS = EXTENSION_NO_INTRA_EMPHASIS | EXTENSION_TABLES | EXTENSION_FENCED_CODE | EXTENSION_AUTOLINK | EXTENSION_STRIKETHROUGH | EXTENSION_SPACE_HEADERS
+
+// the extensions that suit CommentRenderer
+const COMMENT_EXTENSIONS = EXTENSION_NO_INTRA_EMPHASIS | EXTENSION_FENCED_CODE | EXTENSION_AUTOLINK | EXTENSION_STRIKETHROUGH | EXTENSION_SPACE_HEADERS
+
+// the extensions of GitHub Flavored Markdown, as set by WithGFM
+const GFM_EXTENSIONS = EXTENSION_TABLES | EXTENSION_FENCED_CODE | EXTENSION_AUTOLINK | EXTENSION_STRIKETHROUGH | EXTENSION_SPACE_HEADERS | EXTENSION_TASK_LISTS
+
+// the extensions of MultiMarkdown, as set by WithMultiMarkdown
+const MMD_EXTENSIONS = EXTENSION_TABLES | EXTENSION_FENCED_CODE | EXTENSION_METADATA | EXTENSION_FOOTNOTES | EXTENSION_CITATIONS | EXTENSION_TABLE_CAPTIONS | EXTENSION_DEFINITION_LISTS
+
+// the extensions of Pandoc's markdown, as set by WithPandoc
+const PANDOC_EXTENSIONS = EXTENSION_TABLES | EXTENSION_GRID_TABLES | EXTENSION_FENCED_CODE | EXTENSION_STRIKETHROUGH | EXTENSION_SPACE_HEADERS | EXTENSION_LINE_BLOCKS | EXTENSION_FANCY_LISTS | EXTENSION_EXAMPLE_LISTS | EXTENSION_FOOTNOTES | EXTENSION_DEFINITION_LISTS | EXTENSION_FENCED_DIVS | EXTENSION_ATTRIBUTES | EXTENSION_IMPLICIT_HEADER_REFS
+
 // These are the possible flag values for the link renderer.
 // Only a single one of these values will be used; they are not ORed together.
 // These are mostly of interest if you are writing a new output format.
@@ -38,29 +89,100 @@ const (
 	LINK_TYPE_EMAIL
 )
 
-// These are the possible flag values for the listitem renderer.
-// Multiple flag values may be ORed together.
+// These are the possible flag values for the list and listitem renderers.
+// Multiple flag values may be ORed together. The marker flags of an item
+// are those of its own marker, and those of a list are its first item's;
+// a bullet without one is "*", and a number without one is followed by
+// ".". The number of the first item goes to the list renderer as start.
 // These are mostly of interest if you are writing a new output format.
 const (
 	LIST_TYPE_ORDERED = 1 << iota
 	LIST_ITEM_CONTAINS_BLOCK
 	LIST_ITEM_END_OF_LIST
+	LIST_TYPE_LOWER_ALPHA
+	LIST_TYPE_UPPER_ALPHA
+	LIST_TYPE_LOWER_ROMAN
+	LIST_TYPE_UPPER_ROMAN
+	LIST_TYPE_EXAMPLE
+	LIST_BULLET_PLUS  // the item is marked with "+"
+	LIST_BULLET_DASH  // the item is marked with "-"
+	LIST_DELIM_PAREN  // the item's number is followed by ")"
+	LIST_LOOSE        // only for the list: blank lines set its items apart, so they hold paragraphs
+	LIST_ITEM_TASK    // the item starts with a task box, "[ ]" or "[x]", which is left out of its text
+	LIST_ITEM_CHECKED // the task box is ticked
+	LIST_TYPE_DEFINITION
+	LIST_TYPE_TERM // the item is a term of a definition list rather than a definition
 )
 
+// These are the possible flag values for the footnote renderers.
+// These are mostly of interest if you are writing a new output format.
+const (
+	FOOTNOTE_CITATION = 1 << iota // a citation, [#key], rather than a footnote, [^name]
+)
+
+// the flags that describe the marker of a list item
+const listMarkerFlags = LIST_BULLET_PLUS | LIST_BULLET_DASH | LIST_DELIM_PAREN
+
 // These are the possible flag values for the table cell renderer.
-// Only a single one of these values will be used; they are not ORed together.
+// Only a single one of the alignment values will be used; TABLE_CELL_HEADER
+// is ORed in for the cells of the header row, so mask the flags with
+// TABLE_ALIGNMENT_CENTER to get the alignment.
 // These are mostly of interest if you are writing a new output format.
 const (
 	TABLE_ALIGNMENT_LEFT = 1 << iota
 	TABLE_ALIGNMENT_RIGHT
+	TABLE_CELL_HEADER
 	TABLE_ALIGNMENT_CENTER = (TABLE_ALIGNMENT_LEFT | TABLE_ALIGNMENT_RIGHT)
 )
 
-// The size of a tab stop.
+// These are the possible flag values for the media embed renderer.
+// Only a single one of these values will be used; they are not ORed together.
+// These are mostly of interest if you are writing a new output format.
+const (
+	MEDIA_TYPE_NONE = iota
+	MEDIA_TYPE_VIDEO
+	MEDIA_TYPE_AUDIO
+	MEDIA_TYPE_YOUTUBE
+	MEDIA_TYPE_VIMEO
+)
+
+// These are the possible kinds of destination given to the URL rewriter.
+// Only a single one of these values will be used; they are not ORed together.
+const (
+	URL_LINK = iota
+	URL_IMAGE
+	URL_AUTOLINK
+	URL_EMAIL
+)
+
+// These are the kinds of problem collected by WithDiagnostics.
+const (
+	DIAG_UNRESOLVED_REFERENCE = iota
+	DIAG_DUPLICATE_REFERENCE
+	DIAG_MALFORMED_TABLE
+	DIAG_UNCLOSED_FENCE
+
+	// found in strict mode only
+	DIAG_UNCLOSED_EMPHASIS
+	DIAG_BROKEN_LINK
+	DIAG_MIXED_INDENT
+
+	// found by CheckAnchors
+	DIAG_BROKEN_ANCHOR
+
+	// found when a limit set with WithLimits is reached
+	DIAG_LIMIT
+
+	// found when the input is normalized with WithNormalize
+	DIAG_INVALID_UTF8
+)
+
+// The default size of a tab stop.
 const TAB_SIZE = 4
 
 // These are the tags that are recognized as HTML block tags.
 // Any of these can be included in markdown text without special escaping.
+// Tags are matched without regard to case, so <DIV> is a block tag too.
 var block_tags = map[string]bool{
 	"p":          true,
 	"dl":         true,
@@ -75,15 +197,63 @@ var block_tags = map[string]bool{
 	"del":        true,
 	"div":        true,
 	"ins":        true,
+	"nav":        true,
 	"pre":        true,
 	"form":       true,
+	"main":       true,
 	"math":       true,
+	"aside":      true,
+	"audio":      true,
+	"style":      true,
 	"table":      true,
+	"video":      true,
+	"figure":     true,
+	"footer":     true,
+	"header":     true,
 	"iframe":     true,
 	"script":     true,
+	"article":    true,
+	"details":    true,
+	"section":    true,
 	"fieldset":   true,
 	"noscript":   true,
 	"blockquote": true,
+	"figcaption": true,
+}
+
+// The block tags of Markdown.pl, which predates HTML5 and matches them
+// only in lowercase.
+var markdownPlBlockTags = map[string]bool{
+	"p":          true,
+	"dl":         true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"ol":         true,
+	"ul":         true,
+	"del":        true,
+	"div":        true,
+	"ins":        true,
+	"pre":        true,
+	"form":       true,
+	"math":       true,
+	"table":      true,
+	"iframe":     true,
+	"script":     true,
+	"fieldset":   true,
+	"noscript":   true,
+	"blockquote": true,
+}
+
+// A CodeFence tells the blockcode renderer how a code block was written,
+// for output formats that reproduce the markdown.
+type CodeFence struct {
+	Char   byte // '`' or '~', or 0 for an indented block
+	Length int  // the number of fence characters
+	Indent int  // the spaces before the opening fence
 }
 
 // This struct defines the rendering interface.
@@ -94,19 +264,38 @@ var block_tags = map[string]bool{
 //
 // This is mostly of interest if you are implementing a new rendering format.
 // Most users will use the convenience functions to fill in this structure.
+//
+// To save copying, the text handed to a callback or hook is often a slice
+// of the input itself. It is only lent for the call: it must not be changed,
+// and must be copied to be kept. So are the column flags handed to table.
 type Renderer struct {
 	// block-level callbacks---nil skips the block
-	blockcode  func(out *bytes.Buffer, text []byte, lang string, opaque interface{})
+	blockcode  func(out *bytes.Buffer, text []byte, lang string, info string, fence CodeFence, opaque interface{})
 	blockquote func(out *bytes.Buffer, text []byte, opaque interface{})
 	blockhtml  func(out *bytes.Buffer, text []byte, opaque interface{})
 	header     func(out *bytes.Buffer, text []byte, level int, opaque interface{})
 	hrule      func(out *bytes.Buffer, opaque interface{})
-	list       func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	list       func(out *bytes.Buffer, text []byte, flags int, start int, opaque interface{})
 	listitem   func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
 	paragraph  func(out *bytes.Buffer, text []byte, opaque interface{})
-	table      func(out *bytes.Buffer, header []byte, body []byte, opaque interface{})
+	table      func(out *bytes.Buffer, header []byte, body []byte, caption []byte, columns []int, opaque interface{})
 	tableRow   func(out *bytes.Buffer, text []byte, opaque interface{})
 	tableCell  func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	lineBlock  func(out *bytes.Buffer, text []byte, opaque interface{})
+	details    func(out *bytes.Buffer, summary []byte, text []byte, opaque interface{})
+	div        func(out *bytes.Buffer, text []byte, opaque interface{})
+
+	// the attributes of the header, fenced code block, or fenced div
+	// whose callback comes next---nil drops them
+	attributes func(attrs *Attributes, opaque interface{})
+
+	// the notes at the end, footnotes and then citations, each numbered
+	// by its first reference---nil for footnotes drops them
+	footnotes    func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	footnoteItem func(out *bytes.Buffer, name []byte, text []byte, number int, flags int, opaque interface{})
+
+	// shortcode blocks---nil leaves them to the paragraph parser
+	blockShortcode func(out *bytes.Buffer, text []byte, opaque interface{})
 
 	// span-level callbacks---nil or return 0 prints the span verbatim
 	autolink       func(out *bytes.Buffer, link []byte, kind int, opaque interface{}) int
@@ -114,11 +303,16 @@ type Renderer struct {
 	doubleEmphasis func(out *bytes.Buffer, text []byte, opaque interface{}) int
 	emphasis       func(out *bytes.Buffer, text []byte, opaque interface{}) int
 	image          func(out *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) int
+	mediaEmbed     func(out *bytes.Buffer, link []byte, title []byte, alt []byte, kind int, opaque interface{}) int
 	linebreak      func(out *bytes.Buffer, opaque interface{}) int
 	link           func(out *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int
 	rawHtmlTag     func(out *bytes.Buffer, tag []byte, opaque interface{}) int
 	tripleEmphasis func(out *bytes.Buffer, text []byte, opaque interface{}) int
 	strikethrough  func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	ruby           func(out *bytes.Buffer, base []byte, text []byte, opaque interface{}) int
+	kbd            func(out *bytes.Buffer, key []byte, opaque interface{}) int
+	shortcode      func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	footnoteRef    func(out *bytes.Buffer, name []byte, number int, locator []byte, flags int, opaque interface{}) int
 
 	// low-level callbacks---nil copies input directly into the output
 	entity     func(out *bytes.Buffer, entity []byte, opaque interface{})
@@ -128,19 +322,200 @@ type Renderer struct {
 	documentHeader func(out *bytes.Buffer, opaque interface{})
 	documentFooter func(out *bytes.Buffer, opaque interface{})
 
+	// whether the footer needs all of the output, so none of it can be
+	// written before the end; nil means it does not
+	wholeOutput func(opaque interface{}) bool
+
 	// user data---passed back to every callback
 	opaque interface{}
+
+	// changes to the default HTML block tags---true adds a tag, false removes it
+	blockTags map[string]bool
+
+	// span parsers supplied by the caller, by trigger character
+	inlineParsers map[byte]InlineParser
+
+	// block parsers supplied by the caller, highest priority first
+	blockParsers []customBlock
+
+	// link targets for #hashtags and @mentions---nil or an empty link leaves the text alone
+	hashtagLink func(tag []byte) []byte
+	mentionLink func(name []byte) []byte
+
+	// base URLs for #123, GH-123, commit SHA and @user references---empty leaves them alone
+	issueBase  string
+	commitBase string
+	userBase   string
+
+	// values for {{name}} variables---nil leaves the variable alone
+	variable func(name []byte) []byte
+
+	// link targets for reference ids the document does not define---nil leaves them as text
+	refResolver func(id []byte) (*Reference, bool)
+
+	// rewrites the destinations of links, images, and autolinks---nil leaves them alone
+	urlRewriter func(dest []byte, kind int) []byte
+
+	// rewrites or drops raw HTML blocks and tags---nil leaves them alone
+	htmlHook func(html []byte, block bool) []byte
+
+	// called after each top-level block with where its output starts in out
+	// and the lines and columns it spans in the input---nil skips tracking them
+	sourcepos func(out *bytes.Buffer, mark int, line int, col int, endLine int, endCol int, opaque interface{})
+}
+
+// The callbacks of a renderer, for changing some of them and keeping the
+// rest; see SetCallbacks.
+type Callbacks struct {
+	// block-level callbacks
+	Blockcode      func(out *bytes.Buffer, text []byte, lang string, info string, fence CodeFence, opaque interface{})
+	Blockquote     func(out *bytes.Buffer, text []byte, opaque interface{})
+	Blockhtml      func(out *bytes.Buffer, text []byte, opaque interface{})
+	Header         func(out *bytes.Buffer, text []byte, level int, opaque interface{})
+	Hrule          func(out *bytes.Buffer, opaque interface{})
+	List           func(out *bytes.Buffer, text []byte, flags int, start int, opaque interface{})
+	Listitem       func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	Paragraph      func(out *bytes.Buffer, text []byte, opaque interface{})
+	Table          func(out *bytes.Buffer, header []byte, body []byte, caption []byte, columns []int, opaque interface{})
+	TableRow       func(out *bytes.Buffer, text []byte, opaque interface{})
+	TableCell      func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	LineBlock      func(out *bytes.Buffer, text []byte, opaque interface{})
+	Details        func(out *bytes.Buffer, summary []byte, text []byte, opaque interface{})
+	Div            func(out *bytes.Buffer, text []byte, opaque interface{})
+	Attributes     func(attrs *Attributes, opaque interface{})
+	BlockShortcode func(out *bytes.Buffer, text []byte, opaque interface{})
+	Footnotes      func(out *bytes.Buffer, text []byte, flags int, opaque interface{})
+	FootnoteItem   func(out *bytes.Buffer, name []byte, text []byte, number int, flags int, opaque interface{})
+
+	// span-level callbacks
+	Autolink       func(out *bytes.Buffer, link []byte, kind int, opaque interface{}) int
+	Codespan       func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	DoubleEmphasis func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	Emphasis       func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	Image          func(out *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) int
+	MediaEmbed     func(out *bytes.Buffer, link []byte, title []byte, alt []byte, kind int, opaque interface{}) int
+	Linebreak      func(out *bytes.Buffer, opaque interface{}) int
+	Link           func(out *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) int
+	RawHtmlTag     func(out *bytes.Buffer, tag []byte, opaque interface{}) int
+	TripleEmphasis func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	Strikethrough  func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	Ruby           func(out *bytes.Buffer, base []byte, text []byte, opaque interface{}) int
+	Kbd            func(out *bytes.Buffer, key []byte, opaque interface{}) int
+	Shortcode      func(out *bytes.Buffer, text []byte, opaque interface{}) int
+	FootnoteRef    func(out *bytes.Buffer, name []byte, number int, locator []byte, flags int, opaque interface{}) int
+
+	// low-level callbacks
+	Entity     func(out *bytes.Buffer, entity []byte, opaque interface{})
+	NormalText func(out *bytes.Buffer, text []byte, opaque interface{})
+
+	// header and footer
+	DocumentHeader func(out *bytes.Buffer, opaque interface{})
+	DocumentFooter func(out *bytes.Buffer, opaque interface{})
+
+	// called after each top-level block with where it went in the output and the input
+	Sourcepos func(out *bytes.Buffer, mark int, line int, col int, endLine int, endCol int, opaque interface{})
 }
 
 type inlineParser func(out *bytes.Buffer, rndr *render, data []byte, offset int) int
 
+// An InlineParser handles a span of its own syntax, starting at data[offset]
+// with its trigger character; data is the rest of the block, so the parser
+// can look back as well. It writes the span to out and returns the number
+// of bytes it took, or 0 to leave the text to the built-in parsers.
+type InlineParser func(out *bytes.Buffer, data []byte, offset int, opaque interface{}) int
+
+// A BlockParser handles a block of its own syntax at the start of data,
+// which runs to the end of the text. It writes the block to out and
+// returns the number of bytes it took, or 0 if data does not start with
+// such a block.
+type BlockParser func(out *bytes.Buffer, data []byte, opaque interface{}) int
+
+type customBlock struct {
+	priority int
+	parser   BlockParser
+}
+
 type render struct {
 	mk         *Renderer
 	refs       map[string]*reference
+	defined    int    // references defined by the document
+	key        []byte // room to fold the case of a reference id
+	blockTags  map[string]bool
 	inline     [256]inlineParser
-	flags      uint32
+	commitRefs bool // hex digits trigger only where a commit SHA starts
+	flags      uint64
 	nesting    int
 	maxNesting int
+	tabSize    int
+	keepTabs   bool
+	wide       bool
+	blocksOnly bool
+	strict     bool
+	commonMark bool
+	markdownPl bool
+	limits     Limits
+	opaque     interface{} // user data for the callbacks of this call
+
+	// parsing ends at the next block once done fires
+	done    <-chan bool
+	stopped bool
+
+	// running count of (@) example list items, and the numbers of labelled ones
+	examples      int
+	exampleLabels map[string]int
+
+	// how many headers have each identifier, under EXTENSION_IMPLICIT_HEADER_REFS
+	headerIds map[string]int
+
+	// the input, and where each line of the text came from in it
+	source      []byte
+	sourceLines []sourceLine
+
+	// where the output of each top-level block came from, when asked for
+	mapSource bool
+	sourceMap []SourceSpan
+
+	// problems found so far, when asked for, and the line of the input
+	// they are put down to
+	diagnose    bool
+	diagnostics []Diagnostic
+	line        int
+
+	// buffers given back by the block and span parsers, ready for reuse
+	buffers []*bytes.Buffer
+
+	// records that last for the call
+	arena arena
+
+	// the emphasis index of the text being parsed for spans, once needed,
+	// and those of every level of nesting
+	emph  *emphIndex
+	emphs []emphIndex
+
+	// under CommonMark, the runs of * and _ found so far, those of the
+	// text being parsed for spans from delimBase on, and the emphasis
+	// they make once matched
+	delims      []delimiter
+	delimBase   int
+	emphMatches []emphMatch
+
+	// the footnotes and citations defined by the document, by id, once
+	// either is enabled, and those referred to so far, by number
+	notes     map[string]*footnote
+	footnotes []*footnote
+	citations []*footnote
+
+	// when streaming, where finished top-level blocks go, how much of the
+	// output has gone there, and the first error writing it
+	writer   io.Writer
+	written  int
+	writeErr os.Error
+	inputErr os.Error // the input could not be normalized
+}
+
+type sourceLine struct {
+	number int // counting from 1
+	offset int
 }
 
 
@@ -153,23 +528,527 @@ type render struct {
 // Parse and render a block of markdown-encoded text.
 // The renderer is used to format the output, and extensions dictates which
 // non-standard extensions are enabled.
-func Markdown(input []byte, renderer *Renderer, extensions uint32) []byte {
+// To work on the document between the two steps, use Parse and Render.
+func Markdown(input []byte, renderer *Renderer, extensions uint64) []byte {
 	// no point in parsing if we can't render
 	if renderer == nil {
 		return nil
 	}
+	return MarkdownWith(input, WithRenderer(renderer), WithExtensions(extensions))
+}
+
+// Options collects the settings for MarkdownWith.
+type Options struct {
+	Renderer     *Renderer // formats the output; nil means HtmlRenderer(0)
+	Extensions   uint64    // the non-standard extensions to enable
+	TabSize      int       // the width of a tab stop
+	PreserveTabs bool      // leave tabs alone in fenced code blocks
+	WideColumns  bool      // count East Asian wide characters as two columns
+	MaxNesting   int       // how deeply blocks and spans may be nested
+	BlocksOnly   bool      // pass the text of blocks on without parsing spans
+	Strict       bool      // look for constructs that are likely mistakes
+	Limits       Limits    // caps on the work done on hostile input
+	CommonMark   bool      // follow CommonMark where it differs
+	MarkdownPl   bool      // follow Markdown.pl, quirks and all
+	Normalize    int       // 0 leaves the input alone, or a NORMALIZE_* way to clean it up
+
+	// HTML block tags to recognize, true, or not, false, on top of the
+	// renderer's, by their lowercase names
+	BlockTags map[string]bool
+
+	// passed to the callbacks in place of the renderer's own user data
+	// when not nil, so one renderer can serve many calls at once
+	Opaque interface{}
+
+	// references known before parsing, which the document can override
+	Predefined map[string]*Reference
+
+	// filled in with the references the document defines, when not nil
+	References map[string]*Reference
+
+	// added to with where each top-level block went in the output, when not nil
+	SourceMap *[]SourceSpan
+
+	// added to with the problems found in the document, when not nil
+	Diagnostics *[]Diagnostic
+
+	// run in order on the input before parsing and on the output after rendering
+	InputFilters  []func(input []byte) []byte
+	OutputFilters []func(output []byte) []byte
+
+	// run in order on the document tree between parsing and rendering
+	Transformers []Transformer
+}
+
+// An Option changes one of the settings for MarkdownWith.
+type Option func(options *Options)
+
+// Format the output with the given renderer.
+func WithRenderer(renderer *Renderer) Option {
+	return func(options *Options) {
+		options.Renderer = renderer
+	}
+}
+
+// Enable the given extensions, in addition to any enabled already.
+func WithExtensions(extensions uint64) Option {
+	return func(options *Options) {
+		options.Extensions |= extensions
+	}
+}
+
+// Expand tabs to the given width instead of TAB_SIZE.
+func WithTabSize(size int) Option {
+	return func(options *Options) {
+		if size > 0 {
+			options.TabSize = size
+		}
+	}
+}
+
+// Keep the tabs in fenced code blocks instead of expanding them, for
+// samples such as makefiles where they matter. Only blocks that are not
+// inside another block are affected; tabs elsewhere are always expanded,
+// since they decide the structure of the document.
+func WithPreserveTabs() Option {
+	return func(options *Options) {
+		options.PreserveTabs = true
+	}
+}
+
+// Count the columns a line takes up the way a terminal shows it when
+// expanding tabs: East Asian wide and fullwidth characters take two
+// columns and combining marks none. Without this every character takes
+// one column, which lines up tabs in text where each does.
+func WithWideColumns() Option {
+	return func(options *Options) {
+		options.WideColumns = true
+	}
+}
+
+// Find the blocks of a document but leave the text in them as it is,
+// markup and all, for tools that only need the structure, such as an
+// outline or the code blocks, and would rather skip parsing the spans.
+func WithBlocksOnly() Option {
+	return func(options *Options) {
+		options.BlocksOnly = true
+	}
+}
+
+// Limit the nesting of blocks and spans to the given depth instead of 16.
+// Anything nested deeper is left out of the output.
+func WithMaxNesting(depth int) Option {
+	return func(options *Options) {
+		if depth > 0 {
+			options.MaxNesting = depth
+		}
+	}
+}
+
+// Limits caps the work done on a document, e.g., a comment from an
+// untrusted user, so that hostile input cannot take up a server. A zero
+// field sets no limit. Reaching one leaves part of the document out, the
+// same part every time, and is reported as a DIAG_LIMIT diagnostic, so
+// MarkdownStrict returns an error for it.
+//
+// SoftOutput is checked between top-level blocks only, so that the output
+// stays well formed: the block that goes past it is kept whole, however
+// large a list or quote it is, and the footnotes follow it. A hard cap on
+// the size of the output must be put on the result.
+type Limits struct {
+	Input        int // bytes of input; the rest is left out from the last line break before the limit
+	SoftOutput   int // bytes of output; parsing stops after the top-level block that goes past it
+	TableColumns int // columns of a table; the rest are left out
+	TableRows    int // rows in the body of a table; the rest are left out
+	References   int // reference definitions; later ones are ignored
+}
+
+// Cap the size of the input and tables, the number of reference
+// definitions, and, loosely, the size of the output, as set in limits.
+func WithLimits(limits Limits) Option {
+	return func(options *Options) {
+		options.Limits = limits
+	}
+}
+
+// Pass a value of its own to the callbacks of this call only. The
+// callbacks must accept it as their user data; for an HTML renderer,
+// get one from CallOpaque. The renderer's own user data is left alone.
+func WithOpaque(opaque interface{}) Option {
+	return func(options *Options) {
+		options.Opaque = opaque
+	}
+}
+
+// Start with the given references, e.g., links shared by many documents,
+// as if they were defined in the document. Ids are case-insensitive, and
+// definitions in the document take precedence.
+func WithReferences(refs map[string]*Reference) Option {
+	return func(options *Options) {
+		if options.Predefined == nil {
+			options.Predefined = make(map[string]*Reference)
+		}
+		for id, ref := range refs {
+			options.Predefined[id] = ref
+		}
+	}
+}
+
+// Fill in refs with the references the document defines, by id in lower
+// case, once it has been rendered. Used tells which ones were linked to.
+func CollectReferences(refs map[string]*Reference) Option {
+	return func(options *Options) {
+		options.References = refs
+	}
+}
+
+// A SourceSpan ties the output of a top-level block to the part of the
+// input it came from, as byte offsets; the ends are exclusive.
+type SourceSpan struct {
+	OutStart, OutEnd int
+	InStart, InEnd   int
+}
+
+// Add to spans where the output of each top-level block came from in the
+// input, e.g., to map clicks in a preview back to the source. The input
+// offsets are those after any input filters. The output offsets do not
+// survive changes to the output as a whole, such as the pretty printing,
+// minifying, and attribute hooks of the HTML renderer, or output filters.
+func WithSourceMap(spans *[]SourceSpan) Option {
+	return func(options *Options) {
+		options.SourceMap = spans
+	}
+}
+
+// A Diagnostic is a problem found in a document that does not stop it
+// from being rendered, such as a link to an undefined reference.
+type Diagnostic struct {
+	Line    int // of the input, counting from 1; see WithDiagnostics
+	Kind    int // one of the DIAG_* kinds
+	Message string
+}
+
+// Add the problems found in the document to diags, in order of their
+// lines, e.g., to show them to the writer. A reference definition is
+// placed on its own line; anything else, on the first line of the
+// top-level block it is in.
+func WithDiagnostics(diags *[]Diagnostic) Option {
+	return func(options *Options) {
+		options.Diagnostics = diags
+	}
+}
+
+// Also report constructs that are rendered as literal text but are likely
+// mistakes: emphasis that is never closed, links whose brackets or
+// parentheses are not closed, and indentation that mixes tabs and spaces,
+// which makes the nesting of lists unclear. See MarkdownStrict.
+func WithStrict() Option {
+	return func(options *Options) {
+		options.Strict = true
+	}
+}
+
+// Follow Gruber's original Markdown.pl 1.0.1, for archives that depend on
+// its output: no extensions, every ordered list numbered from 1, only 1.
+// as an ordered list marker, list items put in paragraphs for the blank
+// lines next to them alone, quotes that may interrupt a paragraph, and
+// only the backslash escapes it knows. The renderer is replaced with
+// MarkdownPlRenderer, so any WithRenderer goes after this, as do any
+// extensions to add back.
+func WithMarkdownPl() Option {
+	return func(options *Options) {
+		options.MarkdownPl = true
+		options.Extensions = 0
+		options.Renderer = MarkdownPlRenderer()
+	}
+}
+
+// Recognize the given tags as HTML block tags in this parse, in addition
+// to the defaults and any added to the renderer, e.g., for a site's own
+// custom elements.
+func WithBlockTags(tags ...string) Option {
+	return func(options *Options) {
+		setBlockTags(options, tags, true)
+	}
+}
+
+// Stop recognizing the given tags as HTML block tags in this parse, even
+// if they are among the defaults or added to the renderer.
+func WithoutBlockTags(tags ...string) Option {
+	return func(options *Options) {
+		setBlockTags(options, tags, false)
+	}
+}
+
+func setBlockTags(options *Options, tags []string, add bool) {
+	if options.BlockTags == nil {
+		options.BlockTags = make(map[string]bool)
+	}
+	for _, tag := range tags {
+		options.BlockTags[string(bytes.ToLower([]byte(tag)))] = add
+	}
+}
+
+// Run the given filters, in order, on the input before it is parsed, after
+// any added before. Filters get and return the whole text.
+func WithInputFilters(filters ...func(input []byte) []byte) Option {
+	return func(options *Options) {
+		options.InputFilters = append(options.InputFilters, filters...)
+	}
+}
+
+// Run the given filters, in order, on the output once it is rendered,
+// after any added before.
+func WithOutputFilters(filters ...func(output []byte) []byte) Option {
+	return func(options *Options) {
+		options.OutputFilters = append(options.OutputFilters, filters...)
+	}
+}
+
+// Run the given transformers, in order, on the document tree between
+// parsing and rendering, after any added before, e.g., to demote headers
+// or rewrite the targets of images. The document is rendered as Render
+// does it; custom span and block parsers and SourceMap do not apply.
+func WithTransformers(transformers ...Transformer) Option {
+	return func(options *Options) {
+		options.Transformers = append(options.Transformers, transformers...)
+	}
+}
+
+// Parse and render a block of markdown-encoded text with the given options.
+// With no options, the output is plain HTML and no extensions are enabled.
+func MarkdownWith(input []byte, opts ...Option) []byte {
+	return NewParser(opts...).Markdown(input)
+}
+
+// Parse and render like MarkdownWith in strict mode, e.g., to check
+// documentation in a build, returning an error that names the first
+// problem found, if any. The output is rendered either way, and all of
+// the problems go to WithDiagnostics if it is among the options.
+func MarkdownStrict(input []byte, opts ...Option) ([]byte, os.Error) {
+	p := NewParser(append(opts, WithStrict())...)
+	diags := p.options.Diagnostics
+	if diags == nil {
+		diags = new([]Diagnostic)
+		p.options.Diagnostics = diags
+	}
+	start := len(*diags)
+	output := p.Markdown(input)
+
+	found := (*diags)[start:]
+	if len(found) == 0 {
+		return output, nil
+	}
+	message := "blackfriday: line " + strconv.Itoa(found[0].Line) + ": " + found[0].Message
+	if len(found) > 1 {
+		message += " (and " + strconv.Itoa(len(found)-1) + " more)"
+	}
+	return output, os.NewError(message)
+}
+
+// Render a single line of markdown-encoded text as spans only, e.g., for
+// titles, table cells, and chat messages where blocks are unwanted.
+func MarkdownInline(input []byte, renderer *Renderer, extensions uint64) []byte {
+	if renderer == nil {
+		return nil
+	}
+	return NewParser(WithRenderer(renderer), WithExtensions(extensions)).Inline(input)
+}
+
+// Parse and render like MarkdownWith, but stop at the next block once done
+// is closed or receives a value, e.g., to bound the time spent on untrusted
+// input. The output so far is returned, with false if it stopped early.
+func MarkdownUntil(done <-chan bool, input []byte, opts ...Option) ([]byte, bool) {
+	return NewParser(opts...).MarkdownUntil(done, input)
+}
+
+// Render several documents, such as the chapters of a book, with the given
+// options, letting each one use the references defined in any of them.
+// A document's own definitions take precedence, followed by those of the
+// earliest document that defines an id. Header ids numbered by the
+// renderer keep counting from one document to the next.
+func MarkdownBatch(inputs [][]byte, opts ...Option) [][]byte {
+	// gather the definitions, the first for each id winning
+	shared := make(map[string]*Reference)
+	for _, input := range inputs {
+		for id, ref := range scanReferences(input) {
+			if shared[id] == nil {
+				shared[id] = ref
+			}
+		}
+	}
+
+	p := NewParser(append(opts, WithReferences(shared))...)
+	outputs := make([][]byte, len(inputs))
+	for i, input := range inputs {
+		outputs[i] = p.Markdown(input)
+	}
+	return outputs
+}
+
+// Parse a block of markdown-encoded text once and render it with each of
+// the given renderers, e.g., to HTML and to a table of contents, returning
+// the outputs in the same order. The document is rendered as Render does
+// it. The first renderer's settings steer the parser; the other options
+// apply as for MarkdownWith, except that each renderer gets its own user
+// data.
+func MarkdownTee(input []byte, renderers []*Renderer, opts ...Option) [][]byte {
+	if len(renderers) == 0 {
+		return nil
+	}
+	p := NewParser(append(opts, WithRenderer(renderers[0]))...)
+	doc, _ := p.parseTree(nil, input)
+
+	outputs := make([][]byte, len(renderers))
+	for i, renderer := range renderers {
+		outputs[i] = p.renderTree(doc, renderer, renderer.opaque)
+	}
+	return outputs
+}
+
+// Render the start of a document, e.g., for the index page of a blog:
+// everything before a <!--more--> line, if there is one, or else up to
+// the end of the given number of paragraphs, with any other blocks among
+// them. Links in it can use references defined anywhere in the document.
+// The result says whether anything was left out.
+func MarkdownExcerpt(input []byte, paragraphs int, opts ...Option) ([]byte, bool) {
+	p := NewParser(opts...)
+	end, more := excerptEnd(input, paragraphs, p.options.Extensions)
+	if more {
+		p = NewParser(append(opts, WithReferences(scanReferences(input)))...)
+	}
+	return p.Markdown(input[:end]), more
+}
+
+// where the excerpt of a document ends, and whether anything follows it
+func excerptEnd(input []byte, paragraphs int, extensions uint64) (int, bool) {
+	doc := Parse(input, extensions&^EXTENSION_STRIP_COMMENTS)
+	lines := lineStarts(input)
+	for _, n := range doc.Children {
+		if n.Type == NODE_HTML_BLOCK && n.Pos.Line > 0 && isMoreMarker(n.Literal) {
+			return lines[n.Pos.Line-1], true
+		}
+	}
+
+	count := 0
+	for i, n := range doc.Children {
+		if n.Type != NODE_PARAGRAPH || n.Pos.Line == 0 {
+			continue
+		}
+		if count++; count == paragraphs && i+1 < len(doc.Children) {
+			if n.Pos.EndLine < len(lines) {
+				return lines[n.Pos.EndLine], true
+			}
+			break
+		}
+	}
+	return len(input), false
+}
+
+// check for an HTML comment holding just the word more
+func isMoreMarker(html []byte) bool {
+	html = bytes.TrimSpace(html)
+	if len(html) < 7 || !bytes.HasPrefix(html, []byte("<!--")) || !bytes.HasSuffix(html, []byte("-->")) {
+		return false
+	}
+	return bytes.Equal(bytes.ToLower(bytes.TrimSpace(html[4:len(html)-3])), []byte("more"))
+}
+
+// find the reference definitions in a document without parsing the rest
+func scanReferences(input []byte) map[string]*Reference {
+	rndr := &render{refs: make(map[string]*reference)}
+	for beg := 0; beg < len(input); {
+		if end := isReference(rndr, input[beg:]); end > 0 {
+			beg += end
+			continue
+		}
+		beg = lineEnd(input, beg)
+		beg++
+	}
+
+	refs := make(map[string]*Reference)
+	for id, ref := range rndr.refs {
+		refs[id] = &Reference{Link: ref.link, Title: ref.title}
+	}
+	return refs
+}
+
+// A Parser renders one document after another with the same options,
+// setting up the parser once and reusing its buffers, which pays off for
+// many small documents. It is not safe for concurrent use.
+type Parser struct {
+	options Options
+	rndr    *render
+	inline  [256]inlineParser // the span parsers that suit the options
+	text    *bytes.Buffer     // the input after the first pass
+	tree    *Parser           // makes the document tree for the transformers, if any
+}
+
+// Create a parser with the given options, as for MarkdownWith.
+func NewParser(opts ...Option) *Parser {
+	p := new(Parser)
+	p.options = Options{TabSize: TAB_SIZE, MaxNesting: 16}
+	for _, opt := range opts {
+		opt(&p.options)
+	}
+	if p.options.Renderer == nil {
+		p.options.Renderer = HtmlRenderer(0)
+	}
+	p.rndr = newRender(&p.options)
+	p.inline = p.rndr.inline
+	p.text = bytes.NewBuffer(nil)
+	return p
+}
+
+// fill in the parts of the render structure that stay the same from call to call
+func newRender(options *Options) *render {
+	renderer, extensions := options.Renderer, options.Extensions
 
-	// fill in the render structure
 	rndr := new(render)
 	rndr.mk = renderer
 	rndr.flags = extensions
-	rndr.refs = make(map[string]*reference)
-	rndr.maxNesting = 16
+	rndr.maxNesting = options.MaxNesting
+	rndr.tabSize = options.TabSize
+	rndr.keepTabs = options.PreserveTabs && extensions&EXTENSION_FENCED_CODE != 0
+	rndr.wide = options.WideColumns
+	rndr.blocksOnly = options.BlocksOnly
+	rndr.strict = options.Strict
+	rndr.commonMark = options.CommonMark
+	rndr.markdownPl = options.MarkdownPl
+	rndr.limits = options.Limits
+	rndr.opaque = renderer.opaque
+	if options.Opaque != nil {
+		rndr.opaque = options.Opaque
+	}
+
+	// merge the renderer's block tags, then those of the options, with
+	// the defaults
+	defaults := block_tags
+	if rndr.markdownPl {
+		defaults = markdownPlBlockTags
+	}
+	rndr.blockTags = defaults
+	if len(renderer.blockTags)+len(options.BlockTags) > 0 {
+		rndr.blockTags = make(map[string]bool)
+		for tag := range defaults {
+			rndr.blockTags[tag] = true
+		}
+		for tag, add := range renderer.blockTags {
+			rndr.blockTags[tag] = add
+		}
+		for tag, add := range options.BlockTags {
+			rndr.blockTags[tag] = add
+		}
+	}
 
 	// register inline parsers
 	if rndr.mk.emphasis != nil || rndr.mk.doubleEmphasis != nil || rndr.mk.tripleEmphasis != nil {
 		rndr.inline['*'] = inlineEmphasis
 		rndr.inline['_'] = inlineEmphasis
+		if rndr.commonMark {
+			rndr.inline['*'] = inlineDelimiter
+			rndr.inline['_'] = inlineDelimiter
+		}
 		if extensions&EXTENSION_STRIKETHROUGH != 0 {
 			rndr.inline['~'] = inlineEmphasis
 		}
@@ -177,10 +1056,10 @@ func Markdown(input []byte, renderer *Renderer, extensions uint32) []byte {
 	if rndr.mk.codespan != nil {
 		rndr.inline['`'] = inlineCodespan
 	}
-	if rndr.mk.linebreak != nil {
+	if rndr.mk.linebreak != nil || extensions&EXTENSION_JOIN_CJK_LINES != 0 {
 		rndr.inline['\n'] = inlineLinebreak
 	}
-	if rndr.mk.image != nil || rndr.mk.link != nil {
+	if rndr.mk.image != nil || rndr.mk.link != nil || rndr.mk.footnoteRef != nil {
 		rndr.inline['['] = inlineLink
 	}
 	rndr.inline['<'] = inlineLangle
@@ -196,61 +1075,726 @@ func Markdown(input []byte, renderer *Renderer, extensions uint32) []byte {
 
 		rndr.inline['m'] = inlineAutolink // mailto
 		rndr.inline['M'] = inlineAutolink
+
+		rndr.inline['w'] = inlineWwwAutolink // www.
+		rndr.inline['W'] = inlineWwwAutolink
+
+		rndr.inline['@'] = inlineEmailAutolink // bare email
+	}
+
+	if extensions&EXTENSION_KBD != 0 && rndr.mk.kbd != nil {
+		rndr.inline['['] = inlineKbd
+	}
+
+	if extensions&EXTENSION_RUBY != 0 && rndr.mk.ruby != nil {
+		rndr.inline['{'] = inlineRuby
+	}
+	if extensions&EXTENSION_SHORTCODES != 0 && rndr.mk.shortcode != nil {
+		rndr.inline['{'] = inlineShortcode
+	}
+	if extensions&EXTENSION_VARIABLES != 0 && extensions&EXTENSION_VARIABLES_AS_MARKDOWN == 0 && rndr.mk.variable != nil {
+		rndr.inline['{'] = inlineVariable
+	}
+
+	if extensions&EXTENSION_HASHTAGS != 0 && rndr.mk.hashtagLink != nil {
+		rndr.inline['#'] = inlineHashtag
 	}
+	if extensions&EXTENSION_MENTIONS != 0 && rndr.mk.mentionLink != nil {
+		rndr.inline['@'] = inlineMention
+	}
+
+	if extensions&EXTENSION_GITHUB_REFS != 0 {
+		if rndr.mk.issueBase != "" && rndr.mk.link != nil {
+			rndr.inline['#'] = inlineIssueRef
+			rndr.inline['G'] = inlineIssueRef
+		}
+		if rndr.mk.commitBase != "" && rndr.mk.link != nil {
+			for c := '0'; c <= '9'; c++ {
+				rndr.inline[c] = inlineCommitRef
+			}
+			for c := 'a'; c <= 'f'; c++ {
+				rndr.inline[c] = inlineCommitRef
+			}
+			rndr.commitRefs = true
+		}
+		if rndr.mk.userBase != "" {
+			rndr.inline['@'] = inlineMention
+		}
+	}
+
+	return rndr
+}
 
-	// first pass: look for references, copy everything else
-	text := bytes.NewBuffer(nil)
+// Parse and render a block of markdown-encoded text.
+func (p *Parser) Markdown(input []byte) []byte {
+	output, _ := p.MarkdownUntil(nil, input)
+	return output
+}
+
+// start over from what the last call left behind, returning the input
+// as it is to be parsed
+func (p *Parser) reset(done <-chan bool, input []byte) []byte {
+	options, rndr := &p.options, p.rndr
+	renderer, extensions := options.Renderer, options.Extensions
+
+	// hostile input is cut short before anything else is done with it
+	cut := 0
+	if limit := options.Limits.Input; limit > 0 && len(input) > limit {
+		input = cutInput(input, limit)
+		cut = countLines(input) + 1
+	}
+	bad := 0
+	if options.Normalize != 0 {
+		input, bad = normalize(input, options.Normalize)
+	}
+	for _, filter := range options.InputFilters {
+		input = filter(input)
+	}
+
+	rndr.arena.reset()
+	rndr.refs, rndr.defined = make(map[string]*reference), 0
+	for id, ref := range options.Predefined {
+		if ref != nil {
+			lr := rndr.arena.reference()
+			lr.link, lr.title, lr.external = ref.Link, ref.Title, true
+			rndr.refs[string(bytes.ToLower([]byte(id)))] = lr
+		}
+	}
+	rndr.inline = p.inline
+	rndr.examples, rndr.exampleLabels = 0, nil
+	rndr.headerIds = nil
+	rndr.notes, rndr.footnotes, rndr.citations = nil, rndr.footnotes[:0], rndr.citations[:0]
+	if extensions&(EXTENSION_FOOTNOTES|EXTENSION_CITATIONS) != 0 {
+		rndr.notes = make(map[string]*footnote)
+	}
+	rndr.source, rndr.sourceLines = nil, rndr.sourceLines[:0]
+	rndr.done, rndr.stopped = done, false
+	rndr.mapSource, rndr.sourceMap = options.SourceMap != nil, rndr.sourceMap[:0]
+	rndr.diagnose, rndr.diagnostics, rndr.line = options.Diagnostics != nil, rndr.diagnostics[:0], 0
+	if cut > 0 {
+		rndr.line = cut
+		warn(rndr, DIAG_LIMIT, "input is longer than "+strconv.Itoa(options.Limits.Input)+" bytes; the rest is left out")
+	}
+	rndr.inputErr = nil
+	if bad > 0 {
+		rndr.line = bad
+		if options.Normalize == NORMALIZE_ERROR {
+			rndr.inputErr = invalidUTF8(bad)
+			warn(rndr, DIAG_INVALID_UTF8, "input is not valid UTF-8")
+		} else {
+			warn(rndr, DIAG_INVALID_UTF8, "input is not valid UTF-8; the invalid bytes are replaced with U+FFFD")
+		}
+	}
+
+	// variables can be filled in before parsing, so their values are markdown
+	if extensions&EXTENSION_VARIABLES != 0 && extensions&EXTENSION_VARIABLES_AS_MARKDOWN != 0 && rndr.mk.variable != nil {
+		input = expandVariables(input, rndr.mk.variable)
+	}
+
+	if extensions&EXTENSION_EXAMPLE_LISTS != 0 {
+		rndr.exampleLabels = findExampleLabels(input)
+		if len(rndr.exampleLabels) > 0 {
+			rndr.inline['('] = inlineExampleRef
+		}
+	}
+
+	if extensions&EXTENSION_IMPLICIT_HEADER_REFS != 0 {
+		rndr.headerIds = make(map[string]int)
+		findHeaderRefs(rndr, input)
+	}
+
+	// the caller's span parsers come first, falling back on the built-in ones
+	for c, parser := range renderer.inlineParsers {
+		if parser != nil {
+			rndr.inline[c] = customInline(parser, rndr.inline[c])
+		}
+	}
+
+	return input
+}
+
+// Render a single line of markdown-encoded text as spans only, without
+// looking for paragraphs, headers, lists, or other blocks, e.g., for
+// titles and chat messages. The renderer's document header and footer
+// are left out.
+func (p *Parser) Inline(input []byte) []byte {
+	input = bytes.TrimRight(p.reset(nil, input), " \t\r\n")
+
+	output := bytes.NewBuffer(nil)
+	parseInline(output, p.rndr, input)
+
+	result := output.Bytes()
+	for _, filter := range p.options.OutputFilters {
+		result = filter(result)
+	}
+	return result
+}
+
+// Parse and render a block of markdown-encoded text, stopping early
+// as MarkdownUntil does.
+func (p *Parser) MarkdownUntil(done <-chan bool, input []byte) ([]byte, bool) {
+	if len(p.options.Transformers) > 0 {
+		return p.transform(done, input)
+	}
+	return p.parse(nil, done, input)
+}
+
+// Parse and render a block of markdown-encoded text, writing the output
+// to w a few top-level blocks at a time rather than all at the end, so a
+// long document takes little memory for the output beyond its largest
+// block. Transformers, output filters, and a renderer that changes the
+// output as a whole, such as the HTML renderer when it pretty prints,
+// minifies, or has an attribute hook, need all of it; it is then written
+// in one piece.
+func (p *Parser) MarkdownTo(w io.Writer, input []byte) os.Error {
+	whole := p.options.Renderer.wholeOutput
+	if len(p.options.Transformers) > 0 || len(p.options.OutputFilters) > 0 || (whole != nil && whole(p.rndr.opaque)) {
+		output := p.Markdown(input)
+		if p.rndr.inputErr != nil {
+			return p.rndr.inputErr
+		}
+		_, err := w.Write(output)
+		return err
+	}
+	p.parse(w, nil, input)
+	return p.rndr.writeErr
+}
+
+// parse and render, either returning the output or, if w is not nil,
+// writing it there as it goes and returning nil
+func (p *Parser) parse(w io.Writer, done <-chan bool, input []byte) ([]byte, bool) {
+	options, rndr := &p.options, p.rndr
+	renderer := options.Renderer
+	input = p.reset(done, input)
+	rndr.writer, rndr.written, rndr.writeErr = w, 0, rndr.inputErr
+
+	// first pass: look for references and drop comment lines. The lines
+	// left are used where they are, in input[from:to], until one has to
+	// change: a tab to expand, a \r to turn into \n, or a line kept after
+	// one that was dropped. From there on they are copied into text.
+	text := p.text
+	text.Reset()
+	copied := false
+	from, to := 0, 0
 	beg, end := 0, 0
+	line := 1
+	inFence := false
+	trackLines := renderer.sourcepos != nil || rndr.mapSource || rndr.diagnose
+	if trackLines {
+		rndr.source = input
+	}
 	for beg < len(input) { // iterate over lines
-		if end = isReference(rndr, input[beg:]); end > 0 {
+		rndr.line = line
+		if end = metadataBlock(rndr, input, beg); end > 0 {
+			line += countLines(input[beg : beg+end])
+			beg += end
+		} else if end = isFootnote(rndr, input[beg:]); end > 0 {
+			line += countLines(input[beg : beg+end])
+			beg += end
+		} else if end = isReference(rndr, input[beg:]); end > 0 {
+			line += countLines(input[beg : beg+end])
+			beg += end
+		} else if end = isCommentLine(rndr, input[beg:]); end > 0 {
+			line += countLines(input[beg : beg+end])
 			beg += end
 		} else { // skip to the next line
+			if trackLines {
+				rndr.sourceLines = append(rndr.sourceLines, sourceLine{line, beg})
+			}
 			end = beg
-			for end < len(input) && input[end] != '\n' && input[end] != '\r' {
-				end++
+			end = lineBreak(input, end)
+			keepTabs := inFence && rndr.keepTabs
+
+			if rndr.strict && !inFence && mixedIndent(input[beg:end]) {
+				warn(rndr, DIAG_MIXED_INDENT, "indentation mixes tabs and spaces")
+			}
+
+			// start copying if this line cannot be used where it is
+			if !copied {
+				if from == to {
+					from, to = beg, beg
+				}
+				if beg != to || (!keepTabs && bytes.IndexByte(input[beg:end], '\t') >= 0) ||
+					hasReturn(input, end) {
+					text.Write(input[from:to])
+					copied = true
+				}
 			}
 
 			// add the line body if present
-			if end > beg {
-				expandTabs(text, input[beg:end])
+			if copied && end > beg {
+				if keepTabs {
+					text.Write(input[beg:end])
+				} else {
+					expandTabs(text, input[beg:end], rndr.tabSize, rndr.wide)
+				}
+			}
+
+			// the fence lines themselves are expanded
+			if rndr.keepTabs || (rndr.strict && rndr.flags&EXTENSION_FENCED_CODE != 0) {
+				if inFence {
+					inFence = isFencedCode(input[beg:end], nil, nil) == 0
+				} else {
+					var syntax *string
+					inFence = isFencedCode(input[beg:end], &syntax, nil) > 0
+				}
 			}
 
 			for end < len(input) && (input[end] == '\n' || input[end] == '\r') {
 				// add one \n per newline
 				if input[end] == '\n' || (end+1 < len(input) && input[end+1] != '\n') {
-					text.WriteByte('\n')
+					if copied {
+						text.WriteByte('\n')
+					}
+					line++
+
+					// blank lines are lines of the text too
+					if trackLines && end+1 < len(input) && (input[end+1] == '\n' || input[end+1] == '\r') {
+						rndr.sourceLines = append(rndr.sourceLines, sourceLine{line, end + 1})
+					}
 				}
 				end++
 			}
 
 			beg = end
+			if !copied {
+				to = end
+			}
 		}
 	}
 
 	// second pass: actual rendering
 	output := bytes.NewBuffer(nil)
 	if rndr.mk.documentHeader != nil {
-		rndr.mk.documentHeader(output, rndr.mk.opaque)
+		rndr.mk.documentHeader(output, rndr.opaque)
 	}
 
-	if text.Len() > 0 {
+	data := input[from:to]
+	if copied {
+		data = text.Bytes()
+	}
+	if len(data) > 0 {
 		// add a final newline if not already present
-		finalchar := text.Bytes()[text.Len()-1]
+		finalchar := data[len(data)-1]
 		if finalchar != '\n' && finalchar != '\r' {
+			if !copied {
+				text.Write(data)
+			}
 			text.WriteByte('\n')
+			data = text.Bytes()
 		}
-		parseBlock(output, rndr, text.Bytes())
+		parseBlock(output, rndr, data)
+	}
+	if len(rndr.footnotes)+len(rndr.citations) > 0 && !rndr.stopped {
+		renderFootnotes(output, rndr)
 	}
 
 	if rndr.mk.documentFooter != nil {
-		rndr.mk.documentFooter(output, rndr.mk.opaque)
+		rndr.mk.documentFooter(output, rndr.opaque)
 	}
 
 	if rndr.nesting != 0 {
 		panic("Nesting level did not end at zero")
 	}
 
-	return output.Bytes()
+	if options.SourceMap != nil {
+		*options.SourceMap = append(*options.SourceMap, rndr.sourceMap...)
+	}
+
+	if options.Diagnostics != nil {
+		*options.Diagnostics = append(*options.Diagnostics, rndr.diagnostics...)
+	}
+
+	if options.References != nil {
+		for id, ref := range rndr.refs {
+			if !ref.external {
+				options.References[id] = &Reference{ref.link, ref.title, ref.used}
+			}
+		}
+	}
+
+	if w != nil {
+		if rndr.writeErr == nil {
+			_, rndr.writeErr = w.Write(output.Bytes())
+		}
+		rndr.writer = nil
+		return nil, !rndr.stopped
+	}
+
+	result := output.Bytes()
+	for _, filter := range options.OutputFilters {
+		result = filter(result)
+	}
+	return result, !rndr.stopped
+}
+
+// A Processor renders documents with the same options, and is safe for
+// concurrent use once created. Each call gets its own parser state and,
+// for an HTML renderer, its own user data, so the renderer must not be
+// changed afterwards. Renderers of other kinds must keep per-document
+// state out of their user data. CollectReferences does not apply.
+type Processor struct {
+	opts []Option
+	lock sync.Mutex
+	idle []*Parser // parsers ready for the next call
+}
+
+// Create a processor with the given options, as for MarkdownWith.
+func NewProcessor(opts ...Option) *Processor {
+	p := new(Processor)
+	p.opts = append(p.opts, opts...)
+	p.opts = append(p.opts, CollectReferences(nil))
+	return p
+}
+
+// Parse and render a block of markdown-encoded text.
+func (p *Processor) Render(input []byte) []byte {
+	parser := p.get()
+	output := parser.Markdown(input)
+	p.put(parser)
+	return output
+}
+
+// Parse and render a block of markdown-encoded text, writing the output
+// to w as Parser.MarkdownTo does.
+func (p *Processor) RenderTo(w io.Writer, input []byte) os.Error {
+	parser := p.get()
+	err := parser.MarkdownTo(w, input)
+	p.put(parser)
+	return err
+}
+
+// take an idle parser, or make one, set up for a new call
+func (p *Processor) get() *Parser {
+	p.lock.Lock()
+	var parser *Parser
+	if n := len(p.idle); n > 0 {
+		parser, p.idle = p.idle[n-1], p.idle[:n-1]
+	}
+	p.lock.Unlock()
+	if parser == nil {
+		parser = NewParser(p.opts...)
+	}
+
+	if parser.options.Opaque == nil {
+		parser.rndr.opaque = parser.options.Renderer.CallOpaque()
+	}
+	return parser
+}
+
+// give a parser back for the next call
+func (p *Processor) put(parser *Parser) {
+	p.lock.Lock()
+	p.idle = append(p.idle, parser)
+	p.lock.Unlock()
+}
+
+// Parse and render markdown-encoded text read from r, writing the result
+// to w. Reference links may be defined anywhere in a document, so all of
+// the input is read before any output is written; the output is then
+// written as it is rendered, as Parser.MarkdownTo does.
+func MarkdownFrom(r io.Reader, w io.Writer, renderer *Renderer, extensions uint64) os.Error {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if renderer == nil {
+		return nil
+	}
+	return NewParser(WithRenderer(renderer), WithExtensions(extensions)).MarkdownTo(w, input)
+}
+
+// Render untrusted short-form input, such as comments, with
+// CommentRenderer and COMMENT_EXTENSIONS.
+func MarkdownComment(input []byte) []byte {
+	return Markdown(input, CommentRenderer(), COMMENT_EXTENSIONS)
+}
+
+// Render input as GitHub does, under WithGFM.
+func MarkdownGFM(input []byte) []byte {
+	return MarkdownWith(input, WithGFM())
+}
+
+// Render input as Markdown.pl does, under WithMarkdownPl.
+func MarkdownPl(input []byte) []byte {
+	return MarkdownWith(input, WithMarkdownPl())
+}
+
+// Recognize an additional tag as an HTML block tag when parsing with
+// this renderer, e.g., "template", "svg", or a custom element.
+func (r *Renderer) AddBlockTag(tag string) {
+	if r.blockTags == nil {
+		r.blockTags = make(map[string]bool)
+	}
+	r.blockTags[string(bytes.ToLower([]byte(tag)))] = true
+}
+
+// Handle spans starting with a character with a parser of your own, e.g.,
+// for icons, macros, or ticket numbers. When the parser takes nothing, any
+// built-in handling of the character still applies. A nil parser removes
+// the one added before.
+func (r *Renderer) AddInlineParser(c byte, parser InlineParser) {
+	if r.inlineParsers == nil {
+		r.inlineParsers = make(map[byte]InlineParser)
+	}
+	r.inlineParsers[c] = parser
+}
+
+// Handle blocks of your own syntax, e.g., directives, with a parser of your
+// own. Parsers with a priority above 0 are tried before the built-in ones,
+// the rest only where no built-in block matches, before falling back on a
+// paragraph; higher priorities are tried first. Custom blocks do not
+// interrupt a paragraph, so they need a blank line before them.
+func (r *Renderer) AddBlockParser(priority int, parser BlockParser) {
+	i := len(r.blockParsers)
+	for i > 0 && r.blockParsers[i-1].priority < priority {
+		i--
+	}
+	r.blockParsers = append(r.blockParsers, customBlock{})
+	copy(r.blockParsers[i+1:], r.blockParsers[i:])
+	r.blockParsers[i] = customBlock{priority, parser}
+}
+
+// Stop recognizing a tag as an HTML block tag when parsing with this renderer.
+// Text starting with the tag is then handled as ordinary inline HTML.
+func (r *Renderer) RemoveBlockTag(tag string) {
+	if r.blockTags == nil {
+		r.blockTags = make(map[string]bool)
+	}
+	r.blockTags[string(bytes.ToLower([]byte(tag)))] = false
+}
+
+// Set the function that gives the link target for a #hashtag when
+// EXTENSION_HASHTAGS is enabled. It receives the tag without the '#'.
+func (r *Renderer) SetHashtagLink(f func(tag []byte) []byte) {
+	r.hashtagLink = f
+}
+
+// Set the function that gives the link target for an @mention when
+// EXTENSION_MENTIONS is enabled. It receives the name without the '@'.
+func (r *Renderer) SetMentionLink(f func(name []byte) []byte) {
+	r.mentionLink = f
+}
+
+// Set the function that gives the value of a {{name}} variable when
+// EXTENSION_VARIABLES is enabled. It receives the name without the braces
+// and returns nil for unknown variables, which are left alone.
+// Values are inserted as plain text unless EXTENSION_VARIABLES_AS_MARKDOWN
+// is also enabled, in which case they are substituted before parsing.
+func (r *Renderer) SetVariables(f func(name []byte) []byte) {
+	r.variable = f
+}
+
+// Set a fixed map of values for {{name}} variables.
+// See SetVariables for details.
+func (r *Renderer) SetVariableMap(vars map[string]string) {
+	r.variable = func(name []byte) []byte {
+		if value, ok := vars[string(name)]; ok {
+			return []byte(value)
+		}
+		return nil
+	}
+}
+
+// Set the base URLs used for GitHub-style references when
+// EXTENSION_GITHUB_REFS is enabled. The issue number, commit SHA, or
+// user name is appended to the matching base, e.g., with issues set to
+// "https://github.com/russross/blackfriday/issues/", #12 and GH-12 both
+// link to issue 12. An empty base leaves that kind of reference as text.
+func (r *Renderer) SetGithubRefLinks(issues, commits, users string) {
+	r.issueBase = issues
+	r.commitBase = commits
+	r.userBase = users
+}
+
+// Set the function that rewrites the destination of every link, image,
+// and autolink before it goes to the renderer, e.g., to serve images
+// from a CDN or resolve relative paths. It receives one of the URL_*
+// kinds; email autolinks come as the bare address. Autolinks show the
+// rewritten address, as it is all the renderer gets.
+func (r *Renderer) SetUrlRewriter(f func(dest []byte, kind int) []byte) {
+	r.urlRewriter = f
+}
+
+// Set the function that sees each raw HTML block and inline tag before
+// the renderer does, e.g., to apply a policy of your own or to swap in
+// components. It returns the HTML to use in its place; nil drops it.
+// Blocks holding markdown come as their opening and closing tags.
+func (r *Renderer) SetRawHtmlHook(f func(html []byte, block bool) []byte) {
+	r.htmlHook = f
+}
+
+// Set the function that supplies the reference for [text][id], [text] [id],
+// [text][] or [text] when the document does not define the id, e.g., to
+// link to wiki pages or tickets. It receives the id as written, the text
+// for the last two; returning false leaves the text alone.
+func (r *Renderer) SetReferenceResolver(f func(id []byte) (*Reference, bool)) {
+	r.refResolver = f
+}
+
+// Get the callbacks of the renderer, e.g., so that a replacement can fall
+// back on the one it replaces.
+func (r *Renderer) Callbacks() Callbacks {
+	return Callbacks{
+		Blockcode:      r.blockcode,
+		Blockquote:     r.blockquote,
+		Blockhtml:      r.blockhtml,
+		Header:         r.header,
+		Hrule:          r.hrule,
+		List:           r.list,
+		Listitem:       r.listitem,
+		Paragraph:      r.paragraph,
+		Table:          r.table,
+		TableRow:       r.tableRow,
+		TableCell:      r.tableCell,
+		LineBlock:      r.lineBlock,
+		Details:        r.details,
+		Div:            r.div,
+		Attributes:     r.attributes,
+		BlockShortcode: r.blockShortcode,
+		Footnotes:      r.footnotes,
+		FootnoteItem:   r.footnoteItem,
+		Autolink:       r.autolink,
+		Codespan:       r.codespan,
+		DoubleEmphasis: r.doubleEmphasis,
+		Emphasis:       r.emphasis,
+		Image:          r.image,
+		MediaEmbed:     r.mediaEmbed,
+		Linebreak:      r.linebreak,
+		Link:           r.link,
+		RawHtmlTag:     r.rawHtmlTag,
+		TripleEmphasis: r.tripleEmphasis,
+		Strikethrough:  r.strikethrough,
+		Ruby:           r.ruby,
+		Kbd:            r.kbd,
+		Shortcode:      r.shortcode,
+		FootnoteRef:    r.footnoteRef,
+		Entity:         r.entity,
+		NormalText:     r.normalText,
+		DocumentHeader: r.documentHeader,
+		DocumentFooter: r.documentFooter,
+		Sourcepos:      r.sourcepos,
+	}
+}
+
+// Replace the callbacks that are set in c, leaving the others alone, e.g.,
+// to change how an HTML renderer writes images and code blocks. The
+// replacements are handed the renderer's user data like the others.
+func (r *Renderer) SetCallbacks(c Callbacks) {
+	if c.Blockcode != nil {
+		r.blockcode = c.Blockcode
+	}
+	if c.Blockquote != nil {
+		r.blockquote = c.Blockquote
+	}
+	if c.Blockhtml != nil {
+		r.blockhtml = c.Blockhtml
+	}
+	if c.Header != nil {
+		r.header = c.Header
+	}
+	if c.Hrule != nil {
+		r.hrule = c.Hrule
+	}
+	if c.List != nil {
+		r.list = c.List
+	}
+	if c.Listitem != nil {
+		r.listitem = c.Listitem
+	}
+	if c.Paragraph != nil {
+		r.paragraph = c.Paragraph
+	}
+	if c.Table != nil {
+		r.table = c.Table
+	}
+	if c.TableRow != nil {
+		r.tableRow = c.TableRow
+	}
+	if c.TableCell != nil {
+		r.tableCell = c.TableCell
+	}
+	if c.LineBlock != nil {
+		r.lineBlock = c.LineBlock
+	}
+	if c.Details != nil {
+		r.details = c.Details
+	}
+	if c.Div != nil {
+		r.div = c.Div
+	}
+	if c.Attributes != nil {
+		r.attributes = c.Attributes
+	}
+	if c.BlockShortcode != nil {
+		r.blockShortcode = c.BlockShortcode
+	}
+	if c.Footnotes != nil {
+		r.footnotes = c.Footnotes
+	}
+	if c.FootnoteItem != nil {
+		r.footnoteItem = c.FootnoteItem
+	}
+	if c.Autolink != nil {
+		r.autolink = c.Autolink
+	}
+	if c.Codespan != nil {
+		r.codespan = c.Codespan
+	}
+	if c.DoubleEmphasis != nil {
+		r.doubleEmphasis = c.DoubleEmphasis
+	}
+	if c.Emphasis != nil {
+		r.emphasis = c.Emphasis
+	}
+	if c.Image != nil {
+		r.image = c.Image
+	}
+	if c.MediaEmbed != nil {
+		r.mediaEmbed = c.MediaEmbed
+	}
+	if c.Linebreak != nil {
+		r.linebreak = c.Linebreak
+	}
+	if c.Link != nil {
+		r.link = c.Link
+	}
+	if c.RawHtmlTag != nil {
+		r.rawHtmlTag = c.RawHtmlTag
+	}
+	if c.TripleEmphasis != nil {
+		r.tripleEmphasis = c.TripleEmphasis
+	}
+	if c.Strikethrough != nil {
+		r.strikethrough = c.Strikethrough
+	}
+	if c.Ruby != nil {
+		r.ruby = c.Ruby
+	}
+	if c.Kbd != nil {
+		r.kbd = c.Kbd
+	}
+	if c.Shortcode != nil {
+		r.shortcode = c.Shortcode
+	}
+	if c.FootnoteRef != nil {
+		r.footnoteRef = c.FootnoteRef
+	}
+	if c.Entity != nil {
+		r.entity = c.Entity
+	}
+	if c.NormalText != nil {
+		r.normalText = c.NormalText
+	}
+	if c.DocumentHeader != nil {
+		r.documentHeader = c.DocumentHeader
+	}
+	if c.DocumentFooter != nil {
+		r.documentFooter = c.DocumentFooter
+	}
+	if c.Sourcepos != nil {
+		r.sourcepos = c.Sourcepos
+	}
 }
 
 
@@ -271,8 +1815,47 @@ func Markdown(input []byte, renderer *Renderer, extensions uint32) []byte {
 
 // References are parsed and stored in this struct.
 type reference struct {
-	link  []byte
-	title []byte
+	link     []byte
+	title    []byte
+	used     bool // a link refers to it
+	external bool // it came from the caller, not the document
+}
+
+// A Reference is the target of a reference link, as given by the
+// function set with SetReferenceResolver or collected by CollectReferences.
+type Reference struct {
+	Link  []byte
+	Title []byte
+	Used  bool // only set by CollectReferences
+}
+
+// the key of a reference id in rndr.refs, as ids match whatever their
+// case; an id without capitals is its own key, and one with only ASCII
+// capitals is folded into room kept by the parser, so neither is copied
+// until the key goes into the map
+func refKey(rndr *render, id []byte) []byte {
+	upper := false
+	for _, c := range id {
+		if c >= utf8.RuneSelf {
+			return bytes.ToLower(id)
+		}
+		if c >= 'A' && c <= 'Z' {
+			upper = true
+		}
+	}
+	if !upper {
+		return id
+	}
+
+	key := rndr.key[:0]
+	for _, c := range id {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		key = append(key, c)
+	}
+	rndr.key = key
+	return key
 }
 
 // Compare two []byte values (case-insensitive), returning
@@ -302,6 +1885,52 @@ func less(a []byte, b []byte) bool {
 	return false
 }
 
+// Replace each {{name}} variable in the input with its value.
+func expandVariables(input []byte, value func(name []byte) []byte) []byte {
+	out := bytes.NewBuffer(nil)
+	mark := 0
+	for i := 0; i+1 < len(input); i++ {
+		if input[i] != '{' || input[i+1] != '{' {
+			continue
+		}
+		end, name := variableName(input[i:])
+		if end == 0 {
+			continue
+		}
+		if v := value(name); v != nil {
+			out.Write(input[mark:i])
+			out.Write(v)
+			mark = i + end
+		}
+		i += end - 1
+	}
+	if mark == 0 {
+		return input
+	}
+	out.Write(input[mark:])
+	return out.Bytes()
+}
+
+// Check whether or not data starts with a %% comment line, which
+// is dropped from the input when EXTENSION_STRIP_COMMENTS is enabled.
+// Returns the number of bytes to skip to move past it, or zero
+// if the first line is not a comment.
+func isCommentLine(rndr *render, data []byte) int {
+	if rndr.flags&EXTENSION_STRIP_COMMENTS == 0 || len(data) < 2 || data[0] != '%' || data[1] != '%' {
+		return 0
+	}
+
+	i := 2
+	i = lineBreak(data, i)
+	if i < len(data) && data[i] == '\r' {
+		i++
+	}
+	if i < len(data) && data[i] == '\n' {
+		i++
+	}
+	return i
+}
+
 // Check whether or not data starts with a reference link.
 // If so, it is parsed and stored in the list of references
 // (in the render struct).
@@ -402,9 +2031,7 @@ func isReference(rndr *render, data []byte) int {
 		title_offset = i
 
 		// look for EOL
-		for i < len(data) && data[i] != '\n' && data[i] != '\r' {
-			i++
-		}
+		i = lineBreak(data, i)
 		if i+1 < len(data) && data[i] == '\n' && data[i+1] == '\r' {
 			title_end = i + 1
 		} else {
@@ -431,11 +2058,18 @@ func isReference(rndr *render, data []byte) int {
 	}
 
 	// id matches are case-insensitive
-	id := string(bytes.ToLower(data[id_offset:id_end]))
-	rndr.refs[id] = &reference{
-		link:  data[link_offset:link_end],
-		title: data[title_offset:title_end],
+	key := refKey(rndr, data[id_offset:id_end])
+	if old, ok := rndr.refs[string(key)]; ok && !old.external {
+		warn(rndr, DIAG_DUPLICATE_REFERENCE, "reference ["+string(data[id_offset:id_end])+"] is defined again; the last definition is used")
+	} else if limit := rndr.limits.References; limit > 0 && rndr.defined >= limit {
+		warn(rndr, DIAG_LIMIT, "more than "+strconv.Itoa(limit)+" references are defined; ["+string(data[id_offset:id_end])+"] is ignored")
+		return line_end
+	} else {
+		rndr.defined++
 	}
+	ref := rndr.arena.reference()
+	ref.link, ref.title = data[link_offset:link_end], data[title_offset:title_end]
+	rndr.refs[string(key)] = ref
 
 	return line_end
 }
@@ -465,39 +2099,339 @@ func isspace(c byte) bool {
 }
 
 // Test if a character is a letter or a digit.
-// TODO: check when this is looking for ASCII alnum and when it should use unicode
 func isalnum(c byte) bool {
 	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
 
-// Replace tab characters with spaces, aligning to the next TAB_SIZE column.
-// TODO: count runes rather than bytes
-func expandTabs(out *bytes.Buffer, line []byte) {
-	i, tab := 0, 0
+// Whether the last character of data, or the first, is whitespace,
+// punctuation, or part of a word. A character beyond ASCII is decoded
+// from UTF-8 and classed by the unicode tables, with symbols counting as
+// punctuation and combining marks as part of the word they sit on, so
+// that *слово* and 「*強調*」 find their boundaries as ASCII text does.
+// No character at all counts as whitespace, and an invalid sequence as
+// none of the three.
+func runeClass(data []byte, last bool) (space, punct, alnum bool) {
+	if len(data) == 0 {
+		return true, false, false
+	}
+	r, _ := utf8.DecodeRune(data)
+	if last {
+		r, _ = utf8.DecodeLastRune(data)
+	}
+	if r < utf8.RuneSelf {
+		return isspace(byte(r)), ispunct(byte(r)), isalnum(byte(r))
+	}
+	if r == utf8.RuneError {
+		return false, false, false
+	}
+	return unicode.IsSpace(r), unicode.IsPunct(r) || unicode.IsSymbol(r),
+		unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
 
-	for i < len(line) {
-		org := i
-		for i < len(line) && line[i] != '\t' {
-			i++
-			tab++
-		}
+// Test if the character at data[i], or the one ending just before it,
+// is whitespace; the ends of data count as whitespace.
+func isspaceAt(data []byte, i int) bool {
+	space, _, _ := runeClass(data[i:], false)
+	return space
+}
 
-		if i > org {
-			out.Write(line[org:i])
-		}
+func isspaceBefore(data []byte, i int) bool {
+	space, _, _ := runeClass(data[:i], true)
+	return space
+}
 
-		if i >= len(line) {
-			break
+// Test if the character at data[i], or the one ending just before it,
+// is a letter or digit.
+func isalnumAt(data []byte, i int) bool {
+	_, _, alnum := runeClass(data[i:], false)
+	return alnum
+}
+
+func isalnumBefore(data []byte, i int) bool {
+	_, _, alnum := runeClass(data[:i], true)
+	return alnum
+}
+
+// Test if a word may start at data[i], or end just before it: the
+// character on the other side is whitespace or punctuation, or there is
+// none.
+func wordStart(data []byte, i int) bool {
+	space, punct, _ := runeClass(data[:i], true)
+	return space || punct
+}
+
+func wordEnd(data []byte, i int) bool {
+	space, punct, _ := runeClass(data[i:], false)
+	return space || punct
+}
+
+// Replace tab characters with spaces, aligning to the next tab stop.
+// Most lines have no tabs, and are written as they are. Columns are
+// counted in characters, or in the width of each when wide is set.
+func expandTabs(out *bytes.Buffer, line []byte, tabSize int, wide bool) {
+	tab := 0
+	for {
+		i := bytes.IndexByte(line, '\t')
+		if i < 0 {
+			out.Write(line)
+			return
+		}
+		out.Write(line[:i])
+		for _, c := range string(line[:i]) {
+			switch {
+			case c < utf8.RuneSelf || !wide:
+				tab++
+			case unicode.Is(unicode.Mn, c) || unicode.Is(unicode.Me, c):
+				// combining marks take no room of their own
+			case isWide(int(c)):
+				tab += 2
+			default:
+				tab++
+			}
 		}
 
 		for {
 			out.WriteByte(' ')
 			tab++
-			if tab%TAB_SIZE == 0 {
+			if tab%tabSize == 0 {
 				break
 			}
 		}
 
-		i++
+		line = line[i+1:]
+	}
+}
+
+// Test if a character is East Asian wide or fullwidth, by the blocks
+// made up of such characters.
+func isWide(c int) bool {
+	return (c >= 0x1100 && c <= 0x115f) || // hangul jamo initial consonants
+		(c >= 0x2e80 && c <= 0x303e) || // radicals, kangxi, CJK symbols and punctuation
+		(c >= 0x3041 && c <= 0x33ff) || // kana, bopomofo, CJK compatibility
+		(c >= 0x3400 && c <= 0x4dbf) || // ideographs extension A
+		(c >= 0x4e00 && c <= 0x9fff) || // unified ideographs
+		(c >= 0xa000 && c <= 0xa4cf) || // yi
+		(c >= 0xac00 && c <= 0xd7a3) || // hangul syllables
+		(c >= 0xf900 && c <= 0xfaff) || // compatibility ideographs
+		(c >= 0xfe30 && c <= 0xfe4f) || // CJK compatibility forms
+		(c >= 0xff00 && c <= 0xff60) || // fullwidth forms
+		(c >= 0xffe0 && c <= 0xffe6) || // fullwidth signs
+		(c >= 0x1f300 && c <= 0x1f64f) || // pictographs and emoticons
+		(c >= 0x1f900 && c <= 0x1f9ff) || // supplemental pictographs
+		(c >= 0x20000 && c <= 0x3fffd) // supplementary ideographs
+}
+
+// cut input down to at most limit bytes, after the last line break if
+// there is one, or else before the character the limit falls in
+func cutInput(input []byte, limit int) []byte {
+	if i := bytes.LastIndex(input[:limit], []byte("\n")); i >= 0 {
+		return input[:i+1]
+	}
+	for limit > 0 && !utf8.RuneStart(input[limit]) {
+		limit--
+	}
+	return input[:limit]
+}
+
+// the position of the first \n from data[i] on, or the length of data
+func lineEnd(data []byte, i int) int {
+	if i >= len(data) {
+		return i
+	}
+	if j := bytes.IndexByte(data[i:], '\n'); j >= 0 {
+		return i + j
+	}
+	return len(data)
+}
+
+// the position of the first \n or \r from data[i] on, or the length of
+// data; a \r is rare, so it is looked for only before the \n
+func lineBreak(data []byte, i int) int {
+	end := lineEnd(data, i)
+	if i < end {
+		if j := bytes.IndexByte(data[i:end], '\r'); j >= 0 {
+			return i + j
+		}
+	}
+	return end
+}
+
+// the start of the line after the one data[i] is on, or the length of
+// data if there is none
+func nextLine(data []byte, i int) int {
+	if end := lineEnd(data, i); end < len(data) {
+		return end + 1
+	}
+	return len(data)
+}
+
+// check whether the line breaks starting at data[i] include a \r
+func hasReturn(data []byte, i int) bool {
+	for ; i < len(data) && (data[i] == '\n' || data[i] == '\r'); i++ {
+		if data[i] == '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+// count the line breaks in data, taking \r\n as one
+func countLines(data []byte) int {
+	n := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\n' || (data[i] == '\r' && (i+1 >= len(data) || data[i+1] != '\n')) {
+			n++
+		}
+	}
+	return n
+}
+
+// check whether the indentation of a line has both tabs and spaces
+func mixedIndent(line []byte) bool {
+	tabs, spaces := false, false
+	for i := 0; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ {
+		if line[i] == '\t' {
+			tabs = true
+		} else {
+			spaces = true
+		}
+	}
+	return tabs && spaces
+}
+
+// note a problem with the document on the current line, keeping the
+// problems in order of their lines
+func warn(rndr *render, kind int, message string) {
+	if !rndr.diagnose {
+		return
+	}
+	i := len(rndr.diagnostics)
+	rndr.diagnostics = append(rndr.diagnostics, Diagnostic{rndr.line, kind, message})
+	for i > 0 && rndr.diagnostics[i-1].Line > rndr.line {
+		rndr.diagnostics[i] = rndr.diagnostics[i-1]
+		i--
+	}
+	rndr.diagnostics[i] = Diagnostic{rndr.line, kind, message}
+}
+
+// the largest buffer worth keeping for reuse; a bigger one is left to
+// the garbage collector rather than held on to by an idle parser
+const maxFreeBuffer = 64 << 10
+
+// an empty buffer for the output of a nested block or span, reusing one
+// that has been given back if there is one
+func newBuffer(rndr *render) *bytes.Buffer {
+	n := len(rndr.buffers)
+	if n == 0 {
+		return bytes.NewBuffer(nil)
+	}
+	b := rndr.buffers[n-1]
+	rndr.buffers = rndr.buffers[:n-1]
+	b.Reset()
+	return b
+}
+
+// give a buffer from newBuffer back once the callbacks are done with
+// its contents
+func freeBuffer(rndr *render, b *bytes.Buffer) {
+	if cap(b.Bytes()) <= maxFreeBuffer {
+		rndr.buffers = append(rndr.buffers, b)
+	}
+}
+
+// An arena hands out the small records of a call, such as reference
+// definitions, table columns and the tables of the emphasis index, from
+// a few large blocks instead of one object at a time. They are all
+// taken back at once when the next call starts, so a parser used over
+// and over stops allocating them once its blocks are big enough. A
+// slice from the arena must not be appended to.
+type arena struct {
+	refs  []reference
+	ints  []int
+	bools []bool
+}
+
+// the size of the first block of each kind, and of the largest one kept
+// for the next call; a slice longer than maxArenaSlice is one object
+// anyway, so it is made on its own
+const (
+	minArenaBlock = 64
+	maxArenaBlock = 64 << 10
+	maxArenaSlice = 4 << 10
+)
+
+// take back everything handed out, keeping the blocks unless they are
+// too big to hold on to
+func (a *arena) reset() {
+	// references point into the input of the last call, which must not
+	// be kept alive by them
+	for i := range a.refs {
+		a.refs[i] = reference{}
+	}
+	a.refs = a.refs[:0]
+	if cap(a.refs) > maxArenaBlock {
+		a.refs = nil
+	}
+	a.ints = a.ints[:0]
+	if cap(a.ints) > maxArenaBlock {
+		a.ints = nil
+	}
+	a.bools = a.bools[:0]
+	if cap(a.bools) > maxArenaBlock {
+		a.bools = nil
+	}
+}
+
+// the size of a new block, once one of size have has run out with n
+// more wanted; the full block is left to the records handed out from it
+func arenaBlock(have, n int) int {
+	size := 2 * have
+	if size < minArenaBlock {
+		size = minArenaBlock
+	}
+	for size < n {
+		size *= 2
+	}
+	return size
+}
+
+// an empty reference
+func (a *arena) reference() *reference {
+	if len(a.refs) == cap(a.refs) {
+		a.refs = make([]reference, 0, arenaBlock(cap(a.refs), 1))
+	}
+	a.refs = a.refs[:len(a.refs)+1]
+	return &a.refs[len(a.refs)-1]
+}
+
+// n zeros
+func (a *arena) intSlice(n int) []int {
+	if n > maxArenaSlice {
+		return make([]int, n)
+	}
+	if len(a.ints)+n > cap(a.ints) {
+		a.ints = make([]int, 0, arenaBlock(cap(a.ints), n))
+	}
+	s := a.ints[len(a.ints) : len(a.ints)+n]
+	for i := range s {
+		s[i] = 0
+	}
+	a.ints = a.ints[:len(a.ints)+n]
+	return s
+}
+
+// n falses
+func (a *arena) boolSlice(n int) []bool {
+	if n > maxArenaSlice {
+		return make([]bool, n)
+	}
+	if len(a.bools)+n > cap(a.bools) {
+		a.bools = make([]bool, 0, arenaBlock(cap(a.bools), n))
+	}
+	s := a.bools[len(a.bools) : len(a.bools)+n]
+	for i := range s {
+		s[i] = false
 	}
+	a.bools = a.bools[:len(a.bools)+n]
+	return s
 }
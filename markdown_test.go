@@ -0,0 +1,95 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Checks and benchmarks of the parser
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// a document of about 50KB mixing headers, emphasis, links, nested
+// lists, quotes, code and tables
+func mixedDocument() []byte {
+	doc := bytes.NewBuffer(nil)
+	for i := 0; doc.Len() < 50<<10; i++ {
+		n := strconv.Itoa(i)
+		doc.WriteString("## Section " + n + "\n\n")
+		doc.WriteString("Some *emphasis*, some **strong text**, a [link](http://example.com/" + n + " \"title\") and `code`.\n")
+		doc.WriteString("A second line with ~~struck~~ words and http://example.com/auto.\n\n")
+		doc.WriteString("- item one\n- item *two*\n    1. nested\n    2. list\n\n")
+		doc.WriteString("> a quote with **strong** text\n> over two lines\n\n")
+		doc.WriteString("```go\nfunc f() int { return " + n + " }\n```\n\n")
+		doc.WriteString("Name | Value\n-----|------\nfirst | *" + n + "*\nsecond | [x](/x)\n\n")
+	}
+	return doc.Bytes()
+}
+
+// a parser reused from call to call gives what a fresh one gives
+func TestParserReuse(t *testing.T) {
+	input := mixedDocument()
+	want := string(Markdown(input, HtmlRenderer(0), COMMON_EXTENSIONS))
+	p := NewParser(WithExtensions(COMMON_EXTENSIONS))
+	for i := 0; i < 3; i++ {
+		if output := string(p.Markdown(input)); output != want {
+			t.Fatalf("call %d differs from a fresh parse", i+1)
+		}
+		p.Markdown([]byte("a *short* [text](/x)\n"))
+	}
+}
+
+// the output limit is checked between top-level blocks, so the block
+// that goes past it is kept whole and the ones after it are left out
+func TestSoftOutputLimit(t *testing.T) {
+	input := []byte("- one\n- two\n- three\n\nafter\n")
+	p := NewParser(WithLimits(Limits{SoftOutput: 10}))
+	want := "<ul>\n<li>one</li>\n<li>two</li>\n<li>three</li>\n</ul>\n"
+	if output := string(p.Markdown(input)); output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func BenchmarkMarkdown(b *testing.B) {
+	b.StopTimer()
+	input := mixedDocument()
+	renderer := HtmlRenderer(0)
+	b.SetBytes(int64(len(input)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		Markdown(input, renderer, COMMON_EXTENSIONS)
+	}
+}
+
+// a reused parser keeps its buffers from one call to the next
+func BenchmarkParserReused(b *testing.B) {
+	b.StopTimer()
+	input := mixedDocument()
+	p := NewParser(WithExtensions(COMMON_EXTENSIONS))
+	b.SetBytes(int64(len(input)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		p.Markdown(input)
+	}
+}
+
+// the cost of a call on its own, which dominates for short comments
+func BenchmarkParserReusedShort(b *testing.B) {
+	b.StopTimer()
+	input := []byte("Some *emphasis* and a [link](http://example.com/).\n")
+	p := NewParser(WithExtensions(COMMON_EXTENSIONS))
+	b.SetBytes(int64(len(input)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		p.Markdown(input)
+	}
+}
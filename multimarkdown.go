@@ -0,0 +1,480 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// MultiMarkdown compatibility: metadata, footnotes, citations, table
+// captions, and definition lists
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+)
+
+// Follow MultiMarkdown (https://fletcher.github.io/MultiMarkdown-6) by
+// turning on MMD_EXTENSIONS: a metadata block at the top, footnotes,
+// citations, captions on tables, and definition lists, besides tables
+// and fenced code. Use Metadata to read the metadata block, which is
+// left out of the output.
+func WithMultiMarkdown() Option {
+	return func(options *Options) {
+		options.Extensions |= MMD_EXTENSIONS
+	}
+}
+
+//
+// Metadata
+//
+
+// Read the MultiMarkdown metadata block at the start of input, lines of
+// "Key: value" up to the first blank line, as EXTENSION_METADATA leaves
+// it out of the output. Keys are lowercased with their spaces removed,
+// as MultiMarkdown has them, and indented lines carry on the value of
+// the line before, joined by newlines. The map is empty if there is no
+// such block.
+func Metadata(input []byte) map[string]string {
+	meta := make(map[string]string)
+	end := isMetadata(input)
+	key := ""
+	for beg := 0; beg < end; beg = nextLine(input, beg) {
+		line := bytes.TrimRight(input[beg:lineEnd(input, beg)], " \t\r")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			meta[key] += "\n" + string(bytes.TrimSpace(line))
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		key = string(bytes.ToLower(bytes.Replace(line[:colon], []byte(" "), nil, -1)))
+		meta[key] = string(bytes.TrimSpace(line[colon+1:]))
+	}
+	return meta
+}
+
+// under EXTENSION_METADATA, the length of the metadata block that
+// data[beg] starts, or 0 if there is none or it is not the first line
+func metadataBlock(rndr *render, data []byte, beg int) int {
+	if beg > 0 || rndr.flags&EXTENSION_METADATA == 0 {
+		return 0
+	}
+	return isMetadata(data)
+}
+
+// the length of the metadata block at the start of data, with the blank
+// line after it, or 0 if there is none
+func isMetadata(data []byte) int {
+	beg := 0
+	for beg < len(data) {
+		end := lineEnd(data, beg)
+		line := bytes.TrimRight(data[beg:end], " \t\r")
+		switch {
+		case len(line) == 0:
+			return nextLine(data, beg)
+		case line[0] == ' ' || line[0] == '\t':
+			// carries on the value of the line before
+			if beg == 0 {
+				return 0
+			}
+		case !isMetadataLine(line):
+			if beg == 0 {
+				return 0
+			}
+			return beg
+		}
+		beg = nextLine(data, beg)
+	}
+	return beg
+}
+
+// whether a line is a key of letters, digits, spaces, dashes, dots and
+// underscores followed by a colon and whitespace, which rules out URLs
+func isMetadataLine(line []byte) bool {
+	if !isalnum(line[0]) {
+		return false
+	}
+	i := 1
+	for i < len(line) && (isalnum(line[i]) || line[i] == ' ' || line[i] == '-' || line[i] == '.' || line[i] == '_') {
+		i++
+	}
+	return i < len(line) && line[i] == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t')
+}
+
+//
+// Footnotes and citations
+//
+
+// a footnote or citation defined by the document
+type footnote struct {
+	name   []byte // as written, without the ^ or #
+	text   []byte // the markdown of the note, unindented
+	flags  int    // FOOTNOTE_CITATION for a citation
+	number int    // by order of first use, or 0 if it is not used
+}
+
+// Check whether data starts with the definition of a footnote, [^name]:,
+// or under EXTENSION_CITATIONS, of a citation, [#key]:. The note runs on
+// over indented lines, and lines that carry on a paragraph, as the items
+// of a list do. It is stored in the notes of the render structure.
+// Returns the number of bytes to skip to move past it, or zero if there
+// is none.
+func isFootnote(rndr *render, data []byte) int {
+	id, flags, i := footnoteStart(rndr, data)
+	if i == 0 {
+		return 0
+	}
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+
+	text := bytes.NewBuffer(nil)
+	end := lineEnd(data, i)
+	text.Write(bytes.TrimRight(data[i:end], "\r"))
+	text.WriteByte('\n')
+
+	// the lines that follow, up to one that is not indented after a blank;
+	// blank lines after the note stay, as they end a paragraph before it
+	last := nextLine(data, i)
+	blank := false
+	for beg := last; beg < len(data); beg = nextLine(data, beg) {
+		line := bytes.TrimRight(data[beg:lineEnd(data, beg)], "\r")
+		if isBlankLine(line) {
+			blank = true
+			continue
+		}
+		indent := 0
+		for indent < 4 && line[indent] == ' ' {
+			indent++
+		}
+		if line[0] == '\t' {
+			indent = 1
+		} else if indent < 4 && (blank || footnoteStartsAt(rndr, line)) {
+			break
+		}
+		if blank {
+			text.WriteByte('\n')
+			blank = false
+		}
+		expandTabs(text, line[indent:], rndr.tabSize, rndr.wide)
+		text.WriteByte('\n')
+		last = nextLine(data, beg)
+	}
+
+	key := string(refKey(rndr, id))
+	if _, ok := rndr.notes[key]; ok {
+		warn(rndr, DIAG_DUPLICATE_REFERENCE, "note ["+string(id)+"] is defined again; the last definition is used")
+	}
+	rndr.notes[key] = &footnote{name: id[1:], text: text.Bytes(), flags: flags}
+	return last
+}
+
+// the id of the note defined at the start of data, its name after the ^
+// or #, its flags, and the length of the definition's [^name]: or
+// [#key]:, or 0 if there is none
+func footnoteStart(rndr *render, data []byte) ([]byte, int, int) {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i+4 >= len(data) || data[i] != '[' {
+		return nil, 0, 0
+	}
+	flags := 0
+	switch {
+	case data[i+1] == '^' && rndr.flags&EXTENSION_FOOTNOTES != 0:
+	case data[i+1] == '#' && rndr.flags&EXTENSION_CITATIONS != 0:
+		flags = FOOTNOTE_CITATION
+	default:
+		return nil, 0, 0
+	}
+	id := i + 1
+	i += 2
+	for i < len(data) && data[i] != ']' && data[i] != '\n' && data[i] != '\r' {
+		i++
+	}
+	if i == id+1 || i+1 >= len(data) || data[i] != ']' || data[i+1] != ':' {
+		return nil, 0, 0
+	}
+	return data[id:i], flags, i + 2
+}
+
+func footnoteStartsAt(rndr *render, line []byte) bool {
+	_, _, i := footnoteStart(rndr, line)
+	return i > 0
+}
+
+// '[' under EXTENSION_FOOTNOTES or EXTENSION_CITATIONS: a reference to a
+// note, [^name] or [#key], or a citation with a locator, [p. 42][#key]
+func inlineFootnote(out *bytes.Buffer, rndr *render, data []byte) int {
+	end := bytes.IndexByte(data, ']')
+	if end < 2 || rndr.mk.footnoteRef == nil {
+		return 0
+	}
+
+	var locator []byte
+	id := data[1:end]
+	if id[0] != '^' && id[0] != '#' {
+		// the locator comes first, then the key
+		if end+3 >= len(data) || data[end+1] != '[' || data[end+2] != '#' {
+			return 0
+		}
+		locator = id
+		close := bytes.IndexByte(data[end+1:], ']')
+		if close < 0 {
+			return 0
+		}
+		id = data[end+2 : end+1+close]
+		end += 1 + close
+	}
+	if bytes.IndexByte(id, '\n') >= 0 {
+		return 0
+	}
+	note, ok := rndr.notes[string(refKey(rndr, id))]
+	if !ok || (locator != nil && note.flags&FOOTNOTE_CITATION == 0) {
+		return 0
+	}
+
+	// a note is numbered by the first reference to it
+	added := false
+	if note.number == 0 {
+		if note.flags&FOOTNOTE_CITATION != 0 {
+			rndr.citations = append(rndr.citations, note)
+			note.number = len(rndr.citations)
+		} else {
+			rndr.footnotes = append(rndr.footnotes, note)
+			note.number = len(rndr.footnotes)
+		}
+		added = true
+	}
+
+	work := newBuffer(rndr)
+	if locator != nil {
+		parseInline(work, rndr, locator)
+	}
+	ret := rndr.mk.footnoteRef(out, note.name, note.number, work.Bytes(), note.flags, rndr.opaque)
+	freeBuffer(rndr, work)
+	if ret == 0 {
+		if added {
+			note.number = 0
+			if note.flags&FOOTNOTE_CITATION != 0 {
+				rndr.citations = rndr.citations[:len(rndr.citations)-1]
+			} else {
+				rndr.footnotes = rndr.footnotes[:len(rndr.footnotes)-1]
+			}
+		}
+		return 0
+	}
+	return end + 1
+}
+
+// render the footnotes, then the citations, that the document refers
+// to, in the order of their numbers; a note may refer to later ones
+func renderFootnotes(out *bytes.Buffer, rndr *render) {
+	if rndr.mk.footnotes == nil {
+		return
+	}
+	rndr.nesting++
+	for _, flags := range []int{0, FOOTNOTE_CITATION} {
+		items := newBuffer(rndr)
+		for i := 0; ; i++ {
+			notes := rndr.footnotes
+			if flags != 0 {
+				notes = rndr.citations
+			}
+			if i >= len(notes) {
+				break
+			}
+			note := notes[i]
+			text := newBuffer(rndr)
+			parseBlock(text, rndr, note.text)
+			if rndr.mk.footnoteItem != nil {
+				rndr.mk.footnoteItem(items, note.name, text.Bytes(), note.number, note.flags, rndr.opaque)
+			}
+			freeBuffer(rndr, text)
+		}
+		if items.Len() > 0 {
+			rndr.mk.footnotes(out, items.Bytes(), flags, rndr.opaque)
+		}
+		freeBuffer(rndr, items)
+	}
+	rndr.nesting--
+}
+
+//
+// Table captions
+//
+
+// Check whether data starts with a table caption alone on its line,
+// [like this], which may be followed by a label, [like this][label].
+// Returns the caption and the length of its line, or 0 if there is none.
+func tableCaption(data []byte) ([]byte, int) {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	end := lineEnd(data, i)
+	line := bytes.TrimRight(data[i:end], " \t\r")
+	if len(line) < 3 || line[0] != '[' || line[len(line)-1] != ']' {
+		return nil, 0
+	}
+	close := bytes.IndexByte(line, ']')
+	caption, label := line[1:close], line[close+1:]
+	if len(caption) == 0 || caption[0] == '^' || caption[0] == '#' {
+		return nil, 0
+	}
+	if len(label) > 0 && (label[0] != '[' || bytes.IndexByte(label[1:], ']') != len(label)-2) {
+		return nil, 0
+	}
+	return caption, nextLine(data, i)
+}
+
+//
+// Definition lists
+//
+
+// the length of the prefix of a definition, a colon and whitespace after
+// up to three spaces, or 0 if the line does not start one
+func definitionPrefix(data []byte) int {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i+1 >= len(data) || data[i] != ':' || (data[i+1] != ' ' && data[i+1] != '\t') {
+		return 0
+	}
+	i++
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// the end of the terms at the start of data, lines of text, and the start
+// of the first definition after them, which may follow blank lines; 0, 0
+// if they are not followed by a definition
+func definitionTerms(data []byte) (int, int) {
+	beg := 0
+	for beg < len(data) && !isBlankLine(data[beg:lineEnd(data, beg)]) && definitionPrefix(data[beg:]) == 0 {
+		beg = nextLine(data, beg)
+	}
+	if beg == 0 {
+		return 0, 0
+	}
+	terms := beg
+	for beg < len(data) && isBlankLine(data[beg:lineEnd(data, beg)]) {
+		beg = nextLine(data, beg)
+	}
+	if beg >= len(data) || definitionPrefix(data[beg:]) == 0 {
+		return 0, 0
+	}
+	return terms, beg
+}
+
+// a definition list: groups of terms, one to a line, each followed by
+// definitions that start with a colon
+func blockDefinitionList(out *bytes.Buffer, rndr *render, data []byte) int {
+	if rndr.mk.list == nil {
+		return 0
+	}
+	terms, defs := definitionTerms(data)
+	if terms == 0 {
+		return 0
+	}
+
+	work := newBuffer(rndr)
+	text := newBuffer(rndr)
+	beg := 0
+	for {
+		for beg < terms {
+			end := lineEnd(data, beg)
+			text.Reset()
+			parseInline(text, rndr, bytes.TrimSpace(data[beg:end]))
+			if rndr.mk.listitem != nil {
+				rndr.mk.listitem(work, text.Bytes(), LIST_TYPE_DEFINITION|LIST_TYPE_TERM, rndr.opaque)
+			}
+			beg = nextLine(data, beg)
+		}
+
+		// a blank line before a definition makes it a paragraph
+		loose := defs > terms
+		beg = defs
+		for beg < len(data) && definitionPrefix(data[beg:]) > 0 {
+			beg, loose = blockDefinition(work, rndr, data, beg, loose)
+		}
+
+		// more terms may follow
+		t, d := definitionTerms(data[beg:])
+		if t == 0 {
+			break
+		}
+		terms, defs = beg+t, beg+d
+	}
+
+	rndr.mk.list(out, work.Bytes(), LIST_TYPE_DEFINITION, 0, rndr.opaque)
+	freeBuffer(rndr, text)
+	freeBuffer(rndr, work)
+	return beg
+}
+
+// a definition starting at data[beg], rendered as paragraphs if it is
+// loose or holds blank lines. Returns where it ends, after any blank
+// lines, and whether there were any, which make the next one loose.
+func blockDefinition(out *bytes.Buffer, rndr *render, data []byte, beg int, loose bool) (int, bool) {
+	work := blockText{data: data}
+	end := nextLine(data, beg)
+	work.add(rndr, beg+definitionPrefix(data[beg:]), end)
+	beg = end
+
+	blank := false
+	for beg < len(data) {
+		end = nextLine(data, beg)
+		line := data[beg:end]
+		if isBlankLine(line) {
+			blank = true
+			beg = end
+			continue
+		}
+		i := 0
+		for i < 4 && line[i] == ' ' {
+			i++
+		}
+		if i == 4 || line[0] == '\t' {
+			// indented lines belong to it, even after a blank line
+			if line[0] == '\t' {
+				i = 1
+			}
+			if blank {
+				work.addNewline(rndr)
+				loose = true
+				blank = false
+			}
+			work.add(rndr, beg+i, end)
+		} else if blank || definitionPrefix(line) > 0 {
+			break
+		} else {
+			work.add(rndr, beg, end)
+		}
+		beg = end
+	}
+
+	text := newBuffer(rndr)
+	flags := LIST_TYPE_DEFINITION
+	if loose {
+		flags |= LIST_ITEM_CONTAINS_BLOCK
+		parseBlock(text, rndr, work.bytes())
+	} else {
+		parseInline(text, rndr, bytes.TrimRight(work.bytes(), "\n"))
+	}
+	if rndr.mk.listitem != nil {
+		rndr.mk.listitem(out, text.Bytes(), flags, rndr.opaque)
+	}
+	freeBuffer(rndr, text)
+	work.free(rndr)
+	return beg, blank
+}
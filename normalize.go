@@ -0,0 +1,107 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Input normalization: line breaks, byte order marks, and invalid UTF-8
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"utf8"
+)
+
+// These are the ways WithNormalize and Normalize can treat input that
+// is not valid UTF-8.
+const (
+	NORMALIZE_REPLACE = iota + 1 // put U+FFFD in place of each invalid byte
+	NORMALIZE_ERROR              // give up on the input with an error
+)
+
+var byteOrderMark = []byte("\xef\xbb\xbf")
+
+// Clean up the input before anything else is done with it, so that
+// callers need not: \r\n and a lone \r become \n, a leading UTF-8 byte
+// order mark is dropped, and invalid UTF-8 is replaced or refused, as
+// invalid is NORMALIZE_REPLACE or NORMALIZE_ERROR. Either way the first
+// invalid byte is reported as a DIAG_INVALID_UTF8 diagnostic. A refused
+// document is left empty; MarkdownTo writes nothing and returns the
+// error, as MarkdownStrict does. Input filters get the input once it is
+// normalized.
+func WithNormalize(invalid int) Option {
+	return func(options *Options) {
+		options.Normalize = invalid
+	}
+}
+
+// Normalize input as WithNormalize does, returning an error that names
+// the line of the first invalid byte under NORMALIZE_ERROR. Input that
+// needs no change is returned as it is.
+func Normalize(input []byte, invalid int) ([]byte, os.Error) {
+	output, line := normalize(input, invalid)
+	if line > 0 && invalid == NORMALIZE_ERROR {
+		return nil, invalidUTF8(line)
+	}
+	return output, nil
+}
+
+func invalidUTF8(line int) os.Error {
+	return os.NewError("blackfriday: line " + strconv.Itoa(line) + ": input is not valid UTF-8")
+}
+
+// normalize input, returning it with the line of the first invalid
+// byte, or 0 if there is none; under NORMALIZE_ERROR it stops there
+// and returns nil
+func normalize(input []byte, invalid int) ([]byte, int) {
+	var out bytes.Buffer
+	copied, bad := false, 0
+	beg := 0
+	if bytes.HasPrefix(input, byteOrderMark) {
+		beg = len(byteOrderMark)
+	}
+	for i := beg; i < len(input); {
+		c := input[i]
+		if c < utf8.RuneSelf && c != '\r' {
+			i++
+			continue
+		}
+
+		size, with := 1, "\n"
+		if c == '\r' {
+			if i+1 < len(input) && input[i+1] == '\n' {
+				size = 2
+			}
+		} else {
+			if r, n := utf8.DecodeRune(input[i:]); r != utf8.RuneError || n > 1 {
+				i += n
+				continue
+			}
+			if bad == 0 {
+				bad = countLines(input[:i]) + 1
+			}
+			if invalid == NORMALIZE_ERROR {
+				return nil, bad
+			}
+			with = "\uFFFD"
+		}
+
+		out.Write(input[beg:i])
+		out.WriteString(with)
+		i += size
+		beg = i
+		copied = true
+	}
+	if !copied {
+		return input[beg:], bad
+	}
+	out.Write(input[beg:])
+	return out.Bytes(), bad
+}
@@ -0,0 +1,298 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Pandoc compatibility: fenced divs, attributes, and implicit header
+// references
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"strconv"
+	"unicode"
+)
+
+// Follow Pandoc's markdown (https://pandoc.org/MANUAL.html) by turning
+// on PANDOC_EXTENSIONS: fenced divs, {#id .class key=value} attributes
+// on headers and fenced code, and links to headers by their text, along
+// with the tables, lists, footnotes, and line blocks Pandoc has.
+func WithPandoc() Option {
+	return func(options *Options) {
+		options.Extensions |= PANDOC_EXTENSIONS
+	}
+}
+
+// The attributes given to a block with Pandoc's {#id .class key=value}
+// syntax under EXTENSION_ATTRIBUTES, or the identifier a header gets
+// under EXTENSION_IMPLICIT_HEADER_REFS. The classes of a fenced code
+// block are its language, so only its id and key=value pairs are here.
+type Attributes struct {
+	Id      string
+	Classes []string
+	Pairs   [][2]string // key=value pairs, in order
+}
+
+// hand the attributes of a block, nil if it has none, to the renderer
+// just before the block's own callback
+func blockAttributes(rndr *render, attrs *Attributes) {
+	if rndr.mk.attributes != nil {
+		rndr.mk.attributes(attrs, rndr.opaque)
+	}
+}
+
+// parse the inside of {#id .class key=value key2="quoted value"}, with
+// - for the class unnumbered; nil if it is not a list of attributes
+func parseAttributes(data []byte) *Attributes {
+	attrs := new(Attributes)
+	i := 0
+	for {
+		for i < len(data) && isspace(data[i]) {
+			i++
+		}
+		if i >= len(data) {
+			break
+		}
+
+		start := i
+		for i < len(data) && !isspace(data[i]) && data[i] != '=' {
+			i++
+		}
+		word := data[start:i]
+		switch {
+		case i < len(data) && data[i] == '=':
+			if !isAttributeKey(word) {
+				return nil
+			}
+			i++
+			value := i
+			if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+				end := bytes.IndexByte(data[i+1:], data[i])
+				if end < 0 {
+					return nil
+				}
+				value, i = i+1, i+1+end
+				attrs.Pairs = append(attrs.Pairs, [2]string{string(word), string(data[value:i])})
+				i++
+			} else {
+				for i < len(data) && !isspace(data[i]) {
+					i++
+				}
+				attrs.Pairs = append(attrs.Pairs, [2]string{string(word), string(data[value:i])})
+			}
+		case len(word) > 1 && word[0] == '#':
+			attrs.Id = string(word[1:])
+		case len(word) > 1 && word[0] == '.':
+			attrs.Classes = append(attrs.Classes, string(word[1:]))
+		case len(word) == 1 && word[0] == '-':
+			attrs.Classes = append(attrs.Classes, "unnumbered")
+		default:
+			return nil
+		}
+	}
+	if attrs.Id == "" && len(attrs.Classes) == 0 && len(attrs.Pairs) == 0 {
+		return nil
+	}
+	return attrs
+}
+
+func isAttributeKey(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, c := range key {
+		if !isalnum(c) && c != '-' && c != '_' && c != ':' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// split the attributes at the end of the text of a header from the text
+func splitAttributes(data []byte) ([]byte, *Attributes) {
+	end := len(data)
+	for end > 0 && isspace(data[end-1]) {
+		end--
+	}
+	if end == 0 || data[end-1] != '}' {
+		return data, nil
+	}
+	open := bytes.LastIndex(data[:end], []byte("{"))
+	if open < 0 {
+		return data, nil
+	}
+	attrs := parseAttributes(data[open+1 : end-1])
+	if attrs == nil {
+		return data, nil
+	}
+	for open > 0 && isspace(data[open-1]) {
+		open--
+	}
+	return data[:open], attrs
+}
+
+// the text of a header without its attributes, and the attributes with
+// its identifier filled in under EXTENSION_IMPLICIT_HEADER_REFS
+func headerAttributes(rndr *render, data []byte) ([]byte, *Attributes) {
+	var attrs *Attributes
+	if rndr.flags&EXTENSION_ATTRIBUTES != 0 {
+		data, attrs = splitAttributes(data)
+	}
+	if rndr.headerIds != nil {
+		if attrs == nil {
+			attrs = new(Attributes)
+		}
+		attrs.Id = headerId(rndr.headerIds, data, attrs.Id)
+	}
+	return data, attrs
+}
+
+// the identifier of a header, its own or one made from its text, told
+// apart from those of the headers before it with -1, -2, and so on
+func headerId(ids map[string]int, text []byte, id string) string {
+	if id == "" {
+		id = pandocId(text)
+		if n := ids[id]; n > 0 {
+			ids[id]++
+			id += "-" + strconv.Itoa(n)
+		}
+	}
+	ids[id]++
+	return id
+}
+
+// make an identifier from the text of a header as Pandoc does: letters
+// and digits are kept, lowercased, along with _, -, and ., white space
+// turns into -, and everything before the first letter goes. The text
+// is taken as it is written, markup and all.
+func pandocId(text []byte) string {
+	id := bytes.NewBuffer(nil)
+	for _, c := range string(text) {
+		switch {
+		case unicode.IsLetter(c):
+			id.WriteRune(unicode.ToLower(c))
+		case id.Len() == 0:
+		case unicode.IsDigit(c) || c == '_' || c == '-' || c == '.':
+			id.WriteRune(c)
+		case unicode.IsSpace(c):
+			id.WriteByte('-')
+		}
+	}
+	if id.Len() == 0 {
+		return "section"
+	}
+	return id.String()
+}
+
+// under EXTENSION_IMPLICIT_HEADER_REFS, make each header a reference
+// by its text, as in [Header text] or [see here][Header text], unless
+// the caller or the document defines one by that name. The first of
+// several headers with the same text wins.
+func findHeaderRefs(rndr *render, data []byte) {
+	ids := make(map[string]int)
+	inFence := false
+	for beg := 0; beg < len(data); {
+		end := lineEnd(data, beg)
+		line := data[beg:end]
+		next := end + 1
+		beg = next
+
+		var text []byte
+		switch {
+		case rndr.flags&EXTENSION_FENCED_CODE != 0 && isFencedCode(line, nil, nil) > 0:
+			inFence = !inFence
+			continue
+		case inFence || isEmpty(line) > 0:
+			continue
+		case isPrefixHeader(rndr, line):
+			i := 0
+			for i < len(line) && line[i] == '#' {
+				i++
+			}
+			text = bytes.TrimRight(line[i:], "# \t")
+		case rndr.flags&EXTENSION_NO_SETEXT_HEADERS == 0 && next < len(data) && isUnderlinedHeader(data[next:]) > 0 && blockCodePrefix(line) == 0:
+			text = line
+			beg = lineEnd(data, next) + 1
+		default:
+			continue
+		}
+
+		var attrs *Attributes
+		if rndr.flags&EXTENSION_ATTRIBUTES != 0 {
+			text, attrs = splitAttributes(text)
+		}
+		text = bytes.TrimSpace(text)
+		id := ""
+		if attrs != nil {
+			id = attrs.Id
+		}
+		id = headerId(ids, text, id)
+
+		key := string(refKey(rndr, text))
+		if _, ok := rndr.refs[key]; !ok && len(text) > 0 {
+			ref := rndr.arena.reference()
+			ref.link, ref.external = []byte("#"+id), true
+			rndr.refs[key] = ref
+		}
+	}
+}
+
+// parse a fenced div, a fence of three or more colons with attributes
+// or a single class, the blocks in it, and a closing fence:
+//
+//	::: {#note .warning}
+//	Mind the gap.
+//	:::
+//
+// divs may be nested
+func blockFencedDiv(out *bytes.Buffer, rndr *render, data []byte) int {
+	i := blockContainerFence(data)
+	if i == 0 {
+		return 0
+	}
+	end := lineEnd(data, i)
+	spec := bytes.TrimRight(bytes.TrimSpace(data[i:end]), ":")
+	spec = bytes.TrimSpace(spec)
+
+	var attrs *Attributes
+	switch {
+	case len(spec) == 0:
+		return 0
+	case spec[0] == '{' && spec[len(spec)-1] == '}':
+		attrs = parseAttributes(spec[1 : len(spec)-1])
+	case bytes.IndexAny(spec, " \t{}") < 0:
+		attrs = &Attributes{Classes: []string{string(spec)}}
+	}
+	if attrs == nil {
+		return 0
+	}
+
+	beg := end + 1
+	close := blockContainerEnd(data, beg)
+	if close >= len(data) {
+		return 0
+	}
+
+	work := newBuffer(rndr)
+	parseBlock(work, rndr, data[beg:close])
+	if rndr.mk.div != nil {
+		blockAttributes(rndr, attrs)
+		rndr.mk.div(out, work.Bytes(), rndr.opaque)
+	} else {
+		out.Write(work.Bytes())
+	}
+	freeBuffer(rndr, work)
+
+	// skip the closing line
+	i = lineEnd(data, close)
+	if i < len(data) {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,274 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Allowlist policy for raw HTML
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+)
+
+// An HtmlPolicy lists the raw HTML that the HTML renderer lets through.
+// Tags that are not allowed are dropped along with their attributes
+// (and the contents of script and style elements); the text around
+// them is kept. Attributes holding URLs must be relative links or
+// use a safe scheme.
+type HtmlPolicy struct {
+	tags map[string]map[string]bool
+}
+
+// attributes whose values are checked as URLs
+var urlAttrs = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"formaction": true,
+	"href":       true,
+	"longdesc":   true,
+	"poster":     true,
+	"src":        true,
+}
+
+// Create an empty policy, which drops every tag.
+func NewHtmlPolicy() *HtmlPolicy {
+	return &HtmlPolicy{tags: make(map[string]map[string]bool)}
+}
+
+// Allow the given tags, without any attributes.
+func (p *HtmlPolicy) AllowTags(tags ...string) {
+	for _, tag := range tags {
+		tag = string(bytes.ToLower([]byte(tag)))
+		if p.tags[tag] == nil {
+			p.tags[tag] = make(map[string]bool)
+		}
+	}
+}
+
+// Allow the given attributes on a tag, allowing the tag as well.
+// The tag "*" allows the attributes on every allowed tag.
+func (p *HtmlPolicy) AllowAttrs(tag string, attrs ...string) {
+	p.AllowTags(tag)
+	tag = string(bytes.ToLower([]byte(tag)))
+	for _, attr := range attrs {
+		p.tags[tag][string(bytes.ToLower([]byte(attr)))] = true
+	}
+}
+
+// Use a policy for the raw HTML passed through by a renderer
+// created by HtmlRenderer. A nil policy lets all raw HTML through.
+func (r *Renderer) SetHtmlPolicy(p *HtmlPolicy) {
+	if options, ok := r.opaque.(*htmlOptions); ok {
+		options.policy = p
+	}
+}
+
+// write raw HTML, keeping only the tags and attributes the policy allows
+func (p *HtmlPolicy) sanitize(ob *bytes.Buffer, data []byte) {
+	mark := 0
+	skip := "" // the contents of a dropped script or style element go too
+	for i := 0; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		end, name, closing := htmlTagInfo(data[i:])
+		if end == 0 {
+			continue
+		}
+
+		if skip == "" {
+			htmlTextEscape(ob, data[mark:i])
+		}
+		switch {
+		case skip != "":
+			if closing && name == skip {
+				skip = ""
+			}
+		case p.tags[name] != nil:
+			p.writeTag(ob, data[i:i+end], name, closing)
+		case !closing && (name == "script" || name == "style"):
+			skip = name
+		}
+
+		i += end - 1
+		mark = i + 1
+	}
+	if skip == "" {
+		htmlTextEscape(ob, data[mark:])
+	}
+}
+
+// write an allowed tag with only its allowed attributes
+func (p *HtmlPolicy) writeTag(ob *bytes.Buffer, tag []byte, name string, closing bool) {
+	if closing {
+		ob.WriteString("</" + name + ">")
+		return
+	}
+
+	ob.WriteString("<" + name)
+	for _, attr := range htmlTagAttrs(tag, name) {
+		if !p.tags[name][attr[0]] && !(p.tags["*"] != nil && p.tags["*"][attr[0]]) {
+			continue
+		}
+		value := []byte(attr[1])
+		if urlAttrs[attr[0]] && !isSafeHtmlUrl(value) {
+			continue
+		}
+		ob.WriteString(" " + attr[0] + "=\"")
+		htmlTextEscape(ob, bytes.Replace(value, []byte("\""), []byte("&quot;"), -1))
+		ob.WriteByte('"')
+	}
+
+	if len(tag) > 1 && tag[len(tag)-2] == '/' {
+		ob.WriteString(" /")
+	}
+	ob.WriteByte('>')
+}
+
+// split the attributes of a start tag into lowercase names and values,
+// with the values as written
+func htmlTagAttrs(tag []byte, name string) [][2]string {
+	var attrs [][2]string
+	i := 1 + len(name)
+	for i < len(tag)-1 {
+		if isspace(tag[i]) || tag[i] == '/' {
+			i++
+			continue
+		}
+
+		// attribute name
+		beg := i
+		for i < len(tag)-1 && !isspace(tag[i]) && tag[i] != '=' && tag[i] != '/' {
+			i++
+		}
+		attr := string(bytes.ToLower(tag[beg:i]))
+
+		// optional value, quoted or bare
+		var value []byte
+		for i < len(tag)-1 && isspace(tag[i]) {
+			i++
+		}
+		if i < len(tag)-1 && tag[i] == '=' {
+			i++
+			for i < len(tag)-1 && isspace(tag[i]) {
+				i++
+			}
+			if i < len(tag)-1 && (tag[i] == '"' || tag[i] == '\'') {
+				q := tag[i]
+				i++
+				beg = i
+				for i < len(tag)-1 && tag[i] != q {
+					i++
+				}
+				value = tag[beg:i]
+				i++
+			} else {
+				beg = i
+				for i < len(tag)-1 && !isspace(tag[i]) {
+					i++
+				}
+				value = tag[beg:i]
+			}
+		}
+
+		attrs = append(attrs, [2]string{attr, string(value)})
+	}
+	return attrs
+}
+
+// return the length of the tag or comment at the start of data,
+// along with its lowercase name and whether it is a closing tag
+// the length is 0 if data does not start with a tag
+func htmlTagInfo(data []byte) (int, string, bool) {
+	if len(data) < 3 || data[0] != '<' {
+		return 0, "", false
+	}
+
+	// comments end at the first -->
+	if bytes.HasPrefix(data, []byte("<!--")) {
+		end := bytes.Index(data[4:], []byte("-->"))
+		if end < 0 {
+			return 0, "", false
+		}
+		return end + 7, "!--", false
+	}
+
+	i := 1
+	closing := data[i] == '/'
+	if closing {
+		i++
+	}
+	beg := i
+	for i < len(data) && (isalnum(data[i]) || (i > beg && data[i] == '-') || (i == beg && data[i] == '!')) {
+		i++
+	}
+	if i == beg {
+		return 0, "", false
+	}
+	name := string(bytes.ToLower(data[beg:i]))
+
+	// find the end of the tag, skipping over quoted values
+	for i < len(data) && data[i] != '>' {
+		if data[i] == '"' || data[i] == '\'' {
+			q := data[i]
+			i++
+			for i < len(data) && data[i] != q {
+				i++
+			}
+		}
+		i++
+	}
+	if i >= len(data) {
+		return 0, "", false
+	}
+	return i + 1, name, closing
+}
+
+// write text from raw HTML, escaping any angle brackets left in it
+func htmlTextEscape(ob *bytes.Buffer, text []byte) {
+	mark := 0
+	for i, c := range text {
+		if c != '<' && c != '>' {
+			continue
+		}
+		ob.Write(text[mark:i])
+		if c == '<' {
+			ob.WriteString("&lt;")
+		} else {
+			ob.WriteString("&gt;")
+		}
+		mark = i + 1
+	}
+	ob.Write(text[mark:])
+}
+
+// Test if a URL in an attribute is a relative link or uses a safe scheme.
+// Character references could hide the scheme, so only &amp; is allowed.
+func isSafeHtmlUrl(link []byte) bool {
+	link = bytes.TrimSpace(link)
+	for i := 0; i < len(link); i++ {
+		if link[i] < ' ' || (link[i] == '&' && !bytes.HasPrefix(link[i:], []byte("&amp;"))) {
+			return false
+		}
+	}
+
+	if isSafeLink(link) {
+		return true
+	}
+	for _, c := range link {
+		switch c {
+		case ':':
+			return false
+		case '/', '?', '#':
+			return true
+		}
+	}
+	return true
+}
@@ -19,8 +19,16 @@ import (
 type smartypantsData struct {
 	inSingleQuote bool
 	inDoubleQuote bool
+	quotes        *[4]string
 }
 
+// opening and closing double quotes, then opening and closing single quotes
+var (
+	englishQuotes = [4]string{"&ldquo;", "&rdquo;", "&lsquo;", "&rsquo;"}
+	angledQuotes  = [4]string{"&laquo;", "&raquo;", "&lsaquo;", "&rsaquo;"}
+	germanQuotes  = [4]string{"&bdquo;", "&ldquo;", "&sbquo;", "&lsquo;"}
+)
+
 func wordBoundary(c byte) bool {
 	return c == 0 || isspace(c) || ispunct(c)
 }
@@ -36,7 +44,7 @@ func isdigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
 
-func smartQuotesHelper(ob *bytes.Buffer, previousChar byte, nextChar byte, quote byte, isOpen *bool) bool {
+func smartQuotesHelper(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, nextChar byte, quote byte, isOpen *bool) bool {
 	switch {
 	// edge of the buffer is likely to be a tag that we don't get to see,
 	// so we assume there is text there
@@ -54,14 +62,14 @@ func smartQuotesHelper(ob *bytes.Buffer, previousChar byte, nextChar byte, quote
 		*isOpen = !*isOpen
 	}
 
-	ob.WriteByte('&')
-	if *isOpen {
-		ob.WriteByte('l')
-	} else {
-		ob.WriteByte('r')
+	i := 0
+	if quote == 's' {
+		i = 2
+	}
+	if !*isOpen {
+		i++
 	}
-	ob.WriteByte(quote)
-	ob.WriteString("quo;")
+	ob.WriteString(smrt.quotes[i])
 	return true
 }
 
@@ -74,7 +82,7 @@ func smartSquote(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, tex
 			if len(text) >= 3 {
 				nextChar = text[2]
 			}
-			if smartQuotesHelper(ob, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
+			if smartQuotesHelper(ob, smrt, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
 				return 1
 			}
 		}
@@ -98,7 +106,7 @@ func smartSquote(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, tex
 	if len(text) > 1 {
 		nextChar = text[1]
 	}
-	if smartQuotesHelper(ob, previousChar, nextChar, 's', &smrt.inSingleQuote) {
+	if smartQuotesHelper(ob, smrt, previousChar, nextChar, 's', &smrt.inSingleQuote) {
 		return 0
 	}
 
@@ -168,7 +176,7 @@ func smartAmp(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, text [
 		if len(text) >= 7 {
 			nextChar = text[6]
 		}
-		if smartQuotesHelper(ob, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
+		if smartQuotesHelper(ob, smrt, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
 			return 5
 		}
 	}
@@ -202,7 +210,7 @@ func smartBacktick(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, t
 		if len(text) >= 3 {
 			nextChar = text[2]
 		}
-		if smartQuotesHelper(ob, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
+		if smartQuotesHelper(ob, smrt, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
 			return 1
 		}
 	}
@@ -280,7 +288,7 @@ func smartDquote(ob *bytes.Buffer, smrt *smartypantsData, previousChar byte, tex
 	if len(text) > 1 {
 		nextChar = text[1]
 	}
-	if !smartQuotesHelper(ob, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
+	if !smartQuotesHelper(ob, smrt, previousChar, nextChar, 'd', &smrt.inDoubleQuote) {
 		ob.WriteString("&quot;")
 	}
 
@@ -302,11 +310,17 @@ type smartCallback func(ob *bytes.Buffer, smrt *smartypantsData, previousChar by
 
 type SmartypantsRenderer [256]smartCallback
 
-func Smartypants(flags int) *SmartypantsRenderer {
+func Smartypants(flags uint64) *SmartypantsRenderer {
 	r := new(SmartypantsRenderer)
 	r['"'] = smartDquote
 	r['&'] = smartAmp
 	r['\''] = smartSquote
+	r['<'] = smartLtag
+	r['`'] = smartBacktick
+	if flags&HTML_SMARTYPANTS_QUOTES_ONLY != 0 {
+		return r
+	}
+
 	r['('] = smartParens
 	if flags&HTML_SMARTYPANTS_LATEX_DASHES == 0 {
 		r['-'] = smartDash
@@ -322,20 +336,30 @@ func Smartypants(flags int) *SmartypantsRenderer {
 			r[ch] = smartNumberGeneric
 		}
 	}
-	r['<'] = smartLtag
-	r['`'] = smartBacktick
 	return r
 }
 
 func htmlSmartypants(ob *bytes.Buffer, text []byte, opaque interface{}) {
 	options := opaque.(*htmlOptions)
-	smrt := smartypantsData{false, false}
+	smrt := smartypantsData{false, false, &englishQuotes}
+	switch {
+	case options.flags&HTML_SMARTYPANTS_ANGLED_QUOTES != 0:
+		smrt.quotes = &angledQuotes
+	case options.flags&HTML_SMARTYPANTS_GERMAN_QUOTES != 0:
+		smrt.quotes = &germanQuotes
+	}
 
 	// first do normal entity escaping
 	escaped := bytes.NewBuffer(nil)
 	attrEscape(escaped, text)
 	text = escaped.Bytes()
 
+	if options.flags&HTML_SYMBOL_REPLACEMENTS != 0 {
+		replaced := bytes.NewBuffer(nil)
+		symbolReplacements(replaced, text)
+		text = replaced.Bytes()
+	}
+
 	mark := 0
 	for i := 0; i < len(text); i++ {
 		if action := options.smartypants[text[i]]; action != nil {
@@ -356,3 +380,41 @@ func htmlSmartypants(ob *bytes.Buffer, text []byte, opaque interface{}) {
 		ob.Write(text[mark:])
 	}
 }
+
+// These are the symbols substituted by symbolReplacements,
+// matched against text that has already been escaped.
+var symbols = []struct {
+	text   []byte
+	entity string
+}{
+	{[]byte("(c)"), "&copy;"},
+	{[]byte("(C)"), "&copy;"},
+	{[]byte("(r)"), "&reg;"},
+	{[]byte("(R)"), "&reg;"},
+	{[]byte("(tm)"), "&trade;"},
+	{[]byte("(TM)"), "&trade;"},
+	{[]byte("+-"), "&plusmn;"},
+	{[]byte("--&gt;"), "&rarr;"},
+	{[]byte("&lt;--"), "&larr;"},
+}
+
+// Replace plain-text stand-ins such as (c) and --> with proper symbols.
+func symbolReplacements(ob *bytes.Buffer, text []byte) {
+	mark := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c != '(' && c != '+' && c != '-' && c != '&' {
+			continue
+		}
+		for _, sym := range symbols {
+			if bytes.HasPrefix(text[i:], sym.text) {
+				ob.Write(text[mark:i])
+				ob.WriteString(sym.entity)
+				i += len(sym.text) - 1
+				mark = i + 1
+				break
+			}
+		}
+	}
+	ob.Write(text[mark:])
+}
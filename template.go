@@ -0,0 +1,58 @@
+//
+// Black Friday Markdown Processor
+// Originally based on http://github.com/tanoku/upskirt
+// by Russ Ross <russ@russross.com>
+//
+
+//
+//
+// Formatters for the template package
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"template"
+)
+
+// Create formatters that render a field of a template as markdown:
+// {Body|markdown} for trusted text, such as the pages of a site, and
+// {Comment|markdown-safe} for text from users, whose raw HTML must pass
+// the policy and whose links are made safe and marked nofollow. A nil
+// policy drops all raw HTML from untrusted text. Both use the given
+// extensions, and the formatters may be used by templates running at
+// the same time.
+func TemplateFormatters(extensions uint64, policy *HtmlPolicy) template.FormatterMap {
+	if policy == nil {
+		policy = NewHtmlPolicy()
+	}
+	untrusted := HtmlRenderer(HTML_SAFELINK | HTML_NOFOLLOW_LINKS)
+	untrusted.SetHtmlPolicy(policy)
+
+	return template.FormatterMap{
+		"markdown":      markdownFormatter(NewProcessor(WithRenderer(HtmlRenderer(0)), WithExtensions(extensions))),
+		"markdown-safe": markdownFormatter(NewProcessor(WithRenderer(untrusted), WithExtensions(extensions))),
+	}
+}
+
+// a formatter that renders its values, run together, with a processor
+func markdownFormatter(p *Processor) func(w io.Writer, format string, values ...interface{}) {
+	return func(w io.Writer, format string, values ...interface{}) {
+		input := bytes.NewBuffer(nil)
+		for _, value := range values {
+			switch value := value.(type) {
+			case []byte:
+				input.Write(value)
+			case string:
+				input.WriteString(value)
+			default:
+				fmt.Fprint(input, value)
+			}
+		}
+		w.Write(p.Render(input.Bytes()))
+	}
+}